@@ -0,0 +1,230 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package authstore provides the stores that gateways use to share the authentication IDs of journeys in progress.
+// The stores are kept in the gateway's module so that their dependencies are not added to the SDK.
+package authstore
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+	"github.com/ForgeRock/iot-edge/v7/internal/tokencache"
+	bolt "go.etcd.io/bbolt"
+)
+
+// expiresIn returns the time until the token expires using the expiry time in the token if it can be parsed,
+// otherwise the default expiry time
+func expiresIn(token string, defaultExpiration time.Duration) time.Duration {
+	if expiry, ok := tokencache.Expiry(token); ok && !expiry.IsZero() {
+		return time.Until(expiry)
+	}
+	return defaultExpiration
+}
+
+// FileStore keeps tokens in a bucket of a bbolt database file so that they can be shared by processes on the same
+// host. The file is only opened for the duration of each operation since bbolt allows a single process to hold it open.
+// Expired tokens are not returned by the store and are removed from the file by a sweep that runs on the cleanup
+// interval.
+type FileStore struct {
+	path              string
+	bucket            []byte
+	defaultExpiration time.Duration
+	maxEntries        int
+	options           *bolt.Options
+	readOptions       *bolt.Options
+	stop              chan struct{}
+	stopped           chan struct{}
+	closeOnce         sync.Once
+}
+
+// NewFileStore creates a token store backed by the named bucket of the database file at the given path, creating the
+// file if it does not exist. Stores that use different buckets of the same file do not share tokens. The store holds at most maxEntries tokens, a limit of zero or less means that the number of entries is
+// unlimited. Expired tokens are deleted from the file every cleanup interval until the store is closed, an interval
+// of zero or less disables the sweep.
+func NewFileStore(path, bucket string, defaultExpiration, cleanupInterval time.Duration,
+	maxEntries int) (*FileStore, error) {
+	s := &FileStore{
+		path:              path,
+		bucket:            []byte(bucket),
+		defaultExpiration: defaultExpiration,
+		maxEntries:        maxEntries,
+		options:           &bolt.Options{Timeout: 5 * time.Second},
+		readOptions:       &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true},
+		stop:              make(chan struct{}),
+		stopped:           make(chan struct{}),
+	}
+	err := s.update(func(b *bolt.Bucket) error {
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cleanupInterval > 0 {
+		go s.sweep(cleanupInterval)
+	} else {
+		close(s.stopped)
+	}
+	return s, nil
+}
+
+// sweep deletes the expired tokens every interval until the store is closed
+func (s *FileStore) sweep(interval time.Duration) {
+	defer close(s.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.DeleteExpired(); err != nil {
+				debug.Log.Warn("failed to delete expired tokens from store", "error", err)
+			}
+		}
+	}
+}
+
+// Close stops the sweep of expired tokens and waits for a sweep in progress to finish
+func (s *FileStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.stopped
+	return nil
+}
+
+// update runs the function in a read-write transaction on the store's bucket
+func (s *FileStore) update(fn func(b *bolt.Bucket) error) error {
+	db, err := bolt.Open(s.path, 0600, s.options)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(s.bucket)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// view runs the function in a read-only transaction on the store's bucket, the function is passed a nil bucket if
+// no tokens have been added yet
+func (s *FileStore) view(fn func(b *bolt.Bucket) error) error {
+	db, err := bolt.Open(s.path, 0600, s.readOptions)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(s.bucket))
+	})
+}
+
+// encodeEntry prefixes the token with its expiry time
+func encodeEntry(token string, expiry time.Time) []byte {
+	value := make([]byte, 8+len(token))
+	binary.BigEndian.PutUint64(value, uint64(expiry.UnixNano()))
+	copy(value[8:], token)
+	return value
+}
+
+// decodeEntry returns the token and its expiry time
+func decodeEntry(value []byte) (token string, expiry time.Time, ok bool) {
+	if len(value) < 8 {
+		return "", expiry, false
+	}
+	expiry = time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+	return string(value[8:]), expiry, true
+}
+
+// count returns the number of tokens in the bucket
+func count(b *bolt.Bucket) (n int) {
+	_ = b.ForEach(func(k, v []byte) error {
+		n++
+		return nil
+	})
+	return n
+}
+
+// deleteExpired removes all the expired tokens from the bucket
+func deleteExpired(b *bolt.Bucket, now time.Time) error {
+	var expired [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		if _, expiry, ok := decodeEntry(v); !ok || !now.Before(expiry) {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err = b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add the token to the store with the given key
+func (s *FileStore) Add(key, token string) error {
+	now := clock.Clock()
+	expiry := now.Add(expiresIn(token, s.defaultExpiration))
+	return s.update(func(b *bolt.Bucket) error {
+		if s.maxEntries > 0 && count(b) >= s.maxEntries {
+			if err := deleteExpired(b, now); err != nil {
+				return err
+			}
+			if count(b) >= s.maxEntries {
+				return tokencache.ErrFull
+			}
+		}
+		return b.Put([]byte(key), encodeEntry(token, expiry))
+	})
+}
+
+// Get a token from the store, expired tokens are left for the sweep to delete
+func (s *FileStore) Get(key string) (token string, ok bool) {
+	err := s.view(func(b *bolt.Bucket) error {
+		if b == nil {
+			return nil
+		}
+		var expiry time.Time
+		token, expiry, ok = decodeEntry(b.Get([]byte(key)))
+		if ok && !clock.Clock().Before(expiry) {
+			token, ok = "", false
+		}
+		return nil
+	})
+	if err != nil {
+		debug.Log.Warn("failed to get token from store", "error", err)
+		return "", false
+	}
+	return token, ok
+}
+
+// DeleteExpired removes all the expired tokens from the store
+func (s *FileStore) DeleteExpired() error {
+	return s.update(func(b *bolt.Bucket) error {
+		return deleteExpired(b, clock.Clock())
+	})
+}
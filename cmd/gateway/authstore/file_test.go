@@ -0,0 +1,220 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package authstore
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+	"github.com/ForgeRock/iot-edge/v7/internal/tokencache"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func signedToken(t *testing.T, expiry time.Time) string {
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("secret")},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(sig).Claims(jwt.Claims{Expiry: jwt.NewNumericDate(expiry)}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func testFileStore(t *testing.T, maxEntries int) *FileStore {
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "tokens.db"), "tokens", 5*time.Minute, 0, maxEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	return store
+}
+
+func TestFileStore_AddGet(t *testing.T) {
+	store := testFileStore(t, 0)
+	if err := store.Add("1", "token"); err != nil {
+		t.Fatal(err)
+	}
+	token, ok := store.Get("1")
+	if !ok || token != "token" {
+		t.Errorf("expected token, got %s, %v", token, ok)
+	}
+	if _, ok = store.Get("2"); ok {
+		t.Error("unexpected token")
+	}
+}
+
+// check that tokens added by one store can be read by another that uses the same file
+func TestFileStore_Shared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+	first, err := NewFileStore(path, "tokens", 5*time.Minute, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewFileStore(path, "tokens", 5*time.Minute, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = first.Add("1", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if token, ok := second.Get("1"); !ok || token != "token" {
+		t.Errorf("expected token, got %s, %v", token, ok)
+	}
+}
+
+func TestFileStore_Expiry(t *testing.T) {
+	defer func() {
+		clock.Clock = clock.DefaultClock()
+	}()
+	now := time.Now()
+	clock.Clock = func() time.Time {
+		return now
+	}
+	store := testFileStore(t, 0)
+	if err := store.Add("jwt", signedToken(t, now.Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add("default", "token"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, ok := store.Get("jwt"); ok {
+		t.Error("token returned after JWT expiry")
+	}
+	if _, ok := store.Get("default"); !ok {
+		t.Error("token expired before the default expiry")
+	}
+	now = now.Add(5 * time.Minute)
+	if _, ok := store.Get("default"); ok {
+		t.Error("token returned after the default expiry")
+	}
+}
+
+func TestFileStore_Full(t *testing.T) {
+	defer func() {
+		clock.Clock = clock.DefaultClock()
+	}()
+	now := time.Now()
+	clock.Clock = func() time.Time {
+		return now
+	}
+	store := testFileStore(t, 2)
+	for _, key := range []string{"1", "2"} {
+		if err := store.Add(key, "token"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Add("3", "token"); err != tokencache.ErrFull {
+		t.Errorf("expected ErrFull, got %v", err)
+	}
+	// expired tokens are removed to make space
+	now = now.Add(10 * time.Minute)
+	if err := store.Add("3", "token"); err != nil {
+		t.Errorf("expected token to be added, got %v", err)
+	}
+}
+
+// entries returns the number of entries in the store's file, including expired ones
+func entries(t *testing.T, store *FileStore) (n int) {
+	err := store.view(func(b *bolt.Bucket) error {
+		if b != nil {
+			n = count(b)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestFileStore_Sweep(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+	store, err := NewFileStore(path, "tokens", 5*time.Minute, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err = store.Add("1", signedToken(t, time.Now().Add(-time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Get("1"); ok {
+		t.Error("expired token returned")
+	}
+	// reading the store does not delete the expired token
+	if n := entries(t, store); n != 1 {
+		t.Fatalf("expected 1 entry, got %d", n)
+	}
+
+	sweeper, err := NewFileStore(path, "tokens", 5*time.Minute, 10*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sweeper.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for entries(t, store) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired token not deleted by the sweep")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileStore_Close(t *testing.T) {
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "tokens.db"), "tokens", 5*time.Minute, time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// closing the store more than once is safe
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// check that stores that use different buckets of the same file do not share tokens
+func TestFileStore_Buckets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+	acme, err := NewFileStore(path, "acme", 5*time.Minute, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewFileStore(path, "other", 5*time.Minute, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = acme.Add("1", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.Get("1"); ok {
+		t.Error("token returned by the store of another bucket")
+	}
+	if token, ok := acme.Get("1"); !ok || token != "token" {
+		t.Errorf("expected token, got %s, %v", token, ok)
+	}
+}
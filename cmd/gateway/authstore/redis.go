@@ -0,0 +1,193 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package authstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+)
+
+// RedisStore keeps tokens in a Redis compatible key-value server so that they can be shared by gateways on different
+// hosts. Tokens are written with an expiry so the server removes them once they are no longer valid.
+type RedisStore struct {
+	address           string
+	password          string
+	keyPrefix         string
+	defaultExpiration time.Duration
+	timeout           time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisStore creates a token store that uses the key-value server at the given address.
+// All keys are prefixed with keyPrefix so that the server can be shared with other applications. If the password is
+// not empty then it is used to authenticate the connection. The connection is opened when it is first needed.
+func NewRedisStore(address, password, keyPrefix string, defaultExpiration, timeout time.Duration) *RedisStore {
+	return &RedisStore{
+		address:           address,
+		password:          password,
+		keyPrefix:         keyPrefix,
+		defaultExpiration: defaultExpiration,
+		timeout:           timeout,
+	}
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// errNil is returned when the server replies with a null value
+var errNil = errors.New("redis: nil")
+
+// connect returns the current connection or opens a new one
+func (s *RedisStore) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+	if err != nil {
+		return err
+	}
+	s.conn, s.reader = conn, bufio.NewReader(conn)
+	if s.password != "" {
+		if _, err = s.exchange("AUTH", s.password); err != nil {
+			s.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// close the current connection
+func (s *RedisStore) close() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	s.conn, s.reader = nil, nil
+}
+
+// Close the connection to the server
+func (s *RedisStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close()
+	return nil
+}
+
+// do sends the command to the server and returns the reply, reconnecting once if the connection has been lost
+func (s *RedisStore) do(args ...string) (reply string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = s.connect(); err != nil {
+			return "", err
+		}
+		reply, err = s.exchange(args...)
+		var replyErr redisError
+		if err == nil || errors.Is(err, errNil) || errors.As(err, &replyErr) {
+			return reply, err
+		}
+		s.close()
+	}
+	return reply, err
+}
+
+// exchange writes the command and reads the reply on the current connection
+func (s *RedisStore) exchange(args ...string) (string, error) {
+	if s.timeout > 0 {
+		_ = s.conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return "", err
+	}
+	return readReply(s.reader)
+}
+
+// readReply reads a simple string, error, integer or bulk string reply
+func readReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", err
+		}
+		if n < 0 {
+			return "", errNil
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return "", err
+		}
+		return string(data[:n]), nil
+	default:
+		return "", fmt.Errorf("redis: unsupported reply %q", line)
+	}
+}
+
+// Add the token to the store with the given key
+func (s *RedisStore) Add(key, token string) error {
+	expiry := expiresIn(token, s.defaultExpiration).Milliseconds()
+	if expiry <= 0 {
+		// the token has already expired
+		return nil
+	}
+	_, err := s.do("SET", s.keyPrefix+key, token, "PX", strconv.FormatInt(expiry, 10))
+	return err
+}
+
+// Get a token from the store
+func (s *RedisStore) Get(key string) (token string, ok bool) {
+	token, err := s.do("GET", s.keyPrefix+key)
+	if err != nil {
+		if !errors.Is(err, errNil) {
+			debug.Log.Warn("failed to get token from store", "error", err)
+		}
+		return "", false
+	}
+	return token, true
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package authstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process key-value server that implements the subset of the Redis protocol used by RedisStore
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	mu       sync.Mutex
+	values   map[string]string
+	ttls     map[string]time.Duration
+	commands []string
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		listener: l,
+		password: password,
+		values:   make(map[string]string),
+		ttls:     make(map[string]time.Duration),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	return f
+}
+
+func (f *fakeRedis) address() string {
+	return f.listener.Addr().String()
+}
+
+// entry returns the value stored with the key and its time to live
+func (f *fakeRedis) entry(key string) (value string, ttl time.Duration, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok = f.values[key]
+	return value, f.ttls[key], ok
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, args[0])
+		var reply string
+		switch {
+		case args[0] == "AUTH":
+			if len(args) == 2 && args[1] == f.password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "SET" && len(args) == 5 && args[3] == "PX":
+			ms, _ := strconv.Atoi(args[4])
+			f.values[args[1]] = args[2]
+			f.ttls[args[1]] = time.Duration(ms) * time.Millisecond
+			reply = "+OK\r\n"
+		case args[0] == "GET" && len(args) == 2:
+			if v, ok := f.values[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				reply = "$-1\r\n"
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		f.mu.Unlock()
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) (args []string, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+func TestRedisStore_AddGet(t *testing.T) {
+	server := startFakeRedis(t, "")
+	store := NewRedisStore(server.address(), "", "gateway:", 5*time.Minute, time.Second)
+	defer store.Close()
+	if err := store.Add("1", "token"); err != nil {
+		t.Fatal(err)
+	}
+	value, ttl, ok := server.entry("gateway:1")
+	if !ok || value != "token" {
+		t.Error("key prefix not used")
+	}
+	if ttl != 5*time.Minute {
+		t.Errorf("expected default expiry, got %v", ttl)
+	}
+	token, ok := store.Get("1")
+	if !ok || token != "token" {
+		t.Errorf("expected token, got %s, %v", token, ok)
+	}
+	if _, ok = store.Get("2"); ok {
+		t.Error("unexpected token")
+	}
+}
+
+// check that a token added by one gateway can be read by another
+func TestRedisStore_Shared(t *testing.T) {
+	server := startFakeRedis(t, "")
+	first := NewRedisStore(server.address(), "", "", 5*time.Minute, time.Second)
+	defer first.Close()
+	second := NewRedisStore(server.address(), "", "", 5*time.Minute, time.Second)
+	defer second.Close()
+	if err := first.Add("1", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if token, ok := second.Get("1"); !ok || token != "token" {
+		t.Errorf("expected token, got %s, %v", token, ok)
+	}
+}
+
+func TestRedisStore_Expiry(t *testing.T) {
+	server := startFakeRedis(t, "")
+	store := NewRedisStore(server.address(), "", "", 5*time.Minute, time.Second)
+	defer store.Close()
+	if err := store.Add("1", signedToken(t, time.Now().Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ttl, _ := server.entry("1"); ttl > time.Minute || ttl < 58*time.Second {
+		t.Errorf("JWT expiry not used, got %v", ttl)
+	}
+	// expired tokens are not stored
+	if err := store.Add("2", signedToken(t, time.Now().Add(-time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := server.entry("2"); ok {
+		t.Error("expired token stored")
+	}
+}
+
+func TestRedisStore_Password(t *testing.T) {
+	server := startFakeRedis(t, "secret")
+	store := NewRedisStore(server.address(), "secret", "", 5*time.Minute, time.Second)
+	defer store.Close()
+	if err := store.Add("1", "token"); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	commands := server.commands
+	server.mu.Unlock()
+	if commands[0] != "AUTH" {
+		t.Errorf("expected AUTH command first, got %v", commands)
+	}
+
+	wrong := NewRedisStore(server.address(), "wrong", "", 5*time.Minute, time.Second)
+	defer wrong.Close()
+	if err := wrong.Add("1", "token"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// check that the store reconnects when the connection has been closed
+func TestRedisStore_Reconnect(t *testing.T) {
+	server := startFakeRedis(t, "")
+	store := NewRedisStore(server.address(), "", "", 5*time.Minute, time.Second)
+	defer store.Close()
+	if err := store.Add("1", "token"); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.conn.Close()
+	if token, ok := store.Get("1"); !ok || token != "token" {
+		t.Errorf("expected token, got %s, %v", token, ok)
+	}
+}
+
+func TestRedisStore_Unavailable(t *testing.T) {
+	server := startFakeRedis(t, "")
+	address := server.address()
+	_ = server.listener.Close()
+	store := NewRedisStore(address, "", "", 5*time.Minute, time.Second)
+	if err := store.Add("1", "token"); err == nil {
+		t.Error("expected an error")
+	}
+	if _, ok := store.Get("1"); ok {
+		t.Error("unexpected token")
+	}
+}
@@ -0,0 +1,525 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/gateway"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of environment variables that override configuration values.
+// The variable name is the prefix followed by the path to the value in upper case, joined by underscores.
+// For example, GATEWAY_AM_TIMEOUT overrides am.timeout.
+const envPrefix = "GATEWAY"
+
+// config holds the gateway configuration
+type config struct {
+	AM        amConfig         `yaml:"am"`
+	Gateway   thingConfig      `yaml:"gateway"`
+	Listeners []listenerConfig `yaml:"listeners"`
+	// routes to the realms and trees of tenants, checked in order
+	Routes    []routeConfig   `yaml:"routes"`
+	RateLimit rateLimitConfig `yaml:"rate_limit"`
+	AuthCache authCacheConfig `yaml:"auth_cache"`
+	Offline   offlineConfig   `yaml:"offline"`
+	PoP       popConfig       `yaml:"pop"`
+	Audit     auditConfig     `yaml:"audit"`
+	Admin     adminConfig     `yaml:"admin"`
+	// introspection endpoint for local resource servers
+	Introspection introspectionConfig `yaml:"introspection"`
+	Shutdown      shutdownConfig      `yaml:"shutdown"`
+	Log           logConfig           `yaml:"log"`
+}
+
+// amConfig holds the settings used to connect to AM
+type amConfig struct {
+	URL      string `yaml:"url"`
+	Realm    string `yaml:"realm"`
+	Audience string `yaml:"audience"`
+	// reloadable
+	Tree string `yaml:"tree"`
+	// see time.ParseDuration for valid timeout strings, reloadable
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// thingConfig holds the identity of the gateway thing
+type thingConfig struct {
+	Name     string `yaml:"name"`
+	KeyFile  string `yaml:"key"`
+	KeyID    string `yaml:"kid"`
+	CertFile string `yaml:"cert"`
+}
+
+// listenerConfig holds the settings of a CoAP listener
+type listenerConfig struct {
+	Address string `yaml:"address"`
+	// the file containing the DTLS key of the listener, a key is generated if not provided
+	KeyFile string `yaml:"key"`
+	// the file containing the DTLS certificate chain of the listener, a self-signed certificate is used if not set
+	CertFile string `yaml:"cert"`
+	// any_certificate or verified_certificate, defaults to any_certificate
+	Security string `yaml:"security"`
+	// the CA certificates that verify the certificates of things in the verified_certificate mode
+	ClientCAFile string `yaml:"client_ca"`
+}
+
+// routeConfig holds the settings of a route to the realm and tree of a tenant
+type routeConfig struct {
+	Name string `yaml:"name"`
+	// the URL of AM, defaults to am.url
+	URL   string `yaml:"url"`
+	Realm string `yaml:"realm"`
+	Tree  string `yaml:"tree"`
+	// defaults to am.timeout
+	Timeout time.Duration    `yaml:"timeout"`
+	Match   routeMatchConfig `yaml:"match"`
+}
+
+// routeMatchConfig holds the conditions that a request must meet to be sent to a route, at least one is required
+type routeMatchConfig struct {
+	// the subject common name of the certificate that the thing presents in the DTLS handshake
+	ClientCommonName string `yaml:"client_cn"`
+	PathPrefix       string `yaml:"path_prefix"`
+	// a URI query parameter, for example tenant=acme
+	Query    string `yaml:"query"`
+	Audience string `yaml:"audience"`
+}
+
+// rateLimitConfig holds the rate limit applied to each peer, reloadable
+type rateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+}
+
+// authCacheConfig holds the settings of the authentication ID cache
+type authCacheConfig struct {
+	// memory, file or redis
+	Store           string        `yaml:"store"`
+	Expiry          time.Duration `yaml:"expiry"`
+	CleanupInterval time.Duration `yaml:"cleanup_interval"`
+	MaxEntries      int           `yaml:"max_entries"`
+	// the database file used by the file store
+	File  string      `yaml:"file"`
+	Redis redisConfig `yaml:"redis"`
+}
+
+// redisConfig holds the settings of the redis store
+type redisConfig struct {
+	Address   string        `yaml:"address"`
+	Password  string        `yaml:"password"`
+	KeyPrefix string        `yaml:"key_prefix"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+// offlineConfig holds the settings used to serve things while AM is unavailable, reloadable
+type offlineConfig struct {
+	// zero switches offline mode off
+	MaxStaleness  time.Duration `yaml:"max_staleness"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+// popConfig holds the settings used to verify the proof of possession JWTs signed by things, reloadable
+type popConfig struct {
+	Verify bool `yaml:"verify"`
+	// reject requests from sessions whose key is not known instead of forwarding them to AM
+	Strict bool `yaml:"strict"`
+}
+
+// auditConfig holds the settings of the audit log
+type auditConfig struct {
+	// the JSON Lines file that the audit entries are appended to, auditing is off if not set
+	File string `yaml:"file"`
+	// the size in megabytes at which the file is rotated, 0 for no rotation
+	MaxSizeMB  int  `yaml:"max_size_mb"`
+	MaxBackups int  `yaml:"max_backups"`
+	HashChain  bool `yaml:"hash_chain"`
+}
+
+// adminConfig holds the settings of the admin API
+type adminConfig struct {
+	// the TCP address of the admin API, the API is off if not set
+	Address string `yaml:"address"`
+	// the bearer token that authorises admin requests
+	Token string `yaml:"token"`
+	// the server certificate and key, the API uses TLS if set
+	CertFile string `yaml:"cert"`
+	KeyFile  string `yaml:"key"`
+	// the CA certificates used to verify client certificates
+	ClientCAFile string `yaml:"client_ca"`
+}
+
+// introspectionConfig holds the settings of the token introspection endpoint
+type introspectionConfig struct {
+	// the TCP address of the endpoint, the endpoint is off if not set
+	Address string `yaml:"address"`
+	// the secrets of the resource servers that may introspect tokens keyed by client ID
+	Clients map[string]string `yaml:"clients"`
+	// the server certificate and key, the endpoint uses TLS if set
+	CertFile string `yaml:"cert"`
+	KeyFile  string `yaml:"key"`
+	// the CA certificates used to verify client certificates
+	ClientCAFile string `yaml:"client_ca"`
+}
+
+// shutdownConfig holds the shutdown settings, reloadable
+type shutdownConfig struct {
+	// the time given to the requests that are being handled to complete
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// logConfig holds the log settings, reloadable
+type logConfig struct {
+	Format     string   `yaml:"format"`
+	Level      string   `yaml:"level"`
+	Debug      bool     `yaml:"debug"`
+	Unredacted []string `yaml:"unredacted"`
+}
+
+// defaultConfig returns the configuration used for values that are not set
+func defaultConfig() config {
+	return config{
+		AM: amConfig{
+			Timeout: 5 * time.Second,
+		},
+		RateLimit: rateLimitConfig{
+			Burst: 1,
+		},
+		AuthCache: authCacheConfig{
+			Store:           "memory",
+			Expiry:          5 * time.Minute,
+			CleanupInterval: 10 * time.Minute,
+			Redis: redisConfig{
+				KeyPrefix: "iot-gateway:",
+				Timeout:   5 * time.Second,
+			},
+		},
+		Offline: offlineConfig{
+			RetryInterval: 10 * time.Second,
+		},
+		PoP: popConfig{
+			Verify: true,
+		},
+		Audit: auditConfig{
+			MaxSizeMB:  100,
+			MaxBackups: 5,
+		},
+		Shutdown: shutdownConfig{
+			Timeout: 30 * time.Second,
+		},
+		Log: logConfig{
+			Format: "text",
+			Level:  "info",
+		},
+	}
+}
+
+// loadConfig reads the configuration file and applies environment variable overrides on top of the defaults.
+// The file can be YAML or JSON.
+func loadConfig(filename string, lookupEnv func(string) (string, bool)) (c config, err error) {
+	c = defaultConfig()
+	if filename != "" {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return c, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(b))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+			return c, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	err = applyEnv(reflect.ValueOf(&c).Elem(), envPrefix, lookupEnv)
+	return c, err
+}
+
+// applyEnv overrides the fields of the value with any matching environment variables
+func applyEnv(v reflect.Value, prefix string, lookupEnv func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		tag, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+		name := prefix + "_" + strings.ToUpper(tag)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name, lookupEnv); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromString(field, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setFromString sets the value from its string representation
+func setFromString(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		switch field.Type().Elem().Kind() {
+		case reflect.String:
+			field.Set(reflect.ValueOf(strings.Split(value, ",")))
+		case reflect.Struct:
+			if _, ok := field.Type().Elem().FieldByName("Address"); !ok {
+				return fmt.Errorf("unsupported type %s", field.Type())
+			}
+			// a list of listener addresses
+			addresses := strings.Split(value, ",")
+			field.Set(reflect.MakeSlice(field.Type(), len(addresses), len(addresses)))
+			for i, address := range addresses {
+				field.Index(i).FieldByName("Address").SetString(address)
+			}
+		default:
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+	case reflect.Map:
+		if field.Type().Key().Kind() != reflect.String || field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		// a list of key:value pairs
+		m := make(map[string]string)
+		for _, pair := range strings.Split(value, ",") {
+			k, v, ok := strings.Cut(pair, ":")
+			if !ok {
+				return fmt.Errorf("expected key:value pairs")
+			}
+			m[k] = v
+		}
+		field.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// validate checks that the configuration is complete and consistent
+func (c config) validate() error {
+	var errs []error
+	required := func(value, name string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+	required(c.AM.URL, "am.url")
+	required(c.AM.Audience, "am.audience")
+	required(c.AM.Tree, "am.tree")
+	required(c.Gateway.Name, "gateway.name")
+	required(c.Gateway.KeyFile, "gateway.key")
+	if c.AM.URL != "" {
+		if u, err := url.Parse(c.AM.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("am.url must be an http(s) URL"))
+		}
+	}
+	if c.AM.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("am.timeout must not be negative"))
+	}
+	if len(c.Listeners) == 0 {
+		errs = append(errs, fmt.Errorf("at least one listener is required"))
+	}
+	files := []string{c.Gateway.KeyFile, c.Gateway.CertFile, c.Admin.CertFile, c.Admin.KeyFile, c.Admin.ClientCAFile,
+		c.Introspection.CertFile, c.Introspection.KeyFile, c.Introspection.ClientCAFile}
+	addresses := make(map[string]bool, len(c.Listeners))
+	for i, l := range c.Listeners {
+		required(l.Address, fmt.Sprintf("listeners[%d].address", i))
+		if addresses[l.Address] {
+			errs = append(errs, fmt.Errorf("listeners[%d].address %s is repeated", i, l.Address))
+		}
+		addresses[l.Address] = true
+		if l.CertFile != "" && l.KeyFile == "" {
+			errs = append(errs, fmt.Errorf("listeners[%d].cert requires listeners[%d].key", i, i))
+		}
+		switch l.Security {
+		case "", gateway.SecurityAnyCertificate.String():
+		case gateway.SecurityVerifiedCertificate.String():
+			required(l.ClientCAFile, fmt.Sprintf("listeners[%d].client_ca", i))
+		default:
+			errs = append(errs, fmt.Errorf("listeners[%d].security must be %s or %s", i,
+				gateway.SecurityAnyCertificate, gateway.SecurityVerifiedCertificate))
+		}
+		files = append(files, l.KeyFile, l.CertFile, l.ClientCAFile)
+	}
+	names := make(map[string]bool, len(c.Routes))
+	for i, r := range c.Routes {
+		required(r.Name, fmt.Sprintf("routes[%d].name", i))
+		required(r.Tree, fmt.Sprintf("routes[%d].tree", i))
+		if names[r.Name] {
+			errs = append(errs, fmt.Errorf("routes[%d].name %s is repeated", i, r.Name))
+		}
+		names[r.Name] = true
+		if r.URL != "" {
+			if u, err := url.Parse(r.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				errs = append(errs, fmt.Errorf("routes[%d].url must be an http(s) URL", i))
+			}
+		}
+		if r.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("routes[%d].timeout must not be negative", i))
+		}
+		if r.Match == (routeMatchConfig{}) {
+			errs = append(errs, fmt.Errorf("routes[%d].match requires at least one condition", i))
+		}
+		if p := r.Match.PathPrefix; p != "" && (!strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/")) {
+			errs = append(errs, fmt.Errorf("routes[%d].match.path_prefix must start and must not end with /", i))
+		}
+	}
+	if c.RateLimit.RequestsPerSecond < 0 || c.RateLimit.Burst < 0 {
+		errs = append(errs, fmt.Errorf("rate_limit values must not be negative"))
+	}
+	if c.AuthCache.Expiry <= 0 || c.AuthCache.CleanupInterval <= 0 {
+		errs = append(errs, fmt.Errorf("auth_cache durations must be positive"))
+	}
+	if c.Offline.MaxStaleness < 0 || c.Offline.RetryInterval <= 0 {
+		errs = append(errs, fmt.Errorf("offline.max_staleness must not be negative and offline.retry_interval must be positive"))
+	}
+	if c.AuthCache.MaxEntries < 0 {
+		errs = append(errs, fmt.Errorf("auth_cache.max_entries must not be negative"))
+	}
+	switch c.AuthCache.Store {
+	case "memory":
+	case "file":
+		required(c.AuthCache.File, "auth_cache.file")
+	case "redis":
+		required(c.AuthCache.Redis.Address, "auth_cache.redis.address")
+	default:
+		errs = append(errs, fmt.Errorf("auth_cache.store must be memory, file or redis"))
+	}
+	if c.Audit.MaxSizeMB < 0 || c.Audit.MaxBackups < 0 {
+		errs = append(errs, fmt.Errorf("audit values must not be negative"))
+	}
+	if c.Admin.Address != "" {
+		if c.Admin.Token == "" && c.Admin.ClientCAFile == "" {
+			errs = append(errs, fmt.Errorf("admin.token or admin.client_ca is required"))
+		}
+		if (c.Admin.CertFile == "") != (c.Admin.KeyFile == "") {
+			errs = append(errs, fmt.Errorf("admin.cert and admin.key must be set together"))
+		}
+		if c.Admin.ClientCAFile != "" && c.Admin.CertFile == "" {
+			errs = append(errs, fmt.Errorf("admin.client_ca requires admin.cert"))
+		}
+	}
+	if c.Introspection.Address != "" {
+		if len(c.Introspection.Clients) == 0 && c.Introspection.ClientCAFile == "" {
+			errs = append(errs, fmt.Errorf("introspection.clients or introspection.client_ca is required"))
+		}
+		if (c.Introspection.CertFile == "") != (c.Introspection.KeyFile == "") {
+			errs = append(errs, fmt.Errorf("introspection.cert and introspection.key must be set together"))
+		}
+		if c.Introspection.ClientCAFile != "" && c.Introspection.CertFile == "" {
+			errs = append(errs, fmt.Errorf("introspection.client_ca requires introspection.cert"))
+		}
+	}
+	if c.Shutdown.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("shutdown.timeout must not be negative"))
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format must be text or json"))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	for _, name := range files {
+		if name == "" {
+			continue
+		}
+		if _, err := os.Stat(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reloaded returns the configuration that is running after the updated configuration has been reloaded. The settings
+// that require a restart are kept so that they are reported again on the next reload.
+func (c config) reloaded(updated config) config {
+	updated.AM.URL, updated.AM.Realm, updated.AM.Audience = c.AM.URL, c.AM.Realm, c.AM.Audience
+	updated.Gateway, updated.Listeners, updated.Routes, updated.AuthCache = c.Gateway, c.Listeners, c.Routes, c.AuthCache
+	updated.Audit, updated.Admin, updated.Introspection = c.Audit, c.Admin, c.Introspection
+	return updated
+}
+
+// restartRequired returns the names of the settings that differ between the configurations and can only be changed
+// by restarting the gateway
+func (c config) restartRequired(other config) (names []string) {
+	if c.AM.URL != other.AM.URL || c.AM.Realm != other.AM.Realm || c.AM.Audience != other.AM.Audience {
+		names = append(names, "am")
+	}
+	if c.Gateway != other.Gateway {
+		names = append(names, "gateway")
+	}
+	if !reflect.DeepEqual(c.Listeners, other.Listeners) {
+		names = append(names, "listeners")
+	}
+	if !reflect.DeepEqual(c.Routes, other.Routes) {
+		names = append(names, "routes")
+	}
+	if c.AuthCache != other.AuthCache {
+		names = append(names, "auth_cache")
+	}
+	if c.Audit != other.Audit {
+		names = append(names, "audit")
+	}
+	if c.Admin != other.Admin {
+		names = append(names, "admin")
+	}
+	if !reflect.DeepEqual(c.Introspection, other.Introspection) {
+		names = append(names, "introspection")
+	}
+	return names
+}
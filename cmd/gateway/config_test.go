@@ -0,0 +1,323 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func noEnv(string) (string, bool) {
+	return "", false
+}
+
+func envMap(m map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := m[name]
+		return v, ok
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	name := filepath.Join(t.TempDir(), "gateway.yaml")
+	if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestLoadConfig_Example(t *testing.T) {
+	c, err := loadConfig("gateway.example.yaml", noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.AM.Tree != "auth-tree" || c.AM.Timeout != 5*time.Second || c.Listeners[0].Address != ":5683" {
+		t.Errorf("unexpected config %+v", c)
+	}
+}
+
+func TestLoadConfig_JSON(t *testing.T) {
+	name := writeConfig(t, `{"am": {"url": "https://am.example.com/am", "timeout": "10s"}, "rate_limit": {"burst": 3}}`)
+	c, err := loadConfig(name, noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AM.URL != "https://am.example.com/am" || c.AM.Timeout != 10*time.Second || c.RateLimit.Burst != 3 {
+		t.Errorf("unexpected config %+v", c)
+	}
+	// defaults are kept for values that are not in the file
+	if c.AuthCache != defaultConfig().AuthCache || c.Log.Format != "text" {
+		t.Errorf("unexpected config %+v", c)
+	}
+}
+
+func TestLoadConfig_UnknownField(t *testing.T) {
+	name := writeConfig(t, "am:\n  tre: auth-tree\n")
+	if _, err := loadConfig(name, noEnv); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestLoadConfig_Environment(t *testing.T) {
+	c, err := loadConfig("gateway.example.yaml", envMap(map[string]string{
+		"GATEWAY_AM_TREE":                        "other-tree",
+		"GATEWAY_AM_TIMEOUT":                     "1m",
+		"GATEWAY_RATE_LIMIT_REQUESTS_PER_SECOND": "2.5",
+		"GATEWAY_AUTH_CACHE_MAX_ENTRIES":         "100",
+		"GATEWAY_AUTH_CACHE_STORE":               "redis",
+		"GATEWAY_AUTH_CACHE_REDIS_ADDRESS":       "redis:6379",
+		"GATEWAY_OFFLINE_MAX_STALENESS":          "1h",
+		"GATEWAY_POP_STRICT":                     "true",
+		"GATEWAY_AUDIT_FILE":                     "/var/log/iot-gateway/audit.log",
+		"GATEWAY_AUDIT_HASH_CHAIN":               "true",
+		"GATEWAY_ADMIN_ADDRESS":                  "localhost:8090",
+		"GATEWAY_ADMIN_TOKEN":                    "secret",
+		"GATEWAY_INTROSPECTION_ADDRESS":          "localhost:8091",
+		"GATEWAY_INTROSPECTION_CLIENTS":          "mosquitto:s1,hivemq:s2",
+		"GATEWAY_SHUTDOWN_TIMEOUT":               "1m",
+		"GATEWAY_LOG_DEBUG":                      "true",
+		"GATEWAY_LOG_UNREDACTED":                 "csrf,tokenId",
+		"GATEWAY_LISTENERS":                      ":5684",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := config{
+		AM: amConfig{
+			URL:      "http://am.localtest.me:8080/am",
+			Realm:    "/",
+			Audience: "/",
+			Tree:     "other-tree",
+			Timeout:  time.Minute,
+		},
+		Gateway: thingConfig{
+			Name:    "manual-gateway",
+			KeyFile: "../../examples/resources/eckey1.key.pem",
+			KeyID:   "cbnztC8J_l2feNf0aTFBDDQJuvrd2JbLPoOAxHR2N8o=",
+		},
+		Listeners: []listenerConfig{{Address: ":5684"}},
+		RateLimit: rateLimitConfig{RequestsPerSecond: 2.5, Burst: 1},
+		AuthCache: authCacheConfig{
+			Store:           "redis",
+			Expiry:          5 * time.Minute,
+			CleanupInterval: 10 * time.Minute,
+			MaxEntries:      100,
+			Redis:           redisConfig{Address: "redis:6379", KeyPrefix: "iot-gateway:", Timeout: 5 * time.Second},
+		},
+		Offline: offlineConfig{MaxStaleness: time.Hour, RetryInterval: 10 * time.Second},
+		PoP:     popConfig{Verify: true, Strict: true},
+		Audit:   auditConfig{File: "/var/log/iot-gateway/audit.log", MaxSizeMB: 100, MaxBackups: 5, HashChain: true},
+		Admin:   adminConfig{Address: "localhost:8090", Token: "secret"},
+		Introspection: introspectionConfig{
+			Address: "localhost:8091",
+			Clients: map[string]string{"mosquitto": "s1", "hivemq": "s2"},
+		},
+		Shutdown: shutdownConfig{Timeout: time.Minute},
+		Log:      logConfig{Format: "text", Level: "info", Debug: true, Unredacted: []string{"csrf", "tokenId"}},
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("expected %+v\ngot %+v", expected, c)
+	}
+}
+
+func TestLoadConfig_InvalidEnvironment(t *testing.T) {
+	_, err := loadConfig("", envMap(map[string]string{"GATEWAY_AM_TIMEOUT": "soon"}))
+	if err == nil {
+		t.Error("expected an error")
+	}
+	_, err = loadConfig("", envMap(map[string]string{"GATEWAY_INTROSPECTION_CLIENTS": "no-secret"}))
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestCommandlineOpts_Apply(t *testing.T) {
+	c, err := loadConfig("gateway.example.yaml", noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commandlineOpts{Tree: "flag-tree", Address: ":5690", Timeout: time.Second, Debug: true}.apply(&c)
+	if c.AM.Tree != "flag-tree" || c.Listeners[0].Address != ":5690" || c.AM.Timeout != time.Second || !c.Log.Debug {
+		t.Errorf("unexpected config %+v", c)
+	}
+	// unset options do not override the file
+	if c.AM.URL != "http://am.localtest.me:8080/am" || c.Gateway.Name != "manual-gateway" {
+		t.Errorf("unexpected config %+v", c)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *config)
+	}{
+		{name: "no-url", modify: func(c *config) { c.AM.URL = "" }},
+		{name: "bad-url", modify: func(c *config) { c.AM.URL = "am.example.com" }},
+		{name: "no-tree", modify: func(c *config) { c.AM.Tree = "" }},
+		{name: "no-name", modify: func(c *config) { c.Gateway.Name = "" }},
+		{name: "missing-key", modify: func(c *config) { c.Gateway.KeyFile = "missing.pem" }},
+		{name: "no-listener", modify: func(c *config) { c.Listeners = nil }},
+		{name: "repeated-listener", modify: func(c *config) { c.Listeners = append(c.Listeners, c.Listeners[0]) }},
+		{name: "listener-security", modify: func(c *config) { c.Listeners[0].Security = "none" }},
+		{name: "listener-no-client-ca", modify: func(c *config) { c.Listeners[0].Security = "verified_certificate" }},
+		{name: "listener-cert-without-key", modify: func(c *config) { c.Listeners[0].CertFile = "listener.pem" }},
+		{name: "route-no-name", modify: func(c *config) { c.Routes = []routeConfig{testRoute("")} }},
+		{name: "repeated-route", modify: func(c *config) { c.Routes = []routeConfig{testRoute("a"), testRoute("a")} }},
+		{name: "route-no-match", modify: func(c *config) {
+			c.Routes = []routeConfig{{Name: "acme", Tree: "acme-tree"}}
+		}},
+		{name: "route-path-prefix", modify: func(c *config) {
+			c.Routes = []routeConfig{testRoute("acme")}
+			c.Routes[0].Match.PathPrefix = "acme/"
+		}},
+		{name: "route-url", modify: func(c *config) {
+			c.Routes = []routeConfig{testRoute("acme")}
+			c.Routes[0].URL = "coap://am.example.com"
+		}},
+		{name: "negative-rate", modify: func(c *config) { c.RateLimit.RequestsPerSecond = -1 }},
+		{name: "zero-expiry", modify: func(c *config) { c.AuthCache.Expiry = 0 }},
+		{name: "auth-store", modify: func(c *config) { c.AuthCache.Store = "disk" }},
+		{name: "no-auth-file", modify: func(c *config) { c.AuthCache.Store = "file" }},
+		{name: "no-redis-address", modify: func(c *config) { c.AuthCache.Store = "redis" }},
+		{name: "negative-staleness", modify: func(c *config) { c.Offline.MaxStaleness = -time.Second }},
+		{name: "negative-audit-size", modify: func(c *config) { c.Audit.MaxSizeMB = -1 }},
+		{name: "unprotected-admin", modify: func(c *config) { c.Admin.Address = "localhost:8090" }},
+		{name: "admin-cert-without-key", modify: func(c *config) {
+			c.Admin = adminConfig{Address: "localhost:8090", Token: "secret", CertFile: "admin.pem"}
+		}},
+		{name: "unprotected-introspection", modify: func(c *config) { c.Introspection.Address = "localhost:8091" }},
+		{name: "introspection-ca-without-cert", modify: func(c *config) {
+			c.Introspection = introspectionConfig{Address: "localhost:8091", ClientCAFile: "ca.pem"}
+		}},
+		{name: "negative-shutdown-timeout", modify: func(c *config) { c.Shutdown.Timeout = -time.Second }},
+		{name: "log-format", modify: func(c *config) { c.Log.Format = "xml" }},
+		{name: "log-level", modify: func(c *config) { c.Log.Level = "verbose" }},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			c, err := loadConfig("gateway.example.yaml", noEnv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			subtest.modify(&c)
+			if err = c.validate(); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestConfig_Validate_Listeners(t *testing.T) {
+	c, err := loadConfig("gateway.example.yaml", noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Listeners = append(c.Listeners, listenerConfig{
+		Address:      "[::1]:5684",
+		KeyFile:      "../../examples/resources/eckey1.key.pem",
+		Security:     "verified_certificate",
+		ClientCAFile: "../../examples/resources/dynamic-gateway.cert.pem",
+	})
+	if err = c.validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func testRoute(name string) routeConfig {
+	return routeConfig{Name: name, Realm: "acme", Tree: "acme-tree", Match: routeMatchConfig{Query: "tenant=acme"}}
+}
+
+func TestLoadConfig_Routes(t *testing.T) {
+	name := writeConfig(t, `
+routes:
+  - name: acme
+    realm: acme
+    tree: acme-registration
+    match:
+      path_prefix: /acme
+      client_cn: acme-thing
+`)
+	c, err := loadConfig(name, noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []routeConfig{{Name: "acme", Realm: "acme", Tree: "acme-registration",
+		Match: routeMatchConfig{PathPrefix: "/acme", ClientCommonName: "acme-thing"}}}
+	if !reflect.DeepEqual(c.Routes, expected) {
+		t.Errorf("unexpected routes %+v", c.Routes)
+	}
+	// routes can not be set from a list of addresses
+	if _, err = loadConfig("", envMap(map[string]string{"GATEWAY_ROUTES": "acme"})); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestConfig_RestartRequired(t *testing.T) {
+	current, err := loadConfig("gateway.example.yaml", noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := loadConfig("gateway.example.yaml", noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated.AM.Tree = "other-tree"
+	updated.RateLimit.RequestsPerSecond = 10
+	updated.Log.Level = "debug"
+	if names := current.restartRequired(updated); len(names) != 0 {
+		t.Errorf("unexpected restart for %v", names)
+	}
+	updated.AM.URL = "https://am.example.com/am"
+	updated.Listeners[0].Address = ":5684"
+	if names := current.restartRequired(updated); !reflect.DeepEqual(names, []string{"am", "listeners"}) {
+		t.Errorf("unexpected restart for %v", names)
+	}
+}
+
+func TestConfig_Reloaded(t *testing.T) {
+	current, err := loadConfig("gateway.example.yaml", noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.Routes = []routeConfig{{Name: "acme", Realm: "acme", Tree: "acme-registration"}}
+	updated, err := loadConfig("gateway.example.yaml", noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated.AM.Tree = "other-tree"
+	updated.Routes = []routeConfig{{Name: "other", Realm: "other", Tree: "other-registration"}}
+	updated.Listeners[0].Address = ":5684"
+
+	running := current.reloaded(updated)
+	if running.AM.Tree != "other-tree" {
+		t.Errorf("expected the reloadable settings to be applied, got tree %s", running.AM.Tree)
+	}
+	if !reflect.DeepEqual(running.Routes, current.Routes) || !reflect.DeepEqual(running.Listeners, current.Listeners) {
+		t.Errorf("expected the routes and listeners to survive the reload, got %+v, %+v", running.Routes,
+			running.Listeners)
+	}
+	// the settings that require a restart are reported again on the next reload
+	if names := running.restartRequired(updated); !reflect.DeepEqual(names, []string{"listeners", "routes"}) {
+		t.Errorf("unexpected restart for %v", names)
+	}
+}
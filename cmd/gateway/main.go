@@ -17,20 +17,27 @@
 package main
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/ForgeRock/iot-edge/v7/cmd/gateway/authstore"
+	"github.com/ForgeRock/iot-edge/v7/internal/audit"
 	"github.com/ForgeRock/iot-edge/v7/internal/gateway"
+	"github.com/ForgeRock/iot-edge/v7/internal/tokencache"
 	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
 	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
 	"github.com/jessevdk/go-flags"
@@ -63,23 +70,30 @@ func loadCertificates(filename string) ([]*x509.Certificate, error) {
 }
 
 type commandlineOpts struct {
-	URL      string `long:"url" required:"true" description:"AM URL"`
-	Realm    string `long:"realm" description:"AM Realm"`
-	Audience string `long:"audience" required:"true" description:"JWT Audience"`
-	Tree     string `long:"tree" required:"true" description:"Authentication tree"`
-	Name     string `long:"name" required:"true" description:"Gateway name"`
-	Address  string `long:"address" required:"true" description:"CoAP Address of Gateway"`
-	KeyFile  string `long:"key" required:"true" description:"The file containing the Gateway's signing key"`
-	KeyID    string `long:"kid" description:"The Gateway's signing key ID"`
-	CertFile string `long:"cert" description:"The file containing the Gateway's certificate"`
+	ConfigFile  string `short:"c" long:"config" description:"The YAML or JSON file containing the gateway configuration"`
+	CheckConfig bool   `long:"check-config" description:"Validate the configuration and exit"`
+	URL         string `long:"url" description:"AM URL"`
+	Realm       string `long:"realm" description:"AM Realm"`
+	Audience    string `long:"audience" description:"JWT Audience"`
+	Tree        string `long:"tree" description:"Authentication tree"`
+	Name        string `long:"name" description:"Gateway name"`
+	Address     string `long:"address" description:"CoAP Address of Gateway"`
+	KeyFile     string `long:"key" description:"The file containing the Gateway's signing key"`
+	KeyID       string `long:"kid" description:"The Gateway's signing key ID"`
+	CertFile    string `long:"cert" description:"The file containing the Gateway's certificate"`
 	// see time.ParseDuration for valid timeout strings
-	Timeout time.Duration `long:"timeout" default:"5s" description:"Timeout for AM communications"`
-	Debug   bool          `short:"d" long:"debug" description:"Switch on debug"`
+	Timeout   time.Duration `long:"timeout" description:"Timeout for AM communications (default: 5s)"`
+	Debug     bool          `short:"d" long:"debug" description:"Switch on debug"`
+	LogFormat string        `long:"log-format" choice:"text" choice:"json" description:"Format of log records (default: text)"`
+	LogLevel  string        `long:"log-level" choice:"debug" choice:"info" choice:"warn" choice:"error" description:"Minimum level of log records (default: info)"`
+	// for troubleshooting only, names of headers, cookies and JSON fields that will not be redacted from debug output
+	Unredacted []string `long:"unredacted" description:"Name of a value that will not be redacted from debug output"`
 }
 
 func (o commandlineOpts) String() string {
 	return fmt.Sprintf(
 		`Provided commandline options:
+	config: %s
 	url: %s
 	realm: %s
 	tree: %s
@@ -89,27 +103,216 @@ func (o commandlineOpts) String() string {
 	kid: %s
 	certificate: %s
 	timeout %v
-	debug: %v`,
-		o.URL, o.Realm, o.Tree, o.Name, o.Address, o.KeyFile, o.KeyID, o.CertFile, o.Timeout, o.Debug)
+	debug: %v
+	log format: %s
+	log level: %s
+	unredacted: %v`,
+		o.ConfigFile, o.URL, o.Realm, o.Tree, o.Name, o.Address, o.KeyFile, o.KeyID, o.CertFile, o.Timeout, o.Debug,
+		o.LogFormat, o.LogLevel, o.Unredacted)
+}
+
+// apply overrides the configuration with the options that have been set on the commandline
+func (o commandlineOpts) apply(c *config) {
+	setString := func(dst *string, value string) {
+		if value != "" {
+			*dst = value
+		}
+	}
+	setString(&c.AM.URL, o.URL)
+	setString(&c.AM.Realm, o.Realm)
+	setString(&c.AM.Audience, o.Audience)
+	setString(&c.AM.Tree, o.Tree)
+	setString(&c.Gateway.Name, o.Name)
+	setString(&c.Gateway.KeyFile, o.KeyFile)
+	setString(&c.Gateway.KeyID, o.KeyID)
+	setString(&c.Gateway.CertFile, o.CertFile)
+	setString(&c.Log.Format, o.LogFormat)
+	setString(&c.Log.Level, o.LogLevel)
+	if o.Address != "" {
+		c.Listeners = []listenerConfig{{Address: o.Address}}
+	}
+	if o.Timeout != 0 {
+		c.AM.Timeout = o.Timeout
+	}
+	if o.Debug {
+		c.Log.Debug = true
+	}
+	if len(o.Unredacted) > 0 {
+		c.Log.Unredacted = o.Unredacted
+	}
+}
+
+// readConfig reads the gateway configuration from the configuration file, the environment and the commandline
+func readConfig(opts commandlineOpts) (config, error) {
+	c, err := loadConfig(opts.ConfigFile, os.LookupEnv)
+	if err != nil {
+		return c, err
+	}
+	opts.apply(&c)
+	return c, c.validate()
+}
+
+// logHandler creates the handler for the gateway's log records
+func logHandler(c logConfig) (slog.Handler, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return nil, err
+	}
+	if c.Debug {
+		level = slog.LevelDebug
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	if c.Format == "json" {
+		return slog.NewJSONHandler(os.Stdout, handlerOpts), nil
+	}
+	return slog.NewTextHandler(os.Stdout, handlerOpts), nil
+}
+
+// configureLogging applies the log configuration
+func configureLogging(c logConfig) error {
+	handler, err := logHandler(c)
+	if err != nil {
+		return err
+	}
+	thing.SetLogHandler(handler)
+	slog.SetDefault(slog.New(handler))
+	thing.SetRedactionAllowlist(c.Unredacted...)
+	return nil
+}
+
+// reload applies the reloadable settings of the new configuration to the running gateway
+func reload(iotGateway *gateway.Gateway, current, updated config) error {
+	if err := configureLogging(updated.Log); err != nil {
+		return err
+	}
+	if updated.AM.Tree != current.AM.Tree || updated.AM.Timeout != current.AM.Timeout {
+		if err := iotGateway.Reconfigure(updated.AM.Timeout, updated.AM.Tree); err != nil {
+			return err
+		}
+	}
+	iotGateway.SetRateLimit(updated.RateLimit.RequestsPerSecond, updated.RateLimit.Burst)
+	iotGateway.SetOfflineMode(updated.Offline.MaxStaleness, updated.Offline.RetryInterval)
+	iotGateway.SetPoPVerification(updated.PoP.Verify, updated.PoP.Strict)
+	if names := current.restartRequired(updated); len(names) > 0 {
+		slog.Warn("configuration changes require a restart to take effect", "sections", names)
+	}
+	return nil
+}
+
+// authStores creates the stores that hold the authentication IDs of journeys in progress and closes them when the
+// gateway shuts down
+type authStores []io.Closer
+
+// create a store from the configuration for the named route, or for the gateway if the name is empty. The journeys of
+// each route are kept apart from the journeys of the gateway and of the other routes.
+func (s *authStores) create(c authCacheConfig, route string) (tokencache.Store, error) {
+	switch c.Store {
+	case "file":
+		bucket := "tokens"
+		if route != "" {
+			bucket = "route:" + route
+		}
+		store, err := authstore.NewFileStore(c.File, bucket, c.Expiry, c.CleanupInterval, c.MaxEntries)
+		if err != nil {
+			return nil, err
+		}
+		*s = append(*s, store)
+		return store, nil
+	case "redis":
+		prefix := c.Redis.KeyPrefix
+		if route != "" {
+			prefix += "route:" + route + ":"
+		}
+		store := authstore.NewRedisStore(c.Redis.Address, c.Redis.Password, prefix, c.Expiry, c.Redis.Timeout)
+		*s = append(*s, store)
+		return store, nil
+	default:
+		return tokencache.NewWithLimit(c.Expiry, c.CleanupInterval, c.MaxEntries), nil
+	}
+}
+
+// Close all the stores that have been created
+func (s authStores) Close() {
+	for _, store := range s {
+		if err := store.Close(); err != nil {
+			slog.Warn("failed to close auth store", "err", err)
+		}
+	}
+}
+
+// serverTLSConfig returns the TLS configuration of a local HTTP server, nil if TLS is not configured
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		if tlsConfig.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+	return pool, nil
+}
+
+// coapListenerConfig returns the configuration of a CoAP listener, generating a key if none is set
+func coapListenerConfig(conf listenerConfig) (listener gateway.ListenerConfig, err error) {
+	listener.Address = conf.Address
+	if conf.KeyFile != "" {
+		listener.Key, err = loadKey(conf.KeyFile)
+	} else {
+		listener.Key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return listener, err
+	}
+	if conf.CertFile != "" {
+		if listener.Certificates, err = loadCertificates(conf.CertFile); err != nil {
+			return listener, err
+		}
+	}
+	if conf.Security == gateway.SecurityVerifiedCertificate.String() {
+		listener.Security = gateway.SecurityVerifiedCertificate
+		if listener.ClientCAs, err = loadCertPool(conf.ClientCAFile); err != nil {
+			return listener, err
+		}
+	}
+	return listener, nil
 }
 
 // runGateway initialises and runs an IoT Gateway
-func runGateway(opts commandlineOpts) error {
+func runGateway(opts commandlineOpts, conf config) error {
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	if opts.Debug {
-		// pipe debug to standard out
-		thing.SetDebugLogger(log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lmicroseconds|log.Llongfile))
+	if err := configureLogging(conf.Log); err != nil {
+		return err
 	}
 
-	amKey, err := loadKey(opts.KeyFile)
+	amKey, err := loadKey(conf.Gateway.KeyFile)
 	if err != nil {
 		return err
 	}
 
-	if opts.KeyID == "" {
-		opts.KeyID, err = thing.JWKThumbprint(amKey)
+	keyID := conf.Gateway.KeyID
+	if keyID == "" {
+		keyID, err = thing.JWKThumbprint(amKey)
 		if err != nil {
 			return err
 		}
@@ -117,45 +320,132 @@ func runGateway(opts commandlineOpts) error {
 
 	callbacks := []callback.Handler{
 		callback.AuthenticateHandler{
-			Audience: opts.Audience,
-			ThingID:  opts.Name,
-			KeyID:    opts.KeyID,
+			Audience: conf.AM.Audience,
+			ThingID:  conf.Gateway.Name,
+			KeyID:    keyID,
 			Key:      amKey,
 		}}
-	if opts.CertFile != "" {
-		certs, err := loadCertificates(opts.CertFile)
+	if conf.Gateway.CertFile != "" {
+		certs, err := loadCertificates(conf.Gateway.CertFile)
 		if err != nil {
 			return err
 		}
 		callbacks = append(callbacks, callback.RegisterHandler{
-			Audience:     opts.Audience,
-			ThingID:      opts.Name,
+			Audience:     conf.AM.Audience,
+			ThingID:      conf.Gateway.Name,
 			ThingType:    callback.TypeGateway,
-			KeyID:        opts.KeyID,
+			KeyID:        keyID,
 			Key:          amKey,
 			Certificates: certs,
 		})
 
 	}
-	iotGateway := gateway.New(opts.URL, opts.Realm, opts.Tree, opts.Timeout, callbacks)
-
-	err = iotGateway.Initialise()
+	iotGateway := gateway.New(conf.AM.URL, conf.AM.Realm, conf.AM.Tree, conf.AM.Timeout, callbacks)
+	var stores authStores
+	defer stores.Close()
+	authStore, err := stores.create(conf.AuthCache, "")
 	if err != nil {
 		return err
 	}
+	iotGateway.SetAuthStore(authStore)
+	iotGateway.SetRateLimit(conf.RateLimit.RequestsPerSecond, conf.RateLimit.Burst)
+	iotGateway.SetOfflineMode(conf.Offline.MaxStaleness, conf.Offline.RetryInterval)
+	iotGateway.SetPoPVerification(conf.PoP.Verify, conf.PoP.Strict)
+	if conf.Audit.File != "" {
+		auditLog, err := audit.NewLog(conf.Audit.File, int64(conf.Audit.MaxSizeMB)<<20, conf.Audit.MaxBackups,
+			conf.Audit.HashChain)
+		if err != nil {
+			return err
+		}
+		defer auditLog.Close()
+		iotGateway.SetAuditLog(auditLog)
+	}
 
-	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	err = iotGateway.Initialise()
 	if err != nil {
 		return err
 	}
-	err = iotGateway.StartCOAPServer(opts.Address, serverKey)
-	if err != nil {
-		return err
+
+	for _, r := range conf.Routes {
+		authStore, err = stores.create(conf.AuthCache, r.Name)
+		if err != nil {
+			return err
+		}
+		err = iotGateway.AddRoute(gateway.Route{
+			Name: r.Name,
+			Match: gateway.RouteMatch{
+				ClientCommonName: r.Match.ClientCommonName,
+				PathPrefix:       r.Match.PathPrefix,
+				Query:            r.Match.Query,
+				Audience:         r.Match.Audience,
+			},
+			URL:       r.URL,
+			Realm:     r.Realm,
+			Tree:      r.Tree,
+			Timeout:   r.Timeout,
+			AuthStore: authStore,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, l := range conf.Listeners {
+		listener, err := coapListenerConfig(l)
+		if err == nil {
+			_, err = iotGateway.StartListener(listener)
+		}
+		if err != nil {
+			iotGateway.ShutdownCOAPServer()
+			return fmt.Errorf("listener %s: %w", l.Address, err)
+		}
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), conf.Shutdown.Timeout)
+		defer cancel()
+		if err := iotGateway.Shutdown(ctx); err != nil {
+			slog.Warn("gateway shutdown was not clean", "err", err)
+		}
+	}()
+
+	if conf.Admin.Address != "" {
+		tlsConfig, err := serverTLSConfig(conf.Admin.CertFile, conf.Admin.KeyFile, conf.Admin.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		if err = iotGateway.StartAdminServer(conf.Admin.Address, tlsConfig, conf.Admin.Token); err != nil {
+			return err
+		}
+	}
+	if conf.Introspection.Address != "" {
+		tlsConfig, err := serverTLSConfig(conf.Introspection.CertFile, conf.Introspection.KeyFile,
+			conf.Introspection.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		err = iotGateway.StartIntrospectionServer(conf.Introspection.Address, tlsConfig, conf.Introspection.Clients)
+		if err != nil {
+			return err
+		}
 	}
-	defer iotGateway.ShutdownCOAPServer()
 
 	fmt.Println("IoT Gateway server started.")
-	<-signals
+	for s := range signals {
+		if s != syscall.SIGHUP {
+			break
+		}
+		updated, err := readConfig(opts)
+		if err != nil {
+			slog.Error("invalid configuration, keeping the current configuration", "err", err)
+			continue
+		}
+		if err = reload(iotGateway, conf, updated); err != nil {
+			slog.Error("failed to reload configuration", "err", err)
+			continue
+		}
+		conf = conf.reloaded(updated)
+		slog.Info("configuration reloaded")
+	}
 	fmt.Println("IoT Gateway server shutting down.")
 	return nil
 }
@@ -168,7 +458,15 @@ func main() {
 	}
 	fmt.Printf("%v\n", opts)
 
-	if err := runGateway(opts); err != nil {
+	conf, err := readConfig(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.CheckConfig {
+		fmt.Println("Configuration is valid.")
+		return
+	}
+	if err := runGateway(opts, conf); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// gatewayctl manages a running IoT Gateway through its admin API.
+//
+//	gatewayctl [options] peers                  list the DTLS peers of the gateway
+//	gatewayctl [options] close-peer ADDRESS     close the DTLS session with a peer
+//	gatewayctl [options] auth-cache KEY         show an entry of the authentication ID cache
+//	gatewayctl [options] logout THING_ID        log out the AM sessions of a thing
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+type commandlineOpts struct {
+	URL      string        `long:"url" default:"http://localhost:8090" description:"URL of the gateway admin API"`
+	Token    string        `long:"token" env:"GATEWAY_ADMIN_TOKEN" description:"Admin token"`
+	CertFile string        `long:"cert" description:"Client certificate PEM"`
+	KeyFile  string        `long:"key" description:"Client private key PEM"`
+	CAFile   string        `long:"cacert" description:"CA certificate PEM used to verify the admin server"`
+	Timeout  time.Duration `long:"timeout" default:"10s" description:"Request timeout"`
+	Args     struct {
+		Command  string   `positional-arg-name:"command" description:"peers, close-peer, auth-cache or logout"`
+		Argument []string `positional-arg-name:"argument"`
+	} `positional-args:"true" required:"true"`
+}
+
+// httpClient returns a client that presents the client certificate and trusts the CA certificate, if given
+func (opts commandlineOpts) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if opts.CAFile != "" {
+		b, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+	}
+	return &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// request returns the method and path of the admin API request for the command
+func request(command string, args []string) (method, path string, err error) {
+	argument := func() (string, error) {
+		if len(args) != 1 {
+			return "", fmt.Errorf("%s takes exactly one argument", command)
+		}
+		return url.PathEscape(args[0]), nil
+	}
+	switch command {
+	case "peers":
+		if len(args) != 0 {
+			return "", "", fmt.Errorf("peers takes no arguments")
+		}
+		return http.MethodGet, "/peers", nil
+	case "close-peer":
+		address, err := argument()
+		return http.MethodDelete, "/peers/" + address, err
+	case "auth-cache":
+		key, err := argument()
+		return http.MethodGet, "/auth-cache/" + key, err
+	case "logout":
+		thingID, err := argument()
+		return http.MethodPost, "/things/" + thingID + "/logout", err
+	default:
+		return "", "", fmt.Errorf("unknown command %s", command)
+	}
+}
+
+func run(opts commandlineOpts) error {
+	method, path, err := request(opts.Args.Command, opts.Args.Argument)
+	if err != nil {
+		return err
+	}
+	httpClient, err := opts.httpClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(opts.URL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.Token)
+	}
+	response, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s: %s", response.Status, bytes.TrimSpace(body))
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	var out bytes.Buffer
+	if err = json.Indent(&out, body, "", "  "); err != nil {
+		out.Write(body)
+	}
+	fmt.Println(strings.TrimSpace(out.String()))
+	return nil
+}
+
+func main() {
+	var opts commandlineOpts
+	if _, err := flags.Parse(&opts); err != nil {
+		os.Exit(1)
+	}
+	if err := run(opts); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -18,10 +18,7 @@ package main
 
 import (
 	"crypto"
-	"crypto/rand"
-	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/pem"
 	"fmt"
 	"github.com/ForgeRock/iot-edge/examples/secrets"
 	"github.com/ForgeRock/iot-edge/v7/pkg/builder"
@@ -31,22 +28,10 @@ import (
 	"os"
 )
 
-type csrHandler struct {
-	thingID string
-	signer  crypto.PrivateKey
-}
-
-func (a csrHandler) Handle(cb callback.Callback) (bool, error) {
-	if cb.Type == callback.TypeHiddenValueCallback && cb.ID() != "csr" {
-		return false, nil
-	}
-	csrPem := certificateSigningRequest(a.thingID, a.signer)
-	cb.Input[0].Value = csrPem
-	return true, nil
-}
-
-func certificateSigningRequest(thingID string, signer crypto.PrivateKey) string {
-	thingCSRTemplate := &x509.CertificateRequest{
+// csrHandler sends a certificate signing request to the tree node that issues the thing's certificate
+func csrHandler(thingID string, signer crypto.Signer) callback.Handler {
+	return callback.CSRHandler{
+		Key: signer,
 		Subject: pkix.Name{
 			CommonName:         thingID,
 			Country:            []string{"GB"},
@@ -54,15 +39,7 @@ func certificateSigningRequest(thingID string, signer crypto.PrivateKey) string
 			Organization:       []string{"ForgeRock"},
 			OrganizationalUnit: []string{"Engineering"},
 		},
-		SignatureAlgorithm: x509.ECDSAWithSHA256,
 	}
-	csr, err := x509.CreateCertificateRequest(rand.Reader, thingCSRTemplate, signer)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-	csrPem := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))
-	return csrPem
 }
 
 func register(tree string, deviceID string, amURL *url.URL, keyID string, signer crypto.Signer) thing.Thing {
@@ -74,7 +51,7 @@ func register(tree string, deviceID string, amURL *url.URL, keyID string, signer
 		AuthenticateThing(deviceID, "/", keyID, signer, nil).
 		HandleCallbacksWith(
 			callback.ProofOfPossessionHandler(deviceID, "/", keyID, signer),
-			csrHandler{deviceID, signer}).
+			csrHandler(deviceID, signer)).
 		Create()
 	if err != nil {
 		fmt.Println("Registration & Authentication failed", "\nReason: ", err)
@@ -92,7 +69,7 @@ func authenticate(tree string, deviceID string, amURL *url.URL, keyID string, si
 		WithTree(tree).
 		AuthenticateThing(deviceID, "/", keyID, signer, nil).
 		HandleCallbacksWith(
-			csrHandler{deviceID, signer}).
+			csrHandler(deviceID, signer)).
 		Create()
 	if err != nil {
 		fmt.Println("Authentication failed", "\nReason: ", err)
@@ -104,29 +81,18 @@ func authenticate(tree string, deviceID string, amURL *url.URL, keyID string, si
 
 func requestCertificate(device thing.Thing) {
 	fmt.Println("--> Requesting x.509 Certificate")
-	certResponse, err := device.RequestAttributes("thingCertificatePem")
-	certString, err := certResponse.GetFirst("thingCertificatePem")
-	if err != nil {
-		fmt.Println(certResponse.Content)
-		fmt.Println("request attributes failed", err)
-		os.Exit(1)
-	}
-
-	block, _ := pem.Decode([]byte(certString))
-	if block == nil {
-		fmt.Println("Failed to parse PEM")
-		os.Exit(1)
-	}
-	cert, err := x509.ParseCertificate(block.Bytes)
+	chain, err := device.RequestCertificateChain(thing.CertificateAttribute)
 	if err != nil {
-		fmt.Println("Failed to parse certificate", err)
+		fmt.Println("request certificate failed", err)
 		os.Exit(1)
 	}
+	cert := chain.Leaf()
 	fmt.Println("== x.509 Certificate ==",
 		"\nSubject:", cert.Subject,
 		"\nIssuer:", cert.Issuer,
 		"\nSerial Number:", cert.SerialNumber,
-		"\nValidity:", "\n\tNot Before:", cert.NotBefore, "\n\tNot After: ", cert.NotAfter)
+		"\nValidity:", "\n\tNot Before:", cert.NotBefore, "\n\tNot After: ", cert.NotAfter,
+		"\nRenew at:", chain.RenewAt(0.8))
 }
 
 func registerThings(tree string) {
@@ -1,6 +1,6 @@
 module github.com/ForgeRock/iot-edge/v7
 
-go 1.19
+go 1.21
 
 require (
 	github.com/dchest/uniuri v1.2.0
@@ -19,5 +19,5 @@ require (
 	github.com/pion/udp v0.1.1 // indirect
 	golang.org/x/crypto v0.0.0-20220427172511-eb4f295cb31f // indirect
 	golang.org/x/net v0.0.0-20220425223048-2871e0cb64e4 // indirect
-	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+	golang.org/x/sys v0.4.0 // indirect
 )
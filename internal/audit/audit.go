@@ -0,0 +1,251 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package audit writes an append only record of the requests handled by the IoT Gateway.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// tailSize is the amount read from the end of an existing log to find the last entry
+const tailSize = 64 * 1024
+
+// ErrBrokenChain is returned when the hash chain of a log does not match its entries
+var ErrBrokenChain = errors.New("audit log hash chain is broken")
+
+// Entry records the outcome of a request handled by the gateway. It must never contain token values.
+type Entry struct {
+	Time time.Time `json:"time"`
+	// the address of the DTLS peer
+	Peer string `json:"peer"`
+	// the RFC 7638 thumbprint of the key that the thing has proven possession of
+	KeyThumbprint string   `json:"key_thumbprint,omitempty"`
+	ThingID       string   `json:"thing_id,omitempty"`
+	Endpoint      string   `json:"endpoint"`
+	Scopes        []string `json:"scopes,omitempty"`
+	// the CoAP response code in c.dd format
+	Code string `json:"code"`
+	// the hash of the previous entry and the hash of this entry when the log is hash chained
+	Previous string `json:"prev,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// hash returns the hash of the entry, which includes the hash of the previous entry
+func (e Entry) hash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	d := sha256.Sum256(b)
+	return hex.EncodeToString(d[:]), nil
+}
+
+// Log writes entries as JSON Lines to a file that is rotated once it reaches its maximum size
+type Log struct {
+	mu         sync.Mutex
+	filename   string
+	maxSize    int64
+	maxBackups int
+	hashChain  bool
+	file       *os.File
+	size       int64
+	last       string
+}
+
+// NewLog opens the audit log file for appending, creating it if it does not exist. The file is rotated before it
+// exceeds maxSize bytes, keeping maxBackups rotated files named after the log with the suffix .1, .2 and so on. A
+// maxSize of zero disables rotation. When hashChain is true, each entry contains its own hash and the hash of the
+// previous entry so that changes to the log can be detected with VerifyChain. The chain continues from the last entry
+// of an existing log and across rotations.
+func NewLog(filename string, maxSize int64, maxBackups int, hashChain bool) (*Log, error) {
+	l := &Log{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		hashChain:  hashChain,
+	}
+	if hashChain {
+		var err error
+		if l.last, err = lastHash(filename); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// lastHash returns the hash of the last entry in the file
+func lastHash(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := info.Size() - tailSize
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, info.Size()-offset)
+	if _, err = f.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return "", err
+	}
+	lines := bytes.Split(bytes.TrimSpace(tail), []byte("\n"))
+	line := lines[len(lines)-1]
+	if len(line) == 0 {
+		return "", nil
+	}
+	var e Entry
+	if err = json.Unmarshal(line, &e); err != nil {
+		return "", fmt.Errorf("unable to read last audit entry: %w", err)
+	}
+	return e.Hash, nil
+}
+
+// open the log file for appending
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// backupName returns the name of the nth rotated file
+func (l *Log) backupName(n int) string {
+	return fmt.Sprintf("%s.%d", l.filename, n)
+}
+
+// rotate moves the current file to the first backup, shifting older backups along and dropping the oldest
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if l.maxBackups <= 0 {
+		if err := os.Remove(l.filename); err != nil {
+			return err
+		}
+		return l.open()
+	}
+	_ = os.Remove(l.backupName(l.maxBackups))
+	for n := l.maxBackups - 1; n > 0; n-- {
+		if err := os.Rename(l.backupName(n), l.backupName(n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(l.filename, l.backupName(1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Write appends the entry to the log
+func (l *Log) Write(e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return os.ErrClosed
+	}
+	e.Time = e.Time.UTC()
+	e.Previous, e.Hash = "", ""
+	if l.hashChain {
+		e.Previous = l.last
+		var err error
+		if e.Hash, err = e.hash(); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err = l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.last = e.Hash
+	return nil
+}
+
+// Close the log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// VerifyChain checks the hash chain of the entries read from r. The chain must start from the hash given in previous,
+// which is empty for the first file of a log. The hash of the last entry is returned so that the next file of a
+// rotated log can be checked.
+func VerifyChain(r io.Reader, previous string) (last string, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), tailSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var e Entry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return previous, fmt.Errorf("line %d: %w", line, err)
+		}
+		hash, err := e.hash()
+		if err != nil {
+			return previous, err
+		}
+		if e.Previous != previous || e.Hash != hash {
+			return previous, fmt.Errorf("line %d: %w", line, ErrBrokenChain)
+		}
+		previous = e.Hash
+	}
+	return previous, scanner.Err()
+}
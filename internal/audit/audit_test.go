@@ -0,0 +1,184 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEntry(n int) Entry {
+	return Entry{
+		Time:     time.Now(),
+		Peer:     "127.0.0.1:5000",
+		ThingID:  fmt.Sprintf("thing-%d", n),
+		Endpoint: "accesstoken",
+		Scopes:   []string{"publish", "subscribe"},
+		Code:     "2.04",
+	}
+}
+
+func writeEntries(t *testing.T, l *Log, from, to int) {
+	for n := from; n < to; n++ {
+		if err := l.Write(testEntry(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readEntries(t *testing.T, filename string) (entries []Entry) {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Entry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestLog_Write(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewLog(filename, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEntries(t, l, 0, 3)
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// entries are appended to an existing log
+	if l, err = NewLog(filename, 0, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	writeEntries(t, l, 3, 4)
+	_ = l.Close()
+
+	entries := readEntries(t, filename)
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(entries))
+	}
+	for n, e := range entries {
+		if e.ThingID != fmt.Sprintf("thing-%d", n) || e.Code != "2.04" || len(e.Scopes) != 2 {
+			t.Errorf("unexpected entry %+v", e)
+		}
+		if e.Hash != "" || e.Previous != "" {
+			t.Errorf("unexpected hash in entry %+v", e)
+		}
+	}
+	if err = l.Write(testEntry(5)); err == nil {
+		t.Error("expected an error writing to a closed log")
+	}
+}
+
+func TestLog_Rotate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	e := testEntry(0)
+	e.Previous, e.Hash = strings.Repeat("0", 64), strings.Repeat("0", 64)
+	b, _ := json.Marshal(e)
+	// room for two entries in each file
+	l, err := NewLog(filename, int64(2*len(b)+10), 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	writeEntries(t, l, 0, 7)
+
+	if _, err = os.Stat(filename + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected only two backups, %v", err)
+	}
+	var count int
+	for _, name := range []string{filename + ".2", filename + ".1", filename} {
+		count += len(readEntries(t, name))
+	}
+	// the oldest file was dropped
+	if count != 5 {
+		t.Errorf("expected 5 entries, got %d", count)
+	}
+	if entries := readEntries(t, filename); entries[len(entries)-1].ThingID != "thing-6" {
+		t.Errorf("expected the last entry in the current file, got %+v", entries)
+	}
+}
+
+func TestLog_HashChain(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewLog(filename, 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEntries(t, l, 0, 3)
+	_ = l.Close()
+	// the chain continues from the existing entries
+	if l, err = NewLog(filename, 0, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	writeEntries(t, l, 3, 5)
+	_ = l.Close()
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := VerifyChain(bytes.NewReader(content), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := readEntries(t, filename)
+	if last != entries[4].Hash || entries[3].Previous != entries[2].Hash {
+		t.Errorf("unexpected chain %+v", entries)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(lines []string) []string
+	}{
+		{name: "modified", modify: func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], "thing-1", "thing-9", 1)
+			return lines
+		}},
+		{name: "removed", modify: func(lines []string) []string {
+			return append(lines[:2], lines[3:]...)
+		}},
+		{name: "reordered", modify: func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			lines := subtest.modify(strings.Split(strings.TrimSpace(string(content)), "\n"))
+			_, err := VerifyChain(strings.NewReader(strings.Join(lines, "\n")), "")
+			if !errors.Is(err, ErrBrokenChain) {
+				t.Errorf("expected broken chain, got %v", err)
+			}
+		})
+	}
+}
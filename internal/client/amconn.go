@@ -26,6 +26,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/ForgeRock/iot-edge/v7/internal/debug"
@@ -40,12 +41,14 @@ const (
 	authNEndpointVersion      = "protocol=1.0,resource=2.1"
 	thingsEndpointVersion     = "protocol=2.0,resource=1.0"
 	sessionsEndpointVersion   = "resource=4.0"
+	usersEndpointVersion      = "protocol=1.0,resource=3.0"
 	httpContentType           = "Content-Type"
 	// Query keys
 	fieldQueryKey         = "_fields"
 	realmQueryKey         = "realm"
 	authIndexTypeQueryKey = "authIndexType"
 	authTreeQueryKey      = "authIndexValue"
+	forceAuthQueryKey     = "ForceAuth"
 )
 
 // newSessionRequest returns a new session request
@@ -69,18 +72,18 @@ func (c *amConnection) newSessionRequest(tokenID, url, payload string, content C
 func (c *amConnection) LogoutSession(tokenID string, content ContentType, payload string) (err error) {
 	request, err := c.newSessionRequest(tokenID, c.sessionLogoutURL(), payload, content)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.LogHTTPRoundTrip(request, nil)
 		return err
 	}
 
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return err
 	}
 	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return fmt.Errorf("session logout failed")
 	}
 	return nil
@@ -90,13 +93,13 @@ func (c *amConnection) LogoutSession(tokenID string, content ContentType, payloa
 func (c *amConnection) ValidateSession(tokenID string, content ContentType, payload string) (ok bool, err error) {
 	request, err := c.newSessionRequest(tokenID, c.sessionValidateURL(), payload, content)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.LogHTTPRoundTrip(request, nil)
 		return false, err
 	}
 
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return false, err
 	}
 	defer response.Body.Close()
@@ -106,13 +109,13 @@ func (c *amConnection) ValidateSession(tokenID string, content ContentType, payl
 	case http.StatusUnauthorized:
 		return false, nil
 	default:
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return false, fmt.Errorf("session validation failed")
 	}
 
 	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return false, err
 	}
 	info := struct {
@@ -125,6 +128,31 @@ func (c *amConnection) ValidateSession(tokenID string, content ContentType, payl
 
 }
 
+// SessionInfo requests the information about the session represented by the given token
+func (c *amConnection) SessionInfo(tokenID string, content ContentType, payload string) (reply []byte, err error) {
+	request, err := c.newSessionRequest(tokenID, c.sessionInfoURL(), payload, content)
+	if err != nil {
+		debug.LogHTTPRoundTrip(request, nil)
+		return nil, err
+	}
+
+	response, err := c.Do(request)
+	if err != nil {
+		debug.LogHTTPRoundTrip(request, response)
+		return nil, err
+	}
+	defer response.Body.Close()
+	reply, err = io.ReadAll(response.Body)
+	if err != nil {
+		debug.LogHTTPRoundTrip(request, response)
+		return nil, err
+	}
+	if err = errorFromStatus(response.StatusCode, reply); err != nil {
+		debug.LogHTTPRoundTrip(request, response)
+	}
+	return reply, err
+}
+
 // Initialise checks that the server can be reached and prepares the client for further communication
 func (c *amConnection) Initialise() error {
 	info, err := c.getServerInfo()
@@ -136,16 +164,36 @@ func (c *amConnection) Initialise() error {
 	return nil
 }
 
+// Ping checks that the server can be reached with a server information request. Unlike Initialise, it does not
+// update the connection so it can be called while the connection is in use.
+func (c *amConnection) Ping() error {
+	_, err := c.getServerInfo()
+	return err
+}
+
 // Authenticate with the AM authTree using the given payload
 // This is a single round trip
 func (c *amConnection) Authenticate(payload AuthenticatePayload) (reply AuthenticatePayload, err error) {
+	return c.authenticate("", c.authTree, false, payload)
+}
+
+// AuthenticateStepUp with the given tree against the session represented by the given token
+// This is a single round trip
+func (c *amConnection) AuthenticateStepUp(tokenID, tree string, forceAuth bool, payload AuthenticatePayload) (
+	reply AuthenticatePayload, err error) {
+	return c.authenticate(tokenID, tree, forceAuth, payload)
+}
+
+// authenticate makes a single authenticate request, with the session cookie if a token is given
+func (c *amConnection) authenticate(tokenID, tree string, forceAuth bool, payload AuthenticatePayload) (
+	reply AuthenticatePayload, err error) {
 	requestBody, err := json.Marshal(payload)
 	if err != nil {
 		return reply, err
 	}
 	request, err := http.NewRequest(http.MethodPost, c.baseURL+"/json/authenticate", bytes.NewBuffer(requestBody))
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.LogHTTPRoundTrip(request, nil)
 		return reply, err
 	}
 
@@ -155,28 +203,34 @@ func (c *amConnection) Authenticate(payload AuthenticatePayload) (reply Authenti
 		q.Set(realmQueryKey, c.realm)
 	}
 	q.Set(authIndexTypeQueryKey, "service")
-	q.Set(authTreeQueryKey, c.authTree)
+	q.Set(authTreeQueryKey, tree)
+	if forceAuth {
+		q.Set(forceAuthQueryKey, "true")
+	}
 	request.URL.RawQuery = q.Encode()
 
 	request.Header.Add(acceptAPIVersion, authNEndpointVersion)
 	request.Header.Add(httpContentType, string(ApplicationJSON))
+	if tokenID != "" {
+		request.AddCookie(&http.Cookie{Name: c.cookieName, Value: tokenID})
+	}
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return reply, err
 	}
 	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return reply, ResponseError{ResponseCode: CodeUnauthorized}
 	}
 	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return reply, err
 	}
 	if err = json.Unmarshal(responseBody, &reply); err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return reply, err
 	}
 	return reply, err
@@ -191,7 +245,7 @@ type serverInfo struct {
 func (c *amConnection) getServerInfo() (info serverInfo, err error) {
 	request, err := http.NewRequest(http.MethodGet, c.baseURL+"/json/serverinfo/*", nil)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.LogHTTPRoundTrip(request, nil)
 		return info, err
 	}
 
@@ -203,21 +257,21 @@ func (c *amConnection) getServerInfo() (info serverInfo, err error) {
 	request.Header.Add(httpContentType, string(ApplicationJSON))
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return info, err
 	}
 	defer response.Body.Close()
 	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return info, err
 	}
 	if response.StatusCode != http.StatusOK {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return info, fmt.Errorf("server info request failed")
 	}
 	if err = json.Unmarshal(responseBody, &info); err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return info, err
 	}
 	return info, err
@@ -231,31 +285,31 @@ func (c *amConnection) getJWKSURI() (uri string, err error) {
 	}
 	request, err := http.NewRequest(http.MethodGet, u, nil)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.LogHTTPRoundTrip(request, nil)
 		return uri, err
 	}
 
 	request.Header.Add(httpContentType, string(ApplicationJSON))
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return uri, err
 	}
 	defer response.Body.Close()
 	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return uri, err
 	}
 	if response.StatusCode != http.StatusOK {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return uri, fmt.Errorf("openid-configuration request failed")
 	}
 	var config struct {
 		URI string `json:"jwks_uri"`
 	}
 	if err = json.Unmarshal(responseBody, &config); err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return uri, err
 	}
 	return config.URI, err
@@ -269,28 +323,28 @@ func (c *amConnection) updateJSONWebKeySet() (err error) {
 	}
 	request, err := http.NewRequest(http.MethodGet, uri, nil)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.LogHTTPRoundTrip(request, nil)
 		return err
 	}
 
 	request.Header.Add(httpContentType, string(ApplicationJSON))
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return err
 	}
 	defer response.Body.Close()
 	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return err
 	}
 	if response.StatusCode != http.StatusOK {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return fmt.Errorf("OAuth 2.0 JSON Web Key set request failed")
 	}
 	if err = json.Unmarshal(responseBody, &c.accessTokenJWKS); err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return err
 	}
 	return nil
@@ -352,6 +406,10 @@ func (c *amConnection) sessionLogoutURL() string {
 	return fmt.Sprintf("%s/json/sessions?_action=logout", c.baseURL)
 }
 
+func (c *amConnection) sessionInfoURL() string {
+	return fmt.Sprintf("%s/json/sessions?_action=getSessionInfo", c.baseURL)
+}
+
 // AMInfo returns AM related information to the client
 func (c *amConnection) AMInfo() (info AMInfoResponse, err error) {
 	return AMInfoResponse{
@@ -365,6 +423,7 @@ func (c *amConnection) AMInfo() (info AMInfoResponse, err error) {
 		SessionsVersion:    sessionsEndpointVersion,
 		SessionValidateURL: c.sessionValidateURL(),
 		SessionLogoutURL:   c.sessionLogoutURL(),
+		SessionInfoURL:     c.sessionInfoURL(),
 	}, nil
 }
 
@@ -372,7 +431,7 @@ func (c *amConnection) AMInfo() (info AMInfoResponse, err error) {
 func (c *amConnection) AccessToken(tokenID string, content ContentType, payload string) ([]byte, error) {
 	request, err := http.NewRequest(http.MethodPost, c.accessTokenURL(), strings.NewReader(payload))
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.LogHTTPRoundTrip(request, nil)
 		return nil, err
 	}
 	return c.makeRequest(tokenID, content, request)
@@ -403,44 +462,58 @@ func (c *amConnection) introspectAccessTokenLocally(payload IntrospectPayload) (
 
 	// if keys is empty then we don't have the token key locally, get updated JWK set
 	if len(keys) == 0 {
-		debug.Logger.Println("updating JSON web key set")
+		debug.Log.Debug("updating JSON web key set")
 		err = c.updateJSONWebKeySet()
 		if err != nil {
-			debug.Logger.Printf("unknown access token key: %s. Cannot update jwks; %s", header.KeyID, err)
+			debug.Log.Warn("unknown access token key, cannot update jwks", "kid", header.KeyID, "error", err)
 			return introspect.InactiveIntrospectionBytes, nil
 		}
 		keys = c.accessTokenJWKS.Key(header.KeyID)
 		if len(keys) == 0 {
 			// unknown key, return inactive introspection
-			debug.Logger.Printf("unknown access token key: %s", header.KeyID)
+			debug.Log.Debug("unknown access token key", "kid", header.KeyID)
 			return introspect.InactiveIntrospectionBytes, nil
 		}
 	}
 	if len(keys) > 1 {
-		debug.Logger.Println("Received multiple keys for a single KID; using first key only")
+		debug.Log.Debug("received multiple keys for a single KID, using first key only", "kid", header.KeyID)
 	}
 	introspection, err = object.Verify(keys[0])
 	if err != nil {
-		debug.Logger.Printf("Cryptographic verification failed; %s", err)
+		debug.Log.Debug("cryptographic verification failed", "error", err)
 		return introspect.InactiveIntrospectionBytes, nil
 	}
 
 	if !introspect.ValidNow(introspection) {
-		debug.Logger.Printf("not within the valid time period of the token")
+		debug.Log.Debug("not within the valid time period of the token")
 		return introspect.InactiveIntrospectionBytes, nil
 	}
 	return introspect.CreateFromJWT(introspection)
 }
 
-// IntrospectAccessToken introspects an access token
-func (c *amConnection) IntrospectAccessToken(tokenID string, content ContentType, payload string) (introspection []byte, err error) {
-	var token IntrospectPayload
+// decodeIntrospectPayload extracts the token to be introspected from the request payload
+func decodeIntrospectPayload(content ContentType, payload string) (token IntrospectPayload, err error) {
 	switch content {
 	case ApplicationJOSE:
 		err = jws.ExtractClaims(payload, &token)
 	case ApplicationJSON:
 		err = json.Unmarshal([]byte(payload), &token)
 	}
+	return token, err
+}
+
+// IntrospectAccessTokenLocally introspects an access token without contacting AM
+func (c *amConnection) IntrospectAccessTokenLocally(content ContentType, payload string) (introspection []byte, err error) {
+	token, err := decodeIntrospectPayload(content, payload)
+	if err != nil {
+		return introspection, err
+	}
+	return c.introspectAccessTokenLocally(token)
+}
+
+// IntrospectAccessToken introspects an access token
+func (c *amConnection) IntrospectAccessToken(tokenID string, content ContentType, payload string) (introspection []byte, err error) {
+	token, err := decodeIntrospectPayload(content, payload)
 	if err != nil {
 		return introspection, err
 	}
@@ -448,7 +521,7 @@ func (c *amConnection) IntrospectAccessToken(tokenID string, content ContentType
 	// request AM to introspect the token
 	request, err := http.NewRequest(http.MethodPost, c.introspectURL(), strings.NewReader(payload))
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.LogHTTPRoundTrip(request, nil)
 		return introspection, err
 	}
 	introspection, err = c.makeRequest(tokenID, content, request)
@@ -464,7 +537,7 @@ func (c *amConnection) IntrospectAccessToken(tokenID string, content ContentType
 func (c *amConnection) Attributes(tokenID string, content ContentType, payload string, names []string) (reply []byte, err error) {
 	request, err := http.NewRequest(http.MethodGet, c.attributesURL(names), strings.NewReader(payload))
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.LogHTTPRoundTrip(request, nil)
 		return nil, err
 	}
 	return c.makeRequest(tokenID, content, request)
@@ -474,7 +547,7 @@ func (c *amConnection) Attributes(tokenID string, content ContentType, payload s
 func (c *amConnection) UserCode(tokenID string, content ContentType, payload string) ([]byte, error) {
 	request, err := http.NewRequest(http.MethodPost, c.userCodeURL(), strings.NewReader(payload))
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.LogHTTPRoundTrip(request, nil)
 		return nil, err
 	}
 	return c.makeRequest(tokenID, content, request)
@@ -484,7 +557,7 @@ func (c *amConnection) UserCode(tokenID string, content ContentType, payload str
 func (c *amConnection) UserToken(tokenID string, content ContentType, payload string) ([]byte, error) {
 	request, err := http.NewRequest(http.MethodPost, c.userTokenURL(), strings.NewReader(payload))
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.LogHTTPRoundTrip(request, nil)
 		return nil, err
 	}
 	return c.makeRequest(tokenID, content, request)
@@ -496,22 +569,81 @@ func (c *amConnection) makeRequest(tokenID string, content ContentType, request
 	request.AddCookie(&http.Cookie{Name: c.cookieName, Value: tokenID})
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return nil, err
 	}
 	defer response.Body.Close()
 	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 		return nil, err
 	}
 	err = errorFromStatus(response.StatusCode, responseBody)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.LogHTTPRoundTrip(request, response)
 	}
 	return responseBody, err
 }
 
+// ThingKeys reads the confirmation keys of a thing from the thingKeys attribute of its identity
+func (c *amConnection) ThingKeys(tokenID, thingID string) (keys jose.JSONWebKeySet, err error) {
+	query := url.Values{fieldQueryKey: {"thingKeys"}}
+	if c.realm != "" {
+		query.Set(realmQueryKey, c.realm)
+	}
+	u := c.baseURL + "/json/users/" + url.PathEscape(thingID) + "?" + query.Encode()
+	request, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		debug.LogHTTPRoundTrip(request, nil)
+		return keys, err
+	}
+	request.Header.Set(acceptAPIVersion, usersEndpointVersion)
+	request.Header.Set(httpContentType, string(ApplicationJSON))
+	request.AddCookie(&http.Cookie{Name: c.cookieName, Value: tokenID})
+	response, err := c.Do(request)
+	if err != nil {
+		debug.LogHTTPRoundTrip(request, response)
+		return keys, err
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		debug.LogHTTPRoundTrip(request, response)
+		return keys, err
+	}
+	if err = errorFromStatus(response.StatusCode, responseBody); err != nil {
+		debug.LogHTTPRoundTrip(request, response)
+		return keys, err
+	}
+	var identity struct {
+		ThingKeys json.RawMessage `json:"thingKeys"`
+	}
+	if err = json.Unmarshal(responseBody, &identity); err != nil {
+		return keys, err
+	}
+	return decodeThingKeys(identity.ThingKeys)
+}
+
+// decodeThingKeys decodes the thingKeys attribute, which AM may return as a JSON object, as a string containing the
+// JSON or as a list containing a single string
+func decodeThingKeys(attribute json.RawMessage) (keys jose.JSONWebKeySet, err error) {
+	var values []string
+	var value string
+	switch {
+	case len(attribute) == 0:
+		return keys, fmt.Errorf("thing has no keys")
+	case json.Unmarshal(attribute, &values) == nil:
+		if len(values) == 0 {
+			return keys, fmt.Errorf("thing has no keys")
+		}
+		attribute = []byte(values[0])
+	case json.Unmarshal(attribute, &value) == nil:
+		attribute = []byte(value)
+	}
+	err = json.Unmarshal(attribute, &keys)
+	return keys, err
+}
+
 // SetAuthenticationTree changes the authentication tree that the connection was created with.
 // This is a convenience function for functional testing.
 func SetAuthenticationTree(connection Connection, tree string) {
@@ -1,5 +1,5 @@
 /*
- * Copyright 2020 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -28,6 +28,7 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"strings"
 	"testing"
@@ -121,6 +122,25 @@ func TestAMClient_Initialise(t *testing.T) {
 	}
 }
 
+func TestAMClient_Ping(t *testing.T) {
+	server := httptest.NewTLSServer(testServerInfoHTTPMux(http.StatusOK, testServerInfo()))
+	defer server.Close()
+
+	c := &amConnection{baseURL: server.URL, realm: testRealm, authTree: testTree}
+	testSetRootCAs(c, server)
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	// the connection is not changed by a ping
+	if c.cookieName != "" {
+		t.Errorf("expected the cookie name to be left unset, got %s", c.cookieName)
+	}
+	server.Close()
+	if err := c.Ping(); err == nil {
+		t.Error("expected an error once the server has gone")
+	}
+}
+
 func testAuthHTTPMux(code int, response []byte) (mux *http.ServeMux) {
 	mux = testServerInfoHTTPMux(http.StatusOK, testServerInfo())
 	mux.HandleFunc("/json/authenticate", func(writer http.ResponseWriter, request *http.Request) {
@@ -200,6 +220,50 @@ func TestAMClient_Authenticate(t *testing.T) {
 	}
 }
 
+func TestAMClient_AuthenticateStepUp(t *testing.T) {
+	mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+	var query url.Values
+	var cookie *http.Cookie
+	mux.HandleFunc("/json/authenticate", func(writer http.ResponseWriter, request *http.Request) {
+		query = request.URL.Query()
+		cookie, _ = request.Cookie(testCookieName)
+		_, _ = writer.Write([]byte(`{"tokenId":"upgraded"}`))
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+	c := &amConnection{
+		baseURL:  server.URL,
+		realm:    testRealm,
+		authTree: testTree,
+	}
+	testSetRootCAs(c, server)
+	if err := c.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := c.AuthenticateStepUp("12345", "step-up-tree", true, AuthenticatePayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.TokenID != "upgraded" {
+		t.Errorf("unexpected reply %v", reply)
+	}
+	if query.Get("authIndexValue") != "step-up-tree" || query.Get("ForceAuth") != "true" {
+		t.Errorf("unexpected query %v", query)
+	}
+	if cookie == nil || cookie.Value != "12345" {
+		t.Errorf("expected the session cookie, got %v", cookie)
+	}
+
+	// a normal authentication request has no session cookie
+	if _, err = c.Authenticate(AuthenticatePayload{}); err != nil {
+		t.Fatal(err)
+	}
+	if query.Get("authIndexValue") != testTree || query.Has("ForceAuth") || cookie != nil {
+		t.Errorf("unexpected request %v, %v", query, cookie)
+	}
+}
+
 func TestAMClient_AMInfo(t *testing.T) {
 	url := "http://same-path.org"
 	client := &amConnection{
@@ -472,3 +536,59 @@ func TestAMConnection_IntrospectAccessToken_Locally(t *testing.T) {
 		})
 	}
 }
+
+func TestAMClient_ThingKeys(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "pop.cnf"}}})
+	asString, _ := json.Marshal(string(jwks))
+	tests := []struct {
+		name       string
+		successful bool
+		code       int
+		response   string
+	}{
+		{name: "object", successful: true, code: http.StatusOK, response: `{"thingKeys":` + string(jwks) + `}`},
+		{name: "string", successful: true, code: http.StatusOK, response: `{"thingKeys":` + string(asString) + `}`},
+		{name: "list", successful: true, code: http.StatusOK, response: `{"thingKeys":[` + string(asString) + `]}`},
+		{name: "no-keys", code: http.StatusOK, response: `{}`},
+		{name: "no-go", code: http.StatusForbidden, response: `{}`},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+			mux.HandleFunc("/json/users/thing-1", func(writer http.ResponseWriter, request *http.Request) {
+				query := request.URL.Query()
+				if query.Get("_fields") != "thingKeys" || query.Get("realm") != "/a/realm&x" {
+					t.Errorf("unexpected query %s", request.URL.RawQuery)
+				}
+				if cookie, err := request.Cookie(testCookieName); err != nil || cookie.Value != "aToken" {
+					t.Errorf("expected session cookie")
+				}
+				writer.WriteHeader(subtest.code)
+				_, _ = writer.Write([]byte(subtest.response))
+			})
+			server := httptest.NewTLSServer(mux)
+			defer server.Close()
+			// the realm is escaped in the query
+			c := &amConnection{baseURL: server.URL, realm: "/a/realm&x"}
+			testSetRootCAs(c, server)
+			if err := c.Initialise(); err != nil {
+				t.Fatal(err)
+			}
+
+			keys, err := c.ThingKeys("aToken", "thing-1")
+			if !subtest.successful {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found := keys.Key("pop.cnf"); len(found) != 1 {
+				t.Errorf("expected key in %v", keys)
+			}
+		})
+	}
+}
@@ -1,5 +1,5 @@
 /*
- * Copyright 2020-2022 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -245,6 +245,9 @@ type Connection interface {
 	// LogoutSession makes a request to logout the session
 	LogoutSession(tokenID string, content ContentType, payload string) (err error)
 
+	// SessionInfo makes a request for the information held by AM about the session
+	SessionInfo(tokenID string, content ContentType, payload string) (reply []byte, err error)
+
 	// AccessToken makes an access token request with the given session token and payload
 	AccessToken(tokenID string, content ContentType, payload string) (reply []byte, err error)
 
@@ -261,6 +264,33 @@ type Connection interface {
 	UserToken(tokenID string, content ContentType, payload string) (reply []byte, err error)
 }
 
+// LocalIntrospector is implemented by connections that can introspect access tokens without contacting AM
+type LocalIntrospector interface {
+	// IntrospectAccessTokenLocally introspects a stateless access token using the keys already known by the connection
+	IntrospectAccessTokenLocally(content ContentType, payload string) (introspection []byte, err error)
+}
+
+// ThingKeyReader is implemented by connections that can read the confirmation keys of a thing from AM
+type ThingKeyReader interface {
+	// ThingKeys reads the keys of the thing with the given ID using the given session token, which must be allowed to
+	// read the thing's identity
+	ThingKeys(tokenID, thingID string) (keys jose.JSONWebKeySet, err error)
+}
+
+// Pinger is implemented by connections that can check whether AM can be reached without changing their state
+type Pinger interface {
+	// Ping makes a read-only request to AM
+	Ping() error
+}
+
+// StepUpAuthenticator is implemented by connections that can authenticate with any tree against an existing session
+type StepUpAuthenticator interface {
+	// AuthenticateStepUp sends an authenticate request for the given tree with the session token. AM upgrades the
+	// session when the journey completes. If forceAuth is true then AM runs the tree even if the session satisfies it.
+	AuthenticateStepUp(tokenID, tree string, forceAuth bool, payload AuthenticatePayload) (reply AuthenticatePayload,
+		err error)
+}
+
 type ConnectionBuilder struct {
 	url     *url.URL
 	realm   string
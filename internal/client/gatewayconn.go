@@ -31,6 +31,7 @@ import (
 	"time"
 
 	frcrypto "github.com/ForgeRock/iot-edge/v7/internal/crypto"
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
 	"github.com/go-ocf/go-coap"
 	"github.com/go-ocf/go-coap/codes"
 	"github.com/pion/dtls/v2"
@@ -39,6 +40,28 @@ import (
 // CoAP Content-Formats registry does not contain a JOSE value, using an unassigned value
 const AppJOSE coap.MediaType = 11650
 
+// OptionCacheAge is set by the IoT Gateway on responses that it has served without contacting AM. The value is the
+// age of the response in seconds. The option number is from the experimental use range and is elective so it is
+// ignored by clients that do not recognise it.
+const OptionCacheAge coap.OptionID = 65004
+
+// CacheAge returns the age of a response served by the IoT Gateway without contacting AM
+func CacheAge(msg coap.Message) (age time.Duration, ok bool) {
+	var seconds uint32
+	switch v := msg.Option(OptionCacheAge).(type) {
+	case uint32:
+		seconds = v
+	case []byte:
+		// unrecognised options are returned as opaque values
+		for _, b := range v {
+			seconds = seconds<<8 | uint32(b)
+		}
+	default:
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
 type errCoAPStatusCode struct {
 	code    codes.Code
 	payload []byte
@@ -104,8 +127,34 @@ func (c *gatewayConnection) Initialise() (err error) {
 		// default ping timeout to an hour
 		timeout = 3600 * time.Second
 	}
-	err = conn.Ping(timeout)
-	return err
+	if err = conn.Ping(timeout); err != nil {
+		return err
+	}
+	return c.discover(conn)
+}
+
+// discover reads the resources offered by the IoT Gateway and checks that they match the resources that the client
+// requires. Gateways that do not support resource discovery are assumed to be compatible.
+func (c *gatewayConnection) discover(conn *coap.ClientConn) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	response, err := conn.GetWithContext(ctx, WellKnownCore)
+	if err != nil {
+		return err
+	}
+	switch response.Code() {
+	case codes.Content:
+	case codes.NotFound:
+		debug.Log.Info("IoT Gateway does not support resource discovery")
+		return nil
+	default:
+		return errCoAPStatusCode{response.Code(), response.Payload()}
+	}
+	links, err := ParseLinks(response.Payload())
+	if err != nil {
+		return err
+	}
+	return checkCapabilities(links)
 }
 
 // Authenticate with the AM authTree using the given payload
@@ -129,6 +178,7 @@ func (c *gatewayConnection) Authenticate(payload AuthenticatePayload) (reply Aut
 	defer cancel()
 
 	response, err := conn.ExchangeWithContext(ctx, msg)
+	debug.LogCOAPRoundTrip(conn, msg, response)
 	if err != nil {
 		return reply, err
 	} else if response.Code() != codes.Valid {
@@ -224,9 +274,13 @@ func (c *gatewayConnection) makeAuthorisedPost(tokenID string, endpoint string,
 	}
 	request.SetQuery(query)
 	response, err := conn.ExchangeWithContext(ctx, request)
+	debug.LogCOAPRoundTrip(conn, request, response)
 	if err != nil {
 		return nil, err
 	}
+	if age, ok := CacheAge(response); ok {
+		debug.Log.Info("response served by the gateway while AM is unavailable", debug.Endpoint(endpoint), "age", age)
+	}
 	return response.Payload(), errorFromCode(response.Code(), response.Payload())
 }
 
@@ -256,7 +310,9 @@ func (c *gatewayConnection) makeSessionRequest(tokenID, action, payload string,
 		return response, err
 	}
 	message.SetQueryString(fmt.Sprintf("_action=%s", action))
-	return conn.ExchangeWithContext(ctx, message)
+	response, err = conn.ExchangeWithContext(ctx, message)
+	debug.LogCOAPRoundTrip(conn, message, response)
+	return response, err
 }
 
 // ValidateSession represented by the given token
@@ -282,6 +338,9 @@ func (c *gatewayConnection) LogoutSession(tokenID string, content ContentType, p
 	if err != nil {
 		return err
 	}
+	if _, ok := CacheAge(response); ok {
+		debug.Log.Info("logout queued by the gateway while AM is unavailable")
+	}
 
 	switch response.Code() {
 	case codes.Changed:
@@ -291,6 +350,15 @@ func (c *gatewayConnection) LogoutSession(tokenID string, content ContentType, p
 	}
 }
 
+// SessionInfo requests the information about the session represented by the given token
+func (c *gatewayConnection) SessionInfo(tokenID string, content ContentType, payload string) (reply []byte, err error) {
+	response, err := c.makeSessionRequest(tokenID, "getSessionInfo", payload, content)
+	if err != nil {
+		return nil, err
+	}
+	return response.Payload(), errorFromCode(response.Code(), response.Payload())
+}
+
 // errorFromCode will check if the CoAP code is one of the mapped ResponseCodes
 func errorFromCode(code codes.Code, response []byte) error {
 	for _, responseCode := range ResponseCodes {
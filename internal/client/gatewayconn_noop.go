@@ -1,7 +1,7 @@
 // +build http,!coap
 
 /*
- * Copyright 2020-2022 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -42,6 +42,10 @@ func (c *gatewayConnection) LogoutSession(tokenID string, content ContentType, p
 	return errCOAPNotBuilt
 }
 
+func (c *gatewayConnection) SessionInfo(tokenID string, content ContentType, payload string) (reply []byte, err error) {
+	return reply, errCOAPNotBuilt
+}
+
 func (c *gatewayConnection) AccessToken(tokenID string, content ContentType, payload string) (reply []byte, err error) {
 	return reply, errCOAPNotBuilt
 }
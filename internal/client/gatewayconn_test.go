@@ -1,5 +1,5 @@
 /*
- * Copyright 2020 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -17,6 +17,7 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"crypto"
 	"crypto/ecdsa"
@@ -93,6 +94,15 @@ func testUserTokenCOAPMux(code codes.Code, response []byte) (mux *coap.ServeMux)
 	return mux
 }
 
+func testDiscoveryCOAPMux(links []Link) (mux *coap.ServeMux) {
+	mux = coap.NewServeMux()
+	mux.HandleFunc(WellKnownCore, func(w coap.ResponseWriter, r *coap.Request) {
+		w.SetContentFormat(coap.AppLinkFormat)
+		_, _ = w.Write(FormatLinks(links))
+	})
+	return mux
+}
+
 func testIntrospectionCOAPMux(code codes.Code, response []byte) (mux *coap.ServeMux) {
 	mux = coap.NewServeMux()
 	mux.HandleFunc("/introspect", func(w coap.ResponseWriter, r *coap.Request) {
@@ -154,6 +164,10 @@ func TestGatewayClient_Initialise(t *testing.T) {
 		{name: "success", successful: true, client: &gatewayConnection{key: testGenerateSigner()},
 			server: &testCOAPServer{config: dtlsServerConfig(cert), mux: coap.DefaultServeMux}},
 		{name: "client-no-signer", client: &gatewayConnection{key: nil}, server: nil},
+		{name: "discovery-compatible", successful: true, client: &gatewayConnection{key: testGenerateSigner()},
+			server: &testCOAPServer{config: dtlsServerConfig(cert), mux: testDiscoveryCOAPMux(GatewayLinks())}},
+		{name: "discovery-incompatible", client: &gatewayConnection{key: testGenerateSigner()},
+			server: &testCOAPServer{config: dtlsServerConfig(cert), mux: testDiscoveryCOAPMux(GatewayLinks()[:2])}},
 		// starting a DTLS server without a certificate or PSK is an error.
 		{name: "server-wrong-tls-signer", client: &gatewayConnection{key: testGenerateSigner()},
 			server: &testCOAPServer{config: dtlsServerConfig(testWrongTLSSigner()), mux: coap.DefaultServeMux}},
@@ -503,3 +517,25 @@ func TestGatewayClient_Introspection(t *testing.T) {
 		})
 	}
 }
+
+func TestCacheAge(t *testing.T) {
+	msg := coap.NewDgramMessage(coap.MessageParams{Type: coap.Acknowledgement, Code: codes.Changed, MessageID: 1})
+	if _, ok := CacheAge(msg); ok {
+		t.Error("expected no cache age")
+	}
+	msg.SetOption(OptionCacheAge, uint32(300))
+	// the option is opaque once the message has been sent since it is not known to the CoAP library
+	var b bytes.Buffer
+	if err := msg.MarshalBinary(&b); err != nil {
+		t.Fatal(err)
+	}
+	received, err := coap.ParseDgramMessage(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []coap.Message{msg, received} {
+		if age, ok := CacheAge(m); !ok || age != 5*time.Minute {
+			t.Errorf("expected cache age of 5m, got %v, %v", age, ok)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+)
+
+// ErrNotRecorded is returned by a replay connection for requests that are not part of an authentication journey
+var ErrNotRecorded = errors.New("request is not part of a recorded authentication journey")
+
+// JourneyRound is a single authenticate round trip of a recorded authentication journey.
+// A recording is a sequence of rounds encoded as JSON, one round per line.
+type JourneyRound struct {
+	// the round number within the journey, starting at 1
+	Round    int                 `json:"round"`
+	Request  AuthenticatePayload `json:"request"`
+	Response AuthenticatePayload `json:"response"`
+	// the name of the response code if the round trip failed with a ResponseError
+	Code string `json:"code,omitempty"`
+	// the error returned by the round trip
+	Error string `json:"error,omitempty"`
+}
+
+// err returns the error that was recorded for the round
+func (r JourneyRound) err() error {
+	if r.Error == "" && r.Code == "" {
+		return nil
+	}
+	for _, code := range ResponseCodes {
+		if code.Name == r.Code {
+			responseErr := ResponseError{ResponseCode: code}
+			if r.Error != code.Name {
+				responseErr.Message = r.Error
+			}
+			return responseErr
+		}
+	}
+	return errors.New(r.Error)
+}
+
+// redactInputs returns a copy of the payload where the values of all non-empty callback inputs are redacted
+func redactInputs(payload AuthenticatePayload) AuthenticatePayload {
+	callbacks := make([]callback.Callback, len(payload.Callbacks))
+	for i, cb := range payload.Callbacks {
+		cb.Input = append([]callback.Entry(nil), cb.Input...)
+		for j, e := range cb.Input {
+			if e.Value != nil && e.Value != "" {
+				cb.Input[j].Value = debug.Redacted
+			}
+		}
+		callbacks[i] = cb
+	}
+	payload.Callbacks = callbacks
+	return payload
+}
+
+// recordingConnection records the authenticate round trips made with the connection
+type recordingConnection struct {
+	Connection
+	mu    sync.Mutex
+	w     io.Writer
+	round int
+}
+
+// RecordJourney returns a connection that writes each authenticate round trip made with the given connection to the
+// writer. The values of callback inputs are redacted, along with the session and authentication IDs and any other
+// sensitive values that are redacted from the debug output.
+func RecordJourney(connection Connection, w io.Writer) Connection {
+	return &recordingConnection{Connection: connection, w: w}
+}
+
+func (c *recordingConnection) Authenticate(payload AuthenticatePayload) (reply AuthenticatePayload, err error) {
+	round := JourneyRound{Request: redactInputs(payload)}
+	reply, err = c.Connection.Authenticate(payload)
+	round.Response = reply
+	if err != nil {
+		round.Error = err.Error()
+		if responseErr, ok := err.(ResponseError); ok {
+			round.Code = responseErr.Name
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a request without an authentication ID starts a new journey
+	if payload.AuthId == "" {
+		c.round = 0
+	}
+	c.round++
+	round.Round = c.round
+	b, marshalErr := json.Marshal(round)
+	if marshalErr == nil {
+		_, marshalErr = io.WriteString(c.w, debug.Redact(string(b))+"\n")
+	}
+	if marshalErr != nil {
+		debug.Log.Warn("failed to record authentication journey", "round", round.Round, "error", marshalErr)
+	}
+	return reply, err
+}
+
+// replayConnection plays back a recorded authentication journey
+type replayConnection struct {
+	mu     sync.Mutex
+	rounds []JourneyRound
+	next   int
+}
+
+// NewReplayConnection returns a connection that plays back the authentication journeys of the recording, see
+// RecordJourney. Each authenticate request must match the next recorded request: the callbacks must have the same
+// types and IDs, and every input that was set in the recording must be set. Requests that are not part of an
+// authentication journey fail with ErrNotRecorded.
+func NewReplayConnection(recording io.Reader) (Connection, error) {
+	var rounds []JourneyRound
+	scanner := bufio.NewScanner(recording)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var round JourneyRound
+		if err := json.Unmarshal(scanner.Bytes(), &round); err != nil {
+			return nil, fmt.Errorf("recording line %d: %w", line, err)
+		}
+		rounds = append(rounds, round)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(rounds) == 0 {
+		return nil, errors.New("recording has no authentication rounds")
+	}
+	return &replayConnection{rounds: rounds}, nil
+}
+
+func (c *replayConnection) Initialise() error {
+	return nil
+}
+
+func (c *replayConnection) Authenticate(payload AuthenticatePayload) (reply AuthenticatePayload, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.next >= len(c.rounds) {
+		return reply, errors.New("replay: no more recorded rounds")
+	}
+	round := c.rounds[c.next]
+	c.next++
+	if err = matchRequest(round.Request, payload); err != nil {
+		return reply, fmt.Errorf("replay: round %d: %w", round.Round, err)
+	}
+	return clearRedactedInputs(round.Response), round.err()
+}
+
+// clearRedactedInputs returns a copy of the payload where the redacted callback inputs are empty, so that the
+// callback handlers must set them
+func clearRedactedInputs(payload AuthenticatePayload) AuthenticatePayload {
+	callbacks := make([]callback.Callback, len(payload.Callbacks))
+	for i, cb := range payload.Callbacks {
+		cb.Input = append([]callback.Entry(nil), cb.Input...)
+		for j, e := range cb.Input {
+			if e.Value == debug.Redacted {
+				cb.Input[j].Value = ""
+			}
+		}
+		callbacks[i] = cb
+	}
+	payload.Callbacks = callbacks
+	return payload
+}
+
+// matchRequest checks that the request has the same shape as the recorded request
+func matchRequest(recorded, request AuthenticatePayload) error {
+	if len(recorded.Callbacks) != len(request.Callbacks) {
+		return fmt.Errorf("expected %d callbacks, got %d", len(recorded.Callbacks), len(request.Callbacks))
+	}
+	for i, expected := range recorded.Callbacks {
+		actual := request.Callbacks[i]
+		if actual.Type != expected.Type || actual.ID() != expected.ID() {
+			return fmt.Errorf("expected callback %s id=%s, got %s id=%s", expected.Type, expected.ID(), actual.Type,
+				actual.ID())
+		}
+		if len(actual.Input) != len(expected.Input) {
+			return fmt.Errorf("callback %s: expected %d inputs, got %d", expected.Type, len(expected.Input),
+				len(actual.Input))
+		}
+		for j, e := range expected.Input {
+			if e.Value == debug.Redacted && (actual.Input[j].Value == nil || actual.Input[j].Value == "") {
+				return fmt.Errorf("callback %s: input %s was not set", expected.Type, e.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *replayConnection) AMInfo() (info AMInfoResponse, err error) {
+	return info, nil
+}
+
+func (c *replayConnection) ValidateSession(string, ContentType, string) (bool, error) {
+	return false, ErrNotRecorded
+}
+
+func (c *replayConnection) LogoutSession(string, ContentType, string) error {
+	return ErrNotRecorded
+}
+
+func (c *replayConnection) SessionInfo(string, ContentType, string) ([]byte, error) {
+	return nil, ErrNotRecorded
+}
+
+func (c *replayConnection) AccessToken(string, ContentType, string) ([]byte, error) {
+	return nil, ErrNotRecorded
+}
+
+func (c *replayConnection) IntrospectAccessToken(string, ContentType, string) ([]byte, error) {
+	return nil, ErrNotRecorded
+}
+
+func (c *replayConnection) Attributes(string, ContentType, string, []string) ([]byte, error) {
+	return nil, ErrNotRecorded
+}
+
+func (c *replayConnection) UserCode(string, ContentType, string) ([]byte, error) {
+	return nil, ErrNotRecorded
+}
+
+func (c *replayConnection) UserToken(string, ContentType, string) ([]byte, error) {
+	return nil, ErrNotRecorded
+}
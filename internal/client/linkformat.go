@@ -0,0 +1,219 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-ocf/go-coap"
+)
+
+const (
+	// WellKnownCore is the path of the resource that lists the resources of the IoT Gateway in CoRE Link Format
+	// (RFC 6690)
+	WellKnownCore = "/.well-known/core"
+	// GatewayProtocolVersion is the version of the protocol spoken between things and the IoT Gateway. Clients and
+	// gateways with the same major version are compatible.
+	GatewayProtocolVersion = "1.0"
+	// gatewayInterface is the interface description of the IoT Gateway resources
+	gatewayInterface = "iot.gw"
+)
+
+// ErrIncompatibleGateway is returned when the IoT Gateway does not offer the resources required by the client
+var ErrIncompatibleGateway = errors.New("incompatible IoT Gateway")
+
+// Link describes a resource in CoRE Link Format
+type Link struct {
+	Target string
+	// rt attribute
+	ResourceType string
+	// if attribute
+	Interface string
+	// ct attribute
+	ContentFormats []coap.MediaType
+	// ver attribute, the protocol version of the resource
+	Version string
+}
+
+// String returns the link in CoRE Link Format
+func (l Link) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%s>", l.Target)
+	if l.ResourceType != "" {
+		fmt.Fprintf(&b, `;rt="%s"`, l.ResourceType)
+	}
+	if l.Interface != "" {
+		fmt.Fprintf(&b, `;if="%s"`, l.Interface)
+	}
+	switch len(l.ContentFormats) {
+	case 0:
+	case 1:
+		fmt.Fprintf(&b, ";ct=%d", l.ContentFormats[0])
+	default:
+		formats := make([]string, len(l.ContentFormats))
+		for i, f := range l.ContentFormats {
+			formats[i] = strconv.Itoa(int(f))
+		}
+		fmt.Fprintf(&b, `;ct="%s"`, strings.Join(formats, " "))
+	}
+	if l.Version != "" {
+		fmt.Fprintf(&b, `;ver="%s"`, l.Version)
+	}
+	return b.String()
+}
+
+// FormatLinks returns the links in CoRE Link Format
+func FormatLinks(links []Link) []byte {
+	formatted := make([]string, len(links))
+	for i, l := range links {
+		formatted[i] = l.String()
+	}
+	return []byte(strings.Join(formatted, ","))
+}
+
+// splitUnquoted splits the string at each separator that is not within quotes or angle brackets
+func splitUnquoted(s string, sep rune) (parts []string) {
+	var quoted, bracketed bool
+	start := 0
+	for i, r := range s {
+		switch {
+		case r == '"' && !bracketed:
+			quoted = !quoted
+		case r == '<' && !quoted:
+			bracketed = true
+		case r == '>' && !quoted:
+			bracketed = false
+		case r == sep && !quoted && !bracketed:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// ParseLinks parses a document in CoRE Link Format. Attributes other than rt, if, ct and ver are ignored.
+func ParseLinks(b []byte) (links []Link, err error) {
+	document := strings.TrimSpace(string(b))
+	if document == "" {
+		return nil, nil
+	}
+	for _, value := range splitUnquoted(document, ',') {
+		params := splitUnquoted(strings.TrimSpace(value), ';')
+		target := strings.TrimSpace(params[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			return nil, fmt.Errorf("invalid link %q", value)
+		}
+		link := Link{Target: target[1 : len(target)-1]}
+		for _, param := range params[1:] {
+			name, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			v = strings.Trim(v, `"`)
+			switch name {
+			case "rt":
+				link.ResourceType = v
+			case "if":
+				link.Interface = v
+			case "ct":
+				for _, f := range strings.Fields(v) {
+					n, err := strconv.ParseUint(f, 10, 16)
+					if err != nil {
+						return nil, fmt.Errorf("invalid content format in link %q", value)
+					}
+					link.ContentFormats = append(link.ContentFormats, coap.MediaType(n))
+				}
+			case "ver":
+				link.Version = v
+			}
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// NewGatewayLink returns the link of an IoT Gateway resource at this protocol version. The resource type is derived
+// from the target, for example /aminfo has the resource type iot.gw.aminfo.
+func NewGatewayLink(target string, formats ...coap.MediaType) Link {
+	return Link{
+		Target:         target,
+		ResourceType:   "iot.gw" + strings.ReplaceAll(target, "/", "."),
+		Interface:      gatewayInterface,
+		ContentFormats: formats,
+		Version:        GatewayProtocolVersion,
+	}
+}
+
+// GatewayLinks returns the links of the resources that the IoT Gateway offers at this protocol version, with the
+// content formats that things send to them
+func GatewayLinks() []Link {
+	link := NewGatewayLink
+	return []Link{
+		link("/authenticate", coap.AppJSON),
+		link("/aminfo", coap.AppJSON),
+		link("/accesstoken", coap.AppJSON, AppJOSE),
+		link("/usercode", coap.AppJSON, AppJOSE),
+		link("/usertoken", coap.AppJSON, AppJOSE),
+		link("/introspect", coap.AppJSON, AppJOSE),
+		link("/attributes", coap.AppJSON, AppJOSE),
+		link("/session", coap.AppJSON, AppJOSE),
+	}
+}
+
+// majorVersion returns the major part of a version string
+func majorVersion(version string) string {
+	major, _, _ := strings.Cut(version, ".")
+	return major
+}
+
+// checkCapabilities checks that the gateway offers the resources that the client requires
+func checkCapabilities(offered []Link) error {
+	byTarget := make(map[string]Link, len(offered))
+	for _, l := range offered {
+		byTarget[l.Target] = l
+	}
+	var errs []error
+	for _, required := range GatewayLinks() {
+		l, ok := byTarget[required.Target]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s is not offered", required.Target))
+			continue
+		}
+		if majorVersion(l.Version) != majorVersion(required.Version) {
+			errs = append(errs, fmt.Errorf("%s has version %q, version %s is required", required.Target,
+				l.Version, required.Version))
+		}
+		for _, f := range required.ContentFormats {
+			if !containsFormat(l.ContentFormats, f) {
+				errs = append(errs, fmt.Errorf("%s does not accept content format %d", required.Target, f))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrIncompatibleGateway, errors.Join(errs...))
+	}
+	return nil
+}
+
+func containsFormat(formats []coap.MediaType, format coap.MediaType) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-ocf/go-coap"
+)
+
+func TestFormatLinks(t *testing.T) {
+	links := []Link{
+		{Target: "/accesstoken", ResourceType: "iot.gw.accesstoken", Interface: "iot.gw",
+			ContentFormats: []coap.MediaType{coap.AppJSON, AppJOSE}, Version: "1.0"},
+		{Target: "/aminfo", ContentFormats: []coap.MediaType{coap.AppJSON}},
+	}
+	expected := `</accesstoken>;rt="iot.gw.accesstoken";if="iot.gw";ct="50 11650";ver="1.0",</aminfo>;ct=50`
+	if string(FormatLinks(links)) != expected {
+		t.Errorf("expected %s, got %s", expected, FormatLinks(links))
+	}
+	parsed, err := ParseLinks(FormatLinks(links))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, links) {
+		t.Errorf("expected %+v, got %+v", links, parsed)
+	}
+}
+
+func TestParseLinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		links    []Link
+		err      bool
+	}{
+		{name: "empty", document: ""},
+		{name: "other-attributes", document: `</sensors/temp>;title="a, b; c";rt="temperature-c";if="sensor";sz=262`,
+			links: []Link{{Target: "/sensors/temp", ResourceType: "temperature-c", Interface: "sensor"}}},
+		{name: "unquoted", document: `</a>;rt=x;ct=40, </b>`,
+			links: []Link{{Target: "/a", ResourceType: "x", ContentFormats: []coap.MediaType{coap.AppLinkFormat}},
+				{Target: "/b"}}},
+		{name: "missing-brackets", document: `/a;rt=x`, err: true},
+		{name: "bad-content-format", document: `</a>;ct=json`, err: true},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			links, err := ParseLinks([]byte(subtest.document))
+			if (err != nil) != subtest.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(links, subtest.links) {
+				t.Errorf("expected %+v, got %+v", subtest.links, links)
+			}
+		})
+	}
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(links []Link) []Link
+		ok     bool
+	}{
+		{name: "compatible", modify: func(links []Link) []Link { return links }, ok: true},
+		{name: "minor-version", modify: func(links []Link) []Link {
+			for i := range links {
+				links[i].Version = "1.7"
+			}
+			return links
+		}, ok: true},
+		{name: "extra-resource", modify: func(links []Link) []Link {
+			return append(links, Link{Target: "/children"})
+		}, ok: true},
+		{name: "missing-resource", modify: func(links []Link) []Link { return links[1:] }},
+		{name: "major-version", modify: func(links []Link) []Link {
+			links[2].Version = "2.0"
+			return links
+		}},
+		{name: "content-format", modify: func(links []Link) []Link {
+			links[2].ContentFormats = []coap.MediaType{coap.AppJSON}
+			return links
+		}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			err := checkCapabilities(subtest.modify(GatewayLinks()))
+			if subtest.ok && err != nil {
+				t.Error(err)
+			}
+			if !subtest.ok && !errors.Is(err, ErrIncompatibleGateway) {
+				t.Errorf("expected incompatible gateway error, got %v", err)
+			}
+		})
+	}
+}
@@ -1,5 +1,5 @@
 /*
- * Copyright 2020-2022 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -35,6 +35,7 @@ type AMInfoResponse struct {
 	SessionsVersion    string
 	SessionValidateURL string
 	SessionLogoutURL   string
+	SessionInfoURL     string
 }
 
 // AuthenticatePayload represents the outbound and inbound data during an authentication request
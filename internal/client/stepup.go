@@ -0,0 +1,85 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// treeAdvices are the AM policy advices that name the tree that a session must be stepped up with, in order of
+// preference
+var treeAdvices = []string{"AuthenticateToTreeConditionAdvice", "AuthenticateToServiceConditionAdvice"}
+
+// stepUpConnection authenticates with a tree against an existing session
+type stepUpConnection struct {
+	Connection
+	authenticator StepUpAuthenticator
+	tokenID       string
+	tree          string
+	forceAuth     bool
+}
+
+// StepUpConnection returns a connection whose authenticate requests run the given tree against the session represented
+// by the token, see StepUpAuthenticator. All other requests are made with the given connection. Returns false if the
+// connection does not support step-up authentication.
+func StepUpConnection(connection Connection, tokenID, tree string, forceAuth bool) (Connection, bool) {
+	authenticator, ok := connection.(StepUpAuthenticator)
+	if !ok {
+		return nil, false
+	}
+	return &stepUpConnection{
+		Connection:    connection,
+		authenticator: authenticator,
+		tokenID:       tokenID,
+		tree:          tree,
+		forceAuth:     forceAuth,
+	}, true
+}
+
+func (c *stepUpConnection) Authenticate(payload AuthenticatePayload) (reply AuthenticatePayload, err error) {
+	return c.authenticator.AuthenticateStepUp(c.tokenID, c.tree, c.forceAuth, payload)
+}
+
+// AdvisedTree returns the authentication tree that AM advised in an unauthorized or forbidden response, if any.
+// AM adds advices to the details of the response when the session does not satisfy the policy that protects a resource.
+func AdvisedTree(err error) (tree string, ok bool) {
+	responseErr, ok := err.(ResponseError)
+	if !ok || (responseErr.ResponseCode != CodeUnauthorized && responseErr.ResponseCode != CodeForbidden) {
+		return "", false
+	}
+	var response struct {
+		Detail struct {
+			Advices map[string][]string `json:"advices"`
+		} `json:"detail"`
+	}
+	if json.Unmarshal([]byte(responseErr.Message), &response) != nil {
+		return "", false
+	}
+	for _, advice := range treeAdvices {
+		for _, value := range response.Detail.Advices[advice] {
+			// service advices may be qualified with the realm, for example "/things:step-up-tree"
+			if i := strings.LastIndex(value, ":"); i >= 0 {
+				value = value[i+1:]
+			}
+			if value != "" {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAdvisedTree(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		tree string
+	}{
+		{name: "tree-advice", tree: "step-up-tree", err: ResponseError{
+			ResponseCode: CodeUnauthorized,
+			Message:      `{"code":401,"detail":{"advices":{"AuthenticateToTreeConditionAdvice":["step-up-tree"]}}}`,
+		}},
+		{name: "service-advice", tree: "step-up-tree", err: ResponseError{
+			ResponseCode: CodeForbidden,
+			Message:      `{"code":403,"detail":{"advices":{"AuthenticateToServiceConditionAdvice":["/things:step-up-tree"]}}}`,
+		}},
+		{name: "other-advice", err: ResponseError{
+			ResponseCode: CodeUnauthorized,
+			Message:      `{"code":401,"detail":{"advices":{"AuthLevelConditionAdvice":["2"]}}}`,
+		}},
+		{name: "no-advice", err: ResponseError{ResponseCode: CodeUnauthorized, Message: `{"code":401}`}},
+		{name: "not-json", err: ResponseError{ResponseCode: CodeUnauthorized, Message: "unauthorized"}},
+		{name: "wrong-code", err: ResponseError{
+			ResponseCode: CodeBadRequest,
+			Message:      `{"code":400,"detail":{"advices":{"AuthenticateToTreeConditionAdvice":["step-up-tree"]}}}`,
+		}},
+		{name: "not-response-error", err: errors.New("failed")},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			tree, ok := AdvisedTree(subtest.err)
+			if tree != subtest.tree || ok != (subtest.tree != "") {
+				t.Errorf("unexpected result %s, %v", tree, ok)
+			}
+		})
+	}
+}
@@ -26,11 +26,11 @@ import (
 	"github.com/go-ocf/go-coap"
 )
 
-// All SDK debug information is written to this Logger. The logger is muted by default. To see the debug output assign
+// Logger is the destination of the default log handler. The logger is muted by default. To see the debug output assign
 // your own logger (or a new one) to this variable.
 var Logger = log.New(io.Discard, "", 0)
 
-// DumpHTTPRoundTrip will dump the given HTTP request and response
+// DumpHTTPRoundTrip will dump the given HTTP request and response with sensitive values redacted
 func DumpHTTPRoundTrip(req *http.Request, res *http.Response) (message string) {
 	if req != nil {
 		dump, err := httputil.DumpRequest(req, true)
@@ -39,7 +39,7 @@ func DumpHTTPRoundTrip(req *http.Request, res *http.Response) (message string) {
 		}
 		message = "*** HTTP Request ***\n"
 		if err == nil {
-			message += string(dump)
+			message += redactHTTPDump(string(dump))
 		} else {
 			message += "Failed to dump request: " + err.Error()
 		}
@@ -52,7 +52,7 @@ func DumpHTTPRoundTrip(req *http.Request, res *http.Response) (message string) {
 		}
 		message += "*** HTTP Response ***\n"
 		if err == nil {
-			message += string(dump)
+			message += redactHTTPDump(string(dump))
 		} else {
 			message += "Failed to dump response: " + err.Error()
 		}
@@ -60,7 +60,7 @@ func DumpHTTPRoundTrip(req *http.Request, res *http.Response) (message string) {
 	return message
 }
 
-// dumpCOAPMessage will dump the COAP message
+// dumpCOAPMessage will dump the COAP message with sensitive values redacted
 func dumpCOAPMessage(msg coap.Message) (dump string) {
 	if len(msg.Path()) > 0 {
 		dump += fmt.Sprintf("Path: %v\n", msg.PathString())
@@ -75,11 +75,12 @@ func dumpCOAPMessage(msg coap.Message) (dump string) {
 	if msg.AllOptions().Len() > 0 {
 		dump += fmt.Sprintf("Options: %v\n", msg.AllOptions())
 	}
-	dump += fmt.Sprintf("\nPayload:\n%v\n", string(msg.Payload()))
+	dump += fmt.Sprintf("\nPayload:\n%v\n", Redact(string(msg.Payload())))
 	return dump
 }
 
-// DumpCOAPRoundTrip will dump the given COAP connection, request message and response message
+// DumpCOAPRoundTrip will dump the given COAP connection, request message and response message with sensitive values
+// redacted
 func DumpCOAPRoundTrip(conn *coap.ClientConn, req coap.Message, res coap.Message) (message string) {
 	if conn != nil {
 		message += fmt.Sprintf("\nCONNECTION: %s\n", conn.LocalAddr())
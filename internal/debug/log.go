@@ -0,0 +1,163 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debug
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/go-ocf/go-coap"
+)
+
+// Attribute keys used to correlate log records
+const (
+	KeyThingID   = "thing_id"
+	KeyEndpoint  = "endpoint"
+	KeyMessageID = "coap_message_id"
+	KeyRequestID = "request_id"
+)
+
+// Log receives all SDK log records. By default, the records are written as text to Logger so that the output is
+// muted until Logger is given a destination. Use SetHandler to send the records elsewhere, Log must not be replaced.
+var Log = slog.New(&handlers)
+
+// handlers passes the records of Log to the handler set with SetHandler
+var handlers handlerSwitch
+
+// SetHandler directs all SDK log records to the given handler. A nil handler restores the default handler.
+// It is safe to call while other goroutines are logging. Loggers already derived from Log with With or WithGroup keep
+// the handler that was set when they were derived.
+func SetHandler(handler slog.Handler) {
+	if handler == nil {
+		handler = defaultHandler
+	}
+	handlers.handler.Store(&handler)
+}
+
+// handlerSwitch is a handler that passes records to a handler that can be replaced concurrently
+type handlerSwitch struct {
+	handler atomic.Pointer[slog.Handler]
+}
+
+// current returns the handler that records are passed to
+func (s *handlerSwitch) current() slog.Handler {
+	if h := s.handler.Load(); h != nil {
+		return *h
+	}
+	return defaultHandler
+}
+
+func (s *handlerSwitch) Enabled(ctx context.Context, level slog.Level) bool {
+	return s.current().Enabled(ctx, level)
+}
+
+func (s *handlerSwitch) Handle(ctx context.Context, record slog.Record) error {
+	return s.current().Handle(ctx, record)
+}
+
+func (s *handlerSwitch) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return s.current().WithAttrs(attrs)
+}
+
+func (s *handlerSwitch) WithGroup(name string) slog.Handler {
+	return s.current().WithGroup(name)
+}
+
+// ThingID returns an attribute identifying the thing that the record relates to
+func ThingID(id string) slog.Attr {
+	return slog.String(KeyThingID, id)
+}
+
+// Endpoint returns an attribute identifying the endpoint that the record relates to
+func Endpoint(endpoint string) slog.Attr {
+	return slog.String(KeyEndpoint, endpoint)
+}
+
+// MessageID returns an attribute identifying the CoAP message that the record relates to
+func MessageID(id uint16) slog.Attr {
+	return slog.Int(KeyMessageID, int(id))
+}
+
+// RequestID returns an attribute identifying the request that the record relates to
+func RequestID(id string) slog.Attr {
+	return slog.String(KeyRequestID, id)
+}
+
+// LogHTTPRoundTrip logs a dump of the given HTTP request and response at debug level
+func LogHTTPRoundTrip(req *http.Request, res *http.Response) {
+	if !Log.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	logger := Log
+	if req != nil && req.URL != nil {
+		logger = logger.With(Endpoint(req.URL.Path))
+	}
+	logger.Debug("HTTP round trip", slog.String("dump", DumpHTTPRoundTrip(req, res)))
+}
+
+// LogCOAPRoundTrip logs a dump of the given COAP connection, request message and response message at debug level
+func LogCOAPRoundTrip(conn *coap.ClientConn, req coap.Message, res coap.Message) {
+	if !Log.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	logger := Log
+	if req != nil {
+		logger = logger.With(Endpoint(req.PathString()), MessageID(req.MessageID()))
+	}
+	logger.Debug("COAP round trip", slog.String("dump", DumpCOAPRoundTrip(conn, req, res)))
+}
+
+// defaultHandler writes text records to Logger, preserving the behaviour of the original debug logger
+var defaultHandler slog.Handler = loggerHandler{
+	Handler: slog.NewTextHandler(loggerWriter{}, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// Logger adds its own timestamp
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}),
+}
+
+// loggerWriter forwards each formatted record to the current Logger
+type loggerWriter struct{}
+
+func (loggerWriter) Write(p []byte) (int, error) {
+	return len(p), Logger.Output(4, string(p))
+}
+
+// loggerHandler skips the formatting of records when Logger is muted
+type loggerHandler struct {
+	slog.Handler
+}
+
+func (h loggerHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return Logger.Writer() != io.Discard && h.Handler.Enabled(ctx, level)
+}
+
+func (h loggerHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return loggerHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h loggerHandler) WithGroup(name string) slog.Handler {
+	return loggerHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debug
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// check that the default handler writes text records to Logger
+func TestLog_DefaultHandler(t *testing.T) {
+	defer func(l *log.Logger) {
+		Logger = l
+		SetHandler(nil)
+	}(Logger)
+
+	var buf bytes.Buffer
+	Logger = log.New(&buf, "", 0)
+	SetHandler(nil)
+	Log.Debug("hello", ThingID("thing-1"), Endpoint("/accesstoken"))
+
+	out := buf.String()
+	for _, want := range []string{"level=DEBUG", "msg=hello", KeyThingID + "=thing-1", KeyEndpoint + "=/accesstoken"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in %q", want, out)
+		}
+	}
+	if strings.Contains(out, slog.TimeKey+"=") {
+		t.Errorf("unexpected time attribute in %q", out)
+	}
+
+	// muted logger should disable the handler
+	Logger = log.New(io.Discard, "", 0)
+	if Log.Enabled(context.Background(), slog.LevelError) {
+		t.Error("expected handler to be disabled")
+	}
+}
+
+// check that records are sent to a custom handler
+func TestLog_SetHandler(t *testing.T) {
+	defer SetHandler(nil)
+
+	var buf bytes.Buffer
+	SetHandler(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	Log.With(RequestID("abc")).Info("hello", MessageID(42))
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record[KeyRequestID] != "abc" {
+		t.Errorf("expected request ID in %v", record)
+	}
+	if record[KeyMessageID] != float64(42) {
+		t.Errorf("expected message ID in %v", record)
+	}
+}
+
+// check that the handler can be replaced while records are being logged
+func TestLog_SetHandler_Concurrent(t *testing.T) {
+	defer SetHandler(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				Log.Info("hello", ThingID("thing-1"))
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		SetHandler(slog.NewTextHandler(io.Discard, nil))
+	}
+	wg.Wait()
+
+	var buf bytes.Buffer
+	SetHandler(slog.NewTextHandler(&buf, nil))
+	Log.Info("hello")
+	if !strings.Contains(buf.String(), "msg=hello") {
+		t.Errorf("expected the record to be sent to the last handler, got %q", buf.String())
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debug
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// Redacted replaces sensitive values in debug output
+	Redacted = "REDACTED"
+	// JWTSignature is the allowlist name that stops the signatures of JWTs from being redacted
+	JWTSignature = "jwt_signature"
+)
+
+// sensitiveHeaders are HTTP headers whose values are always redacted
+var sensitiveHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+}
+
+// sensitiveFields are JSON fields, and JWT claims, whose values are redacted
+var sensitiveFields = map[string]bool{
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"tokenid":       true,
+	"authid":        true,
+	"device_code":   true,
+	"token":         true,
+	"csrf":          true,
+}
+
+var (
+	// jwsPattern matches the compact serialisation of a JWS
+	jwsPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	// fieldPattern matches a JSON field with a string value, which can contain escaped quotes
+	fieldPattern = regexp.MustCompile(`"([A-Za-z_]+)"\s*:\s*"(?:[^"\\]|\\.)*"`)
+	// formPattern matches a key=value pair of a form-encoded body or query string, with the separator before it
+	formPattern = regexp.MustCompile(`(^|[?&\s])([A-Za-z_]+)=([^&\s]*)`)
+)
+
+var allowlist atomic.Pointer[map[string]bool]
+
+// SetRedactionAllowlist sets the names of headers, cookies and JSON fields that will not be redacted from debug output.
+// Use JWTSignature to keep the signatures of JWTs. Names are case-insensitive. This should only be used for
+// troubleshooting since the unredacted values can be used to impersonate a thing.
+func SetRedactionAllowlist(names ...string) {
+	allowed := make(map[string]bool, len(names))
+	for _, n := range names {
+		allowed[strings.ToLower(n)] = true
+	}
+	allowlist.Store(&allowed)
+}
+
+// allowed returns true if the named value should not be redacted
+func allowed(name string) bool {
+	allowed := allowlist.Load()
+	return allowed != nil && (*allowed)[strings.ToLower(name)]
+}
+
+// sensitiveField returns true if the value of the named JSON field should be redacted
+func sensitiveField(name string) bool {
+	return sensitiveFields[strings.ToLower(name)] && !allowed(name)
+}
+
+// Redact masks sensitive values in the given text. JSON is parsed and sensitive fields are masked, otherwise any JWTs,
+// sensitive JSON fields and sensitive form-encoded fields found in the text are masked.
+func Redact(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		decoder := json.NewDecoder(strings.NewReader(trimmed))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err == nil && !decoder.More() {
+			if b, err := json.Marshal(redactValue(value)); err == nil {
+				return string(b)
+			}
+		}
+	}
+	text = fieldPattern.ReplaceAllStringFunc(text, func(field string) string {
+		name := fieldPattern.FindStringSubmatch(field)[1]
+		if !sensitiveField(name) {
+			return field
+		}
+		return `"` + name + `":"` + Redacted + `"`
+	})
+	text = formPattern.ReplaceAllStringFunc(text, func(pair string) string {
+		match := formPattern.FindStringSubmatch(pair)
+		if !sensitiveField(match[2]) {
+			return pair
+		}
+		return match[1] + match[2] + "=" + Redacted
+	})
+	return jwsPattern.ReplaceAllStringFunc(text, redactJWT)
+}
+
+// redactValue masks sensitive values in the decoded JSON value
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		passwordCallback := v["type"] == "PasswordCallback"
+		for key, field := range v {
+			switch {
+			case sensitiveField(key) && field != nil:
+				v[key] = Redacted
+			case passwordCallback && key == "input":
+				v[key] = redactEntryValues(field)
+			default:
+				v[key] = redactValue(field)
+			}
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+		return v
+	case string:
+		return jwsPattern.ReplaceAllStringFunc(v, redactJWT)
+	}
+	return value
+}
+
+// redactEntryValues masks the values of callback entries
+func redactEntryValues(value interface{}) interface{} {
+	entries, ok := value.([]interface{})
+	if !ok {
+		return Redacted
+	}
+	for _, e := range entries {
+		if entry, ok := e.(map[string]interface{}); ok {
+			entry["value"] = Redacted
+		}
+	}
+	return entries
+}
+
+// redactJWT masks the signature and any sensitive claims of a JWT
+func redactJWT(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return token
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(b, &header) != nil ||
+		header.Alg == "" {
+		return token
+	}
+	if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil {
+		redacted := Redact(string(payload))
+		if redacted != string(payload) {
+			parts[1] = base64.RawURLEncoding.EncodeToString([]byte(redacted))
+		}
+	}
+	if parts[2] != "" && !allowed(JWTSignature) {
+		parts[2] = Redacted
+	}
+	return strings.Join(parts, ".")
+}
+
+// redactHeader masks the value of a sensitive HTTP header line
+func redactHeader(line string) string {
+	name, value, found := strings.Cut(line, ":")
+	if !found || allowed(name) {
+		return line
+	}
+	switch strings.ToLower(name) {
+	case "cookie":
+		cookies := strings.Split(value, ";")
+		for i, c := range cookies {
+			cookies[i] = redactCookie(c)
+		}
+		return name + ":" + strings.Join(cookies, ";")
+	case "set-cookie":
+		cookie, attributes, _ := strings.Cut(value, ";")
+		line = name + ":" + redactCookie(cookie)
+		if attributes != "" {
+			line += ";" + attributes
+		}
+		return line
+	}
+	if sensitiveHeaders[strings.ToLower(name)] {
+		return name + ": " + Redacted
+	}
+	return jwsPattern.ReplaceAllStringFunc(line, redactJWT)
+}
+
+// redactCookie masks the value of a cookie name-value pair unless the cookie is allowed
+func redactCookie(pair string) string {
+	name, _, found := strings.Cut(pair, "=")
+	if !found || allowed(strings.TrimSpace(name)) {
+		return pair
+	}
+	return name + "=" + Redacted
+}
+
+// redactHTTPDump masks the sensitive headers and body content of a dumped HTTP message
+func redactHTTPDump(dump string) string {
+	head, body, found := strings.Cut(dump, "\r\n\r\n")
+	lines := strings.Split(head, "\r\n")
+	for i, line := range lines {
+		if i == 0 {
+			lines[i] = jwsPattern.ReplaceAllStringFunc(line, redactJWT)
+			continue
+		}
+		lines[i] = redactHeader(line)
+	}
+	head = strings.Join(lines, "\r\n")
+	if !found {
+		return head
+	}
+	return head + "\r\n\r\n" + Redact(body)
+}
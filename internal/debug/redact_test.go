@@ -0,0 +1,234 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debug
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	testSSOToken     = "AQIC5wM2LY4SfczsecretSSOtoken"
+	testAccessToken  = "secretAccessToken"
+	testRefreshToken = "secretRefreshToken"
+	testAuthID       = "secretAuthID"
+	testDeviceCode   = "secretDeviceCode"
+	testPassword     = "secretPassword"
+)
+
+func testPoPJWT(t *testing.T) (token string, signature string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = jwt.Signed(sig).Claims(map[string]interface{}{"csrf": testSSOToken, "scope": "publish"}).
+		CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	return token, parts[2]
+}
+
+func assertRedacted(t *testing.T, dump string, secrets ...string) {
+	t.Helper()
+	for _, s := range secrets {
+		if strings.Contains(dump, s) {
+			t.Errorf("dump leaks %q:\n%s", s, dump)
+		}
+	}
+	if !strings.Contains(dump, Redacted) {
+		t.Errorf("expected redaction marker in dump:\n%s", dump)
+	}
+}
+
+func testHTTPRoundTrip(t *testing.T, requestBody string, responseBody string) (*http.Request, *http.Response) {
+	request, err := http.NewRequest(http.MethodPost, "https://am.example.com/am/json/things/*", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.AddCookie(&http.Cookie{Name: "iPlanetDirectoryPro", Value: testSSOToken})
+	request.Header.Set("Authorization", "Bearer "+testAccessToken)
+	request.Header.Set("Content-Type", "application/json")
+	response := &http.Response{
+		StatusCode: http.StatusOK,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Set-Cookie": []string{"iPlanetDirectoryPro=" + testSSOToken + "; Path=/; HttpOnly"},
+		},
+		Body: io.NopCloser(strings.NewReader(responseBody)),
+	}
+	return request, response
+}
+
+func TestDumpHTTPRoundTrip_Redacted(t *testing.T) {
+	defer SetRedactionAllowlist()
+	token, signature := testPoPJWT(t)
+	tests := []struct {
+		name     string
+		request  string
+		response string
+		secrets  []string
+	}{
+		{
+			name:     "access-token",
+			request:  `{"scope":["publish"]}`,
+			response: `{"access_token":"` + testAccessToken + `","refresh_token":"` + testRefreshToken + `","expires_in":3599}`,
+			secrets:  []string{testAccessToken, testRefreshToken},
+		},
+		{
+			name:     "authenticate",
+			request:  `{"authId":"` + testAuthID + `","callbacks":[{"type":"PasswordCallback","input":[{"name":"IDToken2","value":"` + testPassword + `"}]}]}`,
+			response: `{"tokenId":"` + testSSOToken + `","successUrl":"/am/console"}`,
+			secrets:  []string{testAuthID, testPassword},
+		},
+		{
+			name:     "user-token",
+			request:  `{"device_code":"` + testDeviceCode + `"}`,
+			response: `{}`,
+			secrets:  []string{testDeviceCode},
+		},
+		{
+			name:     "pop-jwt",
+			request:  token,
+			response: `{"valid":true}`,
+			secrets:  []string{signature},
+		},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			request, response := testHTTPRoundTrip(t, subtest.request, subtest.response)
+			dump := DumpHTTPRoundTrip(request, response)
+			assertRedacted(t, dump, append(subtest.secrets, testSSOToken, testAccessToken)...)
+		})
+	}
+}
+
+func TestDumpHTTPRoundTrip_Allowlist(t *testing.T) {
+	defer SetRedactionAllowlist()
+	SetRedactionAllowlist("iPlanetDirectoryPro", "refresh_token")
+
+	request, response := testHTTPRoundTrip(t, `{}`,
+		`{"access_token":"`+testAccessToken+`","refresh_token":"`+testRefreshToken+`"}`)
+	dump := DumpHTTPRoundTrip(request, response)
+	if !strings.Contains(dump, "iPlanetDirectoryPro="+testSSOToken) {
+		t.Errorf("expected allowed cookie in dump:\n%s", dump)
+	}
+	if !strings.Contains(dump, testRefreshToken) {
+		t.Errorf("expected allowed field in dump:\n%s", dump)
+	}
+	assertRedacted(t, dump, testAccessToken)
+}
+
+func TestDumpCOAPRoundTrip_Redacted(t *testing.T) {
+	defer SetRedactionAllowlist()
+	token, signature := testPoPJWT(t)
+
+	request := coap.NewDgramMessage(coap.MessageParams{
+		Type:    coap.Confirmable,
+		Code:    codes.POST,
+		Payload: []byte(token),
+	})
+	request.SetPathString("/accesstoken")
+	response := coap.NewDgramMessage(coap.MessageParams{
+		Type:    coap.Acknowledgement,
+		Code:    codes.Changed,
+		Payload: []byte(`{"access_token":"` + testAccessToken + `","refresh_token":"` + testRefreshToken + `"}`),
+	})
+	dump := DumpCOAPRoundTrip(nil, request, response)
+	assertRedacted(t, dump, signature, testSSOToken, testAccessToken, testRefreshToken)
+}
+
+func TestRedact_JWTSignatureAllowed(t *testing.T) {
+	defer SetRedactionAllowlist()
+	SetRedactionAllowlist(JWTSignature)
+	token, signature := testPoPJWT(t)
+
+	redacted := Redact(token)
+	if !strings.HasSuffix(redacted, "."+signature) {
+		t.Errorf("expected signature to be kept: %s", redacted)
+	}
+	// the claims of the JWT are still redacted
+	var claims struct {
+		CSRF string `json:"csrf"`
+	}
+	if err := jwtClaims(redacted, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.CSRF != Redacted {
+		t.Errorf("expected csrf claim to be redacted: %s", claims.CSRF)
+	}
+}
+
+func jwtClaims(token string, claims interface{}) error {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return err
+	}
+	return parsed.UnsafeClaimsWithoutVerification(claims)
+}
+
+func TestRedact_Unstructured(t *testing.T) {
+	defer SetRedactionAllowlist()
+	text := `partial {"access_token": "` + testAccessToken + `", "tokenId":"` + testSSOToken + `"`
+	redacted := Redact(text)
+	assertRedacted(t, redacted, testAccessToken, testSSOToken)
+	if !bytes.HasPrefix([]byte(redacted), []byte("partial ")) {
+		t.Errorf("unexpected change to unstructured text: %s", redacted)
+	}
+}
+
+func TestRedact_EscapedQuotes(t *testing.T) {
+	defer SetRedactionAllowlist()
+	secret := `secret\"` + testAccessToken + `\"value`
+	text := `partial {"access_token": "` + secret + `", "scope":"publish"`
+	redacted := Redact(text)
+	assertRedacted(t, redacted, testAccessToken, "value")
+	if !strings.Contains(redacted, `"scope":"publish"`) {
+		t.Errorf("expected the fields after the escaped quotes to be kept: %s", redacted)
+	}
+}
+
+func TestRedact_FormEncoded(t *testing.T) {
+	defer SetRedactionAllowlist()
+	text := "grant_type=refresh_token&refresh_token=" + testRefreshToken + "&token=" + testAccessToken +
+		"&client_id=thing"
+	redacted := Redact(text)
+	assertRedacted(t, redacted, testRefreshToken, testAccessToken)
+	if !strings.HasPrefix(redacted, "grant_type=refresh_token&") || !strings.HasSuffix(redacted, "&client_id=thing") {
+		t.Errorf("unexpected change to insensitive fields: %s", redacted)
+	}
+
+	SetRedactionAllowlist("refresh_token")
+	redacted = Redact(text)
+	if !strings.Contains(redacted, testRefreshToken) || strings.Contains(redacted, testAccessToken) {
+		t.Errorf("expected only the allowed field to be kept: %s", redacted)
+	}
+}
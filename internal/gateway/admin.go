@@ -0,0 +1,268 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+	"github.com/ForgeRock/iot-edge/v7/internal/tokencache"
+)
+
+// Admin API design
+// The admin API is a local HTTP API used by operators to inspect and manage the things connected to the gateway
+//   GET    /peers                     lists the DTLS peers
+//   DELETE /peers/{address}           closes the DTLS session with a peer
+//   GET    /auth-cache/{key}          shows an entry of the authentication ID cache
+//   POST   /things/{thingID}/logout   logs out the AM sessions of a thing, 409 (Conflict) if sessions are restricted
+//                                     to proof of possession
+
+const adminShutdownTimeout = 5 * time.Second
+
+var (
+	// ErrAdminServerAlreadyStarted indicates that an admin server has already been started by the IoT Gateway
+	ErrAdminServerAlreadyStarted = errors.New("admin server has already been started")
+	// ErrAdminUnprotected is returned when the admin server is started without client certificate verification or
+	// an admin token, or without TLS on an address that is not a loopback address
+	ErrAdminUnprotected = errors.New("admin server requires client certificate verification or an admin token, " +
+		"and TLS unless it is bound to a loopback address")
+	// ErrUnknownThing is returned when the gateway does not know of any sessions issued to the thing
+	ErrUnknownThing = errors.New("no sessions are known for the thing")
+	// ErrRestrictedSession is returned when sessions of the thing are bound to its proof of possession key. AM only
+	// accepts a logout for these sessions if it is signed by the thing, so the gateway can not log them out.
+	ErrRestrictedSession = errors.New("sessions are restricted to proof of possession and must be logged out by " +
+		"the thing")
+)
+
+// AuthCacheEntry describes an entry of the authentication ID cache. The authentication ID is not included.
+type AuthCacheEntry struct {
+	Key string `json:"key"`
+	// the name of the route whose store holds the entry, empty for the cache of the gateway
+	Route string `json:"route,omitempty"`
+	// the expiry time in the authentication ID, if it can be read
+	Expiry *time.Time `json:"expiry,omitempty"`
+}
+
+// AuthCacheEntry returns the entry with the given key from the authentication ID cache of the gateway or, if it is
+// not found there, from the authentication ID stores of the routes
+func (c *Gateway) AuthCacheEntry(key string) (entry AuthCacheEntry, ok bool) {
+	authID, ok := c.authCache.Get(key)
+	if !ok {
+		c.routes.mu.RLock()
+		for _, rt := range c.routes.routes {
+			if authID, ok = rt.AuthStore.Get(key); ok {
+				entry.Route = rt.Name
+				break
+			}
+		}
+		c.routes.mu.RUnlock()
+	}
+	if !ok {
+		return entry, false
+	}
+	entry.Key = key
+	if expiry, ok := tokencache.Expiry(authID); ok {
+		entry.Expiry = &expiry
+	}
+	return entry, true
+}
+
+// LogoutThing logs out the AM sessions that the gateway knows were issued to the thing and returns the number of
+// sessions that were logged out. Sessions that are restricted to proof of possession are not logged out, if all other
+// sessions were logged out then ErrRestrictedSession is returned.
+func (c *Gateway) LogoutThing(thingID string) (int, error) {
+	tokens, restricted := c.pop.tokens(thingID)
+	if len(tokens) == 0 && len(restricted) == 0 {
+		return 0, ErrUnknownThing
+	}
+	var count int
+	var errs []error
+	for _, token := range tokens {
+		if err := c.sessionConnection(token).LogoutSession(token, client.ApplicationJSON, ""); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.pop.remove(token)
+		c.forgetSession(token)
+		count++
+	}
+	if len(errs) == 0 && len(restricted) > 0 {
+		return count, fmt.Errorf("%w: %d of the thing's sessions", ErrRestrictedSession, len(restricted))
+	}
+	return count, errors.Join(errs...)
+}
+
+// adminAPI serves the admin API
+type adminAPI struct {
+	gateway *Gateway
+	token   string
+}
+
+// authorised returns true if the request presented a verified client certificate or the admin token
+func (a adminAPI) authorised(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	if a.token == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// writeJSON writes the value as the JSON body of the response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		debug.Log.Warn("unable to write admin response", "error", err)
+	}
+}
+
+func (a adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := debug.Log.With("method", r.Method, "path", r.URL.Path)
+	if !a.authorised(r) {
+		logger.Warn("unauthorised admin request", "remote", r.RemoteAddr)
+		http.Error(w, "unauthorised", http.StatusUnauthorized)
+		return
+	}
+	// use the escaped path so that path parameters can contain slashes
+	resource, id, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	id, err := url.PathUnescape(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case resource == "peers" && id == "" && r.Method == http.MethodGet:
+		writeJSON(w, a.gateway.Peers())
+	case resource == "peers" && id != "" && r.Method == http.MethodDelete:
+		err = a.gateway.ClosePeer(id)
+		if errors.Is(err, ErrUnknownPeer) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			logger.Warn("unable to close peer", "peer", id, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Info("closed peer", "peer", id)
+		w.WriteHeader(http.StatusNoContent)
+	case resource == "auth-cache" && id != "" && r.Method == http.MethodGet:
+		entry, ok := a.gateway.AuthCacheEntry(id)
+		if !ok {
+			http.Error(w, "entry not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, entry)
+	case resource == "things" && strings.HasSuffix(id, "/logout") && r.Method == http.MethodPost:
+		thingID := strings.TrimSuffix(id, "/logout")
+		count, err := a.gateway.LogoutThing(thingID)
+		if errors.Is(err, ErrUnknownThing) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if errors.Is(err, ErrRestrictedSession) {
+			logger.Warn("unable to log out restricted sessions", debug.ThingID(thingID), "sessions", count,
+				"error", err)
+			http.Error(w, fmt.Sprintf("%d sessions logged out, %v", count, err), http.StatusConflict)
+			return
+		} else if err != nil {
+			logger.Warn("unable to log out thing", debug.ThingID(thingID), "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		logger.Info("logged out thing", debug.ThingID(thingID), "sessions", count)
+		writeJSON(w, struct {
+			Sessions int `json:"sessions"`
+		}{Sessions: count})
+	default:
+		http.Error(w, fmt.Sprintf("unknown request %s %s", r.Method, r.URL.Path), http.StatusNotFound)
+	}
+}
+
+// AdminHandler returns the handler of the admin API. A request is authorised if it presents a client certificate
+// that has been verified by the TLS server or if it presents the admin token as a bearer token. An empty token
+// means that only client certificates are accepted.
+func (c *Gateway) AdminHandler(token string) http.Handler {
+	return adminAPI{gateway: c, token: token}
+}
+
+// StartAdminServer starts the admin API server on the given TCP address. The server uses TLS if tlsConfig is not nil.
+// Either tlsConfig must require and verify client certificates or a token must be given. The token is only accepted
+// in cleartext if the server is bound to a loopback address, so tlsConfig can only be nil for a loopback address.
+func (c *Gateway) StartAdminServer(address string, tlsConfig *tls.Config, token string) error {
+	if c.adminServer != nil {
+		return ErrAdminServerAlreadyStarted
+	}
+	if token == "" && (tlsConfig == nil || tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert) {
+		return ErrAdminUnprotected
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if tcpAddr, ok := l.Addr().(*net.TCPAddr); tlsConfig == nil && (!ok || !tcpAddr.IP.IsLoopback()) {
+		_ = l.Close()
+		return ErrAdminUnprotected
+	}
+	c.adminAddress = l.Addr()
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	c.adminChan = make(chan error, 1)
+	c.adminServer = &http.Server{
+		Handler:           c.AdminHandler(token),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func(server *http.Server) {
+		c.adminChan <- server.Serve(l)
+	}(c.adminServer)
+	return nil
+}
+
+// ShutdownAdminServer gracefully shuts the admin API server down
+func (c *Gateway) ShutdownAdminServer() {
+	if c.adminServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	if err := c.adminServer.Shutdown(ctx); err != nil {
+		debug.Log.Error("admin server shutdown failed", "error", err)
+	}
+	<-c.adminChan
+	c.adminServer = nil
+	c.adminAddress = nil
+}
+
+// AdminAddress returns in string form the address that the admin server is listening on.
+func (c *Gateway) AdminAddress() string {
+	if c.adminAddress == nil {
+		return ""
+	}
+	return c.adminAddress.String()
+}
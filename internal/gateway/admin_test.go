@@ -0,0 +1,252 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/internal/mocks"
+	"github.com/ForgeRock/iot-edge/v7/internal/tokencache"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const adminToken = "admin-secret"
+
+func adminRequest(t *testing.T, httpClient *http.Client, method, url, token string) (int, []byte) {
+	t.Helper()
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var body bytes.Buffer
+	_, _ = body.ReadFrom(response.Body)
+	return response.StatusCode, body.Bytes()
+}
+
+func testAuthID(t *testing.T, expiry time.Time) string {
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("secret")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(sig).Claims(jwt.Claims{Expiry: jwt.NewNumericDate(expiry)}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestGateway_Admin(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	am := newFakeAM()
+	am.AuthenticateFunc = func(client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+		reply.TokenID = "12345"
+		return reply, nil
+	}
+	gateway, conn := startOfflineGateway(t, am, 0)
+	payload, _ := json.Marshal(client.AuthenticatePayload{Callbacks: popCallbacks(t, key, true)})
+	request, err := conn.NewPostRequest("/authenticate", coap.AppJSON, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response, err := conn.Exchange(request); err != nil || response.Code() != codes.Valid {
+		t.Fatalf("authentication failed: %v", err)
+	}
+	// base64 keys can contain slashes
+	expiry := time.Now().Add(time.Minute).Truncate(time.Second)
+	authKey := "a/b+c=="
+	if err = gateway.authCache.Add(authKey, testAuthID(t, expiry)); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(gateway.AdminHandler(adminToken))
+	defer server.Close()
+	httpClient := server.Client()
+
+	code, _ := adminRequest(t, httpClient, http.MethodGet, server.URL+"/peers", "")
+	if code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorised without a token, got %d", code)
+	}
+	code, _ = adminRequest(t, httpClient, http.MethodGet, server.URL+"/peers", "wrong")
+	if code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorised with the wrong token, got %d", code)
+	}
+
+	code, body := adminRequest(t, httpClient, http.MethodGet, server.URL+"/peers", adminToken)
+	var peers []Peer
+	if err = json.Unmarshal(body, &peers); code != http.StatusOK || err != nil {
+		t.Fatalf("unexpected peers response %d %s", code, body)
+	}
+	if len(peers) != 1 || peers[0].ThingID != "thing-1" || peers[0].LastSeen.IsZero() {
+		t.Errorf("unexpected peers %+v", peers)
+	}
+
+	code, body = adminRequest(t, httpClient, http.MethodGet, server.URL+"/auth-cache/"+url.PathEscape(authKey),
+		adminToken)
+	var entry AuthCacheEntry
+	if err = json.Unmarshal(body, &entry); code != http.StatusOK || err != nil {
+		t.Fatalf("unexpected auth cache response %d %s", code, body)
+	}
+	if entry.Key != authKey || entry.Expiry == nil || !entry.Expiry.Equal(expiry) {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if bytes.Contains(body, []byte("eyJ")) {
+		t.Errorf("auth cache response contains the authentication ID: %s", body)
+	}
+	code, _ = adminRequest(t, httpClient, http.MethodGet, server.URL+"/auth-cache/unknown", adminToken)
+	if code != http.StatusNotFound {
+		t.Errorf("expected not found, got %d", code)
+	}
+	// entries of journeys on a route are held in the store of the route
+	routeStore := tokencache.New(time.Minute, time.Minute)
+	gateway.routes.routes = append(gateway.routes.routes, &route{Route: Route{Name: "tenant", AuthStore: routeStore}})
+	if err = routeStore.Add("route-key", testAuthID(t, expiry)); err != nil {
+		t.Fatal(err)
+	}
+	code, body = adminRequest(t, httpClient, http.MethodGet, server.URL+"/auth-cache/route-key", adminToken)
+	entry = AuthCacheEntry{}
+	if err = json.Unmarshal(body, &entry); code != http.StatusOK || err != nil {
+		t.Fatalf("unexpected auth cache response %d %s", code, body)
+	}
+	if entry.Key != "route-key" || entry.Route != "tenant" || entry.Expiry == nil {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	// the PoP session can only be logged out by the thing
+	code, body = adminRequest(t, httpClient, http.MethodPost, server.URL+"/things/thing-1/logout", adminToken)
+	if code != http.StatusConflict || am.logouts.Load() != 0 {
+		t.Errorf("unexpected logout response %d %s, logouts %d", code, body, am.logouts.Load())
+	}
+	gateway.pop.add("67890", &popSession{thingID: "thing-2", nonce: -1})
+	code, body = adminRequest(t, httpClient, http.MethodPost, server.URL+"/things/thing-2/logout", adminToken)
+	if code != http.StatusOK || am.logouts.Load() != 1 {
+		t.Errorf("unexpected logout response %d %s, logouts %d", code, body, am.logouts.Load())
+	}
+	code, _ = adminRequest(t, httpClient, http.MethodPost, server.URL+"/things/thing-2/logout", adminToken)
+	if code != http.StatusNotFound {
+		t.Errorf("expected not found once logged out, got %d", code)
+	}
+
+	peerURL := server.URL + "/peers/" + url.PathEscape(peers[0].Address)
+	if code, body = adminRequest(t, httpClient, http.MethodDelete, peerURL, adminToken); code != http.StatusNoContent {
+		t.Errorf("unexpected close response %d %s", code, body)
+	}
+	if len(gateway.Peers()) != 0 {
+		t.Errorf("expected no peers, got %+v", gateway.Peers())
+	}
+	if code, _ = adminRequest(t, httpClient, http.MethodDelete, peerURL, adminToken); code != http.StatusNotFound {
+		t.Errorf("expected not found once closed, got %d", code)
+	}
+	code, _ = adminRequest(t, httpClient, http.MethodPut, server.URL+"/peers", adminToken)
+	if code != http.StatusNotFound {
+		t.Errorf("expected not found for an unknown request, got %d", code)
+	}
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(raw)
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestGateway_AdminClientCertificate(t *testing.T) {
+	gateway := testGateway(&mocks.MockClient{})
+	clientCert := testCertificate(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCert.Leaf)
+
+	server := httptest.NewUnstartedServer(gateway.AdminHandler(""))
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+
+	// no certificate and no token
+	code, _ := adminRequest(t, server.Client(), http.MethodGet, server.URL+"/peers", "")
+	if code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorised without a certificate, got %d", code)
+	}
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{clientCert}
+	httpClient := &http.Client{Transport: transport}
+	if code, body := adminRequest(t, httpClient, http.MethodGet, server.URL+"/peers", ""); code != http.StatusOK {
+		t.Errorf("unexpected response %d %s", code, body)
+	}
+}
+
+func TestGateway_StartAdminServer(t *testing.T) {
+	gateway := testGateway(&mocks.MockClient{})
+	if err := gateway.StartAdminServer("127.0.0.1:0", nil, ""); !errors.Is(err, ErrAdminUnprotected) {
+		t.Fatalf("expected unprotected error, got %v", err)
+	}
+	// the token is not sent in cleartext to an address that is not a loopback address
+	if err := gateway.StartAdminServer(":0", nil, adminToken); !errors.Is(err, ErrAdminUnprotected) {
+		t.Fatalf("expected unprotected error, got %v", err)
+	}
+	if err := gateway.StartAdminServer("127.0.0.1:0", nil, adminToken); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownAdminServer()
+	if err := gateway.StartAdminServer("127.0.0.1:0", nil, adminToken); !errors.Is(err, ErrAdminServerAlreadyStarted) {
+		t.Errorf("expected already started error, got %v", err)
+	}
+	code, body := adminRequest(t, http.DefaultClient, http.MethodGet, "http://"+gateway.AdminAddress()+"/peers",
+		adminToken)
+	if code != http.StatusOK || string(bytes.TrimSpace(body)) != "[]" {
+		t.Errorf("unexpected response %d %s", code, body)
+	}
+	gateway.ShutdownAdminServer()
+	if gateway.AdminAddress() != "" {
+		t.Errorf("expected no address after shutdown")
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/audit"
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// formatCode returns the CoAP code in c.dd format
+func formatCode(code codes.Code) string {
+	return fmt.Sprintf("%d.%02d", code>>5, code&0x1f)
+}
+
+// SetAuditLog sets the log that records the outcome of each request received by the CoAP server. Each entry holds the
+// time, the peer address, the thing ID and key thumbprint when they are known, the endpoint, the granted scopes and the
+// response code. Token values are never recorded. Set to nil to stop auditing.
+func (c *Gateway) SetAuditLog(log *audit.Log) {
+	c.auditLog.Store(log)
+}
+
+// audit records the outcome of the exchange in the audit log
+func (c *Gateway) audit(e *Exchange) {
+	log := c.auditLog.Load()
+	if log == nil {
+		return
+	}
+	endpoint := e.Endpoint
+	if len(e.Query) > 0 {
+		endpoint += "?" + strings.Join(e.Query, "&")
+	}
+	entry := audit.Entry{
+		Time:          e.Time,
+		Peer:          e.Peer,
+		KeyThumbprint: e.Thing.KeyThumbprint,
+		ThingID:       e.Thing.ID,
+		Endpoint:      endpoint,
+		Scopes:        e.scopes,
+		Code:          formatCode(e.Code),
+	}
+	if err := log.Write(entry); err != nil {
+		debug.Log.Error("unable to write audit entry", "error", err)
+	}
+}
+
+// auditScopes adds the scopes granted in an OAuth 2.0 token response to the exchange of the request
+func auditScopes(w coap.ResponseWriter, response []byte) {
+	e := exchangeOf(w)
+	if e == nil {
+		return
+	}
+	var token struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.Unmarshal(response, &token); err == nil && token.Scope != "" {
+		e.scopes = strings.Fields(token.Scope)
+	}
+}
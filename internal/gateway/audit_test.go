@@ -0,0 +1,131 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/audit"
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+func TestGateway_AuditLog(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	am := newFakeAM()
+	am.AMInfoSet = popAMInfo
+	am.AuthenticateFunc = func(client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+		reply.TokenID = "12345"
+		return reply, nil
+	}
+	am.AccessTokenFunc = func(string, string) ([]byte, error) {
+		return []byte(`{"access_token":"secret-access-token","scope":"publish subscribe"}`), nil
+	}
+	gateway, conn := startOfflineGateway(t, am, 0)
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	log, err := audit.NewLog(filename, 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	gateway.SetAuditLog(log)
+
+	payload, _ := json.Marshal(client.AuthenticatePayload{Callbacks: popCallbacks(t, key, true)})
+	request, err := conn.NewPostRequest("/authenticate", coap.AppJSON, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response, err := conn.Exchange(request); err != nil || response.Code() != codes.Valid {
+		t.Fatalf("authentication failed: %v", err)
+	}
+	signedJWT := signPoP(t, key, popAMInfo.AccessTokenURL, popAMInfo.ThingsVersion, 0, "12345")
+	checkResponse(t, postJWS(t, conn, "/accesstoken", "", signedJWT), codes.Changed, false)
+	// replayed request
+	checkResponse(t, postJWS(t, conn, "/accesstoken", "", signedJWT), codes.Unauthorized, false)
+	// switch auditing off
+	gateway.SetAuditLog(nil)
+	checkResponse(t, post(t, conn, "/attributes", ""), codes.Unauthorized, false)
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"12345", "secret-access-token", signedJWT} {
+		if strings.Contains(string(content), `"`+secret) {
+			t.Errorf("audit log contains token %s", secret)
+		}
+	}
+	if _, err = audit.VerifyChain(bytes.NewReader(content), ""); err != nil {
+		t.Error(err)
+	}
+
+	thumbprint, _ := thing.JWKThumbprint(key)
+	expected := []audit.Entry{
+		{ThingID: "thing-1", KeyThumbprint: thumbprint, Endpoint: "authenticate", Code: "2.03"},
+		{ThingID: "thing-1", KeyThumbprint: thumbprint, Endpoint: "accesstoken", Code: "2.04",
+			Scopes: []string{"publish", "subscribe"}},
+		{ThingID: "thing-1", KeyThumbprint: thumbprint, Endpoint: "accesstoken", Code: "4.01"},
+	}
+	var entries []audit.Entry
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		var e audit.Entry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d: %s", len(expected), len(entries), content)
+	}
+	for i, e := range entries {
+		if e.ThingID != expected[i].ThingID || e.KeyThumbprint != expected[i].KeyThumbprint ||
+			e.Endpoint != expected[i].Endpoint || e.Code != expected[i].Code ||
+			strings.Join(e.Scopes, " ") != strings.Join(expected[i].Scopes, " ") {
+			t.Errorf("expected %+v, got %+v", expected[i], e)
+		}
+		if e.Peer == "" || e.Time.IsZero() {
+			t.Errorf("missing peer or time %+v", e)
+		}
+	}
+}
+
+func TestFormatCode(t *testing.T) {
+	for code, expected := range map[codes.Code]string{
+		codes.Valid:                 "2.03",
+		codes.Changed:               "2.04",
+		codes.Unauthorized:          "4.01",
+		codes.GatewayTimeout:        "5.04",
+		codes.ServiceUnavailable:    "5.03",
+		codes.RequestEntityTooLarge: "4.13",
+	} {
+		if formatCode(code) != expected {
+			t.Errorf("expected %s, got %s", expected, formatCode(code))
+		}
+	}
+}
@@ -0,0 +1,324 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	ithing "github.com/ForgeRock/iot-edge/v7/internal/thing"
+	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Child thing design
+// Devices such as BLE or Modbus sensors can not run the SDK or sign JWTs. The gateway registers and authenticates
+// them as child things with keys that it holds, using the same callback handlers that things use, and makes requests
+// to AM on their behalf. The ID of the gateway is added to the registration JWT of each child as the ParentClaim.
+// Child things are served to local bridges by the CoAP resources below /children, keyed by child ID:
+//  GET  /children                       lists the IDs of the child things
+//  POST /children/{id}/accesstoken      requests an access token, the optional JSON payload holds the scope
+//  GET  /children/{id}/attributes       requests the attributes named in the query
+// Requests are rejected unless they are allowed by the ChildAuthoriser set with SetChildAuthoriser.
+
+// ParentClaim is the registration claim that holds the ID of the gateway that registered a child thing
+const ParentClaim = "parentThingId"
+
+var (
+	// ErrUnknownChild is returned when the gateway does not manage a child thing with the given ID
+	ErrUnknownChild = errors.New("unknown child thing")
+	// ErrChildExists is returned when a child thing with the same ID has already been added
+	ErrChildExists = errors.New("child thing already exists")
+)
+
+// ChildThing describes a thing that the gateway registers and authenticates on behalf of a device that can not do so
+// itself
+type ChildThing struct {
+	ID string
+	// the type of the thing, either device or service, defaults to device
+	Type     callback.ThingType
+	Audience string
+	KeyID    string
+	// the key held by the gateway for the thing
+	Key          crypto.Signer
+	Certificates []*x509.Certificate
+	// additional claims added to the registration JWT
+	Claims map[string]interface{}
+	// handlers for any callbacks in the journey other than the registration and authentication callbacks
+	Handlers []callback.Handler
+}
+
+// ChildAuthoriser decides whether a request may act on behalf of a child thing. The child ID is empty when the
+// request lists the child things.
+type ChildAuthoriser func(e *Exchange, childID string) bool
+
+// childEntry is a child thing managed by the gateway
+type childEntry struct {
+	thing    thing.Thing
+	identity ThingIdentity
+}
+
+// childRegistry holds the child things managed by the gateway
+type childRegistry struct {
+	mu        sync.RWMutex
+	parentID  string
+	things    map[string]childEntry
+	authorise ChildAuthoriser
+}
+
+// SetChildAuthoriser sets the function that decides whether a CoAP request may act on behalf of a child thing. All
+// requests to the child thing resources are rejected with 4.03 (Forbidden) until an authoriser is set.
+func (c *Gateway) SetChildAuthoriser(authorise ChildAuthoriser) {
+	c.children.mu.Lock()
+	defer c.children.mu.Unlock()
+	c.children.authorise = authorise
+}
+
+// parentID returns the ID of the gateway's own identity in AM
+func (c *Gateway) parentID() (string, error) {
+	c.children.mu.RLock()
+	parentID := c.children.parentID
+	c.children.mu.RUnlock()
+	if parentID != "" {
+		return parentID, nil
+	}
+	if c.gatewayThing == nil {
+		return "", errors.New("the gateway has not been initialised")
+	}
+	attributes, err := c.gatewayThing.RequestAttributes()
+	if err != nil {
+		return "", err
+	}
+	parentID, err = attributes.ID()
+	if err != nil {
+		return "", err
+	}
+	c.children.mu.Lock()
+	defer c.children.mu.Unlock()
+	c.children.parentID = parentID
+	return parentID, nil
+}
+
+// AddChild registers and authenticates a child thing with AM on behalf of a device that can not do so itself. The
+// child is registered if it does not have an identity in AM yet, with the ID of the gateway in the ParentClaim.
+func (c *Gateway) AddChild(child ChildThing) error {
+	if child.ID == "" {
+		return errors.New("child thing requires an ID")
+	}
+	if child.Key == nil || child.KeyID == "" {
+		return fmt.Errorf("child thing %s requires a key and key ID", child.ID)
+	}
+	if child.Type == "" {
+		child.Type = callback.TypeDevice
+	}
+	if child.Type != callback.TypeDevice && child.Type != callback.TypeService {
+		return fmt.Errorf("child thing %s can not be of type %s", child.ID, child.Type)
+	}
+	if _, err := c.Child(child.ID); err == nil {
+		return fmt.Errorf("%w: %s", ErrChildExists, child.ID)
+	}
+	parentID, err := c.parentID()
+	if err != nil {
+		return fmt.Errorf("unable to read the ID of the gateway: %w", err)
+	}
+	claims := func() interface{} {
+		registration := make(map[string]interface{}, len(child.Claims)+1)
+		for k, v := range child.Claims {
+			registration[k] = v
+		}
+		registration[ParentClaim] = parentID
+		return registration
+	}
+	builder := &ithing.BaseBuilder{}
+	builder.WithConnection(c.connection()).
+		HandleCallbacksWith(child.Handlers...).
+		AuthenticateThing(child.ID, child.Audience, child.KeyID, child.Key, nil).
+		RegisterThing(child.Certificates, claims)
+	if child.Type == callback.TypeService {
+		builder.AsService()
+	}
+	childThing, err := builder.Create()
+	if err != nil {
+		return err
+	}
+
+	c.children.mu.Lock()
+	defer c.children.mu.Unlock()
+	if _, ok := c.children.things[child.ID]; ok {
+		// the child was added concurrently
+		_ = childThing.Logout()
+		return fmt.Errorf("%w: %s", ErrChildExists, child.ID)
+	}
+	if c.children.things == nil {
+		c.children.things = make(map[string]childEntry)
+	}
+	c.children.things[child.ID] = childEntry{
+		thing: childThing,
+		identity: ThingIdentity{
+			ID:            child.ID,
+			Type:          child.Type,
+			KeyThumbprint: keyThumbprint(&jose.JSONWebKey{Key: child.Key.Public()}),
+		},
+	}
+	return nil
+}
+
+// Child returns the thing that the gateway uses to make requests to AM on behalf of the child thing
+func (c *Gateway) Child(id string) (thing.Thing, error) {
+	c.children.mu.RLock()
+	defer c.children.mu.RUnlock()
+	entry, ok := c.children.things[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownChild, id)
+	}
+	return entry.thing, nil
+}
+
+// Children returns the IDs of the child things managed by the gateway in order
+func (c *Gateway) Children() []string {
+	c.children.mu.RLock()
+	defer c.children.mu.RUnlock()
+	ids := make([]string, 0, len(c.children.things))
+	for id := range c.children.things {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// RemoveChild logs out the session of the child thing and stops managing it. The identity of the child in AM is not
+// removed.
+func (c *Gateway) RemoveChild(id string) error {
+	c.children.mu.Lock()
+	entry, ok := c.children.things[id]
+	delete(c.children.things, id)
+	c.children.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownChild, id)
+	}
+	return entry.thing.Logout()
+}
+
+// childIdentity returns the identity of the child thing with the given ID
+func (c *Gateway) childIdentity(id string) (ThingIdentity, bool) {
+	c.children.mu.RLock()
+	defer c.children.mu.RUnlock()
+	entry, ok := c.children.things[id]
+	return entry.identity, ok
+}
+
+// authoriseChild returns true if the request may act on behalf of the child thing
+func (c *Gateway) authoriseChild(w coap.ResponseWriter, childID string) bool {
+	c.children.mu.RLock()
+	authorise := c.children.authorise
+	c.children.mu.RUnlock()
+	e := exchangeOf(w)
+	return authorise != nil && e != nil && authorise(e, childID)
+}
+
+// childrenHandler handles requests made on behalf of child things
+func (c *Gateway) childrenHandler(w coap.ResponseWriter, r *coap.Request) {
+	logger := requestLogger(r)
+	logger.Debug("childrenHandler")
+	path := r.Msg.Path()
+	childID := ""
+	if len(path) > 1 {
+		childID = path[1]
+		logger = logger.With("child", childID)
+	}
+	if !c.authoriseChild(w, childID) {
+		logger.Warn("request for child thing not authorised")
+		w.SetCode(codes.Forbidden)
+		writeResponse(w, nil)
+		return
+	}
+	var resource string
+	switch len(path) {
+	case 1:
+		resource = ""
+	case 3:
+		resource = path[2]
+	default:
+		w.SetCode(codes.NotFound)
+		writeResponse(w, nil)
+		return
+	}
+	method := r.Msg.Code()
+	if resource == "" {
+		if method != codes.GET {
+			w.SetCode(codes.MethodNotAllowed)
+			writeResponse(w, nil)
+			return
+		}
+		b, err := json.Marshal(c.Children())
+		handleResponse(logger, b, err, codes.Content, w)
+		return
+	}
+	child, err := c.Child(childID)
+	if err != nil {
+		w.SetCode(codes.NotFound)
+		writeResponse(w, []byte(err.Error()))
+		return
+	}
+	switch {
+	case resource == "accesstoken" && method == codes.POST:
+		var request struct {
+			Scope []string `json:"scope"`
+		}
+		if payload := r.Msg.Payload(); len(payload) > 0 {
+			if err := json.Unmarshal(payload, &request); err != nil {
+				logger.Warn("unable to unmarshal payload", "error", err)
+				w.SetCode(codes.BadRequest)
+				writeResponse(w, []byte("Unable to unmarshal payload"))
+				return
+			}
+		}
+		response, err := child.RequestAccessToken(request.Scope...)
+		var b []byte
+		if err == nil {
+			b, err = json.Marshal(response.Content)
+		}
+		handleResponse(logger, b, err, codes.Changed, w)
+	case resource == "attributes" && method == codes.GET:
+		var names []string
+		for _, q := range r.Msg.Query() {
+			if q != "" {
+				names = append(names, q)
+			}
+		}
+		response, err := child.RequestAttributes(names...)
+		var b []byte
+		if err == nil {
+			b, err = json.Marshal(response.Content)
+		}
+		handleResponse(logger, b, err, codes.Content, w)
+	case resource == "accesstoken" || resource == "attributes":
+		w.SetCode(codes.MethodNotAllowed)
+		writeResponse(w, nil)
+	default:
+		w.SetCode(codes.NotFound)
+		writeResponse(w, nil)
+	}
+}
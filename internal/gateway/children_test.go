@@ -0,0 +1,245 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
+	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// fakeParentThing is a gateway thing with a known ID
+type fakeParentThing struct {
+	thing.Thing
+}
+
+func (fakeParentThing) RequestAttributes(...string) (thing.AttributesResponse, error) {
+	return thing.AttributesResponse{Content: thing.JSONContent{"_id": "gateway-1"}}, nil
+}
+
+// childAM returns a fake AM that registers things with a JWT PoP registration callback and records the registration
+// claims
+func childAM() (am *fakeAM, registrations chan map[string]interface{}) {
+	am = newFakeAM()
+	am.AMInfoSet = popAMInfo
+	registrations = make(chan map[string]interface{}, 1)
+	am.AuthenticateFunc = func(auth client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+		if len(auth.Callbacks) == 0 {
+			reply.AuthId = "auth-id"
+			reply.Callbacks = []callback.Callback{{
+				Type: callback.TypeHiddenValueCallback,
+				Output: []callback.Entry{
+					{Name: "value", Value: "challenge"},
+					{Name: "id", Value: "jwt-pop-registration"},
+				},
+				Input: []callback.Entry{{Name: "IDToken1", Value: ""}},
+			}}
+			return reply, nil
+		}
+		var claims map[string]interface{}
+		if err = jws.ExtractClaims(auth.Callbacks[0].Input[0].Value.(string), &claims); err != nil {
+			return reply, err
+		}
+		registrations <- claims
+		reply.TokenID = "child-token"
+		return reply, nil
+	}
+	am.AccessTokenFunc = func(string, string) ([]byte, error) {
+		return []byte(`{"access_token":"child-access-token"}`), nil
+	}
+	return am, registrations
+}
+
+func TestGateway_AddChild(t *testing.T) {
+	am, registrations := childAM()
+	gateway := testGateway(&am.MockClient)
+	gateway.amConnection = am
+	gateway.gatewayThing = fakeParentThing{}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	child := ChildThing{
+		ID:       "sensor-1",
+		Audience: "/",
+		KeyID:    "sensor-key",
+		Key:      key,
+		Claims:   map[string]interface{}{"model": "ble-thermometer"},
+	}
+	if err := gateway.AddChild(child); err != nil {
+		t.Fatal(err)
+	}
+	claims := <-registrations
+	if claims["sub"] != "sensor-1" || claims["thingType"] != string(callback.TypeDevice) {
+		t.Errorf("unexpected registration claims %v", claims)
+	}
+	if claims[ParentClaim] != "gateway-1" || claims["model"] != "ble-thermometer" {
+		t.Errorf("expected parent and custom claims, got %v", claims)
+	}
+	if err := gateway.AddChild(child); !errors.Is(err, ErrChildExists) {
+		t.Errorf("expected %v, got %v", ErrChildExists, err)
+	}
+	if children := gateway.Children(); !reflect.DeepEqual(children, []string{"sensor-1"}) {
+		t.Errorf("unexpected children %v", children)
+	}
+
+	childThing, err := gateway.Child("sensor-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := childThing.RequestAccessToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := response.AccessToken(); token != "child-access-token" {
+		t.Errorf("unexpected access token %s", token)
+	}
+
+	if err = gateway.RemoveChild("sensor-1"); err != nil {
+		t.Fatal(err)
+	}
+	if am.logouts.Load() != 1 {
+		t.Error("expected the child session to be logged out")
+	}
+	if _, err = gateway.Child("sensor-1"); !errors.Is(err, ErrUnknownChild) {
+		t.Errorf("expected %v, got %v", ErrUnknownChild, err)
+	}
+}
+
+func TestGateway_AddChild_Invalid(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name  string
+		child ChildThing
+	}{
+		{name: "no-id", child: ChildThing{KeyID: "k", Key: key}},
+		{name: "no-key", child: ChildThing{ID: "a", KeyID: "k"}},
+		{name: "no-key-id", child: ChildThing{ID: "a", Key: key}},
+		{name: "gateway-type", child: ChildThing{ID: "a", KeyID: "k", Key: key, Type: callback.TypeGateway}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			am, _ := childAM()
+			gateway := testGateway(&am.MockClient)
+			gateway.gatewayThing = fakeParentThing{}
+			if err := gateway.AddChild(subtest.child); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestGateway_ChildResources(t *testing.T) {
+	am, registrations := childAM()
+	gateway := testGateway(&am.MockClient)
+	gateway.amConnection = am
+	gateway.gatewayThing = fakeParentThing{}
+	var mu sync.Mutex
+	var identities []ThingIdentity
+	gateway.Use(func(next ExchangeHandler) ExchangeHandler {
+		return func(e *Exchange) {
+			mu.Lock()
+			identities = append(identities, e.Thing)
+			mu.Unlock()
+			next(e)
+		}
+	})
+	conn := startAndDial(t, gateway)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.AddChild(ChildThing{ID: "sensor-1", Audience: "/", KeyID: "sensor-key", Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	<-registrations
+
+	get := func(path, query string) coap.Message {
+		request, err := conn.NewGetRequest(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.SetQueryString(query)
+		response, err := conn.Exchange(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	postJSON := func(path, payload string) coap.Message {
+		request, err := conn.NewPostRequest(path, coap.AppJSON, strings.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := conn.Exchange(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	// rejected until an authoriser is set
+	checkResponse(t, get("/children", ""), codes.Forbidden, false)
+	gateway.SetChildAuthoriser(func(e *Exchange, childID string) bool {
+		return childID != "sensor-2"
+	})
+	checkResponse(t, get("/children/sensor-2/attributes", ""), codes.Forbidden, false)
+
+	response := get("/children", "")
+	checkResponse(t, response, codes.Content, false)
+	var children []string
+	if err := json.Unmarshal(response.Payload(), &children); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(children, []string{"sensor-1"}) {
+		t.Errorf("unexpected children %v", children)
+	}
+
+	response = postJSON("/children/sensor-1/accesstoken", `{"scope":["publish"]}`)
+	checkResponse(t, response, codes.Changed, false)
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(response.Payload(), &token); err != nil || token.AccessToken != "child-access-token" {
+		t.Errorf("unexpected access token response %s, %v", response.Payload(), err)
+	}
+
+	response = get("/children/sensor-1/attributes", "thingConfig")
+	checkResponse(t, response, codes.Content, false)
+	if string(response.Payload()) != `{"thingConfig":"a"}` {
+		t.Errorf("unexpected attributes %s", response.Payload())
+	}
+
+	checkResponse(t, get("/children/sensor-1/accesstoken", ""), codes.MethodNotAllowed, false)
+	checkResponse(t, get("/children/sensor-1/unknown", ""), codes.NotFound, false)
+	checkResponse(t, get("/children/sensor-3/attributes", ""), codes.NotFound, false)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if identities[len(identities)-4].ID != "sensor-1" || identities[len(identities)-4].KeyThumbprint == "" {
+		t.Errorf("expected the exchange to identify the child, got %v", identities[len(identities)-4])
+	}
+}
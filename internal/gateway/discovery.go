@@ -0,0 +1,113 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// resource is a CoAP resource served by the gateway
+type resource struct {
+	link    client.Link
+	handler func(w coap.ResponseWriter, r *coap.Request)
+	// the handler also serves the resources below the target
+	subresources bool
+}
+
+// resources returns the resources served by the CoAP server
+func (c *Gateway) resources() []resource {
+	links := make(map[string]client.Link)
+	for _, l := range client.GatewayLinks() {
+		links[l.Target] = l
+	}
+	return []resource{
+		{link: links["/authenticate"], handler: c.authenticateHandler},
+		{link: links["/aminfo"], handler: c.amInfoHandler},
+		{link: links["/accesstoken"], handler: endpoint(c.accessTokenHandler)},
+		{link: links["/usercode"], handler: endpoint(c.userCodeHandler)},
+		{link: links["/usertoken"], handler: endpoint(c.userTokenHandler)},
+		{link: links["/introspect"], handler: endpoint(c.introspectHandler)},
+		{link: links["/attributes"], handler: endpoint(c.attributesHandler)},
+		{link: links["/session"], handler: endpoint(c.sessionHandler)},
+		{link: client.NewGatewayLink("/children", coap.AppJSON), handler: c.childrenHandler, subresources: true},
+	}
+}
+
+// matchLink returns true if the link matches the query filter as described in RFC 6690 section 4.1. A value ending in
+// '*' matches any value that starts with the rest of the filter.
+func matchLink(link client.Link, filter string) bool {
+	name, value, _ := strings.Cut(filter, "=")
+	if name == "" {
+		return true
+	}
+	match := func(v string) bool {
+		if prefix, ok := strings.CutSuffix(value, "*"); ok {
+			return strings.HasPrefix(v, prefix)
+		}
+		return v == value
+	}
+	switch name {
+	case "href":
+		return match(link.Target)
+	case "rt":
+		return match(link.ResourceType)
+	case "if":
+		return match(link.Interface)
+	case "ver":
+		return match(link.Version)
+	case "ct":
+		for _, f := range link.ContentFormats {
+			if match(strconv.Itoa(int(f))) {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// wellKnownCoreHandler returns a handler that lists the resources in CoRE Link Format (RFC 6690)
+func wellKnownCoreHandler(resources []resource) func(w coap.ResponseWriter, r *coap.Request) {
+	return func(w coap.ResponseWriter, r *coap.Request) {
+		logger := requestLogger(r)
+		logger.Debug("wellKnownCoreHandler")
+		if r.Msg.Code() != codes.GET {
+			w.SetCode(codes.MethodNotAllowed)
+			writeResponse(w, nil)
+			return
+		}
+		var links []client.Link
+		for _, res := range resources {
+			matched := true
+			for _, filter := range r.Msg.Query() {
+				matched = matched && matchLink(res.link, filter)
+			}
+			if matched {
+				links = append(links, res.link)
+			}
+		}
+		w.SetContentFormat(coap.AppLinkFormat)
+		w.SetCode(codes.Content)
+		writeResponse(w, client.FormatLinks(links))
+	}
+}
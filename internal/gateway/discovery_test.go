@@ -0,0 +1,72 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+func TestGateway_WellKnownCore(t *testing.T) {
+	am := newFakeAM()
+	gateway := testGateway(&am.MockClient)
+	gateway.amConnection = am
+	conn := startAndDial(t, gateway)
+
+	all := append(client.GatewayLinks(), client.NewGatewayLink("/children", coap.AppJSON))
+	tests := []struct {
+		name     string
+		query    string
+		expected []client.Link
+	}{
+		{name: "all", expected: all},
+		{name: "href", query: "href=/aminfo", expected: all[1:2]},
+		{name: "rt-prefix", query: "rt=iot.gw.user*", expected: all[3:5]},
+		{name: "ct", query: "ct=11650", expected: all[2:8]},
+		{name: "no-match", query: "if=core.ll", expected: nil},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			request, err := conn.NewGetRequest(client.WellKnownCore)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.SetQueryString(subtest.query)
+			response, err := conn.Exchange(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Code() != codes.Content {
+				t.Fatalf("expected code %v, got %v", codes.Content, response.Code())
+			}
+			if format, ok := response.Option(coap.ContentFormat).(coap.MediaType); !ok || format != coap.AppLinkFormat {
+				t.Errorf("expected link format, got %v", response.Option(coap.ContentFormat))
+			}
+			links, err := client.ParseLinks(response.Payload())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(links, subtest.expected) {
+				t.Errorf("expected %v, got %v", subtest.expected, links)
+			}
+		})
+	}
+}
@@ -1,5 +1,5 @@
 /*
- * Copyright 2020-2022 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -24,21 +24,25 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ForgeRock/iot-edge/v7/internal/audit"
 	"github.com/ForgeRock/iot-edge/v7/internal/client"
-	frcrypto "github.com/ForgeRock/iot-edge/v7/internal/crypto"
 	"github.com/ForgeRock/iot-edge/v7/internal/debug"
 	"github.com/ForgeRock/iot-edge/v7/internal/jws"
 	ithing "github.com/ForgeRock/iot-edge/v7/internal/thing"
 	"github.com/ForgeRock/iot-edge/v7/internal/tokencache"
 	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
 	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
+	"github.com/dchest/uniuri"
 	"github.com/go-ocf/go-coap"
 	"github.com/go-ocf/go-coap/codes"
-	coapnet "github.com/go-ocf/go-coap/net"
 	"github.com/pion/dtls/v2"
 )
 
@@ -53,13 +57,42 @@ var ErrCOAPServerAlreadyStarted = errors.New("CoAP server has already been start
 // Gateway represents the IoT Gateway
 type Gateway struct {
 	gatewayThing     thing.Thing
-	authCache        *tokencache.Cache
+	authCache        tokencache.Store
 	callbackHandlers []callback.Handler
-	// coap server
-	coapServer *coap.Server
-	coapChan   chan error
-	address    net.Addr
-	// AM connection
+	// creates the in-memory caches of the routes that are added without an auth store
+	routeAuthCache func() tokencache.Store
+	// CoAP listeners, guarded by listenersMu
+	listenersMu sync.Mutex
+	listeners   []*Listener
+	// rate limits requests from each peer
+	limiter rateLimiter
+	// state used to serve requests while AM is unavailable
+	offline offlineMode
+	// verifies the proof of possession JWTs signed by things
+	pop popVerifier
+	// records the outcome of each request, nil if auditing is switched off
+	auditLog atomic.Pointer[audit.Log]
+	// the DTLS peers of the CoAP server
+	peers peerTracker
+	// admin API server
+	adminServer  *http.Server
+	adminChan    chan error
+	adminAddress net.Addr
+	// token introspection server for local resource servers
+	introspectionServer  *http.Server
+	introspectionChan    chan error
+	introspectionAddress net.Addr
+	introspections       introspectionCache
+	// wraps the CoAP endpoint handlers
+	middleware []Middleware
+	// things that the gateway registers and authenticates on behalf of devices
+	children childRegistry
+	// routes requests to the realms and trees of tenants
+	routes routeTable
+	// tracks work done in the background so that it can be completed on shutdown
+	background sync.WaitGroup
+	// AM connection, guarded by mu since it can be replaced while the gateway is running
+	mu           sync.RWMutex
 	amConnection client.Connection
 	amURL        string
 	realm        string
@@ -69,14 +102,15 @@ type Gateway struct {
 
 // New creates a new IoT Gateway
 func New(baseURL string, realm string, authTree string, timeout time.Duration, handlers []callback.Handler) *Gateway {
-	return &Gateway{
-		authCache:        tokencache.New(5*time.Minute, 10*time.Minute),
+	c := &Gateway{
 		amURL:            baseURL,
 		realm:            realm,
 		authTree:         authTree,
 		callbackHandlers: handlers,
 		timeout:          timeout,
 	}
+	c.SetAuthCache(5*time.Minute, 10*time.Minute, 0)
+	return c
 }
 
 // Initialise the IoT Gateway
@@ -107,23 +141,88 @@ func (c *Gateway) Initialise() error {
 // SetAuthenticationTree changes the authentication tree that the gateway was created with.
 // This is a convenience function for functional testing.
 func SetAuthenticationTree(c *Gateway, tree string) {
-	client.SetAuthenticationTree(c.amConnection, tree)
+	client.SetAuthenticationTree(c.connection(), tree)
 }
 
-// authenticate a Thing with AM using the given payload
-func (c *Gateway) authenticate(auth client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+// connection returns the current connection to AM
+func (c *Gateway) connection() client.Connection {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.amConnection
+}
+
+// Reconfigure replaces the connection used to forward thing requests to AM with one that uses the given timeout and
+// authentication tree. Requests that are in progress complete with the previous connection and the CoAP server
+// continues to run so DTLS sessions with things are kept.
+func (c *Gateway) Reconfigure(timeout time.Duration, authTree string) error {
+	amURL, err := url.Parse(c.amURL)
+	if err != nil {
+		return err
+	}
+	connection, err := client.NewConnection().
+		ConnectTo(amURL).
+		InRealm(c.realm).
+		WithTree(authTree).
+		TimeoutRequestAfter(timeout).
+		Create()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.amConnection = connection
+	c.authTree = authTree
+	c.timeout = timeout
+	return nil
+}
+
+// SetRateLimit sets the number of requests per second allowed from each peer and the maximum burst size. Requests
+// that exceed the limit receive a 5.03 (Service Unavailable) response. A rate of zero or less disables rate limiting.
+// The limit can be changed while the CoAP server is running.
+func (c *Gateway) SetRateLimit(requestsPerSecond float64, burst int) {
+	c.limiter.set(requestsPerSecond, burst)
+}
+
+// SetAuthCache sets the expiry, cleanup interval and maximum number of entries of the cache used to hold the
+// authentication IDs of things that are in the middle of an authentication journey. It should be set before the
+// CoAP server is started since the entries of the current cache are discarded. Routes that are added without an auth
+// store afterwards are given a cache of their own with the same settings.
+func (c *Gateway) SetAuthCache(expiry, cleanupInterval time.Duration, maxEntries int) {
+	c.authCache = tokencache.NewWithLimit(expiry, cleanupInterval, maxEntries)
+	c.routeAuthCache = func() tokencache.Store {
+		return tokencache.NewWithLimit(expiry, cleanupInterval, maxEntries)
+	}
+}
+
+// SetAuthStore sets the store used to hold the authentication IDs of things that are in the middle of an
+// authentication journey. Gateways that share a store can continue each other's journeys so things can be load
+// balanced across them. It should be set before the CoAP server is started.
+func (c *Gateway) SetAuthStore(store tokencache.Store) {
+	c.authCache = store
+}
+
+// authenticate a Thing with AM using the given payload, with the connection and cache of the route or of the gateway
+// for the default route
+func (c *Gateway) authenticate(rt *route, auth client.AuthenticatePayload) (reply client.AuthenticatePayload,
+	err error) {
+	authCache := c.authCache
+	if rt != nil {
+		authCache = rt.AuthStore
+	}
 	if auth.AuthIDKey != "" {
-		auth.AuthId, _ = c.authCache.Get(auth.AuthIDKey)
+		auth.AuthId, _ = authCache.Get(auth.AuthIDKey)
 	}
 	auth.AuthIDKey = ""
 
-	reply, err = c.amConnection.Authenticate(auth)
+	reply, err = c.routeConnection(rt).Authenticate(auth)
 	if err != nil {
 		return
 	}
 
 	// if reply has a token, authentication has successfully completed
 	if reply.HasSessionToken() {
+		c.pop.learn(reply.TokenID, auth.Callbacks)
+		c.learnSession(reply.TokenID, rt)
 		return reply, nil
 	}
 
@@ -136,7 +235,9 @@ func (c *Gateway) authenticate(auth client.AuthenticatePayload) (reply client.Au
 	// Use the hash value of the id as its key
 	d := sha256.Sum256([]byte(reply.AuthId))
 	reply.AuthIDKey = base64.StdEncoding.EncodeToString(d[:])
-	c.authCache.Add(reply.AuthIDKey, reply.AuthId)
+	if err = authCache.Add(reply.AuthIDKey, reply.AuthId); err != nil {
+		return reply, err
+	}
 	reply.AuthId = ""
 
 	return
@@ -144,162 +245,229 @@ func (c *Gateway) authenticate(auth client.AuthenticatePayload) (reply client.Au
 
 var heartBeat time.Duration = time.Millisecond * 100
 
+// requestLogger returns a logger that annotates records with the details of the CoAP request
+func requestLogger(r *coap.Request) *slog.Logger {
+	return debug.Log.With(
+		debug.Endpoint(r.Msg.PathString()),
+		debug.MessageID(r.Msg.MessageID()),
+		debug.RequestID(uniuri.NewLen(8)))
+}
+
 // authenticateHandler handles authentication requests
 func (c *Gateway) authenticateHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("authenticateHandler")
+	logger := requestLogger(r)
+	logger.Debug("authenticateHandler")
 	var auth client.AuthenticatePayload
 	if err := json.Unmarshal(r.Msg.Payload(), &auth); err != nil {
-		debug.Logger.Printf("Unable to unmarshall payload; %s", err)
+		logger.Warn("unable to unmarshal payload", "error", err)
 		w.SetCode(codes.BadRequest)
 		writeResponse(w, []byte("Unable to unmarshal payload"))
 		return
 	}
 
-	reply, err := c.authenticate(auth)
+	if thingID := identityFromCallbacks(auth.Callbacks).ID; thingID != "" {
+		logger = logger.With(debug.ThingID(thingID))
+	}
+	reply, err := c.authenticate(routeOf(w), auth)
 	if err != nil {
-		debug.Logger.Printf("Error connecting to AM; %s", err)
+		logger.Warn("error connecting to AM", "error", err)
 		w.SetCode(codes.Unauthorized)
 		writeResponse(w, []byte(err.Error()))
 		return
 	}
 
+	if reply.HasSessionToken() {
+		c.identifySession(w, reply.TokenID)
+	}
 	b, err := json.Marshal(reply)
 	if err != nil {
-		debug.Logger.Printf("Error marshalling Auth Payload; %s", err)
+		logger.Error("error marshalling auth payload", "error", err)
 		w.SetCode(codes.BadGateway)
 		writeResponse(w, []byte(err.Error()))
 		return
 	}
 	w.SetCode(codes.Valid)
 	writeResponse(w, b)
-	debug.Logger.Println("authenticateHandler: success")
+	logger.Debug("authenticateHandler: success")
 }
 
 // amInfoHandler handles AM Info requests
 func (c *Gateway) amInfoHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("amInfoHandler")
-	info, err := c.amConnection.AMInfo()
+	logger := requestLogger(r)
+	logger.Debug("amInfoHandler")
+	info, err := c.requestConnection(w).AMInfo()
 	if err != nil {
+		logger.Warn("error getting AM info", "error", err)
 		w.SetCode(codes.GatewayTimeout)
 		writeResponse(w, nil)
 		return
 	}
 	b, err := json.Marshal(info)
 	if err != nil {
-		debug.Logger.Printf("Error marshalling amInfo; %s", err)
+		logger.Error("error marshalling AM info", "error", err)
 		w.SetCode(codes.BadGateway)
 		writeResponse(w, []byte(err.Error()))
 		return
 	}
 	w.SetCode(codes.Content)
 	writeResponse(w, b)
-	debug.Logger.Println("amInfoHandler: success")
+	logger.Debug("amInfoHandler: success")
+}
+
+// sessionRequest is a request made with the session of a thing
+type sessionRequest struct {
+	token   string
+	content client.ContentType
+	payload string
+}
+
+// decodeRequest decodes the session token, content type and payload of a request to the endpoint. The zero value is
+// returned for endpoints that are not called with the session of a thing.
+func decodeRequest(endpoint string, msg coap.Message) (sessionRequest, error) {
+	switch endpoint {
+	case "session":
+		return decodeSessionTokenRequest(msg)
+	case "accesstoken", "usercode", "usertoken", "attributes", "introspect":
+		return decodeThingEndpointRequest(msg)
+	}
+	return sessionRequest{}, nil
 }
 
-func decodeThingEndpointRequest(msg coap.Message) (token string, content client.ContentType, payload string, err error) {
+func decodeThingEndpointRequest(msg coap.Message) (req sessionRequest, err error) {
 	coapFormat, ok := msg.Option(coap.ContentFormat).(coap.MediaType)
 	if !ok {
-		return token, content, payload, fmt.Errorf("missing content format")
+		return req, fmt.Errorf("missing content format")
 	}
 
 	switch coapFormat {
 	case coap.AppJSON:
 		var request client.ThingEndpointPayload
 		if err := json.Unmarshal(msg.Payload(), &request); err != nil {
-			return token, content, payload, err
+			return req, err
 		}
-		token = request.Token
-		content = client.ApplicationJSON
-		payload = request.Payload
+		req.token = request.Token
+		req.content = client.ApplicationJSON
+		req.payload = request.Payload
 	case client.AppJOSE:
-		payload = string(msg.Payload())
+		req.payload = string(msg.Payload())
 		// get SSO token from the CSRF claim in the JWT
 		var claims struct {
 			CSRF string `json:"csrf"`
 		}
-		if err := jws.ExtractClaims(payload, &claims); err != nil {
-			return token, content, payload, err
+		if err := jws.ExtractClaims(req.payload, &claims); err != nil {
+			return req, err
 		}
-		token = claims.CSRF
-		content = client.ApplicationJOSE
+		req.token = claims.CSRF
+		req.content = client.ApplicationJOSE
 	}
-	return token, content, payload, nil
+	return req, nil
 }
 
-// accessTokenHandler handles access token requests
-func (c *Gateway) accessTokenHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("accessTokenHandler")
-
-	token, content, payload, err := decodeThingEndpointRequest(r.Msg)
-	if err != nil {
-		w.SetCode(codes.BadRequest)
-		writeResponse(w, []byte(err.Error()))
-		return
+func decodeSessionTokenRequest(msg coap.Message) (req sessionRequest, err error) {
+	coapFormat, ok := msg.Option(coap.ContentFormat).(coap.MediaType)
+	if !ok {
+		return req, fmt.Errorf("missing content format")
 	}
 
-	b, err := c.amConnection.AccessToken(token, content, payload)
-	handleResponse(b, err, codes.Changed, w)
+	switch coapFormat {
+	case coap.AppJSON:
+		var request client.SessionToken
+		if err = json.Unmarshal(msg.Payload(), &request); err != nil {
+			return req, err
+		}
+		req.token = request.TokenID
+		req.content = client.ApplicationJSON
+	case client.AppJOSE:
+		req.payload = string(msg.Payload())
+		// get SSO token from the CSRF claim in the JWT
+		var claims struct {
+			CSRF string `json:"csrf"`
+		}
+		if err = jws.ExtractClaims(req.payload, &claims); err != nil {
+			return req, err
+		}
+		req.token = claims.CSRF
+		req.content = client.ApplicationJOSE
+	}
+	return req, nil
 }
 
-// userCodeHandler handles user code requests
-func (c *Gateway) userCodeHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("userCodeHandler")
+// amRequest makes a request to AM with the session of a thing
+type amRequest func(connection client.Connection, tokenID string, content client.ContentType, payload string) (
+	[]byte, error)
+
+// forward makes the request to AM with the connection of the exchange and writes the response. Requests are not
+// forwarded while AM is unavailable and the gateway is serving offline. Returns the reply and true if AM answered
+// successfully.
+func (c *Gateway) forward(e *Exchange, successCode codes.Code, request amRequest) ([]byte, bool) {
+	if c.servingOffline() {
+		writeUnavailable(e.logger, e.writer)
+		return nil, false
+	}
+	b, err := request(c.requestConnection(e.writer), e.session.token, e.session.content, e.session.payload)
+	c.trackAM(e.logger, err)
+	handleResponse(e.logger, b, err, successCode, e.writer)
+	return b, err == nil
+}
 
-	token, content, payload, err := decodeThingEndpointRequest(r.Msg)
-	if err != nil {
-		w.SetCode(codes.BadRequest)
-		writeResponse(w, []byte(err.Error()))
-		return
+// accessTokenHandler handles access token requests
+func (c *Gateway) accessTokenHandler(e *Exchange) {
+	if b, ok := c.forward(e, codes.Changed, client.Connection.AccessToken); ok {
+		auditScopes(e.writer, b)
 	}
+}
 
-	b, err := c.amConnection.UserCode(token, content, payload)
-	handleResponse(b, err, codes.Changed, w)
+// userCodeHandler handles user code requests
+func (c *Gateway) userCodeHandler(e *Exchange) {
+	c.forward(e, codes.Changed, client.Connection.UserCode)
 }
 
 // userTokenHandler handles user token requests
-func (c *Gateway) userTokenHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("userTokenHandler")
-
-	token, content, payload, err := decodeThingEndpointRequest(r.Msg)
-	if err != nil {
-		w.SetCode(codes.BadRequest)
-		writeResponse(w, []byte(err.Error()))
-		return
+func (c *Gateway) userTokenHandler(e *Exchange) {
+	if b, ok := c.forward(e, codes.Changed, client.Connection.UserToken); ok {
+		auditScopes(e.writer, b)
 	}
-
-	b, err := c.amConnection.UserToken(token, content, payload)
-	handleResponse(b, err, codes.Changed, w)
 }
 
 // attributesHandler handles a thing attributes requests
-func (c *Gateway) attributesHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("attributesHandler")
-	names := r.Msg.Query()
-
-	token, format, payload, err := decodeThingEndpointRequest(r.Msg)
-	if err != nil {
-		w.SetCode(codes.BadRequest)
-		writeResponse(w, []byte(err.Error()))
+func (c *Gateway) attributesHandler(e *Exchange) {
+	names := e.request.Msg.Query()
+	key := attributesKey(e.session.token, names)
+	if !c.servingOffline() {
+		b, err := c.requestConnection(e.writer).Attributes(e.session.token, e.session.content, e.session.payload, names)
+		if !c.trackAM(e.logger, err) {
+			if err == nil {
+				c.offline.storeAttributes(key, b)
+			}
+			handleResponse(e.logger, b, err, codes.Changed, e.writer)
+			return
+		}
+	}
+	if b, age, ok := c.offline.cachedAttributes(e.session.token, key); ok {
+		writeOfflineResponse(e.logger, e.writer, codes.Changed, b, age)
 		return
 	}
-	b, err := c.amConnection.Attributes(token, format, payload, names)
-	handleResponse(b, err, codes.Changed, w)
+	writeUnavailable(e.logger, e.writer)
 }
 
-// sessionHandler handles a session validation request
-func (c *Gateway) sessionHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("sessionHandler")
-
-	token, payload, contentType, err := decodeSessionTokenRequest(r.Msg)
-	if err != nil {
-		w.SetCode(codes.BadRequest)
-		writeResponse(w, []byte(err.Error()))
-		return
-	}
-	switch r.Msg.QueryString() {
+// sessionHandler handles session validation, information and logout requests
+func (c *Gateway) sessionHandler(e *Exchange) {
+	logger, w, req := e.logger, e.writer, e.session
+	switch e.request.Msg.QueryString() {
 	case "_action=validate":
-		valid, err := c.amConnection.ValidateSession(token, contentType, payload)
+		if c.servingOffline() {
+			if c.offline.isRevoked(req.token) {
+				age, _ := c.offline.age()
+				writeOfflineResponse(logger, w, codes.Unauthorized, nil, age)
+				return
+			}
+			writeUnavailable(logger, w)
+			return
+		}
+		valid, err := c.requestConnection(w).ValidateSession(req.token, req.content, req.payload)
+		c.trackAM(logger, err)
 		if err != nil {
+			logger.Warn("error connecting to AM", "error", err)
 			w.SetCode(codes.GatewayTimeout)
 			writeResponse(w, []byte(err.Error()))
 			return
@@ -310,66 +478,51 @@ func (c *Gateway) sessionHandler(w coap.ResponseWriter, r *coap.Request) {
 			w.SetCode(codes.Unauthorized)
 		}
 		writeResponse(w, nil)
-		debug.Logger.Printf("sessionHandler: success. validate %v", valid)
+		logger.Debug("sessionHandler: success", "action", "validate", "valid", valid)
+	case "_action=getSessionInfo":
+		c.forward(e, codes.Content, client.Connection.SessionInfo)
 	case "_action=logout":
-		err = c.amConnection.LogoutSession(token, contentType, payload)
-		if err != nil {
-			w.SetCode(codes.GatewayTimeout)
-			writeResponse(w, []byte(err.Error()))
-			return
+		if !c.servingOffline() {
+			err := c.requestConnection(w).LogoutSession(req.token, req.content, req.payload)
+			if !c.trackAM(logger, err) {
+				if err != nil {
+					logger.Warn("error connecting to AM", "error", err)
+					w.SetCode(codes.GatewayTimeout)
+					writeResponse(w, []byte(err.Error()))
+					return
+				}
+				c.pop.remove(req.token)
+				c.forgetSession(req.token)
+				w.SetCode(codes.Changed)
+				writeResponse(w, nil)
+				logger.Debug("sessionHandler: success", "action", "logout")
+				return
+			}
 		}
-		w.SetCode(codes.Changed)
-		writeResponse(w, nil)
-		debug.Logger.Printf("sessionHandler: success. log out")
+		c.offline.queueLogout(queuedLogout{token: req.token, content: req.content, payload: req.payload})
+		c.pop.remove(req.token)
+		age, _ := c.offline.age()
+		writeOfflineResponse(logger, w, codes.Changed, nil, age)
+		logger.Debug("sessionHandler: logout queued", "action", "logout")
 	default:
+		logger.Warn("unknown/missing query", "query", e.request.Msg.QueryString())
 		w.SetCode(codes.BadRequest)
 		writeResponse(w, []byte("unknown/missing query"))
-		return
 	}
 }
 
-func decodeSessionTokenRequest(msg coap.Message) (token, payload string, contentType client.ContentType, err error) {
-	coapFormat, ok := msg.Option(coap.ContentFormat).(coap.MediaType)
-	if !ok {
-		return token, payload, contentType, fmt.Errorf("missing content format")
-	}
-
-	switch coapFormat {
-	case coap.AppJSON:
-		var request client.SessionToken
-		if err = json.Unmarshal(msg.Payload(), &request); err != nil {
-			return
-		}
-		token = request.TokenID
-		contentType = client.ApplicationJSON
-	case client.AppJOSE:
-		payload = string(msg.Payload())
-		// get SSO token from the CSRF claim in the JWT
-		var claims struct {
-			CSRF string `json:"csrf"`
-		}
-		if err = jws.ExtractClaims(payload, &claims); err != nil {
+// introspectHandler handles an introspect OAuth2 access token request
+func (c *Gateway) introspectHandler(e *Exchange) {
+	if !c.servingOffline() {
+		// the connection introspects locally if AM fails so only failures are tracked
+		b, err := c.requestConnection(e.writer).IntrospectAccessToken(e.session.token, e.session.content,
+			e.session.payload)
+		if err == nil || !c.amFailed(e.logger, err) {
+			handleResponse(e.logger, b, err, codes.Changed, e.writer)
 			return
 		}
-		token = claims.CSRF
-		contentType = client.ApplicationJOSE
-	}
-	return
-}
-
-// introspectHandler handles an introspect OAuth2 access token request
-func (c *Gateway) introspectHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("introspectHandler")
-
-	token, content, payload, err := decodeThingEndpointRequest(r.Msg)
-	if err != nil {
-		w.SetCode(codes.BadRequest)
-		writeResponse(w, []byte(err.Error()))
-		return
 	}
-
-	b, err := c.amConnection.IntrospectAccessToken(token, content, payload)
-	handleResponse(b, err, codes.Changed, w)
+	c.introspectOffline(e.logger, e.writer, e.session.content, e.session.payload)
 }
 
 func dtlsServerConfig(cert ...tls.Certificate) *dtls.Config {
@@ -380,84 +533,46 @@ func dtlsServerConfig(cert ...tls.Certificate) *dtls.Config {
 	}
 }
 
-// StartCOAPServer starts a COAP server within the IoT Gateway
+// StartCOAPServer starts a COAP server within the IoT Gateway, listening on a single address with a self-signed
+// DTLS identity for the key. Use StartListener to listen on more than one address.
 func (c *Gateway) StartCOAPServer(address string, key crypto.Signer) error {
-	if c.coapServer != nil {
+	if len(c.Listeners()) > 0 {
 		return ErrCOAPServerAlreadyStarted
 	}
-	if key == nil {
-		return jws.ErrMissingSigner
-	}
-	c.coapChan = make(chan error, 1)
-	mux := coap.NewServeMux()
-	mux.HandleFunc("/authenticate", c.authenticateHandler)
-	mux.HandleFunc("/aminfo", c.amInfoHandler)
-	mux.HandleFunc("/accesstoken", c.accessTokenHandler)
-	mux.HandleFunc("/usercode", c.userCodeHandler)
-	mux.HandleFunc("/usertoken", c.userTokenHandler)
-	mux.HandleFunc("/introspect", c.introspectHandler)
-	mux.HandleFunc("/attributes", c.attributesHandler)
-	mux.HandleFunc("/session", c.sessionHandler)
-
-	cert, err := frcrypto.PublicKeyCertificate(key)
-	if err != nil {
-		return err
-	}
-	l, err := coapnet.NewDTLSListener("udp", address, dtlsServerConfig(cert), heartBeat)
-	if err != nil {
-		return err
-	}
-	c.address = l.Addr()
-
-	// it is safer to wait for the CoAP server to fully start before returning from the function
-	// since instructing the server to shutdown while it is still starting up can cause a hang
-	started := make(chan struct{})
-
-	c.coapServer = &coap.Server{
-		Listener: l,
-		Handler:  mux,
-		NotifyStartedFunc: func() {
-			close(started)
-		},
-	}
-	go func() {
-		c.coapChan <- c.coapServer.ActivateAndServe()
-		l.Close()
-		c.coapServer = nil
-	}()
-	<-started
-	return nil
+	_, err := c.StartListener(ListenerConfig{Address: address, Key: key})
+	return err
 }
 
-// ShutdownCOAPServer gracefully shuts the COAP server down
-func (c *Gateway) ShutdownCOAPServer() {
-	if c.coapServer == nil {
-		return
-	}
-	if err := c.coapServer.Shutdown(); err != nil {
-		debug.Logger.Println(err)
-		return
-	}
-	// wait for shutdown to complete
-	<-c.coapChan
-	c.address = nil
+// rateLimited rejects requests from peers that have exceeded the rate limit before passing them on to the handler
+func (c *Gateway) rateLimited(handler coap.Handler) coap.Handler {
+	return coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+		if !c.limiter.allow(r.Client.RemoteAddr().String()) {
+			requestLogger(r).Warn("rate limit exceeded", "peer", r.Client.RemoteAddr().String())
+			w.SetCode(codes.ServiceUnavailable)
+			writeResponse(w, []byte("rate limit exceeded"))
+			return
+		}
+		handler.ServeCOAP(w, r)
+	})
 }
 
-// Address returns in string form the address that it is listening on.
+// Address returns in string form the address that the first listener is listening on, the empty string if no
+// listener has been started.
 func (c *Gateway) Address() string {
-	if c.address == nil {
+	listeners := c.Listeners()
+	if len(listeners) == 0 {
 		return ""
 	}
-	return c.address.String()
+	return listeners[0].Address()
 }
 
 // handleResponse will write the response to the given writer if the response is not nil. It will also process the
 // response error and set the appropriate response code on the response writer.
-func handleResponse(response []byte, responseError error, successCode codes.Code, responseWriter coap.ResponseWriter) {
+func handleResponse(logger *slog.Logger, response []byte, responseError error, successCode codes.Code, responseWriter coap.ResponseWriter) {
 	if responseError == nil {
 		responseWriter.SetCode(successCode)
 		writeResponse(responseWriter, response)
-		debug.Logger.Println("response success: ", successCode.String())
+		logger.Debug("response success", "code", successCode.String())
 		return
 	}
 	var responseCode codes.Code
@@ -471,11 +586,11 @@ func handleResponse(response []byte, responseError error, successCode codes.Code
 	}
 	responseWriter.SetCode(responseCode)
 	writeResponse(responseWriter, response)
-	debug.Logger.Println("response failure: ", responseCode.String())
+	logger.Debug("response failure", "code", responseCode.String(), "error", responseError)
 }
 
 func writeResponse(w coap.ResponseWriter, response []byte) {
 	if _, err := w.Write(response); err != nil {
-		debug.Logger.Println(err)
+		debug.Log.Warn("unable to write response", "error", err)
 	}
 }
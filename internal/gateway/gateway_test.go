@@ -1,5 +1,5 @@
 /*
- * Copyright 2020 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -34,16 +34,13 @@ import (
 	"github.com/ForgeRock/iot-edge/v7/internal/mocks"
 	"github.com/ForgeRock/iot-edge/v7/internal/tokencache"
 	"github.com/go-ocf/go-coap"
-	"github.com/go-ocf/go-coap/net"
 	"github.com/pion/dtls/v2"
 )
 
 func testGateway(client *mocks.MockClient) *Gateway {
-	return &Gateway{
-		amConnection: client,
-		authCache:    tokencache.New(5*time.Minute, 10*time.Minute),
-	}
-
+	c := &Gateway{amConnection: client}
+	c.SetAuthCache(5*time.Minute, 10*time.Minute, 0)
+	return c
 }
 
 // check that the Auth Id Key is not sent to AM
@@ -59,11 +56,11 @@ func TestGateway_Authenticate_AuthIdKey_Is_Not_Sent(t *testing.T) {
 
 		}}
 	gateway := testGateway(mockClient)
-	reply, err := gateway.authenticate(client.AuthenticatePayload{})
+	reply, err := gateway.authenticate(nil, client.AuthenticatePayload{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = gateway.authenticate(reply)
+	_, err = gateway.authenticate(nil, reply)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -79,7 +76,7 @@ func TestGateway_Authenticate_AuthId_Is_Not_Returned(t *testing.T) {
 
 		}}
 	gateway := testGateway(mockClient)
-	reply, _ := gateway.authenticate(client.AuthenticatePayload{})
+	reply, _ := gateway.authenticate(nil, client.AuthenticatePayload{})
 	if reply.AuthId != "" {
 		t.Fatal("AuthId has been returned")
 	}
@@ -95,7 +92,7 @@ func TestGateway_Authenticate_AuthId_Is_Cached(t *testing.T) {
 
 		}}
 	gateway := testGateway(mockClient)
-	reply, _ := gateway.authenticate(client.AuthenticatePayload{})
+	reply, _ := gateway.authenticate(nil, client.AuthenticatePayload{})
 	id, ok := gateway.authCache.Get(reply.AuthIDKey)
 	if !ok {
 		t.Fatal("The authId has not been stored")
@@ -105,6 +102,36 @@ func TestGateway_Authenticate_AuthId_Is_Cached(t *testing.T) {
 	}
 }
 
+// check that an authentication journey started on one gateway can be continued on another that shares the auth store
+func TestGateway_Authenticate_Shared_Store(t *testing.T) {
+	authId := "12345"
+	// the file and Redis stores are shared between processes in the same way, see cmd/gateway/authstore
+	store := tokencache.New(5*time.Minute, 10*time.Minute)
+	first := testGateway(&mocks.MockClient{
+		AuthenticateFunc: func(_ client.AuthenticatePayload) (reply client.AuthenticatePayload, _ error) {
+			reply.AuthId = authId
+			return reply, nil
+		}})
+	first.SetAuthStore(store)
+	second := testGateway(&mocks.MockClient{
+		AuthenticateFunc: func(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, _ error) {
+			if payload.AuthId != authId {
+				return reply, fmt.Errorf("expected auth ID %s, got %s", authId, payload.AuthId)
+			}
+			reply.AuthId = "67890"
+			return reply, nil
+		}})
+	second.SetAuthStore(store)
+
+	reply, err := first.authenticate(nil, client.AuthenticatePayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = second.authenticate(nil, reply); err != nil {
+		t.Error(err)
+	}
+}
+
 func testDial(coapClient *coap.Client) error {
 	gateway := testGateway(&mocks.MockClient{})
 	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -406,10 +433,7 @@ func TestGatewayServer_Address(t *testing.T) {
 	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
 		t.Fatal(err)
 	}
-	l, ok := gateway.coapServer.Listener.(*net.DTLSListener)
-	if !ok {
-		t.Errorf("expected type *net.DTLSListener but got %T", gateway.coapServer.Listener)
-	}
+	l := gateway.listeners[0].listener
 	if gateway.Address() != l.Addr().String() {
 		t.Errorf("Expected CoAP address %s, got %s", l.Addr().String(), gateway.Address())
 
@@ -0,0 +1,288 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+	"github.com/ForgeRock/iot-edge/v7/internal/introspect"
+	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
+)
+
+// Introspection service design
+// Local resource servers, such as MQTT brokers, introspect the access tokens presented by things with the OAuth 2.0
+// Token Introspection endpoint (RFC 7662) served by the gateway instead of each embedding a thing of their own:
+//   POST /introspect   token=...&token_type_hint=access_token
+// Resource servers authenticate with HTTP basic client credentials or with a verified client certificate. Tokens are
+// introspected with the gateway thing's session, or locally with the JWKS known by the AM connection if AM can not
+// be reached. Active introspections are cached until the token expires.
+
+const (
+	introspectionShutdownTimeout = 5 * time.Second
+	// the maximum number of introspections held in the cache
+	introspectionCacheSize = 10000
+)
+
+var (
+	// ErrIntrospectionServerAlreadyStarted indicates that an introspection server has already been started by the
+	// IoT Gateway
+	ErrIntrospectionServerAlreadyStarted = errors.New("introspection server has already been started")
+	// ErrIntrospectionUnprotected is returned when the introspection server is started without client certificate
+	// verification or client credentials, or without TLS on an address that is not a loopback address
+	ErrIntrospectionUnprotected = errors.New("introspection server requires client certificate verification or " +
+		"client credentials, and TLS unless it is bound to a loopback address")
+)
+
+// cachedIntrospection is an introspection response that is valid until the token expires
+type cachedIntrospection struct {
+	response []byte
+	expiry   time.Time
+}
+
+// introspectionCache holds active introspection responses keyed by the hash of the token
+type introspectionCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]cachedIntrospection
+}
+
+func (c *introspectionCache) get(token string) ([]byte, bool) {
+	key := sha256.Sum256([]byte(token))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !clock.Clock().Before(entry.expiry) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.response, true
+}
+
+// add caches the introspection response if the token is active and has an expiry time
+func (c *introspectionCache) add(token string, response []byte) {
+	if !introspect.IsActive(response) {
+		return
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(response, &claims); err != nil || claims.Exp == 0 {
+		return
+	}
+	expiry := time.Unix(claims.Exp, 0)
+	now := clock.Clock()
+	if !now.Before(expiry) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[[sha256.Size]byte]cachedIntrospection)
+	}
+	if len(c.entries) >= introspectionCacheSize {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expiry) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= introspectionCacheSize {
+			return
+		}
+	}
+	c.entries[sha256.Sum256([]byte(token))] = cachedIntrospection{response: response, expiry: expiry}
+}
+
+// IntrospectToken introspects the access token on behalf of a local resource server and returns the RFC 7662
+// introspection response. The gateway thing's session is used to introspect the token with AM. If that fails, the
+// token is introspected locally if the AM connection supports it. Active introspections are cached until the token
+// expires.
+func (c *Gateway) IntrospectToken(token string) ([]byte, error) {
+	if b, ok := c.introspections.get(token); ok {
+		return b, nil
+	}
+	var b []byte
+	err := errors.New("the gateway has not been initialised")
+	if c.gatewayThing != nil {
+		var introspection thing.IntrospectionResponse
+		introspection, err = c.gatewayThing.IntrospectAccessToken(token)
+		if err == nil {
+			b, err = json.Marshal(introspection.Content)
+		}
+	}
+	if err != nil {
+		introspector, ok := c.connection().(client.LocalIntrospector)
+		if !ok {
+			return nil, err
+		}
+		debug.Log.Debug("introspecting token locally", "error", err)
+		payload, _ := json.Marshal(client.IntrospectPayload{Token: token})
+		if b, err = introspector.IntrospectAccessTokenLocally(client.ApplicationJSON, string(payload)); err != nil {
+			return nil, err
+		}
+	}
+	c.introspections.add(token, b)
+	return b, nil
+}
+
+// introspectionAPI serves the token introspection endpoint
+type introspectionAPI struct {
+	gateway *Gateway
+	// client secrets keyed by client ID
+	clients map[string]string
+}
+
+// authorised returns true if the request presented a verified client certificate or valid client credentials
+func (a introspectionAPI) authorised(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	expected, ok := a.clients[id]
+	return ok && expected != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) == 1
+}
+
+// writeIntrospectionError writes an OAuth 2.0 error response
+func writeIntrospectionError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{Error: code})
+}
+
+func (a introspectionAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := debug.Log.With("method", r.Method, "path", r.URL.Path)
+	if r.URL.Path != "/introspect" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorised(r) {
+		logger.Warn("unauthorised introspection request", "remote", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspection"`)
+		writeIntrospectionError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeIntrospectionError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeIntrospectionError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	// the token type hint is ignored since only access tokens can be introspected
+	b, err := a.gateway.IntrospectToken(token)
+	if err != nil {
+		logger.Warn("unable to introspect token", "error", err)
+		writeIntrospectionError(w, http.StatusServiceUnavailable, "temporarily_unavailable")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err = w.Write(b); err != nil {
+		logger.Warn("unable to write introspection response", "error", err)
+	}
+}
+
+// IntrospectionHandler returns the handler of the token introspection endpoint. A request is authorised if it
+// presents a client certificate that has been verified by the TLS server or if it presents the credentials of one of
+// the clients, given as secrets keyed by client ID, with HTTP basic authentication.
+func (c *Gateway) IntrospectionHandler(clients map[string]string) http.Handler {
+	return introspectionAPI{gateway: c, clients: clients}
+}
+
+// StartIntrospectionServer starts the token introspection server on the given TCP address. The server uses TLS if
+// tlsConfig is not nil. Either tlsConfig must require and verify client certificates or client credentials must be
+// given. Client credentials are only accepted in cleartext if the server is bound to a loopback address, so tlsConfig
+// can only be nil for a loopback address.
+func (c *Gateway) StartIntrospectionServer(address string, tlsConfig *tls.Config, clients map[string]string) error {
+	if c.introspectionServer != nil {
+		return ErrIntrospectionServerAlreadyStarted
+	}
+	if len(clients) == 0 && (tlsConfig == nil || tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert) {
+		return ErrIntrospectionUnprotected
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	// the address is checked once bound since host names and unspecified addresses are resolved by then
+	if tcpAddr, ok := l.Addr().(*net.TCPAddr); tlsConfig == nil && (!ok || !tcpAddr.IP.IsLoopback()) {
+		_ = l.Close()
+		return ErrIntrospectionUnprotected
+	}
+	c.introspectionAddress = l.Addr()
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	c.introspectionChan = make(chan error, 1)
+	c.introspectionServer = &http.Server{
+		Handler:           c.IntrospectionHandler(clients),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func(server *http.Server) {
+		c.introspectionChan <- server.Serve(l)
+	}(c.introspectionServer)
+	return nil
+}
+
+// ShutdownIntrospectionServer gracefully shuts the token introspection server down
+func (c *Gateway) ShutdownIntrospectionServer() {
+	if c.introspectionServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), introspectionShutdownTimeout)
+	defer cancel()
+	if err := c.introspectionServer.Shutdown(ctx); err != nil {
+		debug.Log.Error("introspection server shutdown failed", "error", err)
+	}
+	<-c.introspectionChan
+	c.introspectionServer = nil
+	c.introspectionAddress = nil
+}
+
+// IntrospectionAddress returns in string form the address that the introspection server is listening on.
+func (c *Gateway) IntrospectionAddress() string {
+	if c.introspectionAddress == nil {
+		return ""
+	}
+	return c.introspectionAddress.String()
+}
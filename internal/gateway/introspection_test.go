@@ -0,0 +1,165 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
+)
+
+// fakeIntrospectingThing is a gateway thing that introspects tokens named active, inactive and unavailable
+type fakeIntrospectingThing struct {
+	thing.Thing
+	calls atomic.Int32
+}
+
+func (t *fakeIntrospectingThing) IntrospectAccessToken(token string) (thing.IntrospectionResponse, error) {
+	t.calls.Add(1)
+	switch token {
+	case "active":
+		exp := clock.Clock().Add(time.Minute).Unix()
+		return thing.IntrospectionResponse{Content: thing.JSONContent{"active": true, "exp": exp}}, nil
+	case "unavailable":
+		return thing.IntrospectionResponse{}, errors.New("AM is unavailable")
+	default:
+		return thing.IntrospectionResponse{Content: thing.JSONContent{"active": false}}, nil
+	}
+}
+
+func TestGateway_Introspection(t *testing.T) {
+	advance := fakeClock(t)
+	am := newFakeAM()
+	gateway := testGateway(&am.MockClient)
+	gateway.amConnection = am
+	gatewayThing := &fakeIntrospectingThing{}
+	gateway.gatewayThing = gatewayThing
+	if err := gateway.StartIntrospectionServer("localhost:0", nil, map[string]string{"broker": "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(gateway.ShutdownIntrospectionServer)
+	endpoint := fmt.Sprintf("http://%s/introspect", gateway.IntrospectionAddress())
+
+	introspectToken := func(method, user, password string, form url.Values) (int, map[string]interface{}) {
+		request, err := http.NewRequest(method, endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if user != "" {
+			request.SetBasicAuth(user, password)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		b, _ := io.ReadAll(response.Body)
+		var body map[string]interface{}
+		_ = json.Unmarshal(b, &body)
+		return response.StatusCode, body
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		user     string
+		password string
+		token    string
+		code     int
+		expected map[string]interface{}
+	}{
+		{name: "no-credentials", method: http.MethodPost, token: "active", code: http.StatusUnauthorized,
+			expected: map[string]interface{}{"error": "invalid_client"}},
+		{name: "wrong-secret", method: http.MethodPost, user: "broker", password: "wrong", token: "active",
+			code: http.StatusUnauthorized, expected: map[string]interface{}{"error": "invalid_client"}},
+		{name: "get", method: http.MethodGet, user: "broker", password: "secret", token: "active",
+			code: http.StatusMethodNotAllowed},
+		{name: "no-token", method: http.MethodPost, user: "broker", password: "secret",
+			code: http.StatusBadRequest, expected: map[string]interface{}{"error": "invalid_request"}},
+		{name: "inactive", method: http.MethodPost, user: "broker", password: "secret", token: "inactive",
+			code: http.StatusOK, expected: map[string]interface{}{"active": false}},
+		{name: "local", method: http.MethodPost, user: "broker", password: "secret", token: "unavailable",
+			code: http.StatusOK, expected: map[string]interface{}{"active": true, "local": true}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			form := url.Values{}
+			if subtest.token != "" {
+				form.Set("token", subtest.token)
+			}
+			code, body := introspectToken(subtest.method, subtest.user, subtest.password, form)
+			if code != subtest.code {
+				t.Errorf("expected code %d, got %d", subtest.code, code)
+			}
+			if subtest.expected != nil && fmt.Sprint(body) != fmt.Sprint(subtest.expected) {
+				t.Errorf("expected %v, got %v", subtest.expected, body)
+			}
+		})
+	}
+
+	t.Run("cached-until-expiry", func(t *testing.T) {
+		form := url.Values{"token": {"active"}, "token_type_hint": {"access_token"}}
+		calls := gatewayThing.calls.Load()
+		for i := 0; i < 2; i++ {
+			code, body := introspectToken(http.MethodPost, "broker", "secret", form)
+			if code != http.StatusOK || body["active"] != true {
+				t.Fatalf("unexpected response %d %v", code, body)
+			}
+		}
+		if gatewayThing.calls.Load() != calls+1 {
+			t.Errorf("expected the introspection to be cached")
+		}
+		advance(time.Minute)
+		introspectToken(http.MethodPost, "broker", "secret", form)
+		if gatewayThing.calls.Load() != calls+2 {
+			t.Errorf("expected the token to be introspected again once expired")
+		}
+	})
+}
+
+func TestGateway_StartIntrospectionServer(t *testing.T) {
+	gateway := testGateway(&newFakeAM().MockClient)
+	err := gateway.StartIntrospectionServer("localhost:0", &tls.Config{}, nil)
+	if !errors.Is(err, ErrIntrospectionUnprotected) {
+		t.Errorf("expected %v, got %v", ErrIntrospectionUnprotected, err)
+	}
+	// credentials are not accepted in cleartext on addresses that can be reached from other hosts
+	err = gateway.StartIntrospectionServer(":0", nil, map[string]string{"broker": "secret"})
+	if !errors.Is(err, ErrIntrospectionUnprotected) {
+		t.Errorf("expected %v without TLS, got %v", ErrIntrospectionUnprotected, err)
+	}
+	if err = gateway.StartIntrospectionServer("localhost:0", nil, map[string]string{"broker": "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownIntrospectionServer()
+	err = gateway.StartIntrospectionServer("localhost:0", nil, map[string]string{"broker": "secret"})
+	if !errors.Is(err, ErrIntrospectionServerAlreadyStarted) {
+		t.Errorf("expected %v, got %v", ErrIntrospectionServerAlreadyStarted, err)
+	}
+}
@@ -0,0 +1,317 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	frcrypto "github.com/ForgeRock/iot-edge/v7/internal/crypto"
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
+	"github.com/go-ocf/go-coap"
+	"github.com/pion/dtls/v2"
+)
+
+// SecurityMode is the DTLS security mode of a CoAP listener
+type SecurityMode int
+
+const (
+	// SecurityAnyCertificate requires things to present a certificate in the DTLS handshake but does not verify it
+	// since things are authenticated by AM. This is the default mode.
+	SecurityAnyCertificate SecurityMode = iota
+	// SecurityVerifiedCertificate requires things to present a certificate issued by one of the client CAs of the
+	// listener in the DTLS handshake
+	SecurityVerifiedCertificate
+)
+
+func (m SecurityMode) String() string {
+	switch m {
+	case SecurityAnyCertificate:
+		return "any_certificate"
+	case SecurityVerifiedCertificate:
+		return "verified_certificate"
+	default:
+		return fmt.Sprintf("SecurityMode(%d)", int(m))
+	}
+}
+
+// ListenerConfig describes a CoAP listener of the gateway
+type ListenerConfig struct {
+	// the UDP address to listen on, for example :5684, 192.168.1.10:5684 or [fd00::1]:5684
+	Address string
+	// the key of the DTLS identity of the listener
+	Key crypto.Signer
+	// the certificate chain of the DTLS identity, a self-signed certificate is created for the key if not set
+	Certificates []*x509.Certificate
+	Security     SecurityMode
+	// the CA certificates used to verify the certificates of things in the SecurityVerifiedCertificate mode
+	ClientCAs *x509.CertPool
+}
+
+// dtlsConfig returns the DTLS configuration of the listener
+func (l ListenerConfig) dtlsConfig() (*dtls.Config, error) {
+	if l.Key == nil {
+		return nil, jws.ErrMissingSigner
+	}
+	var cert tls.Certificate
+	if len(l.Certificates) == 0 {
+		var err error
+		if cert, err = frcrypto.PublicKeyCertificate(l.Key); err != nil {
+			return nil, err
+		}
+	} else {
+		cert.PrivateKey = l.Key
+		for _, c := range l.Certificates {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+	}
+	config := dtlsServerConfig(cert)
+	switch l.Security {
+	case SecurityAnyCertificate:
+	case SecurityVerifiedCertificate:
+		if l.ClientCAs == nil {
+			return nil, fmt.Errorf("security mode %s requires client CAs", l.Security)
+		}
+		config.ClientAuth = dtls.RequireAndVerifyClientCert
+		config.ClientCAs = l.ClientCAs
+	default:
+		return nil, fmt.Errorf("unknown security mode %s", l.Security)
+	}
+	return config, nil
+}
+
+// Listener is a CoAP listener of the gateway. Each listener has its own DTLS identity and can be shut down
+// independently of the other listeners.
+type Listener struct {
+	gateway *Gateway
+	// accepts DTLS connections, each connection is served by its own CoAP server so that the certificate presented by
+	// the peer in the handshake is known
+	listener net.Listener
+	handler  coap.Handler
+	address  net.Addr
+	// tracks the requests received by the listener so that they can complete on shutdown
+	drain drainer
+	// the connections that are being served, guarded by mu
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	// the accept loop and the connection servers
+	serving sync.WaitGroup
+}
+
+// Address returns in string form the address that the listener is listening on.
+func (l *Listener) Address() string {
+	return l.address.String()
+}
+
+// Shutdown gracefully shuts the listener down. New requests to the listener are rejected with 5.03 (Service
+// Unavailable) while the requests that are being handled are given until the context is done to complete. The
+// context error is returned if requests were cut off.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	if !l.gateway.removeListener(l) {
+		return nil
+	}
+	return l.gateway.shutdownListeners(ctx, []*Listener{l})
+}
+
+// accept serves the connections accepted by the listener until it is closed
+func (l *Listener) accept() {
+	defer l.serving.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if closed {
+				return
+			}
+			// the handshake with the peer failed
+			debug.Log.Debug("DTLS connection not accepted", "address", l.Address(), "error", err)
+			continue
+		}
+		l.serve(conn)
+	}
+}
+
+// serve the connection with a CoAP server until the connection or listener is closed
+func (l *Listener) serve(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		_ = conn.Close()
+		return
+	}
+	peers := &l.gateway.peers
+	address := conn.RemoteAddr().String()
+	if dtlsConn, ok := conn.(*dtls.Conn); ok {
+		if certs := dtlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			if cert, err := x509.ParseCertificate(certs[0]); err == nil {
+				peers.handshake(address, cert)
+			}
+		}
+	}
+	server := &coap.Server{
+		Conn:      conn,
+		Net:       "udp-dtls",
+		Handler:   l.handler,
+		HeartBeat: heartBeat,
+		NotifySessionEndFunc: func(w *coap.ClientConn, err error) {
+			peers.ended(address)
+		},
+	}
+	l.conns[conn] = struct{}{}
+	l.serving.Add(1)
+	go func() {
+		defer l.serving.Done()
+		_ = server.ActivateAndServe()
+		_ = conn.Close()
+		peers.ended(address)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.conns, conn)
+	}()
+}
+
+// close stops the listener accepting connections, closes the connections that are being served and waits for their
+// servers to stop
+func (l *Listener) close() error {
+	l.mu.Lock()
+	l.closed = true
+	err := l.listener.Close()
+	for conn := range l.conns {
+		_ = conn.Close()
+	}
+	l.mu.Unlock()
+	l.serving.Wait()
+	return err
+}
+
+// serveMux returns a multiplexer that routes requests to the CoAP resources of the gateway
+func (c *Gateway) serveMux() *coap.ServeMux {
+	mux := coap.NewServeMux()
+	resources := c.resources()
+	for _, res := range resources {
+		mux.HandleFunc(res.link.Target, res.handler)
+		if res.subresources {
+			mux.HandleFunc(res.link.Target+"/", res.handler)
+		}
+	}
+	mux.HandleFunc(client.WellKnownCore, wellKnownCoreHandler(resources))
+	return mux
+}
+
+// StartListener starts a CoAP listener. The gateway can listen on several addresses, including IPv6 addresses, at
+// the same time.
+func (c *Gateway) StartListener(config ListenerConfig) (*Listener, error) {
+	dtlsConfig, err := config.dtlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	address, err := net.ResolveUDPAddr("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	l, err := dtls.Listen("udp", address, dtlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	listener := &Listener{
+		gateway:  c,
+		listener: l,
+		address:  l.Addr(),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	listener.handler = c.exchanged(listener.drain.draining(c.rateLimited(c.intercepted(c.serveMux()))))
+	listener.serving.Add(1)
+	go listener.accept()
+
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	c.listeners = append(c.listeners, listener)
+	debug.Log.Info("CoAP listener started", "address", listener.Address(), "security", config.Security.String())
+	return listener, nil
+}
+
+// Listeners returns the CoAP listeners of the gateway in the order that they were started
+func (c *Gateway) Listeners() []*Listener {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	return append([]*Listener(nil), c.listeners...)
+}
+
+// removeListener removes the listener from the gateway, returns false if it had already been removed
+func (c *Gateway) removeListener(listener *Listener) bool {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	for i, l := range c.listeners {
+		if l == listener {
+			c.listeners = append(c.listeners[:i], c.listeners[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// removeListeners removes all the listeners from the gateway and returns them
+func (c *Gateway) removeListeners() []*Listener {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	listeners := c.listeners
+	c.listeners = nil
+	return listeners
+}
+
+// shutdownListeners waits for the requests that are being handled by the listeners to complete, or for the context
+// to be done, and then shuts the listeners down
+func (c *Gateway) shutdownListeners(ctx context.Context, listeners []*Listener) error {
+	idle := make([]<-chan struct{}, len(listeners))
+	for i, l := range listeners {
+		idle[i] = l.drain.close()
+	}
+	var drainErr error
+	for _, ch := range idle {
+		select {
+		case <-ch:
+			continue
+		case <-ctx.Done():
+			drainErr = ctx.Err()
+			debug.Log.Warn("shutdown deadline reached before all requests completed", "error", drainErr)
+		}
+		break
+	}
+	errs := []error{drainErr}
+	for _, l := range listeners {
+		if err := l.close(); err != nil {
+			debug.Log.Error("CoAP listener shutdown failed", "address", l.Address(), "error", err)
+			errs = append(errs, err)
+		}
+	}
+	if len(c.Listeners()) == 0 {
+		c.background.Wait()
+		c.peers.reset()
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	frcrypto "github.com/ForgeRock/iot-edge/v7/internal/crypto"
+	"github.com/ForgeRock/iot-edge/v7/internal/mocks"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// dialListener dials the listener with a client certificate and fetches the gateway's resource links
+func dialListener(listener *Listener, cert tls.Certificate) (coap.Message, error) {
+	coapClient := &coap.Client{Net: "udp-dtls", DTLSConfig: dtlsClientConfig(cert)}
+	conn, err := coapClient.Dial(listener.Address())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Get(client.WellKnownCore)
+}
+
+func TestGateway_StartListener(t *testing.T) {
+	gateway := testGateway(&mocks.MockClient{})
+	t.Cleanup(gateway.ShutdownCOAPServer)
+
+	addresses := []string{"127.0.0.1:0", "[::1]:0"}
+	var listeners []*Listener
+	for _, address := range addresses {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		listener, err := gateway.StartListener(ListenerConfig{Address: address, Key: key})
+		if err != nil && strings.HasPrefix(address, "[") {
+			t.Logf("IPv6 is not available: %v", err)
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(gateway.Listeners()) != len(listeners) {
+		t.Fatalf("expected %d listeners, got %d", len(listeners), len(gateway.Listeners()))
+	}
+	if gateway.Address() != listeners[0].Address() {
+		t.Errorf("expected the gateway address %s, got %s", listeners[0].Address(), gateway.Address())
+	}
+	if err := gateway.StartCOAPServer(":0", nil); err != ErrCOAPServerAlreadyStarted {
+		t.Errorf("expected %v, got %v", ErrCOAPServerAlreadyStarted, err)
+	}
+
+	thingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert, _ := frcrypto.PublicKeyCertificate(thingKey)
+	for _, listener := range listeners {
+		response, err := dialListener(listener, cert)
+		if err != nil {
+			t.Fatalf("%s: %v", listener.Address(), err)
+		}
+		checkResponse(t, response, codes.Content, false)
+	}
+
+	// the remaining listeners keep serving after one is shut down
+	if err := listeners[0].Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := listeners[0].Shutdown(context.Background()); err != nil {
+		t.Errorf("expected a repeated shutdown to succeed, got %v", err)
+	}
+	if len(gateway.Listeners()) != len(listeners)-1 {
+		t.Errorf("expected %d listeners, got %d", len(listeners)-1, len(gateway.Listeners()))
+	}
+	for _, listener := range listeners[1:] {
+		response, err := dialListener(listener, cert)
+		if err != nil {
+			t.Fatalf("%s: %v", listener.Address(), err)
+		}
+		checkResponse(t, response, codes.Content, false)
+	}
+}
+
+// testCA creates a certificate authority and a certificate issued by it for a new key
+func testCA(t *testing.T) (pool *x509.CertPool, issued tls.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	pool = x509.NewCertPool()
+	pool.AddCert(ca)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "thing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestGateway_StartListener_VerifiedCertificate(t *testing.T) {
+	gateway := testGateway(&mocks.MockClient{})
+	t.Cleanup(gateway.ShutdownCOAPServer)
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	_, err := gateway.StartListener(ListenerConfig{Address: ":0", Key: serverKey, Security: SecurityVerifiedCertificate})
+	if err == nil {
+		t.Error("expected an error when the client CAs are missing")
+	}
+
+	pool, issued := testCA(t)
+	listener, err := gateway.StartListener(ListenerConfig{
+		Address:   ":0",
+		Key:       serverKey,
+		Security:  SecurityVerifiedCertificate,
+		ClientCAs: pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := dialListener(listener, issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResponse(t, response, codes.Content, false)
+
+	thingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	selfSigned, _ := frcrypto.PublicKeyCertificate(thingKey)
+	if _, err = dialListener(listener, selfSigned); err == nil {
+		t.Error("expected a self-signed certificate to be rejected")
+	}
+}
@@ -0,0 +1,313 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
+	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Middleware design
+// Each request received by the CoAP server is described by an Exchange that is passed through the chain of
+// middleware added with Gateway.Use before it reaches the endpoint handler. The gateway's own rate limiting and
+// shutdown draining run before the chain, so middleware only sees requests that will be handled.
+// Requests made with the session of a thing are decoded once, when the exchange is created. The gateway's own
+// middleware at the start of the chain rejects requests that can not be decoded or fail the proof of possession check,
+// so the identity of the thing has been verified by the time the exchange reaches the middleware and the handlers.
+
+// ThingIdentity is the identity of the thing that made a request, as far as the gateway knows it. The identity is taken
+// from the JWTs that the thing authenticated with and has not been verified by AM when an authentication request is
+// received. Fields are empty if they are not known.
+type ThingIdentity struct {
+	ID   string
+	Type callback.ThingType
+	// the RFC 7638 thumbprint of the thing's confirmation key
+	KeyThumbprint string
+}
+
+// Exchange describes a request received by the CoAP server and its outcome
+type Exchange struct {
+	// the time that the request was received
+	Time time.Time
+	// the path of the endpoint without the leading slash, for example accesstoken
+	Endpoint string
+	Query    []string
+	// the address of the DTLS peer
+	Peer string
+	// the certificate that the DTLS peer presented in the handshake, nil if it is not known
+	PeerCertificate *x509.Certificate
+	Payload         []byte
+	Thing           ThingIdentity
+	// the name of the route that the request is sent to, empty if it is sent to the AM connection that the gateway was
+	// created with
+	Route string
+	// the response code, zero until a response has been written
+	Code codes.Code
+
+	writer  coap.ResponseWriter
+	request *coap.Request
+	route   *route
+	logger  *slog.Logger
+	// the request made with the session of a thing, decodeErr is set if the request could not be decoded
+	session   sessionRequest
+	decodeErr error
+	// the scopes granted by the request, used by the audit log
+	scopes []string
+}
+
+// Context returns the context of the request
+func (e *Exchange) Context() context.Context {
+	return e.request.Ctx
+}
+
+// Respond writes the response to the exchange. Middleware uses it to reject a request without calling the next
+// handler.
+func (e *Exchange) Respond(code codes.Code, payload []byte) {
+	e.writer.SetCode(code)
+	writeResponse(e.writer, payload)
+}
+
+// ExchangeHandler handles an exchange
+type ExchangeHandler func(e *Exchange)
+
+// Middleware wraps the handler of an exchange. It can inspect the exchange before calling next, respond without
+// calling next to reject the request and inspect the response code once next has returned.
+type Middleware func(next ExchangeHandler) ExchangeHandler
+
+// Use adds middleware to the chain that wraps the CoAP endpoint handlers. Middleware is called in the order it is
+// added, after the gateway has rejected requests that fail the proof of possession check. It must be added before the
+// CoAP server is started.
+func (c *Gateway) Use(middleware ...Middleware) {
+	c.middleware = append(c.middleware, middleware...)
+}
+
+// exchangeWriter records the outcome of a request in its exchange
+type exchangeWriter struct {
+	coap.ResponseWriter
+	exchange *Exchange
+}
+
+func (w *exchangeWriter) SetCode(code codes.Code) {
+	w.exchange.Code = code
+	w.ResponseWriter.SetCode(code)
+}
+
+// setDefaultCode records the code that is used when a response is written without setting a code
+func (w *exchangeWriter) setDefaultCode() {
+	if w.exchange.Code != 0 {
+		return
+	}
+	if w.exchange.request.Msg.Code() == codes.GET {
+		w.exchange.Code = codes.Content
+	} else {
+		w.exchange.Code = codes.Changed
+	}
+}
+
+func (w *exchangeWriter) Write(p []byte) (int, error) {
+	w.setDefaultCode()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *exchangeWriter) WriteWithContext(ctx context.Context, p []byte) (int, error) {
+	w.setDefaultCode()
+	return w.ResponseWriter.WriteWithContext(ctx, p)
+}
+
+func (w *exchangeWriter) WriteMsg(msg coap.Message) error {
+	w.exchange.Code = msg.Code()
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+func (w *exchangeWriter) WriteMsgWithContext(ctx context.Context, msg coap.Message) error {
+	w.exchange.Code = msg.Code()
+	return w.ResponseWriter.WriteMsgWithContext(ctx, msg)
+}
+
+// exchangeOf returns the exchange that the writer records the outcome of, nil if it is not an exchange writer
+func exchangeOf(w coap.ResponseWriter) *Exchange {
+	if ew, ok := w.(*exchangeWriter); ok {
+		return ew.exchange
+	}
+	return nil
+}
+
+// identityFromCallbacks returns the unverified identity found in the first signed JWT in the callback inputs
+func identityFromCallbacks(callbacks []callback.Callback) (identity ThingIdentity) {
+	for _, cb := range callbacks {
+		for _, e := range cb.Input {
+			token, ok := e.Value.(string)
+			if !ok {
+				continue
+			}
+			var claims struct {
+				Sub       string             `json:"sub"`
+				ThingType callback.ThingType `json:"thingType"`
+				CNF       struct {
+					JWK *jose.JSONWebKey `json:"jwk"`
+				} `json:"cnf"`
+			}
+			if err := jws.ExtractClaims(token, &claims); err == nil && claims.Sub != "" {
+				return ThingIdentity{ID: claims.Sub, Type: claims.ThingType, KeyThumbprint: keyThumbprint(claims.CNF.JWK)}
+			}
+		}
+	}
+	return identity
+}
+
+// identify sets the identity of the thing that made the request, using the JWTs in an authentication request, the
+// child thing that the request is made on behalf of or the session that other requests are made with
+func (c *Gateway) identify(e *Exchange) {
+	if e.Endpoint == "authenticate" {
+		var auth client.AuthenticatePayload
+		if err := json.Unmarshal(e.Payload, &auth); err == nil {
+			e.Thing = identityFromCallbacks(auth.Callbacks)
+		}
+		return
+	}
+	if childID, ok := strings.CutPrefix(e.Endpoint, "children/"); ok {
+		childID, _, _ = strings.Cut(childID, "/")
+		if identity, ok := c.childIdentity(childID); ok {
+			e.Thing = identity
+		}
+		return
+	}
+	if e.session.token == "" {
+		return
+	}
+	if identity, ok := c.pop.identity(e.session.token); ok {
+		e.Thing = identity
+	}
+}
+
+// identifySession sets the identity of the thing that the session was issued to in the exchange of the request
+func (c *Gateway) identifySession(w coap.ResponseWriter, tokenID string) {
+	e := exchangeOf(w)
+	if e == nil {
+		return
+	}
+	if identity, ok := c.pop.identity(tokenID); ok {
+		e.Thing = identity
+	}
+}
+
+// newExchange describes the request with an exchange and wraps the writer so that it records the outcome
+func (c *Gateway) newExchange(w coap.ResponseWriter, r *coap.Request) *Exchange {
+	peer := r.Client.RemoteAddr().String()
+	cert := c.peers.certificate(peer)
+	// the route is matched first since it can rewrite the path and query of the request
+	rt := c.matchRoute(r, cert)
+	var query []string
+	for _, q := range r.Msg.Query() {
+		if q != "" {
+			query = append(query, q)
+		}
+	}
+	e := &Exchange{
+		Time:            clock.Clock(),
+		Endpoint:        strings.TrimPrefix(r.Msg.PathString(), "/"),
+		Query:           query,
+		Peer:            peer,
+		PeerCertificate: cert,
+		Payload:         r.Msg.Payload(),
+		request:         r,
+		logger:          requestLogger(r),
+	}
+	e.session, e.decodeErr = decodeRequest(e.Endpoint, r.Msg)
+	if rt == nil {
+		rt = c.sessionRoute(e.session.token)
+	}
+	if rt != nil {
+		e.route = rt
+		e.Route = rt.Name
+	}
+	c.identify(e)
+	e.writer = &exchangeWriter{ResponseWriter: w, exchange: e}
+	return e
+}
+
+// exchanged describes each request with an exchange, records the thing that made the request in the peer tracker and
+// the outcome in the audit log
+func (c *Gateway) exchanged(handler coap.Handler) coap.Handler {
+	return coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+		e := c.newExchange(w, r)
+		handler.ServeCOAP(e.writer, r)
+		c.peers.seen(r.Client, e.Thing.ID)
+		c.audit(e)
+	})
+}
+
+// verified rejects requests made with the session of a thing that can not be decoded or fail the proof of possession
+// check
+func (c *Gateway) verified(next ExchangeHandler) ExchangeHandler {
+	return func(e *Exchange) {
+		if e.decodeErr != nil {
+			e.logger.Warn("unable to decode request", "error", e.decodeErr)
+			e.Respond(codes.BadRequest, []byte(e.decodeErr.Error()))
+			return
+		}
+		if !c.checkPoP(e) {
+			return
+		}
+		next(e)
+	}
+}
+
+// intercepted passes each request through the gateway's own middleware and the middleware chain before handing it to
+// the handler
+func (c *Gateway) intercepted(handler coap.Handler) coap.Handler {
+	return coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+		e := exchangeOf(w)
+		if e == nil {
+			e = c.newExchange(w, r)
+		}
+		next := func(e *Exchange) {
+			handler.ServeCOAP(e.writer, e.request)
+		}
+		for i := len(c.middleware) - 1; i >= 0; i-- {
+			next = c.middleware[i](next)
+		}
+		c.verified(next)(e)
+	})
+}
+
+// endpoint adapts an exchange handler so that it can be registered with the CoAP server
+func endpoint(handler ExchangeHandler) func(w coap.ResponseWriter, r *coap.Request) {
+	return func(w coap.ResponseWriter, r *coap.Request) {
+		e := exchangeOf(w)
+		if e == nil {
+			// requests always reach the handlers through intercepted, which describes them with an exchange
+			w.SetCode(codes.InternalServerError)
+			writeResponse(w, nil)
+			return
+		}
+		e.logger.Debug("handling request")
+		handler(e)
+	}
+}
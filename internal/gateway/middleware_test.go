@@ -0,0 +1,130 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+func TestGateway_Middleware(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	am := newFakeAM()
+	am.AMInfoSet = popAMInfo
+	am.AuthenticateFunc = func(client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+		reply.TokenID = "12345"
+		return reply, nil
+	}
+	var userCodes atomic.Int32
+	am.UserCodeFunc = func(string, string) ([]byte, error) {
+		userCodes.Add(1)
+		return []byte("{}"), nil
+	}
+	gateway := testGateway(&am.MockClient)
+	gateway.amConnection = am
+
+	var mu sync.Mutex
+	var calls []string
+	var exchanges []Exchange
+	gateway.Use(
+		func(next ExchangeHandler) ExchangeHandler {
+			return func(e *Exchange) {
+				mu.Lock()
+				calls = append(calls, "first")
+				mu.Unlock()
+				next(e)
+				mu.Lock()
+				exchanges = append(exchanges, *e)
+				mu.Unlock()
+			}
+		},
+		// block devices from requesting user codes
+		func(next ExchangeHandler) ExchangeHandler {
+			return func(e *Exchange) {
+				mu.Lock()
+				calls = append(calls, "second")
+				mu.Unlock()
+				if e.Endpoint == "usercode" && e.Thing.Type == callback.TypeDevice {
+					e.Respond(codes.Forbidden, []byte("devices can not request user codes"))
+					return
+				}
+				next(e)
+			}
+		})
+	conn := startAndDial(t, gateway)
+
+	cb := callback.Callback{
+		Type:   callback.TypeHiddenValueCallback,
+		Output: []callback.Entry{{Name: "value", Value: "challenge"}, {Name: "id", Value: "jwt-pop-registration"}},
+		Input:  []callback.Entry{{Name: "IDToken1", Value: ""}},
+	}
+	handler := callback.RegisterHandler{ThingID: "thing-1", ThingType: callback.TypeDevice, KeyID: "pop.cnf", Key: key}
+	if _, err := handler.Handle(cb); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gateway.authenticate(nil, client.AuthenticatePayload{Callbacks: []callback.Callback{cb}}); err != nil {
+		t.Fatal(err)
+	}
+
+	signedJWT := signPoP(t, key, popAMInfo.UserCodeURL, popAMInfo.ThingsVersion, 0, "12345")
+	checkResponse(t, postJWS(t, conn, "/usercode", "", signedJWT), codes.Forbidden, false)
+	if userCodes.Load() != 0 {
+		t.Error("expected the request to be blocked before it reached AM")
+	}
+	// the blocked request has been verified so its nonce has been used
+	signedJWT = signPoP(t, key, popAMInfo.AccessTokenURL, popAMInfo.ThingsVersion, 1, "12345")
+	checkResponse(t, postJWS(t, conn, "/accesstoken", "", signedJWT), codes.Changed, false)
+	// requests that fail the proof of possession check do not reach the middleware
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signedJWT = signPoP(t, otherKey, popAMInfo.AccessTokenURL, popAMInfo.ThingsVersion, 2, "12345")
+	checkResponse(t, postJWS(t, conn, "/accesstoken", "", signedJWT), codes.Unauthorized, false)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 4 || calls[0] != "first" || calls[1] != "second" {
+		t.Errorf("unexpected middleware calls %v", calls)
+	}
+	if len(exchanges) != 2 {
+		t.Fatalf("expected 2 exchanges, got %d", len(exchanges))
+	}
+	expected := []struct {
+		endpoint string
+		code     codes.Code
+	}{
+		{endpoint: "usercode", code: codes.Forbidden},
+		{endpoint: "accesstoken", code: codes.Changed},
+	}
+	for i, e := range exchanges {
+		if e.Endpoint != expected[i].endpoint || e.Code != expected[i].code {
+			t.Errorf("expected %s %v, got %s %v", expected[i].endpoint, expected[i].code, e.Endpoint, e.Code)
+		}
+		if e.Thing.ID != "thing-1" || e.Thing.Type != callback.TypeDevice || e.Thing.KeyThumbprint == "" {
+			t.Errorf("unexpected identity %+v", e.Thing)
+		}
+		if e.Peer == "" || len(e.Payload) == 0 {
+			t.Errorf("unexpected exchange %+v", e)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+const (
+	// maxCachedResponses is the number of cached responses kept before stale responses are pruned
+	maxCachedResponses = 4096
+	// maxQueuedLogouts is the maximum number of logouts held for replay, the oldest are dropped first
+	maxQueuedLogouts = 1024
+	// defaultRetryInterval is the default time between attempts to reach AM while the gateway is offline
+	defaultRetryInterval = 10 * time.Second
+)
+
+// cachedResponse is a response from AM that can be served while AM is unavailable
+type cachedResponse struct {
+	body   []byte
+	stored time.Time
+}
+
+// queuedLogout is a logout request received while AM was unavailable
+type queuedLogout struct {
+	token   string
+	content client.ContentType
+	payload string
+}
+
+// offlineMode holds the state used to serve things while AM can not be reached
+type offlineMode struct {
+	mu sync.Mutex
+	// the maximum age of the data used to serve requests while offline, zero disables offline mode
+	maxStaleness  time.Duration
+	retryInterval time.Duration
+	offline       bool
+	probing       bool
+	lastContact   time.Time
+	lastAttempt   time.Time
+	attributes    map[string]cachedResponse
+	// session tokens that have been logged out while offline
+	revoked map[string]bool
+	logouts []queuedLogout
+}
+
+// set the maximum staleness and retry interval
+func (o *offlineMode) set(maxStaleness, retryInterval time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if retryInterval <= 0 {
+		retryInterval = defaultRetryInterval
+	}
+	o.maxStaleness = maxStaleness
+	o.retryInterval = retryInterval
+	if o.attributes == nil {
+		o.attributes = make(map[string]cachedResponse)
+		o.revoked = make(map[string]bool)
+	}
+	if maxStaleness <= 0 {
+		o.offline = false
+		o.attributes = make(map[string]cachedResponse)
+	}
+}
+
+// enabled returns true if offline mode has been switched on
+func (o *offlineMode) enabled() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.maxStaleness > 0
+}
+
+// isOffline returns true if AM could not be reached on the last attempt
+func (o *offlineMode) isOffline() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.offline
+}
+
+// contacted records a successful exchange with AM and returns true if the gateway was offline
+func (o *offlineMode) contacted() (wasOffline bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	wasOffline = o.offline
+	o.offline = false
+	o.lastContact = clock.Clock()
+	return wasOffline
+}
+
+// failed records a failed attempt to reach AM and returns true if the gateway has just gone offline
+func (o *offlineMode) failed() (wentOffline bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.maxStaleness <= 0 {
+		return false
+	}
+	wentOffline = !o.offline
+	o.offline = true
+	o.lastAttempt = clock.Clock()
+	if o.lastContact.IsZero() {
+		o.lastContact = o.lastAttempt
+	}
+	return wentOffline
+}
+
+// age returns the time since AM was last reached and whether it is within the maximum staleness
+func (o *offlineMode) age() (age time.Duration, ok bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	age = clock.Clock().Sub(o.lastContact)
+	return age, age <= o.maxStaleness
+}
+
+// startProbe returns true if the caller should try to reach AM now
+func (o *offlineMode) startProbe() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := clock.Clock()
+	if !o.offline || o.probing || now.Sub(o.lastAttempt) < o.retryInterval {
+		return false
+	}
+	o.probing = true
+	o.lastAttempt = now
+	return true
+}
+
+// endProbe marks the end of an attempt to reach AM
+func (o *offlineMode) endProbe() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.probing = false
+}
+
+// attributesKey returns the cache key for an attributes request
+func attributesKey(token string, names []string) string {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	d := sha256.Sum256([]byte(token + "\x00" + strings.Join(sorted, ",")))
+	return base64.StdEncoding.EncodeToString(d[:])
+}
+
+// storeAttributes caches an attributes response
+func (o *offlineMode) storeAttributes(key string, body []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.maxStaleness <= 0 {
+		return
+	}
+	now := clock.Clock()
+	if len(o.attributes) >= maxCachedResponses {
+		for k, r := range o.attributes {
+			if now.Sub(r.stored) > o.maxStaleness {
+				delete(o.attributes, k)
+			}
+		}
+		if len(o.attributes) >= maxCachedResponses {
+			return
+		}
+	}
+	o.attributes[key] = cachedResponse{body: body, stored: now}
+}
+
+// cachedAttributes returns a cached attributes response if it is within the maximum staleness
+func (o *offlineMode) cachedAttributes(token, key string) (body []byte, age time.Duration, ok bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	r, ok := o.attributes[key]
+	if !ok || o.revoked[token] {
+		return nil, 0, false
+	}
+	age = clock.Clock().Sub(r.stored)
+	if age > o.maxStaleness {
+		delete(o.attributes, key)
+		return nil, 0, false
+	}
+	return r.body, age, true
+}
+
+// queueLogout holds the logout for replay and revokes the session locally. The revocation of a dropped logout is
+// removed with it so that the revoked sessions are bounded by the size of the queue.
+func (o *offlineMode) queueLogout(logout queuedLogout) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.logouts) >= maxQueuedLogouts {
+		debug.Log.Warn("logout queue is full, dropping the oldest logout")
+		dropped := o.logouts[0]
+		o.logouts = o.logouts[1:]
+		if !o.queued(dropped.token) {
+			delete(o.revoked, dropped.token)
+		}
+	}
+	o.revoked[logout.token] = true
+	o.logouts = append(o.logouts, logout)
+}
+
+// queued returns true if a logout of the session is in the queue, the caller must hold the lock
+func (o *offlineMode) queued(token string) bool {
+	for _, l := range o.logouts {
+		if l.token == token {
+			return true
+		}
+	}
+	return false
+}
+
+// isRevoked returns true if the session has been logged out while offline
+func (o *offlineMode) isRevoked(token string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.revoked[token]
+}
+
+// replayed removes the local revocation of a session once its logout has been replayed
+func (o *offlineMode) replayed(token string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.revoked, token)
+}
+
+// takeLogouts removes and returns the queued logouts
+func (o *offlineMode) takeLogouts() []queuedLogout {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	logouts := o.logouts
+	o.logouts = nil
+	return logouts
+}
+
+// amUnavailable returns true if the error indicates that AM could not be reached
+func amUnavailable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var responseErr client.ResponseError
+	if errors.As(err, &responseErr) {
+		switch responseErr.ResponseCode {
+		case client.CodeBadGateway, client.CodeServiceUnavailable, client.CodeGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
+
+// SetOfflineMode switches offline mode on when maxStaleness is greater than zero. While AM is unavailable the gateway
+// serves cached attribute responses and introspects stateless access tokens locally as long as the data used is not
+// older than maxStaleness. Logouts are queued and replayed once AM can be reached again, the sessions are treated as
+// revoked in the meantime. The gateway tries to reach AM every retryInterval while it is offline.
+// Responses that have been served without contacting AM include the client.OptionCacheAge option.
+// Revoking OAuth 2.0 tokens is out of scope: the gateway has no token revocation endpoint, so there is nothing to
+// queue, and access tokens remain active in local introspection until they expire, even if the session that they
+// were issued to has been logged out while offline.
+func (c *Gateway) SetOfflineMode(maxStaleness, retryInterval time.Duration) {
+	c.offline.set(maxStaleness, retryInterval)
+}
+
+// Offline returns true if the gateway is serving requests without contacting AM
+func (c *Gateway) Offline() bool {
+	return c.offline.isOffline()
+}
+
+// QueuedLogouts returns the number of logouts waiting to be replayed to AM
+func (c *Gateway) QueuedLogouts() int {
+	c.offline.mu.Lock()
+	defer c.offline.mu.Unlock()
+	return len(c.offline.logouts)
+}
+
+// amReached records a successful exchange with AM and replays any queued logouts if the gateway was offline
+func (c *Gateway) amReached() {
+	if !c.offline.enabled() {
+		return
+	}
+	if c.offline.contacted() {
+		debug.Log.Info("AM is available, gateway is online")
+		c.background.Add(1)
+		go func() {
+			defer c.background.Done()
+			c.replayLogouts()
+		}()
+	}
+}
+
+// amFailed returns true if the error shows that AM could not be reached and the request can be served offline
+func (c *Gateway) amFailed(logger *slog.Logger, err error) bool {
+	if !amUnavailable(err) || !c.offline.enabled() {
+		return false
+	}
+	if c.offline.failed() {
+		logger.Warn("AM is unavailable, gateway is offline", "error", err)
+	}
+	return true
+}
+
+// trackAM records the outcome of a request to AM and returns true if AM could not be reached and the request can be
+// served offline
+func (c *Gateway) trackAM(logger *slog.Logger, err error) bool {
+	if err == nil || !amUnavailable(err) {
+		c.amReached()
+		return false
+	}
+	return c.amFailed(logger, err)
+}
+
+// servingOffline returns true if the request should be served without contacting AM. While the gateway is offline,
+// it periodically checks whether AM can be reached again.
+func (c *Gateway) servingOffline() bool {
+	if !c.offline.isOffline() {
+		return false
+	}
+	if c.offline.startProbe() {
+		c.background.Add(1)
+		go func() {
+			defer c.background.Done()
+			c.probeAM()
+		}()
+	}
+	return true
+}
+
+// probeAM checks whether AM can be reached. The connection is probed with a read-only request since it is shared
+// with the requests that are in progress. A connection that can not be probed is treated as reachable so that the next
+// request to AM decides whether the gateway stays online.
+func (c *Gateway) probeAM() {
+	defer c.offline.endProbe()
+	if pinger, ok := c.connection().(client.Pinger); ok {
+		if err := pinger.Ping(); err != nil {
+			debug.Log.Debug("AM is still unavailable", "error", err)
+			c.offline.failed()
+			return
+		}
+	}
+	c.amReached()
+}
+
+// replayLogouts sends the logouts received while offline to AM
+func (c *Gateway) replayLogouts() {
+	for _, logout := range c.offline.takeLogouts() {
+		err := c.sessionConnection(logout.token).LogoutSession(logout.token, logout.content, logout.payload)
+		if amUnavailable(err) {
+			// AM has gone again, keep the logout for the next replay
+			c.offline.queueLogout(logout)
+			c.offline.failed()
+			continue
+		}
+		if err != nil {
+			debug.Log.Warn("replayed logout failed", "error", err)
+		}
+		c.offline.replayed(logout.token)
+		c.forgetSession(logout.token)
+	}
+}
+
+// introspectOffline introspects the access token locally if the keys used are within the maximum staleness
+func (c *Gateway) introspectOffline(logger *slog.Logger, w coap.ResponseWriter, content client.ContentType, payload string) {
+	age, ok := c.offline.age()
+	introspector, canIntrospect := c.requestConnection(w).(client.LocalIntrospector)
+	if !ok || !canIntrospect {
+		writeUnavailable(logger, w)
+		return
+	}
+	b, err := introspector.IntrospectAccessTokenLocally(content, payload)
+	if err != nil {
+		handleResponse(logger, nil, err, codes.Changed, w)
+		return
+	}
+	writeOfflineResponse(logger, w, codes.Changed, b, age)
+}
+
+// writeOfflineResponse writes a response served without contacting AM
+func writeOfflineResponse(logger *slog.Logger, w coap.ResponseWriter, code codes.Code, body []byte, age time.Duration) {
+	response := w.NewResponse(code)
+	response.SetOption(client.OptionCacheAge, uint32(age/time.Second))
+	if body != nil {
+		response.SetOption(coap.ContentFormat, coap.AppJSON)
+		response.SetPayload(body)
+	}
+	if err := w.WriteMsg(response); err != nil {
+		logger.Warn("unable to write response", "error", err)
+		return
+	}
+	logger.Debug("served offline response", "code", code.String(), "age", age)
+}
+
+// writeUnavailable tells the thing that the request can not be served while AM is unavailable
+func writeUnavailable(logger *slog.Logger, w coap.ResponseWriter) {
+	logger.Debug("request can not be served while AM is unavailable")
+	w.SetCode(codes.GatewayTimeout)
+	writeResponse(w, []byte("AM is unavailable"))
+}
@@ -0,0 +1,306 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+	frcrypto "github.com/ForgeRock/iot-edge/v7/internal/crypto"
+	"github.com/ForgeRock/iot-edge/v7/internal/mocks"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// thingJWS is an unsigned JWT containing the session token 12345
+const thingJWS = ".eyJjc3JmIjoiMTIzNDUifQ."
+
+var errAMDown = &url.Error{Op: "Get", URL: "http://am.example.com", Err: errors.New("connection refused")}
+
+// fakeAM is a mock AM connection that can be switched off
+type fakeAM struct {
+	mocks.MockClient
+	down    atomic.Bool
+	logouts atomic.Int32
+}
+
+func newFakeAM() *fakeAM {
+	am := &fakeAM{}
+	am.AttributesFunc = func(string, string, []string) ([]byte, error) {
+		if am.down.Load() {
+			return nil, errAMDown
+		}
+		return []byte(`{"thingConfig":"a"}`), nil
+	}
+	am.IntrospectAccessTokenFunc = func(string, string) ([]byte, error) {
+		if am.down.Load() {
+			return nil, errAMDown
+		}
+		return []byte(`{"active":true}`), nil
+	}
+	am.IntrospectLocallyFunc = func(string) ([]byte, error) {
+		return []byte(`{"active":true,"local":true}`), nil
+	}
+	am.AccessTokenFunc = func(string, string) ([]byte, error) {
+		if am.down.Load() {
+			return nil, errAMDown
+		}
+		return []byte("{}"), nil
+	}
+	am.LogoutSessionFunc = func(string, string) error {
+		if am.down.Load() {
+			return errAMDown
+		}
+		am.logouts.Add(1)
+		return nil
+	}
+	am.ValidateSessionFunc = func(string, string) (bool, error) {
+		if am.down.Load() {
+			return false, errAMDown
+		}
+		return true, nil
+	}
+	am.PingFunc = func() error {
+		if am.down.Load() {
+			return errAMDown
+		}
+		return nil
+	}
+	return am
+}
+
+// fakeClock replaces the clock with one that only moves when advanced
+func fakeClock(t *testing.T) func(d time.Duration) {
+	var offset atomic.Int64
+	start := time.Now()
+	clock.Clock = func() time.Time {
+		return start.Add(time.Duration(offset.Load()))
+	}
+	t.Cleanup(func() {
+		clock.Clock = clock.DefaultClock()
+	})
+	return func(d time.Duration) {
+		offset.Add(int64(d))
+	}
+}
+
+func startOfflineGateway(t *testing.T, am *fakeAM, maxStaleness time.Duration) (*Gateway, *coap.ClientConn) {
+	gateway := testGateway(&am.MockClient)
+	gateway.amConnection = am
+	gateway.SetOfflineMode(maxStaleness, time.Second)
+	return gateway, startAndDial(t, gateway)
+}
+
+// startAndDial starts the CoAP server of the gateway and connects a client to it
+func startAndDial(t *testing.T, gateway *Gateway) *coap.ClientConn {
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(gateway.ShutdownCOAPServer)
+
+	cert, _ := frcrypto.PublicKeyCertificate(clientKey)
+	coapClient := &coap.Client{Net: "udp-dtls", DTLSConfig: dtlsClientConfig(cert)}
+	conn, err := coapClient.Dial(gateway.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+func post(t *testing.T, conn *coap.ClientConn, path, query string) coap.Message {
+	return postJWS(t, conn, path, query, thingJWS)
+}
+
+func postJWS(t *testing.T, conn *coap.ClientConn, path, query, signedJWT string) coap.Message {
+	request, err := conn.NewPostRequest(path, client.AppJOSE, strings.NewReader(signedJWT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SetQueryString(query)
+	response, err := conn.Exchange(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func checkResponse(t *testing.T, response coap.Message, code codes.Code, cached bool) {
+	t.Helper()
+	if response.Code() != code {
+		t.Errorf("expected code %v, got %v: %s", code, response.Code(), response.Payload())
+	}
+	if _, ok := client.CacheAge(response); ok != cached {
+		t.Errorf("expected cache age option %v, got %v", cached, ok)
+	}
+}
+
+func TestGateway_Offline_Attributes(t *testing.T) {
+	advance := fakeClock(t)
+	am := newFakeAM()
+	gateway, conn := startOfflineGateway(t, am, time.Hour)
+
+	checkResponse(t, post(t, conn, "/attributes", "thingConfig"), codes.Changed, false)
+	am.down.Store(true)
+	advance(10 * time.Minute)
+
+	response := post(t, conn, "/attributes", "thingConfig")
+	checkResponse(t, response, codes.Changed, true)
+	if age, _ := client.CacheAge(response); age != 10*time.Minute {
+		t.Errorf("expected age of 10m, got %v", age)
+	}
+	if string(response.Payload()) != `{"thingConfig":"a"}` {
+		t.Errorf("unexpected payload %s", response.Payload())
+	}
+	if !gateway.Offline() {
+		t.Error("expected gateway to be offline")
+	}
+	// attributes that have not been cached can not be served
+	checkResponse(t, post(t, conn, "/attributes", "other"), codes.GatewayTimeout, false)
+	// requests that need AM fail without waiting for AM
+	checkResponse(t, post(t, conn, "/accesstoken", ""), codes.GatewayTimeout, false)
+
+	// stale attributes are not served
+	advance(time.Hour)
+	checkResponse(t, post(t, conn, "/attributes", "thingConfig"), codes.GatewayTimeout, false)
+}
+
+func TestGateway_Offline_Introspect(t *testing.T) {
+	advance := fakeClock(t)
+	am := newFakeAM()
+	_, conn := startOfflineGateway(t, am, time.Hour)
+
+	checkResponse(t, post(t, conn, "/attributes", ""), codes.Changed, false)
+	am.down.Store(true)
+	// the first failure takes the gateway offline
+	checkResponse(t, post(t, conn, "/accesstoken", ""), codes.InternalServerError, false)
+
+	response := post(t, conn, "/introspect", "")
+	checkResponse(t, response, codes.Changed, true)
+	if string(response.Payload()) != `{"active":true,"local":true}` {
+		t.Errorf("expected local introspection, got %s", response.Payload())
+	}
+	advance(2 * time.Hour)
+	checkResponse(t, post(t, conn, "/introspect", ""), codes.GatewayTimeout, false)
+}
+
+func TestGateway_Offline_Logout(t *testing.T) {
+	advance := fakeClock(t)
+	am := newFakeAM()
+	gateway, conn := startOfflineGateway(t, am, time.Hour)
+
+	checkResponse(t, post(t, conn, "/attributes", ""), codes.Changed, false)
+	am.down.Store(true)
+	checkResponse(t, post(t, conn, "/session", "_action=logout"), codes.Changed, true)
+	if gateway.QueuedLogouts() != 1 {
+		t.Fatalf("expected a queued logout, got %d", gateway.QueuedLogouts())
+	}
+	// the session is revoked locally
+	checkResponse(t, post(t, conn, "/session", "_action=validate"), codes.Unauthorized, true)
+	checkResponse(t, post(t, conn, "/session", "_action=getSessionInfo"), codes.GatewayTimeout, false)
+	checkResponse(t, post(t, conn, "/attributes", ""), codes.GatewayTimeout, false)
+
+	// once AM is back the logout is replayed
+	am.down.Store(false)
+	advance(time.Minute)
+	post(t, conn, "/attributes", "")
+	for i := 0; i < 100 && (am.logouts.Load() == 0 || gateway.Offline()); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if gateway.Offline() {
+		t.Error("expected gateway to be online")
+	}
+	if am.logouts.Load() != 1 || gateway.QueuedLogouts() != 0 {
+		t.Errorf("expected the logout to be replayed, logouts %d, queued %d", am.logouts.Load(),
+			gateway.QueuedLogouts())
+	}
+	checkResponse(t, post(t, conn, "/session", "_action=validate"), codes.Changed, false)
+}
+
+// check that the revocation of a logout dropped from a full queue is dropped with it
+func TestOfflineMode_QueueLogout_Full(t *testing.T) {
+	var o offlineMode
+	o.set(time.Hour, 0)
+	// a session that is logged out twice stays revoked while either logout is queued
+	o.queueLogout(queuedLogout{token: "repeated"})
+	o.queueLogout(queuedLogout{token: "repeated"})
+	for i := 2; i < maxQueuedLogouts; i++ {
+		o.queueLogout(queuedLogout{token: strconv.Itoa(i)})
+	}
+	o.queueLogout(queuedLogout{token: "new"})
+	if !o.isRevoked("repeated") || !o.isRevoked("new") {
+		t.Error("expected the queued sessions to be revoked")
+	}
+	o.queueLogout(queuedLogout{token: "newer"})
+	if o.isRevoked("repeated") {
+		t.Error("expected the revocation to be dropped with the logouts")
+	}
+	if len(o.revoked) != maxQueuedLogouts || len(o.logouts) != maxQueuedLogouts {
+		t.Errorf("expected %d revoked sessions and logouts, got %d and %d", maxQueuedLogouts, len(o.revoked),
+			len(o.logouts))
+	}
+}
+
+// check that failures are returned as before when offline mode is switched off
+func TestGateway_Offline_Disabled(t *testing.T) {
+	am := newFakeAM()
+	gateway, conn := startOfflineGateway(t, am, 0)
+
+	checkResponse(t, post(t, conn, "/attributes", ""), codes.Changed, false)
+	am.down.Store(true)
+	checkResponse(t, post(t, conn, "/attributes", ""), codes.InternalServerError, false)
+	checkResponse(t, post(t, conn, "/session", "_action=logout"), codes.GatewayTimeout, false)
+	if gateway.Offline() || gateway.QueuedLogouts() != 0 {
+		t.Error("offline mode used when switched off")
+	}
+}
+
+func TestAMUnavailable(t *testing.T) {
+	tests := []struct {
+		err         error
+		unavailable bool
+	}{
+		{err: errAMDown, unavailable: true},
+		{err: fmt.Errorf("request failed: %w", errAMDown), unavailable: true},
+		{err: client.ResponseError{ResponseCode: client.CodeServiceUnavailable}, unavailable: true},
+		{err: client.ResponseError{ResponseCode: client.CodeGatewayTimeout}, unavailable: true},
+		{err: client.ResponseError{ResponseCode: client.CodeUnauthorized}},
+		{err: errors.New("bad payload")},
+		{err: nil},
+	}
+	for _, subtest := range tests {
+		t.Run(fmt.Sprint(subtest.err), func(t *testing.T) {
+			if amUnavailable(subtest.err) != subtest.unavailable {
+				t.Errorf("expected %v", subtest.unavailable)
+			}
+		})
+	}
+}
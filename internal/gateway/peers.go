@@ -0,0 +1,144 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/x509"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+	"github.com/go-ocf/go-coap"
+)
+
+// ErrUnknownPeer is returned when there is no DTLS session with the given peer
+var ErrUnknownPeer = errors.New("peer is not connected")
+
+// Peer describes a DTLS peer of the CoAP server
+type Peer struct {
+	Address string `json:"address"`
+	// the ID of the thing that last made a request over the DTLS session, if known
+	ThingID  string    `json:"thing_id,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// peer holds the state of a DTLS session
+type peer struct {
+	conn     *coap.ClientConn
+	thingID  string
+	lastSeen time.Time
+}
+
+// peerTracker keeps track of the DTLS sessions of the CoAP server, keyed by the address of the peer
+type peerTracker struct {
+	mu    sync.Mutex
+	peers map[string]*peer
+	// the certificates that peers presented in the DTLS handshake
+	certificates map[string]*x509.Certificate
+}
+
+// handshake records the certificate that the peer presented in the DTLS handshake
+func (t *peerTracker) handshake(address string, cert *x509.Certificate) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.certificates == nil {
+		t.certificates = make(map[string]*x509.Certificate)
+	}
+	t.certificates[address] = cert
+}
+
+// certificate returns the certificate that the peer presented in the DTLS handshake, nil if it is not known
+func (t *peerTracker) certificate(address string) *x509.Certificate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.certificates[address]
+}
+
+// seen records a request from the peer made by the given thing, which may be empty if the thing is not known
+func (t *peerTracker) seen(conn *coap.ClientConn, thingID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.peers == nil {
+		t.peers = make(map[string]*peer)
+	}
+	address := conn.RemoteAddr().String()
+	p, ok := t.peers[address]
+	if !ok {
+		p = &peer{}
+		t.peers[address] = p
+	}
+	p.conn = conn
+	p.lastSeen = clock.Clock()
+	if thingID != "" {
+		p.thingID = thingID
+	}
+}
+
+// ended removes the peer at the given address once its DTLS session has ended
+func (t *peerTracker) ended(address string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peers, address)
+	delete(t.certificates, address)
+}
+
+// list returns the peers ordered by address
+func (t *peerTracker) list() []Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := make([]Peer, 0, len(t.peers))
+	for address, p := range t.peers {
+		peers = append(peers, Peer{Address: address, ThingID: p.thingID, LastSeen: p.lastSeen})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Address < peers[j].Address
+	})
+	return peers
+}
+
+// close the DTLS session with the peer
+func (t *peerTracker) close(address string) error {
+	t.mu.Lock()
+	p, ok := t.peers[address]
+	delete(t.peers, address)
+	t.mu.Unlock()
+	if !ok {
+		return ErrUnknownPeer
+	}
+	return p.conn.Close()
+}
+
+// reset forgets all peers
+func (t *peerTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peers = nil
+	t.certificates = nil
+}
+
+// Peers returns the DTLS peers of the CoAP server that have made at least one request
+func (c *Gateway) Peers() []Peer {
+	return c.peers.list()
+}
+
+// ClosePeer closes the DTLS session with the peer at the given address. The thing has to perform a new DTLS handshake
+// before it can make another request.
+func (c *Gateway) ClosePeer(address string) error {
+	return c.peers.close(address)
+}
@@ -0,0 +1,441 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
+	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+	"github.com/go-ocf/go-coap/codes"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// maxPoPSessions is the number of PoP sessions tracked before the least recently used are dropped
+	maxPoPSessions = 10000
+	// resolveRetryInterval is the time between attempts to resolve the confirmation key of a session
+	resolveRetryInterval = time.Minute
+)
+
+var (
+	errUnknownKey     = errors.New("confirmation key is not known")
+	errNonceReused    = errors.New("nonce has already been used")
+	errWrongAudience  = errors.New("unexpected audience")
+	errWrongAPI       = errors.New("unexpected api version")
+	errMissingNonce   = errors.New("missing nonce")
+	errUnknownSession = errors.New("session is not known")
+)
+
+// ConfirmationKeyResolver returns the public key that a thing has been issued a PoP session for. It is called with the
+// session token, the ID of the thing and the ID of the key that the thing authenticated with when the key was not
+// learned during registration.
+type ConfirmationKeyResolver func(tokenID, thingID, keyID string) (*jose.JSONWebKey, error)
+
+// popSession holds the state used to verify the requests signed by a thing with a PoP session. The key ID is empty if
+// the session is not a PoP session.
+type popSession struct {
+	thingID     string
+	thingType   callback.ThingType
+	keyID       string
+	key         *jose.JSONWebKey
+	lastResolve time.Time
+	// the nonce of the last accepted request, -1 if no request has been accepted
+	nonce    int64
+	lastUsed time.Time
+}
+
+// popVerifier verifies the proof of possession JWTs that things sign their requests with
+type popVerifier struct {
+	mu       sync.Mutex
+	disabled bool
+	strict   bool
+	resolver ConfirmationKeyResolver
+	sessions map[string]*popSession
+	// confirmation keys learned from registration JWTs, keyed by thing ID and key ID
+	keys map[string]*jose.JSONWebKey
+	// thing types learned from registration JWTs, keyed by thing ID
+	types map[string]callback.ThingType
+}
+
+// set switches verification on or off and sets whether requests from unknown sessions are rejected
+func (p *popVerifier) set(verify, strict bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.disabled = !verify
+	p.strict = strict
+}
+
+func registeredKeyID(thingID, keyID string) string {
+	return thingID + "/" + keyID
+}
+
+// learn records the confirmation key found in the JWTs of a successful authentication request
+func (p *popVerifier) learn(tokenID string, callbacks []callback.Callback) {
+	for _, cb := range callbacks {
+		for _, e := range cb.Input {
+			token, ok := e.Value.(string)
+			if !ok {
+				continue
+			}
+			var claims struct {
+				Sub       string             `json:"sub"`
+				ThingType callback.ThingType `json:"thingType"`
+				CNF       struct {
+					KID string           `json:"kid"`
+					JWK *jose.JSONWebKey `json:"jwk"`
+				} `json:"cnf"`
+			}
+			if err := jws.ExtractClaims(token, &claims); err != nil || claims.Sub == "" {
+				continue
+			}
+			// sessions without a confirmation key are recorded so that requests can be attributed to the thing
+			session := &popSession{thingID: claims.Sub, thingType: claims.ThingType, keyID: claims.CNF.KID, nonce: -1,
+				lastUsed: clock.Clock()}
+			if claims.CNF.JWK != nil {
+				session.key = claims.CNF.JWK
+				if session.keyID == "" {
+					session.keyID = claims.CNF.JWK.KeyID
+				}
+			}
+			p.add(tokenID, session)
+			return
+		}
+	}
+}
+
+// add a PoP session, dropping the least recently used session if the limit has been reached
+func (p *popVerifier) add(tokenID string, session *popSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sessions == nil {
+		p.sessions = make(map[string]*popSession)
+		p.keys = make(map[string]*jose.JSONWebKey)
+		p.types = make(map[string]callback.ThingType)
+	}
+	if session.thingType != "" {
+		if len(p.types) >= maxPoPSessions {
+			for k := range p.types {
+				delete(p.types, k)
+				break
+			}
+		}
+		p.types[session.thingID] = session.thingType
+	} else {
+		session.thingType = p.types[session.thingID]
+	}
+	id := registeredKeyID(session.thingID, session.keyID)
+	switch {
+	case session.keyID == "":
+		// not a PoP session so there is no key to record
+	case session.key != nil:
+		if len(p.keys) >= maxPoPSessions {
+			for k := range p.keys {
+				delete(p.keys, k)
+				break
+			}
+		}
+		p.keys[id] = session.key
+	default:
+		session.key = p.keys[id]
+	}
+	if len(p.sessions) >= maxPoPSessions {
+		var oldest string
+		for t, s := range p.sessions {
+			if oldest == "" || s.lastUsed.Before(p.sessions[oldest].lastUsed) {
+				oldest = t
+			}
+		}
+		delete(p.sessions, oldest)
+	}
+	p.sessions[tokenID] = session
+}
+
+// remove the PoP session
+func (p *popVerifier) remove(tokenID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, tokenID)
+}
+
+// session returns a copy of the PoP session and the resolver to call if the key of the session should be resolved
+func (p *popVerifier) session(tokenID string, defaultResolver ConfirmationKeyResolver) (session popSession,
+	resolver ConfirmationKeyResolver, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.sessions[tokenID]
+	if !ok {
+		return session, nil, false
+	}
+	now := clock.Clock()
+	if s.key == nil && s.keyID != "" && now.Sub(s.lastResolve) >= resolveRetryInterval {
+		s.lastResolve = now
+		resolver = p.resolver
+		if resolver == nil {
+			resolver = defaultResolver
+		}
+	}
+	return *s, resolver, true
+}
+
+// resolved records the key resolved for a PoP session
+func (p *popVerifier) resolved(tokenID string, session popSession, key *jose.JSONWebKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys[registeredKeyID(session.thingID, session.keyID)] = key
+	if s, ok := p.sessions[tokenID]; ok {
+		s.key = key
+	}
+}
+
+// identity returns the identity of the thing that the session was issued to
+func (p *popVerifier) identity(tokenID string) (identity ThingIdentity, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.sessions[tokenID]
+	if !ok {
+		return identity, false
+	}
+	return ThingIdentity{ID: s.thingID, Type: s.thingType, KeyThumbprint: keyThumbprint(s.key)}, true
+}
+
+// keyThumbprint returns the RFC 7638 thumbprint of the key, empty if the key is nil
+func keyThumbprint(key *jose.JSONWebKey) string {
+	if key == nil {
+		return ""
+	}
+	b, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return ""
+	}
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// tokens returns the session tokens issued to the thing. Restricted sessions are bound to a confirmation key so that
+// AM only accepts requests made with them if they are signed by the thing.
+func (p *popVerifier) tokens(thingID string) (unrestricted, restricted []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for tokenID, s := range p.sessions {
+		if s.thingID != thingID {
+			continue
+		}
+		if s.keyID != "" {
+			restricted = append(restricted, tokenID)
+		} else {
+			unrestricted = append(unrestricted, tokenID)
+		}
+	}
+	return unrestricted, restricted
+}
+
+// accept the nonce if it is greater than the nonce of any previously accepted request
+func (p *popVerifier) accept(tokenID string, nonce int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.sessions[tokenID]
+	if !ok {
+		return errUnknownSession
+	}
+	if nonce <= s.nonce {
+		return errNonceReused
+	}
+	s.nonce = nonce
+	s.lastUsed = clock.Clock()
+	return nil
+}
+
+// settings returns whether verification is enabled and strict
+func (p *popVerifier) settings() (enabled, strict bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.disabled, p.strict
+}
+
+// SetPoPVerification switches the verification of the proof of possession JWTs that things sign their requests with
+// on or off. Verification is on by default. The gateway learns the key of each PoP session when the thing
+// authenticates and rejects requests with an invalid signature, an unexpected audience or API version or a nonce that
+// is not greater than the nonce of the previous request. Requests that can not be verified because the key of the
+// session is not known, for example when the thing authenticated before the gateway was restarted, are forwarded to
+// AM unless strict is true.
+func (c *Gateway) SetPoPVerification(verify, strict bool) {
+	c.pop.set(verify, strict)
+}
+
+// SetConfirmationKeyResolver sets the function used to find the key of a PoP session when the thing authenticated
+// with a key that the gateway did not see it register. By default, the key is read from the thing's identity in AM
+// with the gateway's own session, since the session of the thing can only be used with a PoP JWT. The gateway's
+// identity must be allowed to read the identities of the things.
+func (c *Gateway) SetConfirmationKeyResolver(resolver ConfirmationKeyResolver) {
+	c.pop.mu.Lock()
+	defer c.pop.mu.Unlock()
+	c.pop.resolver = resolver
+}
+
+// sessionRequester is implemented by gateway things that can make requests to AM with their own session
+type sessionRequester interface {
+	RequestWithSession(f func(tokenID string) error) error
+}
+
+// resolveFromAM returns a resolver that reads the confirmation key from the thing's identity in AM with the session of
+// the gateway
+func (c *Gateway) resolveFromAM(connection client.Connection) ConfirmationKeyResolver {
+	return func(_, thingID, keyID string) (*jose.JSONWebKey, error) {
+		reader, ok := connection.(client.ThingKeyReader)
+		if !ok {
+			return nil, errUnknownKey
+		}
+		requester, ok := c.gatewayThing.(sessionRequester)
+		if !ok {
+			return nil, errUnknownKey
+		}
+		var keys jose.JSONWebKeySet
+		err := requester.RequestWithSession(func(tokenID string) (err error) {
+			keys, err = reader.ThingKeys(tokenID, thingID)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		found := keys.Key(keyID)
+		if len(found) == 0 {
+			return nil, errUnknownKey
+		}
+		return &found[0], nil
+	}
+}
+
+// popAudience returns the audience and API version that a thing signs requests to the endpoint with
+func popAudience(info client.AMInfoResponse, endpoint string, query []string) (audience, api string, err error) {
+	api = info.ThingsVersion
+	switch strings.TrimPrefix(endpoint, "/") {
+	case "accesstoken":
+		audience = info.AccessTokenURL
+	case "introspect":
+		audience = info.IntrospectURL
+	case "usercode":
+		audience = info.UserCodeURL
+	case "usertoken":
+		audience = info.UserTokenURL
+	case "attributes":
+		audience = info.AttributesURL
+		if len(query) > 0 {
+			// the thing adds the names to the URL in the same way
+			u, err := url.ParseRequestURI(audience)
+			if err != nil {
+				return audience, api, err
+			}
+			prefix := "?"
+			if len(u.Query()) > 0 {
+				prefix = "&"
+			}
+			audience += prefix + "_fields=" + strings.Join(query, ",")
+		}
+	case "session":
+		api = info.SessionsVersion
+		switch strings.Join(query, "&") {
+		case "_action=validate":
+			audience = info.SessionValidateURL
+		case "_action=logout":
+			audience = info.SessionLogoutURL
+		case "_action=getSessionInfo":
+			audience = info.SessionInfoURL
+		}
+	}
+	if audience == "" {
+		return audience, api, fmt.Errorf("no audience for endpoint %s", endpoint)
+	}
+	return audience, api, nil
+}
+
+// verifyPoP checks the PoP JWT signed by the thing against the confirmation key of its session and the audience of
+// the AM that the request is sent to
+func (c *Gateway) verifyPoP(logger *slog.Logger, connection client.Connection, tokenID, signedJWT string,
+	endpoint string, query []string) error {
+	enabled, strict := c.pop.settings()
+	if !enabled {
+		return nil
+	}
+	session, resolver, ok := c.pop.session(tokenID, c.resolveFromAM(connection))
+	if resolver != nil {
+		key, err := resolver(tokenID, session.thingID, session.keyID)
+		if err != nil {
+			logger.Warn("unable to resolve confirmation key", debug.ThingID(session.thingID), "error", err)
+		} else {
+			c.pop.resolved(tokenID, session, key)
+			session.key = key
+		}
+	}
+	if !ok || session.key == nil {
+		if strict {
+			if !ok {
+				return errUnknownSession
+			}
+			return errUnknownKey
+		}
+		logger.Debug("forwarding unverified request", "reason", "unknown session or key")
+		return nil
+	}
+	header, err := jws.Verify(signedJWT, session.key)
+	if err != nil {
+		return err
+	}
+	info, err := connection.AMInfo()
+	if err != nil {
+		return err
+	}
+	audience, api, err := popAudience(info, endpoint, query)
+	if err != nil {
+		return err
+	}
+	if header.Audience != audience {
+		return errWrongAudience
+	}
+	if header.API != api {
+		return errWrongAPI
+	}
+	if header.Nonce == nil {
+		return errMissingNonce
+	}
+	return c.pop.accept(tokenID, *header.Nonce)
+}
+
+// checkPoP verifies the request if it contains a PoP JWT, rejecting it with 4.01 (Unauthorized) if it fails
+func (c *Gateway) checkPoP(e *Exchange) bool {
+	if e.session.content != client.ApplicationJOSE {
+		return true
+	}
+	err := c.verifyPoP(e.logger, c.requestConnection(e.writer), e.session.token, e.session.payload,
+		e.request.Msg.PathString(), e.request.Msg.Query())
+	if err != nil {
+		e.logger.Warn("proof of possession verification failed", "error", err)
+		e.Respond(codes.Unauthorized, []byte("proof of possession verification failed"))
+		return false
+	}
+	return true
+}
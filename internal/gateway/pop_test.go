@@ -0,0 +1,291 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
+	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
+	"github.com/go-ocf/go-coap/codes"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var popAMInfo = client.AMInfoResponse{
+	AccessTokenURL:     "https://am.example.com/json/things/*?_action=get_access_token&realm=/",
+	AttributesURL:      "https://am.example.com/json/things/*?realm=/",
+	UserCodeURL:        "https://am.example.com/json/things/*?_action=get_user_code&realm=/",
+	ThingsVersion:      "protocol=2.0,resource=1.0",
+	SessionsVersion:    "resource=4.0",
+	SessionValidateURL: "https://am.example.com/json/sessions?_action=validate",
+	SessionInfoURL:     "https://am.example.com/json/sessions?_action=getSessionInfo",
+}
+
+// signPoP signs a request in the same way as a thing with a PoP session
+func signPoP(t *testing.T, key crypto.Signer, audience, api string, nonce int, token string) string {
+	opts := &jose.SignerOptions{}
+	opts.WithHeader("aud", audience)
+	opts.WithHeader("api", api)
+	opts.WithHeader("nonce", nonce)
+	signer, err := jws.NewSigner(key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedJWT, err := jwt.Signed(signer).Claims(struct {
+		CSRF string `json:"csrf"`
+	}{CSRF: token}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signedJWT
+}
+
+// popCallbacks returns the callbacks sent by a thing that has registered or authenticated with the given key
+func popCallbacks(t *testing.T, key crypto.Signer, register bool) []callback.Callback {
+	id := "jwt-pop-authentication"
+	var handler callback.Handler = callback.AuthenticateHandler{ThingID: "thing-1", KeyID: "pop.cnf", Key: key}
+	if register {
+		id = "jwt-pop-registration"
+		handler = callback.RegisterHandler{ThingID: "thing-1", KeyID: "pop.cnf", Key: key}
+	}
+	cb := callback.Callback{
+		Type:   callback.TypeHiddenValueCallback,
+		Output: []callback.Entry{{Name: "value", Value: "challenge"}, {Name: "id", Value: id}},
+		Input:  []callback.Entry{{Name: "IDToken1", Value: ""}},
+	}
+	if _, err := handler.Handle(cb); err != nil {
+		t.Fatal(err)
+	}
+	return []callback.Callback{cb}
+}
+
+// startPoPGateway starts a gateway and authenticates a thing with the given callbacks
+func startPoPGateway(t *testing.T, am *fakeAM, callbacks []callback.Callback) (*Gateway,
+	func(path, query, signedJWT string) codes.Code) {
+	am.AMInfoSet = popAMInfo
+	am.AuthenticateFunc = func(client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+		reply.TokenID = "12345"
+		return reply, nil
+	}
+	gateway, conn := startOfflineGateway(t, am, 0)
+	if _, err := gateway.authenticate(nil, client.AuthenticatePayload{Callbacks: callbacks}); err != nil {
+		t.Fatal(err)
+	}
+	return gateway, func(path, query, signedJWT string) codes.Code {
+		return postJWS(t, conn, path, query, signedJWT).Code()
+	}
+}
+
+func TestGateway_PoP(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	things := popAMInfo.ThingsVersion
+	tests := []struct {
+		name      string
+		path      string
+		query     string
+		signedJWT string
+		code      codes.Code
+	}{
+		{name: "valid", path: "/accesstoken",
+			signedJWT: signPoP(t, key, popAMInfo.AccessTokenURL, things, 1, "12345"), code: codes.Changed},
+		{name: "attributes", path: "/attributes", query: "thingConfig",
+			signedJWT: signPoP(t, key, popAMInfo.AttributesURL+"&_fields=thingConfig", things, 1, "12345"),
+			code:      codes.Changed},
+		{name: "session", path: "/session", query: "_action=validate",
+			signedJWT: signPoP(t, key, popAMInfo.SessionValidateURL, popAMInfo.SessionsVersion, 1, "12345"),
+			code:      codes.Changed},
+		{name: "session-info", path: "/session", query: "_action=getSessionInfo",
+			signedJWT: signPoP(t, key, popAMInfo.SessionInfoURL, popAMInfo.SessionsVersion, 1, "12345"),
+			code:      codes.Content},
+		{name: "wrong-session-action", path: "/session", query: "_action=getSessionInfo",
+			signedJWT: signPoP(t, key, popAMInfo.SessionValidateURL, popAMInfo.SessionsVersion, 1, "12345"),
+			code:      codes.Unauthorized},
+		{name: "wrong-key", path: "/accesstoken",
+			signedJWT: signPoP(t, otherKey, popAMInfo.AccessTokenURL, things, 1, "12345"), code: codes.Unauthorized},
+		{name: "wrong-audience", path: "/accesstoken",
+			signedJWT: signPoP(t, key, popAMInfo.AttributesURL, things, 1, "12345"), code: codes.Unauthorized},
+		{name: "wrong-attributes", path: "/attributes", query: "thingConfig",
+			signedJWT: signPoP(t, key, popAMInfo.AttributesURL, things, 1, "12345"), code: codes.Unauthorized},
+		{name: "wrong-api", path: "/accesstoken",
+			signedJWT: signPoP(t, key, popAMInfo.AccessTokenURL, "resource=4.0", 1, "12345"), code: codes.Unauthorized},
+		{name: "unsigned", path: "/accesstoken", signedJWT: thingJWS, code: codes.Unauthorized},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			_, send := startPoPGateway(t, newFakeAM(), popCallbacks(t, key, true))
+			if code := send(subtest.path, subtest.query, subtest.signedJWT); code != subtest.code {
+				t.Errorf("expected %v, got %v", subtest.code, code)
+			}
+		})
+	}
+}
+
+func TestGateway_PoP_Nonce(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, send := startPoPGateway(t, newFakeAM(), popCallbacks(t, key, true))
+	things := popAMInfo.ThingsVersion
+
+	for _, nonce := range []int{0, 1, 5} {
+		signedJWT := signPoP(t, key, popAMInfo.AccessTokenURL, things, nonce, "12345")
+		if code := send("/accesstoken", "", signedJWT); code != codes.Changed {
+			t.Fatalf("nonce %d: expected %v, got %v", nonce, codes.Changed, code)
+		}
+	}
+	for _, nonce := range []int{5, 4, 0} {
+		signedJWT := signPoP(t, key, popAMInfo.AccessTokenURL, things, nonce, "12345")
+		if code := send("/accesstoken", "", signedJWT); code != codes.Unauthorized {
+			t.Errorf("nonce %d: expected %v, got %v", nonce, codes.Unauthorized, code)
+		}
+	}
+}
+
+// fakeSessionThing is a gateway thing that makes requests with the given session token
+type fakeSessionThing struct {
+	thing.Thing
+	tokenID string
+}
+
+func (f fakeSessionThing) RequestWithSession(request func(tokenID string) error) error {
+	return request(f.tokenID)
+}
+
+func TestGateway_PoP_UnknownKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signedJWT := signPoP(t, key, popAMInfo.AccessTokenURL, popAMInfo.ThingsVersion, 0, "12345")
+
+	t.Run("forwarded", func(t *testing.T) {
+		am := newFakeAM()
+		am.ThingKeysFunc = func(string, string) (jose.JSONWebKeySet, error) {
+			return jose.JSONWebKeySet{}, nil
+		}
+		_, send := startPoPGateway(t, am, popCallbacks(t, key, false))
+		if code := send("/accesstoken", "", signedJWT); code != codes.Changed {
+			t.Errorf("expected %v, got %v", codes.Changed, code)
+		}
+	})
+	t.Run("strict", func(t *testing.T) {
+		gateway, send := startPoPGateway(t, newFakeAM(), popCallbacks(t, key, false))
+		gateway.SetPoPVerification(true, true)
+		if code := send("/accesstoken", "", signedJWT); code != codes.Unauthorized {
+			t.Errorf("expected %v, got %v", codes.Unauthorized, code)
+		}
+	})
+	t.Run("resolved", func(t *testing.T) {
+		am := newFakeAM()
+		am.ThingKeysFunc = func(tokenID, thingID string) (jose.JSONWebKeySet, error) {
+			// the keys are read with the gateway's session since the thing's session requires a PoP JWT
+			if tokenID != "gateway-token" || thingID != "thing-1" {
+				t.Errorf("unexpected token %s or thing %s", tokenID, thingID)
+			}
+			return jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "pop.cnf"}}}, nil
+		}
+		gateway, send := startPoPGateway(t, am, popCallbacks(t, key, false))
+		gateway.gatewayThing = fakeSessionThing{tokenID: "gateway-token"}
+		gateway.SetPoPVerification(true, true)
+		if code := send("/accesstoken", "", signedJWT); code != codes.Changed {
+			t.Errorf("expected %v, got %v", codes.Changed, code)
+		}
+		if code := send("/accesstoken", "", signedJWT); code != codes.Unauthorized {
+			t.Errorf("expected replay to be rejected, got %v", code)
+		}
+	})
+	t.Run("unknown-session", func(t *testing.T) {
+		gateway, send := startPoPGateway(t, newFakeAM(), nil)
+		if code := send("/accesstoken", "", signedJWT); code != codes.Changed {
+			t.Errorf("expected %v, got %v", codes.Changed, code)
+		}
+		gateway.SetPoPVerification(true, true)
+		if code := send("/accesstoken", "", signedJWT); code != codes.Unauthorized {
+			t.Errorf("expected %v, got %v", codes.Unauthorized, code)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		gateway, send := startPoPGateway(t, newFakeAM(), popCallbacks(t, key, true))
+		gateway.SetPoPVerification(false, true)
+		if code := send("/accesstoken", "", thingJWS); code != codes.Changed {
+			t.Errorf("expected %v, got %v", codes.Changed, code)
+		}
+	})
+}
+
+// check that a thing that authenticates after registering is verified with the key that it registered
+func TestGateway_PoP_Reauthenticate(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	am := newFakeAM()
+	gateway, send := startPoPGateway(t, am, popCallbacks(t, key, true))
+	gateway.SetConfirmationKeyResolver(func(string, string, string) (*jose.JSONWebKey, error) {
+		t.Error("key should not be resolved")
+		return nil, errUnknownKey
+	})
+	gateway.SetPoPVerification(true, true)
+	am.AuthenticateFunc = func(client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+		reply.TokenID = "67890"
+		return reply, nil
+	}
+	if _, err := gateway.authenticate(nil, client.AuthenticatePayload{Callbacks: popCallbacks(t, key, false)}); err != nil {
+		t.Fatal(err)
+	}
+	signedJWT := signPoP(t, key, popAMInfo.AccessTokenURL, popAMInfo.ThingsVersion, 0, "67890")
+	if code := send("/accesstoken", "", signedJWT); code != codes.Changed {
+		t.Errorf("expected %v, got %v", codes.Changed, code)
+	}
+}
+
+func TestPoPAudience(t *testing.T) {
+	info := popAMInfo
+	tests := []struct {
+		endpoint string
+		query    []string
+		audience string
+		api      string
+	}{
+		{endpoint: "accesstoken", audience: info.AccessTokenURL, api: info.ThingsVersion},
+		{endpoint: "/attributes", audience: info.AttributesURL, api: info.ThingsVersion},
+		{endpoint: "attributes", query: []string{"a", "b"}, audience: info.AttributesURL + "&_fields=a,b",
+			api: info.ThingsVersion},
+		{endpoint: "session", query: []string{"_action=validate"}, audience: info.SessionValidateURL,
+			api: info.SessionsVersion},
+		{endpoint: "session", query: []string{"_action=getSessionInfo"}, audience: info.SessionInfoURL,
+			api: info.SessionsVersion},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.audience, func(t *testing.T) {
+			audience, api, err := popAudience(info, subtest.endpoint, subtest.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if audience != subtest.audience || api != subtest.api {
+				t.Errorf("expected %s %s, got %s %s", subtest.audience, subtest.api, audience, api)
+			}
+		})
+	}
+	info.AttributesURL = "https://am.example.com/json/things/*"
+	if audience, _, _ := popAudience(info, "attributes", []string{"a"}); audience != info.AttributesURL+"?_fields=a" {
+		t.Errorf("unexpected audience %s", audience)
+	}
+	if _, _, err := popAudience(info, "session", []string{"_action=unknown"}); err == nil {
+		t.Error("expected an error")
+	}
+}
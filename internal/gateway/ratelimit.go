@@ -0,0 +1,90 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+)
+
+// maxIdleBuckets is the number of peer buckets kept before full buckets are pruned
+const maxIdleBuckets = 1024
+
+// rateLimiter limits the rate of requests from each peer using a token bucket per peer
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// set the number of requests per second allowed for each peer and the maximum burst size.
+// A rate of zero or less disables rate limiting.
+func (l *rateLimiter) set(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.burst = float64(burst)
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	l.buckets = make(map[string]*bucket)
+}
+
+// allow returns true if the peer is allowed to make a request now
+func (l *rateLimiter) allow(peer string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	now := clock.Clock()
+	if len(l.buckets) >= maxIdleBuckets {
+		l.prune(now)
+	}
+	b, ok := l.buckets[peer]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[peer] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune removes the buckets of peers that have been idle long enough for their bucket to be full
+func (l *rateLimiter) prune(now time.Time) {
+	for peer, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, peer)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	now := time.Now()
+	clock.Clock = func() time.Time {
+		return now
+	}
+	defer func() {
+		clock.Clock = clock.DefaultClock()
+	}()
+
+	var limiter rateLimiter
+	// rate limiting is disabled by default
+	for i := 0; i < 10; i++ {
+		if !limiter.allow("a") {
+			t.Fatal("expected unlimited requests")
+		}
+	}
+
+	limiter.set(1, 2)
+	if !limiter.allow("a") || !limiter.allow("a") {
+		t.Fatal("expected burst to be allowed")
+	}
+	if limiter.allow("a") {
+		t.Error("expected request to be limited")
+	}
+	// other peers have their own bucket
+	if !limiter.allow("b") {
+		t.Error("expected request from another peer to be allowed")
+	}
+	// bucket refills over time
+	now = now.Add(time.Second)
+	if !limiter.allow("a") {
+		t.Error("expected request to be allowed after refill")
+	}
+	if limiter.allow("a") {
+		t.Error("expected request to be limited")
+	}
+}
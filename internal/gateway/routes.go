@@ -0,0 +1,386 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
+	"github.com/ForgeRock/iot-edge/v7/internal/tokencache"
+	"github.com/go-ocf/go-coap"
+)
+
+// Routing design
+// A gateway can serve several tenants, each in its own realm with its own trees and optionally its own AM. Routes are
+// checked in the order that they were added and a request is sent to the first route that matches it, or to the AM
+// connection that the gateway was created with if no route matches. A route matches a request if all the conditions
+// that are set match:
+//   ClientCommonName  the subject common name of the certificate that the thing presented in the DTLS handshake
+//   PathPrefix        the URI path starts with the prefix, for example /acme/authenticate, the prefix is removed
+//   Query             the URI query holds the parameter, for example tenant=acme, the parameter is removed
+//   Audience          the aud claim of the JWTs that the thing authenticates or signs requests with
+// Sessions issued through a route stay on that route so that requests made with the session reach the realm that
+// issued it even when they do not match the route themselves. Each route has its own AM connection and its own store
+// of authentication IDs so that the journeys of tenants are isolated from each other. Offline mode tracks the
+// availability of AM for all routes together.
+
+var (
+	// ErrRouteExists is returned when a route with the same name has already been added
+	ErrRouteExists = errors.New("route already exists")
+	// ErrUnknownRoute is returned when the gateway does not have a route with the given name
+	ErrUnknownRoute = errors.New("unknown route")
+)
+
+// RouteMatch holds the conditions that a request must meet to be sent to a route. Conditions that are empty are
+// ignored.
+type RouteMatch struct {
+	// the subject common name of the certificate that the thing presented in the DTLS handshake
+	ClientCommonName string
+	// the prefix of the URI path, for example /acme, removed from the path before the request is handled
+	PathPrefix string
+	// a URI query parameter, for example tenant=acme, removed from the query before the request is handled
+	Query string
+	// the aud claim of the JWTs that the thing authenticates or signs requests with
+	Audience string
+}
+
+// empty returns true if the match has no conditions
+func (m RouteMatch) empty() bool {
+	return m == RouteMatch{}
+}
+
+// Route sends the requests that match it to a realm and tree
+type Route struct {
+	Name  string
+	Match RouteMatch
+	// the URL of AM, defaults to the URL that the gateway was created with
+	URL   string
+	Realm string
+	Tree  string
+	// the timeout of requests to AM, defaults to the timeout that the gateway was created with
+	Timeout time.Duration
+	// the store of the authentication IDs of journeys in progress, defaults to an in-memory cache for the route with
+	// the settings given to SetAuthCache. Routes must not share a store so that tenants can not continue each other's
+	// journeys.
+	AuthStore tokencache.Store
+}
+
+// route is a route with its AM connection
+type route struct {
+	Route
+	connection client.Connection
+}
+
+// routeTable holds the routes of the gateway
+type routeTable struct {
+	mu     sync.RWMutex
+	routes []*route
+	// the routes that sessions were issued through, keyed by session token
+	sessions map[string]*route
+}
+
+// AddRoute adds a route after the routes that have already been added. A connection to AM is created for the route.
+func (c *Gateway) AddRoute(r Route) error {
+	if r.URL == "" {
+		r.URL = c.amURL
+	}
+	if r.Timeout == 0 {
+		r.Timeout = c.timeout
+	}
+	amURL, err := url.Parse(r.URL)
+	if err != nil {
+		return err
+	}
+	connection, err := client.NewConnection().
+		ConnectTo(amURL).
+		InRealm(r.Realm).
+		WithTree(r.Tree).
+		TimeoutRequestAfter(r.Timeout).
+		Create()
+	if err != nil {
+		return fmt.Errorf("route %s: %w", r.Name, err)
+	}
+	return c.addRoute(r, connection)
+}
+
+// addRoute adds a route that uses the given connection
+func (c *Gateway) addRoute(r Route, connection client.Connection) error {
+	if r.Name == "" {
+		return errors.New("route requires a name")
+	}
+	if r.Match.empty() {
+		return fmt.Errorf("route %s requires at least one match condition", r.Name)
+	}
+	if r.Match.PathPrefix != "" && (!strings.HasPrefix(r.Match.PathPrefix, "/") ||
+		strings.HasSuffix(r.Match.PathPrefix, "/")) {
+		return fmt.Errorf("route %s path prefix must start and must not end with /", r.Name)
+	}
+	if r.AuthStore == nil {
+		r.AuthStore = c.routeAuthCache()
+	}
+	c.routes.mu.Lock()
+	defer c.routes.mu.Unlock()
+	for _, existing := range c.routes.routes {
+		if existing.Name == r.Name {
+			return fmt.Errorf("%w: %s", ErrRouteExists, r.Name)
+		}
+	}
+	c.routes.routes = append(c.routes.routes, &route{Route: r, connection: connection})
+	return nil
+}
+
+// RemoveRoute removes the route. Requests that matched the route are sent to the AM connection that the gateway was
+// created with.
+func (c *Gateway) RemoveRoute(name string) error {
+	c.routes.mu.Lock()
+	defer c.routes.mu.Unlock()
+	for i, r := range c.routes.routes {
+		if r.Name != name {
+			continue
+		}
+		c.routes.routes = append(c.routes.routes[:i], c.routes.routes[i+1:]...)
+		for token, sessionRoute := range c.routes.sessions {
+			if sessionRoute == r {
+				delete(c.routes.sessions, token)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownRoute, name)
+}
+
+// Routes returns the routes of the gateway in the order that they are checked
+func (c *Gateway) Routes() []Route {
+	c.routes.mu.RLock()
+	defer c.routes.mu.RUnlock()
+	routes := make([]Route, len(c.routes.routes))
+	for i, r := range c.routes.routes {
+		routes[i] = r.Route
+	}
+	return routes
+}
+
+// hasQuery returns true if the query parameter is one of the parameters of the request
+func hasQuery(query []string, parameter string) bool {
+	for _, q := range query {
+		if q == parameter {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointOf returns the last segment of the request path, which names the endpoint whether or not the path has a
+// route prefix
+func endpointOf(msg coap.Message) string {
+	path := msg.Path()
+	if len(path) == 0 {
+		return ""
+	}
+	return path[len(path)-1]
+}
+
+// audienceOf returns the unverified aud claim of the JWT
+func audienceOf(token string) string {
+	var claims struct {
+		Aud string `json:"aud"`
+	}
+	_ = jws.ExtractClaims(token, &claims)
+	return claims.Aud
+}
+
+// requestAudiences returns the unverified aud claims of the JWTs in the request
+func requestAudiences(msg coap.Message) (audiences []string) {
+	if endpointOf(msg) == "authenticate" {
+		var auth client.AuthenticatePayload
+		if err := json.Unmarshal(msg.Payload(), &auth); err != nil {
+			return nil
+		}
+		for _, cb := range auth.Callbacks {
+			for _, e := range cb.Input {
+				if token, ok := e.Value.(string); ok {
+					if aud := audienceOf(token); aud != "" {
+						audiences = append(audiences, aud)
+					}
+				}
+			}
+		}
+		return audiences
+	}
+	if format, ok := msg.Option(coap.ContentFormat).(coap.MediaType); !ok || format != client.AppJOSE {
+		return nil
+	}
+	if aud := audienceOf(string(msg.Payload())); aud != "" {
+		audiences = append(audiences, aud)
+	}
+	// things sign requests to the thing endpoints with the audience in the protected header
+	if header, err := jws.ExtractHeader(string(msg.Payload())); err == nil && header.Audience != "" {
+		audiences = append(audiences, header.Audience)
+	}
+	return audiences
+}
+
+// pathSegments splits a path into its segments
+func pathSegments(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+// hasPathPrefix returns true if the path has at least one segment after the segments of the prefix
+func hasPathPrefix(path []string, prefix string) bool {
+	segments := pathSegments(prefix)
+	if len(path) <= len(segments) {
+		return false
+	}
+	for i, s := range segments {
+		if path[i] != s {
+			return false
+		}
+	}
+	return true
+}
+
+// matches returns true if the request meets all the conditions of the match
+func (m RouteMatch) matches(msg coap.Message, cert *x509.Certificate, audiences func() []string) bool {
+	if m.ClientCommonName != "" && (cert == nil || cert.Subject.CommonName != m.ClientCommonName) {
+		return false
+	}
+	if m.PathPrefix != "" && !hasPathPrefix(msg.Path(), m.PathPrefix) {
+		return false
+	}
+	if m.Query != "" && !hasQuery(msg.Query(), m.Query) {
+		return false
+	}
+	if m.Audience != "" && !hasQuery(audiences(), m.Audience) {
+		return false
+	}
+	return true
+}
+
+// rewrite removes the path prefix and query parameter of the match from the request
+func (m RouteMatch) rewrite(msg coap.Message) {
+	if m.PathPrefix != "" {
+		msg.SetPath(msg.Path()[len(pathSegments(m.PathPrefix)):])
+	}
+	if m.Query != "" {
+		var query []string
+		for _, q := range msg.Query() {
+			if q != m.Query {
+				query = append(query, q)
+			}
+		}
+		msg.RemoveOption(coap.URIQuery)
+		if len(query) > 0 {
+			msg.SetQuery(query)
+		}
+	}
+}
+
+// matchRoute returns the route of the request, nil if the request should be sent to the AM connection that the
+// gateway was created with. The path prefix and query parameter of the route are removed from the request.
+func (c *Gateway) matchRoute(r *coap.Request, cert *x509.Certificate) *route {
+	c.routes.mu.RLock()
+	defer c.routes.mu.RUnlock()
+	if len(c.routes.routes) == 0 {
+		return nil
+	}
+	// the payload is only parsed if a route matches on the audience
+	audiences := sync.OnceValue(func() []string {
+		return requestAudiences(r.Msg)
+	})
+	for _, rt := range c.routes.routes {
+		if rt.Match.matches(r.Msg, cert, audiences) {
+			rt.Match.rewrite(r.Msg)
+			return rt
+		}
+	}
+	return nil
+}
+
+// sessionRoute returns the route that the session was created on, nil if it was created with the AM connection that
+// the gateway was created with
+func (c *Gateway) sessionRoute(token string) *route {
+	if token == "" {
+		return nil
+	}
+	c.routes.mu.RLock()
+	defer c.routes.mu.RUnlock()
+	return c.routes.sessions[token]
+}
+
+// learnSession records that the session was issued through the route
+func (c *Gateway) learnSession(tokenID string, rt *route) {
+	if rt == nil {
+		return
+	}
+	c.routes.mu.Lock()
+	defer c.routes.mu.Unlock()
+	if c.routes.sessions == nil {
+		c.routes.sessions = make(map[string]*route)
+	}
+	if len(c.routes.sessions) >= maxPoPSessions {
+		for token := range c.routes.sessions {
+			delete(c.routes.sessions, token)
+			break
+		}
+	}
+	c.routes.sessions[tokenID] = rt
+}
+
+// forgetSession removes the session once it has been logged out
+func (c *Gateway) forgetSession(tokenID string) {
+	c.routes.mu.Lock()
+	defer c.routes.mu.Unlock()
+	delete(c.routes.sessions, tokenID)
+}
+
+// routeOf returns the route of the request that the writer responds to, nil for the default route
+func routeOf(w coap.ResponseWriter) *route {
+	if e := exchangeOf(w); e != nil {
+		return e.route
+	}
+	return nil
+}
+
+// routeConnection returns the AM connection of the route or the connection that the gateway was created with for the
+// default route
+func (c *Gateway) routeConnection(rt *route) client.Connection {
+	if rt == nil {
+		return c.connection()
+	}
+	return rt.connection
+}
+
+// requestConnection returns the AM connection of the route of the request that the writer responds to
+func (c *Gateway) requestConnection(w coap.ResponseWriter) client.Connection {
+	return c.routeConnection(routeOf(w))
+}
+
+// sessionConnection returns the AM connection of the route that the session was issued through
+func (c *Gateway) sessionConnection(tokenID string) client.Connection {
+	c.routes.mu.RLock()
+	rt := c.routes.sessions[tokenID]
+	c.routes.mu.RUnlock()
+	return c.routeConnection(rt)
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	frcrypto "github.com/ForgeRock/iot-edge/v7/internal/crypto"
+	"github.com/ForgeRock/iot-edge/v7/internal/mocks"
+	"github.com/ForgeRock/iot-edge/v7/internal/tokencache"
+	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// tenantAM returns a fake AM that answers attribute requests with the name of the tenant and records the requested
+// attribute names
+func tenantAM(tenant string) (am *fakeAM, names chan []string) {
+	am = newFakeAM()
+	names = make(chan []string, 10)
+	am.AttributesFunc = func(_ string, _ string, n []string) ([]byte, error) {
+		names <- n
+		return []byte(`{"tenant":"` + tenant + `"}`), nil
+	}
+	return am, names
+}
+
+// unsignedJWT returns an unsigned JWT with the given claims
+func unsignedJWT(claims string) string {
+	return "." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + "."
+}
+
+func checkTenant(t *testing.T, response coap.Message, tenant string) {
+	t.Helper()
+	checkResponse(t, response, codes.Changed, false)
+	if expected := `{"tenant":"` + tenant + `"}`; string(response.Payload()) != expected {
+		t.Errorf("expected %s, got %s", expected, response.Payload())
+	}
+}
+
+func TestGateway_Route_PathPrefixAndQuery(t *testing.T) {
+	defaultAM, _ := tenantAM("default")
+	gateway := testGateway(&defaultAM.MockClient)
+	gateway.amConnection = defaultAM
+	acme, acmeNames := tenantAM("acme")
+	if err := gateway.addRoute(Route{Name: "acme", Match: RouteMatch{PathPrefix: "/tenants/acme"}}, acme); err != nil {
+		t.Fatal(err)
+	}
+	globex, globexNames := tenantAM("globex")
+	if err := gateway.addRoute(Route{Name: "globex", Match: RouteMatch{Query: "tenant=globex"}}, globex); err != nil {
+		t.Fatal(err)
+	}
+	conn := startAndDial(t, gateway)
+
+	checkTenant(t, post(t, conn, "/tenants/acme/attributes", "thingConfig"), "acme")
+	if names := <-acmeNames; !reflect.DeepEqual(names, []string{"thingConfig"}) {
+		t.Errorf("unexpected attribute names %v", names)
+	}
+	checkTenant(t, post(t, conn, "/attributes", "tenant=globex&thingConfig"), "globex")
+	if names := <-globexNames; !reflect.DeepEqual(names, []string{"thingConfig"}) {
+		t.Errorf("expected the route query to be removed, got %v", names)
+	}
+	checkTenant(t, post(t, conn, "/attributes", "thingConfig"), "default")
+	checkResponse(t, post(t, conn, "/tenants/initech/attributes", ""), codes.NotFound, false)
+
+	if err := gateway.RemoveRoute("acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.RemoveRoute("acme"); !errors.Is(err, ErrUnknownRoute) {
+		t.Errorf("expected %v, got %v", ErrUnknownRoute, err)
+	}
+	checkResponse(t, post(t, conn, "/tenants/acme/attributes", ""), codes.NotFound, false)
+}
+
+func TestGateway_Route_AudienceAndSession(t *testing.T) {
+	defaultAM, _ := tenantAM("default")
+	gateway := testGateway(&defaultAM.MockClient)
+	gateway.amConnection = defaultAM
+	acme, _ := tenantAM("acme")
+	acme.AuthenticateFunc = func(auth client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+		reply.TokenID = "acme-token"
+		return reply, nil
+	}
+	if err := gateway.addRoute(Route{Name: "acme", Match: RouteMatch{Audience: "acme"}}, acme); err != nil {
+		t.Fatal(err)
+	}
+	conn := startAndDial(t, gateway)
+
+	auth, _ := json.Marshal(client.AuthenticatePayload{Callbacks: []callback.Callback{{
+		Type:  callback.TypeHiddenValueCallback,
+		Input: []callback.Entry{{Name: "IDToken1", Value: unsignedJWT(`{"sub":"thing-1","aud":"acme"}`)}},
+	}}})
+	request, err := conn.NewPostRequest("/authenticate", coap.AppJSON, strings.NewReader(string(auth)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := conn.Exchange(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResponse(t, response, codes.Valid, false)
+	var reply client.AuthenticatePayload
+	if err = json.Unmarshal(response.Payload(), &reply); err != nil || reply.TokenID != "acme-token" {
+		t.Fatalf("expected the session of the route, got %s, %v", response.Payload(), err)
+	}
+
+	// requests made with the session stay on the route that issued it
+	checkTenant(t, postJWS(t, conn, "/attributes", "", unsignedJWT(`{"csrf":"acme-token"}`)), "acme")
+	// requests that sign with the audience of the route are sent to it
+	checkTenant(t, postJWS(t, conn, "/attributes", "", unsignedJWT(`{"csrf":"other","aud":"acme"}`)), "acme")
+	checkTenant(t, post(t, conn, "/attributes", ""), "default")
+
+	checkResponse(t, postJWS(t, conn, "/session", "_action=logout", unsignedJWT(`{"csrf":"acme-token"}`)),
+		codes.Changed, false)
+	if acme.logouts.Load() != 1 || defaultAM.logouts.Load() != 0 {
+		t.Errorf("expected the session to be logged out by the route")
+	}
+	checkTenant(t, postJWS(t, conn, "/attributes", "", unsignedJWT(`{"csrf":"acme-token"}`)), "default")
+}
+
+func TestGateway_Route_AuthStore(t *testing.T) {
+	authenticator := func(authID string) *mocks.MockClient {
+		return &mocks.MockClient{
+			AuthenticateFunc: func(auth client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+				reply.AuthId = authID
+				return reply, nil
+			}}
+	}
+	gateway := testGateway(authenticator("default-auth-id"))
+	if err := gateway.addRoute(Route{Name: "acme", Match: RouteMatch{Query: "tenant=acme"}},
+		authenticator("acme-auth-id")); err != nil {
+		t.Fatal(err)
+	}
+	rt := gateway.routes.routes[0]
+
+	reply, err := gateway.authenticate(rt, client.AuthenticatePayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := rt.AuthStore.Get(reply.AuthIDKey); !ok || id != "acme-auth-id" {
+		t.Errorf("expected the auth ID in the store of the route, got %s", id)
+	}
+	if _, ok := gateway.authCache.Get(reply.AuthIDKey); ok {
+		t.Error("expected the auth ID of the route to be isolated from the gateway store")
+	}
+}
+
+func TestGateway_Route_ClientCommonName(t *testing.T) {
+	defaultAM, _ := tenantAM("default")
+	gateway := testGateway(&defaultAM.MockClient)
+	gateway.amConnection = defaultAM
+	acme, _ := tenantAM("acme")
+	if err := gateway.addRoute(Route{Name: "acme", Match: RouteMatch{ClientCommonName: "thing"}}, acme); err != nil {
+		t.Fatal(err)
+	}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	listener, err := gateway.StartListener(ListenerConfig{Address: "127.0.0.1:0", Key: serverKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(gateway.ShutdownCOAPServer)
+
+	_, issued := testCA(t)
+	thingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	selfSigned, _ := frcrypto.PublicKeyCertificate(thingKey)
+	for _, subtest := range []struct {
+		cert   tls.Certificate
+		tenant string
+	}{
+		{cert: issued, tenant: "acme"},
+		{cert: selfSigned, tenant: "default"},
+	} {
+		coapClient := &coap.Client{Net: "udp-dtls", DTLSConfig: dtlsClientConfig(subtest.cert)}
+		conn, err := coapClient.Dial(listener.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTenant(t, post(t, conn, "/attributes", ""), subtest.tenant)
+		_ = conn.Close()
+	}
+}
+
+func TestGateway_AddRoute_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		route Route
+	}{
+		{name: "no-name", route: Route{Match: RouteMatch{Query: "tenant=acme"}}},
+		{name: "no-match", route: Route{Name: "acme"}},
+		{name: "relative-prefix", route: Route{Name: "acme", Match: RouteMatch{PathPrefix: "acme"}}},
+		{name: "trailing-slash", route: Route{Name: "acme", Match: RouteMatch{PathPrefix: "/acme/"}}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			gateway := testGateway(&mocks.MockClient{})
+			if err := gateway.addRoute(subtest.route, &mocks.MockClient{}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	gateway := testGateway(&mocks.MockClient{})
+	route := Route{Name: "acme", Match: RouteMatch{Query: "tenant=acme"}}
+	if err := gateway.addRoute(route, &mocks.MockClient{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.addRoute(route, &mocks.MockClient{}); !errors.Is(err, ErrRouteExists) {
+		t.Errorf("expected %v, got %v", ErrRouteExists, err)
+	}
+	if routes := gateway.Routes(); len(routes) != 1 || routes[0].Name != "acme" {
+		t.Errorf("unexpected routes %v", routes)
+	}
+}
+
+// check that a route added without an auth store is given a cache of its own with the settings of the gateway's cache
+func TestGateway_Route_AuthCache(t *testing.T) {
+	gateway := testGateway(&mocks.MockClient{})
+	gateway.SetAuthCache(time.Minute, time.Minute, 1)
+	err := gateway.addRoute(Route{Name: "acme", Match: RouteMatch{Query: "tenant=acme"}}, &mocks.MockClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := gateway.routes.routes[0].AuthStore
+	if store == gateway.authCache {
+		t.Fatal("route shares the gateway's auth cache")
+	}
+	if err = store.Add("1", "authID"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gateway.authCache.Get("1"); ok {
+		t.Error("authentication ID of the route found in the gateway's cache")
+	}
+	if err = store.Add("2", "authID"); err != tokencache.ErrFull {
+		t.Errorf("expected the route's cache to be limited to one entry, got %v", err)
+	}
+}
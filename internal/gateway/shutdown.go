@@ -0,0 +1,119 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// drainer counts the requests that are being handled and rejects new requests once the listener is shutting down
+type drainer struct {
+	mu       sync.Mutex
+	closing  bool
+	inflight int
+	// closed once the listener is shutting down and no requests are being handled
+	idle chan struct{}
+}
+
+// start a request, returns false if the listener is shutting down
+func (d *drainer) start() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closing {
+		return false
+	}
+	d.inflight++
+	return true
+}
+
+// done ends a request
+func (d *drainer) done() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inflight--
+	if d.closing && d.inflight == 0 {
+		close(d.idle)
+	}
+}
+
+// close stops new requests from starting and returns a channel that is closed once all requests have ended
+func (d *drainer) close() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.closing {
+		d.closing = true
+		d.idle = make(chan struct{})
+		if d.inflight == 0 {
+			close(d.idle)
+		}
+	}
+	return d.idle
+}
+
+// draining rejects requests once the listener is shutting down and keeps track of the requests that are being
+// handled
+func (d *drainer) draining(handler coap.Handler) coap.Handler {
+	return coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+		if !d.start() {
+			requestLogger(r).Debug("rejecting request, gateway is shutting down")
+			w.SetCode(codes.ServiceUnavailable)
+			writeResponse(w, []byte("gateway is shutting down"))
+			return
+		}
+		defer d.done()
+		handler.ServeCOAP(w, r)
+	})
+}
+
+// shutdownCOAPServer waits for the requests that are being handled to complete, or for the context to be done, and
+// then shuts all the CoAP listeners down
+func (c *Gateway) shutdownCOAPServer(ctx context.Context) error {
+	listeners := c.removeListeners()
+	if len(listeners) == 0 {
+		return nil
+	}
+	return c.shutdownListeners(ctx, listeners)
+}
+
+// ShutdownCOAPServer gracefully shuts all the CoAP listeners down. New requests are rejected with 5.03 (Service Unavailable)
+// and the server waits for the requests that are being handled to complete before it stops.
+func (c *Gateway) ShutdownCOAPServer() {
+	_ = c.shutdownCOAPServer(context.Background())
+}
+
+// Shutdown gracefully shuts the gateway down. New requests are rejected with 5.03 (Service Unavailable) while the
+// requests that are being handled are given until the context is done to complete, after which the CoAP server is
+// stopped. The admin and introspection servers are stopped and the gateway's own session with AM is logged out. The
+// context error is returned if requests were cut off.
+func (c *Gateway) Shutdown(ctx context.Context) error {
+	err := c.shutdownCOAPServer(ctx)
+	c.ShutdownAdminServer()
+	c.ShutdownIntrospectionServer()
+	if c.gatewayThing != nil {
+		if logoutErr := c.gatewayThing.Logout(); logoutErr != nil {
+			debug.Log.Warn("unable to log out the gateway session", "error", logoutErr)
+			err = errors.Join(err, logoutErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// fakeGatewayThing records whether the gateway logged out its session
+type fakeGatewayThing struct {
+	thing.Thing
+	loggedOut atomic.Bool
+}
+
+func (t *fakeGatewayThing) Logout() error {
+	t.loggedOut.Store(true)
+	return nil
+}
+
+// startBlockedGateway starts a gateway whose access token requests block until released
+func startBlockedGateway(t *testing.T) (gateway *Gateway, conn *coap.ClientConn, entered chan struct{},
+	release chan struct{}) {
+	entered, release = make(chan struct{}, 1), make(chan struct{})
+	am := newFakeAM()
+	am.AccessTokenFunc = func(string, string) ([]byte, error) {
+		entered <- struct{}{}
+		<-release
+		return []byte(`{"access_token":"a"}`), nil
+	}
+	gateway, conn = startOfflineGateway(t, am, 0)
+	gateway.SetPoPVerification(false, false)
+	return gateway, conn, entered, release
+}
+
+func TestGateway_Shutdown(t *testing.T) {
+	gateway, conn, entered, release := startBlockedGateway(t)
+	gatewayThing := &fakeGatewayThing{}
+	gateway.gatewayThing = gatewayThing
+
+	inflight := make(chan coap.Message, 1)
+	go func() {
+		inflight <- post(t, conn, "/accesstoken", "")
+	}()
+	<-entered
+
+	listener := gateway.Listeners()[0]
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- gateway.Shutdown(context.Background())
+	}()
+	// wait for the gateway to start draining
+	for i := 0; i < 100; i++ {
+		listener.drain.mu.Lock()
+		closing := listener.drain.closing
+		listener.drain.mu.Unlock()
+		if closing {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkResponse(t, post(t, conn, "/attributes", ""), codes.ServiceUnavailable, false)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown completed before the in-flight request, %v", err)
+	default:
+	}
+
+	close(release)
+	checkResponse(t, <-inflight, codes.Changed, false)
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if !gatewayThing.loggedOut.Load() {
+		t.Error("expected the gateway session to be logged out")
+	}
+	if gateway.Address() != "" {
+		t.Error("expected the CoAP server to be stopped")
+	}
+}
+
+func TestGateway_ShutdownDeadline(t *testing.T) {
+	gateway, conn, entered, release := startBlockedGateway(t)
+	defer close(release)
+
+	go func() {
+		request, err := conn.NewPostRequest("/accesstoken", client.AppJOSE, strings.NewReader(thingJWS))
+		if err == nil {
+			_, _ = conn.Exchange(request)
+		}
+	}()
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := gateway.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("shutdown took %v", time.Since(start))
+	}
+}
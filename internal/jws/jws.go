@@ -1,5 +1,5 @@
 /*
- * Copyright 2020 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -27,6 +27,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"strings"
 
 	"gopkg.in/square/go-jose.v2"
@@ -36,6 +37,7 @@ import (
 var (
 	ErrMissingSigner        = errors.New("missing signer")
 	ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+	ErrInvalidSignature     = errors.New("invalid signature")
 )
 
 // JWAFromKey attempts to deduce the signing algorithm by looking at the public key
@@ -143,3 +145,121 @@ func ExtractClaims(token string, claims interface{}) error {
 	}
 	return json.Unmarshal(payload, claims)
 }
+
+// Header contains the protected header values of a signed JWT used by things for proof of possession
+type Header struct {
+	Algorithm jose.SignatureAlgorithm `json:"alg"`
+	KeyID     string                  `json:"kid,omitempty"`
+	Audience  string                  `json:"aud,omitempty"`
+	API       string                  `json:"api,omitempty"`
+	Nonce     *int64                  `json:"nonce,omitempty"`
+}
+
+// ExtractHeader parses a signed JWT and returns the protected header.
+// The signature is NOT checked so the header values are unverified.
+func ExtractHeader(token string) (header Header, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return header, fmt.Errorf("unexpected serialisation")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return header, err
+	}
+	err = json.Unmarshal(b, &header)
+	return header, err
+}
+
+// Verify checks the signature of a compact serialised JWS with the given public key and returns the protected header.
+// Like ExtractClaims, the token is parsed without the JOSE library so that integer nonces are supported.
+func Verify(token string, key interface{}) (header Header, err error) {
+	header, err = ExtractHeader(token)
+	if err != nil {
+		return header, err
+	}
+	parts := strings.Split(token, ".")
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return header, err
+	}
+	if jwk, ok := key.(*jose.JSONWebKey); ok {
+		key = jwk.Key
+	}
+	if private, ok := key.(crypto.Signer); ok {
+		key = private.Public()
+	}
+	input := []byte(parts[0] + "." + parts[1])
+	return header, verifySignature(header.Algorithm, key, input, signature)
+}
+
+// signatureHash returns the hash function used by the given algorithm
+func signatureHash(alg jose.SignatureAlgorithm) (crypto.Hash, error) {
+	switch alg {
+	case jose.ES256, jose.RS256, jose.PS256:
+		return crypto.SHA256, nil
+	case jose.ES384, jose.RS384, jose.PS384:
+		return crypto.SHA384, nil
+	case jose.ES512, jose.RS512, jose.PS512:
+		return crypto.SHA512, nil
+	}
+	return 0, ErrUnsupportedAlgorithm
+}
+
+// ecdsaCurves maps each ECDSA algorithm to the curve that it must be used with
+var ecdsaCurves = map[jose.SignatureAlgorithm]elliptic.Curve{
+	jose.ES256: elliptic.P256(),
+	jose.ES384: elliptic.P384(),
+	jose.ES512: elliptic.P521(),
+}
+
+// verifySignature checks the signature of the signing input using the given algorithm and public key
+func verifySignature(alg jose.SignatureAlgorithm, key interface{}, input, signature []byte) error {
+	if alg == jose.EdDSA {
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return ErrUnsupportedAlgorithm
+		}
+		if !ed25519.Verify(k, input, signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	hash, err := signatureHash(alg)
+	if err != nil {
+		return err
+	}
+	hasher := hash.New()
+	hasher.Write(input)
+	digest := hasher.Sum(nil)
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != ecdsaCurves[alg] {
+			return ErrUnsupportedAlgorithm
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case *rsa.PublicKey:
+		switch alg {
+		case jose.RS256, jose.RS384, jose.RS512:
+			err = rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		case jose.PS256, jose.PS384, jose.PS512:
+			err = rsa.VerifyPSS(k, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		default:
+			return ErrUnsupportedAlgorithm
+		}
+		if err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return ErrUnsupportedAlgorithm
+}
@@ -1,5 +1,5 @@
 /*
- * Copyright 2020 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -23,11 +23,14 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/base64"
 	"errors"
 	"io"
+	"strings"
 	"testing"
 
 	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
 )
 
 var (
@@ -121,3 +124,93 @@ func TestExtractPayload_Success(t *testing.T) {
 		})
 	}
 }
+
+func signedToken(t *testing.T, signer jose.Signer) string {
+	token, err := jwt.Signed(signer).Claims(dummyClaims{Command: "dance"}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func popSigner(t *testing.T, key crypto.Signer) jose.Signer {
+	opts := &jose.SignerOptions{}
+	opts.WithHeader("aud", "https://am.example.com/json/things/*")
+	opts.WithHeader("api", "protocol=2.0,resource=1.0")
+	opts.WithHeader("nonce", 7)
+	signer, err := NewSigner(key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestVerify_Success(t *testing.T) {
+	rs256, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: rsa256Key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		signer jose.Signer
+		key    interface{}
+	}{
+		{name: "es256", signer: popSigner(t, es256Key), key: es256Key.Public()},
+		{name: "es384", signer: popSigner(t, es384Key), key: es384Key.Public()},
+		{name: "es512", signer: popSigner(t, es512Key), key: es512Key.Public()},
+		{name: "eddsa", signer: popSigner(t, eddsaKey), key: eddsaKey.Public()},
+		{name: "ps256", signer: popSigner(t, rsa256Key), key: rsa256Key.Public()},
+		{name: "rs256", signer: rs256, key: rsa256Key.Public()},
+		{name: "private-key", signer: popSigner(t, es256Key), key: es256Key},
+		{name: "jwk", signer: popSigner(t, es256Key), key: &jose.JSONWebKey{Key: es256Key.Public()}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if _, err := Verify(signedToken(t, subtest.signer), subtest.key); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestVerify_Header(t *testing.T) {
+	header, err := Verify(signedToken(t, popSigner(t, es256Key)), es256Key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Algorithm != jose.ES256 || header.Audience != "https://am.example.com/json/things/*" ||
+		header.API != "protocol=2.0,resource=1.0" || header.Nonce == nil || *header.Nonce != 7 {
+		t.Errorf("unexpected header %+v", header)
+	}
+}
+
+func TestVerify_Failure(t *testing.T) {
+	token := signedToken(t, popSigner(t, es256Key))
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"command":"sing"}`)) + "." + parts[2]
+	tests := []struct {
+		name  string
+		token string
+		key   interface{}
+		err   error
+	}{
+		{name: "wrong-key", token: token, key: es384Key.Public(), err: ErrUnsupportedAlgorithm},
+		{name: "other-key", token: token, key: &rsa256Key.PublicKey, err: ErrUnsupportedAlgorithm},
+		{name: "different-key", token: signedToken(t, popSigner(t, rsa384Key)), key: rsa256Key.Public(),
+			err: ErrInvalidSignature},
+		{name: "tampered-payload", token: tampered, key: es256Key.Public(), err: ErrInvalidSignature},
+		{name: "unsigned", token: parts[0] + "." + parts[1] + ".", key: es256Key.Public(), err: ErrInvalidSignature},
+		{name: "not-compact-serialisation", token: "12345.67890", key: es256Key.Public()},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			_, err := Verify(subtest.token, subtest.key)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if subtest.err != nil && err != subtest.err {
+				t.Errorf("expected %v, got %v", subtest.err, err)
+			}
+		})
+	}
+}
@@ -1,5 +1,5 @@
 /*
- * Copyright 2020-2022 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -20,11 +20,14 @@ import (
 	"github.com/ForgeRock/iot-edge/v7/internal/client"
 	"github.com/ForgeRock/iot-edge/v7/internal/introspect"
 	"github.com/dchest/uniuri"
+	"gopkg.in/square/go-jose.v2"
 )
 
 // MockClient mocks a client.Connection
 type MockClient struct {
-	AuthenticateFunc          func(client.AuthenticatePayload) (client.AuthenticatePayload, error)
+	AuthenticateFunc func(client.AuthenticatePayload) (client.AuthenticatePayload, error)
+	// AuthenticateStepUpFunc is used by AuthenticateStepUp, which uses Authenticate if nil
+	AuthenticateStepUpFunc    func(string, string, bool, client.AuthenticatePayload) (client.AuthenticatePayload, error)
 	AMInfoFunc                func() (client.AMInfoResponse, error)
 	AMInfoSet                 client.AMInfoResponse
 	AccessTokenFunc           func(string, string) ([]byte, error)
@@ -32,17 +35,41 @@ type MockClient struct {
 	UserCodeFunc              func(string, string) ([]byte, error)
 	UserTokenFunc             func(string, string) ([]byte, error)
 	IntrospectAccessTokenFunc func(string, string) ([]byte, error)
+	// IntrospectLocallyFunc is used by IntrospectAccessTokenLocally
+	IntrospectLocallyFunc func(string) ([]byte, error)
+	ValidateSessionFunc   func(string, string) (bool, error)
+	LogoutSessionFunc     func(string, string) error
+	SessionInfoFunc       func(string, string) ([]byte, error)
+	InitialiseFunc        func() error
+	PingFunc              func() error
+	ThingKeysFunc         func(string, string) (jose.JSONWebKeySet, error)
 }
 
 func (m *MockClient) ValidateSession(tokenID string, content client.ContentType, payload string) (ok bool, err error) {
+	if m.ValidateSessionFunc != nil {
+		return m.ValidateSessionFunc(tokenID, payload)
+	}
 	return true, nil
 }
 
 func (m *MockClient) LogoutSession(tokenID string, content client.ContentType, payload string) (err error) {
+	if m.LogoutSessionFunc != nil {
+		return m.LogoutSessionFunc(tokenID, payload)
+	}
 	return nil
 }
 
+func (m *MockClient) SessionInfo(tokenID string, content client.ContentType, payload string) (reply []byte, err error) {
+	if m.SessionInfoFunc != nil {
+		return m.SessionInfoFunc(tokenID, payload)
+	}
+	return []byte("{}"), nil
+}
+
 func (m *MockClient) Initialise() error {
+	if m.InitialiseFunc != nil {
+		return m.InitialiseFunc()
+	}
 	m.AMInfoSet = client.AMInfoResponse{
 		AccessTokenURL: "/things",
 		ThingsVersion:  "1",
@@ -50,6 +77,13 @@ func (m *MockClient) Initialise() error {
 	return nil
 }
 
+func (m *MockClient) Ping() error {
+	if m.PingFunc != nil {
+		return m.PingFunc()
+	}
+	return nil
+}
+
 func (m *MockClient) Authenticate(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
 	if m.AuthenticateFunc != nil {
 		return m.AuthenticateFunc(payload)
@@ -58,6 +92,14 @@ func (m *MockClient) Authenticate(payload client.AuthenticatePayload) (reply cli
 	return reply, nil
 }
 
+func (m *MockClient) AuthenticateStepUp(tokenID, tree string, forceAuth bool, payload client.AuthenticatePayload) (
+	reply client.AuthenticatePayload, err error) {
+	if m.AuthenticateStepUpFunc != nil {
+		return m.AuthenticateStepUpFunc(tokenID, tree, forceAuth, payload)
+	}
+	return m.Authenticate(payload)
+}
+
 func (m *MockClient) AMInfo() (info client.AMInfoResponse, err error) {
 	if m.AMInfoFunc != nil {
 		return m.AMInfoFunc()
@@ -79,6 +121,13 @@ func (m *MockClient) IntrospectAccessToken(tokenID string, content client.Conten
 	return introspect.InactiveIntrospectionBytes, nil
 }
 
+func (m *MockClient) IntrospectAccessTokenLocally(_ client.ContentType, payload string) (introspection []byte, err error) {
+	if m.IntrospectLocallyFunc != nil {
+		return m.IntrospectLocallyFunc(payload)
+	}
+	return introspect.InactiveIntrospectionBytes, nil
+}
+
 func (m *MockClient) Attributes(tokenID string, _ client.ContentType, payload string, names []string) (reply []byte, err error) {
 	if m.AttributesFunc != nil {
 		return m.AttributesFunc(tokenID, payload, names)
@@ -99,3 +148,10 @@ func (m *MockClient) UserToken(tokenID string, _ client.ContentType, payload str
 	}
 	return []byte("{}"), nil
 }
+
+func (m *MockClient) ThingKeys(tokenID, thingID string) (keys jose.JSONWebKeySet, err error) {
+	if m.ThingKeysFunc != nil {
+		return m.ThingKeysFunc(tokenID, thingID)
+	}
+	return keys, nil
+}
@@ -1,5 +1,5 @@
 /*
- * Copyright 2020 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -16,10 +16,13 @@
 
 package mocks
 
+import "github.com/ForgeRock/iot-edge/v7/pkg/session"
+
 // MockSession mocks a session.Session
 type MockSession struct {
 	TokenFunc  func() string
 	ValidFunc  func() (bool, error)
+	InfoFunc   func() (session.Info, error)
 	LogoutFunc func() error
 }
 
@@ -43,3 +46,10 @@ func (s *MockSession) Logout() error {
 	}
 	return nil
 }
+
+func (s *MockSession) Info() (session.Info, error) {
+	if s.InfoFunc != nil {
+		return s.InfoFunc()
+	}
+	return session.Info{}, nil
+}
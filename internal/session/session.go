@@ -1,5 +1,5 @@
 /*
- * Copyright 2020-2022 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -18,11 +18,17 @@ package session
 
 import (
 	"crypto"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/url"
 	"time"
 
 	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
 	"github.com/ForgeRock/iot-edge/v7/internal/jws"
 	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
 	"github.com/ForgeRock/iot-edge/v7/pkg/session"
@@ -33,6 +39,8 @@ import (
 type DefaultSession struct {
 	connection client.Connection
 	token      string
+	// persists the session if not nil
+	store session.Store
 }
 
 func (s *DefaultSession) Token() string {
@@ -43,8 +51,35 @@ func (s *DefaultSession) Valid() (bool, error) {
 	return s.connection.ValidateSession(s.token, client.ApplicationJSON, "")
 }
 
+func (s *DefaultSession) Info() (info session.Info, err error) {
+	reply, err := s.connection.SessionInfo(s.token, client.ApplicationJSON, "")
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(reply, &info)
+	return info, err
+}
+
 func (s *DefaultSession) Logout() error {
-	return s.connection.LogoutSession(s.token, client.ApplicationJSON, "")
+	if err := s.connection.LogoutSession(s.token, client.ApplicationJSON, ""); err != nil {
+		return err
+	}
+	s.forget()
+	return nil
+}
+
+// forget deletes the session from the store, unless the store holds another session
+func (s *DefaultSession) forget() {
+	if s.store == nil {
+		return
+	}
+	stored, err := s.store.Load()
+	if err == nil && stored != nil && stored.Token == s.token {
+		err = s.store.Delete()
+	}
+	if err != nil {
+		debug.Log.Warn("failed to delete the stored session", "error", err)
+	}
 }
 
 // PoPSession is produced when the thing was authenticated using a signed JWT.
@@ -52,10 +87,17 @@ type PoPSession struct {
 	DefaultSession
 	nonce int
 	key   crypto.Signer
+	// the first nonce that has not been reserved in the store
+	nonceLimit int
 }
 
 // SignRequestBody will sign the request in order to satisfy the Proof of Possession restriction added to AM sessions.
 func (s *PoPSession) SignRequestBody(url, version string, body interface{}) (signedJWT string, err error) {
+	if s.store != nil && s.nonce >= s.nonceLimit {
+		if err = s.reserveNonces(); err != nil {
+			return "", err
+		}
+	}
 	opts := &jose.SignerOptions{}
 	opts.WithHeader("aud", url)
 	opts.WithHeader("api", version)
@@ -77,6 +119,19 @@ func (s *PoPSession) SignRequestBody(url, version string, body interface{}) (sig
 	return builder.CompactSerialize()
 }
 
+// reserveNonces saves the session with the next window of nonces reserved so that a resumed session never reuses them
+func (s *PoPSession) reserveNonces() error {
+	stored, err := storedSession(s.token, s.key, s.nonce+session.NonceWindow)
+	if err != nil {
+		return err
+	}
+	if err = s.store.Save(stored); err != nil {
+		return fmt.Errorf("failed to reserve session nonces: %w", err)
+	}
+	s.nonceLimit = stored.Nonce
+	return nil
+}
+
 func (s *PoPSession) Valid() (bool, error) {
 	info, err := s.connection.AMInfo()
 	if err != nil {
@@ -89,6 +144,23 @@ func (s *PoPSession) Valid() (bool, error) {
 	return s.connection.ValidateSession(s.token, client.ApplicationJOSE, requestBody)
 }
 
+func (s *PoPSession) Info() (info session.Info, err error) {
+	amInfo, err := s.connection.AMInfo()
+	if err != nil {
+		return info, err
+	}
+	requestBody, err := s.SignRequestBody(amInfo.SessionInfoURL, amInfo.SessionsVersion, nil)
+	if err != nil {
+		return info, err
+	}
+	reply, err := s.connection.SessionInfo(s.token, client.ApplicationJOSE, requestBody)
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(reply, &info)
+	return info, err
+}
+
 func (s *PoPSession) Logout() error {
 	info, err := s.connection.AMInfo()
 	if err != nil {
@@ -98,7 +170,39 @@ func (s *PoPSession) Logout() error {
 	if err != nil {
 		return err
 	}
-	return s.connection.LogoutSession(s.token, client.ApplicationJOSE, requestBody)
+	if err = s.connection.LogoutSession(s.token, client.ApplicationJOSE, requestBody); err != nil {
+		return err
+	}
+	s.forget()
+	return nil
+}
+
+// storedSession returns the state of a session to persist in a store
+func storedSession(token string, key crypto.Signer, nonce int) (stored session.Stored, err error) {
+	stored = session.Stored{Token: token, Nonce: nonce}
+	if key != nil {
+		stored.Key, err = keyThumbprint(key)
+	}
+	return stored, err
+}
+
+// keyThumbprint returns the JWK thumbprint of the key
+func keyThumbprint(key crypto.Signer) (string, error) {
+	thumbprint, err := (&jose.JSONWebKey{Key: key.Public()}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// JourneyLimits bound the authentication journey of a session
+type JourneyLimits struct {
+	// the maximum number of requests made to AM, no limit if zero or less
+	MaxRounds int
+	// the time that the journey must complete in, no deadline if zero
+	Timeout time.Duration
+	// fail as soon as a callback is not handled instead of submitting an empty input
+	Strict bool
 }
 
 type Builder struct {
@@ -108,6 +212,12 @@ type Builder struct {
 	timeout    time.Duration
 	connection client.Connection
 	handlers   []callback.Handler
+	limits     JourneyLimits
+	recording  io.Writer
+	replay     io.Reader
+	upgrade    session.Session
+	forceAuth  bool
+	store      session.Store
 }
 
 func (b *Builder) AuthenticateWith(handlers ...callback.Handler) session.Builder {
@@ -140,8 +250,65 @@ func (b *Builder) TimeoutRequestAfter(d time.Duration) session.Builder {
 	return b
 }
 
+func (b *Builder) WithMaxRounds(n int) session.Builder {
+	if n < 1 {
+		n = -1
+	}
+	b.limits.MaxRounds = n
+	return b
+}
+
+func (b *Builder) TimeoutJourneyAfter(d time.Duration) session.Builder {
+	b.limits.Timeout = d
+	return b
+}
+
+func (b *Builder) FailOnUnhandledCallbacks() session.Builder {
+	b.limits.Strict = true
+	return b
+}
+
+func (b *Builder) RecordJourneyTo(w io.Writer) session.Builder {
+	b.recording = w
+	return b
+}
+
+func (b *Builder) ReplayJourneyFrom(r io.Reader) session.Builder {
+	b.replay = r
+	return b
+}
+
+func (b *Builder) StepUp(existing session.Session) session.Builder {
+	b.upgrade = existing
+	return b
+}
+
+func (b *Builder) ForceAuth() session.Builder {
+	b.forceAuth = true
+	return b
+}
+
+func (b *Builder) WithStore(store session.Store) session.Builder {
+	b.store = store
+	return b
+}
+
+// WithLimits sets all the limits of the authentication journey
+func (b *Builder) WithLimits(limits JourneyLimits) *Builder {
+	b.limits = limits
+	return b
+}
+
 func (b *Builder) Create() (session.Session, error) {
 	var err error
+	if b.connection == nil && b.replay != nil {
+		if b.connection, err = client.NewReplayConnection(b.replay); err != nil {
+			return nil, err
+		}
+	}
+	if b.connection == nil && b.upgrade != nil {
+		b.connection = connectionOf(b.upgrade)
+	}
 	if b.connection == nil {
 		if b.url == nil {
 			return nil, errors.New("url must be provided")
@@ -155,39 +322,187 @@ func (b *Builder) Create() (session.Session, error) {
 			return nil, err
 		}
 	}
+	if b.store != nil && b.upgrade == nil {
+		if resumed := b.resume(); resumed != nil {
+			return resumed, nil
+		}
+	}
+	connection := b.connection
+	if b.upgrade != nil {
+		if b.tree == "" {
+			return nil, errors.New("session step-up requires a tree")
+		}
+		var ok bool
+		if connection, ok = client.StepUpConnection(connection, b.upgrade.Token(), b.tree, b.forceAuth); !ok {
+			return nil, session.ErrStepUpNotSupported
+		}
+	}
+	if b.recording != nil {
+		connection = client.RecordJourney(connection, b.recording)
+	}
 	auth := client.AuthenticatePayload{}
 	var signer crypto.Signer
-	for {
-		if auth, err = b.connection.Authenticate(auth); err != nil {
+	var unhandled []callback.Callback
+	var deadline time.Time
+	if b.limits.Timeout > 0 {
+		deadline = clock.Clock().Add(b.limits.Timeout)
+	}
+	for round := 1; ; round++ {
+		if b.limits.MaxRounds > 0 && round > b.limits.MaxRounds {
+			return nil, journeyError(session.ErrTooManyRounds, unhandled)
+		}
+		if !deadline.IsZero() && !clock.Clock().Before(deadline) {
+			return nil, journeyError(session.ErrJourneyTimeout, unhandled)
+		}
+		if auth, err = connection.Authenticate(auth); err != nil {
 			return nil, err
 		}
 
 		if auth.HasSessionToken() {
+			var nonce int
+			if signer == nil && b.upgrade != nil {
+				// the upgraded session keeps the proof of possession restriction of the existing session
+				signer, nonce = popKey(b.upgrade, auth.TokenID)
+			}
+			debug.Log.Debug("authentication journey complete", "pop", signer != nil, "rounds", round,
+				"stepUp", b.upgrade != nil)
 			defaultSession := DefaultSession{
 				connection: b.connection,
 				token:      auth.TokenID,
+				store:      b.store,
 			}
+			b.save(auth.TokenID, signer, nonce)
 			if signer != nil {
 				return &PoPSession{
 					DefaultSession: defaultSession,
+					nonce:          nonce,
 					key:            signer,
+					nonceLimit:     nonce,
 				}, nil
 			}
 			return &defaultSession, nil
 		}
-		if signer, err = processCallbacks(b.handlers, auth.Callbacks); err != nil {
+		if signer, unhandled, err = processCallbacks(b.handlers, auth.Callbacks); err != nil {
 			return nil, err
 		}
+		if len(unhandled) == 0 {
+			continue
+		}
+		unhandledErr := &session.UnhandledCallbacksError{Callbacks: unhandled}
+		if b.limits.Strict {
+			return nil, unhandledErr
+		}
+		debug.Log.Warn("submitting callbacks with empty inputs", "error", unhandledErr)
 	}
 }
 
-// processCallbacks attempts to respond to the callbacks with the given callback handlers
-func processCallbacks(handlers []callback.Handler, callbacks []callback.Callback) (signer crypto.Signer, err error) {
+// resume returns the stored session if it is still valid
+func (b *Builder) resume() session.Session {
+	stored, err := b.store.Load()
+	if err != nil {
+		debug.Log.Warn("failed to load the stored session", "error", err)
+		return nil
+	}
+	if stored == nil || stored.Token == "" {
+		return nil
+	}
+	defaultSession := DefaultSession{
+		connection: b.connection,
+		token:      stored.Token,
+		store:      b.store,
+	}
+	var resumed session.Session = &defaultSession
+	if stored.Key != "" {
+		key := b.handlerKey(stored.Key)
+		if key == nil {
+			debug.Log.Debug("none of the callback handlers sign with the key of the stored session")
+			return nil
+		}
+		// continue after the reserved nonces since some of them may have been used before the restart
+		resumed = &PoPSession{
+			DefaultSession: defaultSession,
+			nonce:          stored.Nonce,
+			key:            key,
+			nonceLimit:     stored.Nonce,
+		}
+	}
+	if valid, err := resumed.Valid(); err != nil || !valid {
+		debug.Log.Debug("stored session is not valid", "error", err)
+		return nil
+	}
+	debug.Log.Debug("resumed the stored session", "pop", stored.Key != "")
+	return resumed
+}
+
+// handlerKey returns the signing key of the callback handlers with the given JWK thumbprint
+func (b *Builder) handlerKey(thumbprint string) crypto.Signer {
+	for _, h := range b.handlers {
+		key := handlerSigningKey(h)
+		if key == nil {
+			continue
+		}
+		if candidate, err := keyThumbprint(key); err == nil && candidate == thumbprint {
+			return key
+		}
+	}
+	return nil
+}
+
+// save the created session in the store. The session is still usable if it can't be saved, it just can't be resumed.
+func (b *Builder) save(token string, key crypto.Signer, nonce int) {
+	if b.store == nil {
+		return
+	}
+	stored, err := storedSession(token, key, nonce)
+	if err == nil {
+		err = b.store.Save(stored)
+	}
+	if err != nil {
+		debug.Log.Warn("failed to save the session", "error", err)
+	}
+}
+
+// connectionOf returns the connection of the session if it was created by this package
+func connectionOf(s session.Session) client.Connection {
+	switch s := s.(type) {
+	case *DefaultSession:
+		return s.connection
+	case *PoPSession:
+		return s.connection
+	}
+	return nil
+}
+
+// popKey returns the proof of possession key of the session and the next nonce if the session token is unchanged
+func popKey(s session.Session, token string) (key crypto.Signer, nonce int) {
+	popSession, ok := s.(*PoPSession)
+	if !ok {
+		return nil, 0
+	}
+	if popSession.token == token {
+		nonce = popSession.nonce
+	}
+	return popSession.key, nonce
+}
+
+// journeyError joins the error that ended the journey with the callbacks that were not handled in the last round
+func journeyError(err error, unhandled []callback.Callback) error {
+	if len(unhandled) == 0 {
+		return err
+	}
+	return errors.Join(err, &session.UnhandledCallbacksError{Callbacks: unhandled})
+}
+
+// processCallbacks attempts to respond to the callbacks with the given callback handlers. The callbacks that none of
+// the handlers handled are returned.
+func processCallbacks(handlers []callback.Handler, callbacks []callback.Callback) (signer crypto.Signer,
+	unhandled []callback.Callback, err error) {
 	for _, cb := range callbacks {
+		debug.Log.Debug("processing callback", "type", cb.Type, "id", cb.ID())
+		handled := false
 		for _, h := range handlers {
-			handled, err := h.Handle(cb)
-			if err != nil {
-				return nil, err
+			if handled, err = h.Handle(cb); err != nil {
+				return nil, nil, err
 			}
 			if !handled {
 				continue
@@ -197,8 +512,11 @@ func processCallbacks(handlers []callback.Handler, callbacks []callback.Callback
 			}
 			break
 		}
+		if !handled {
+			unhandled = append(unhandled, cb)
+		}
 	}
-	return signer, nil
+	return signer, unhandled, nil
 }
 
 func handlerSigningKey(handler callback.Handler) crypto.Signer {
@@ -1,5 +1,5 @@
 /*
- * Copyright 2020 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -21,10 +21,18 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
+	"errors"
 	"math/big"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
+	"github.com/ForgeRock/iot-edge/v7/internal/mocks"
 	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+	"github.com/ForgeRock/iot-edge/v7/pkg/session"
 )
 
 func Test_processCallbacks(t *testing.T) {
@@ -68,27 +76,533 @@ func Test_processCallbacks(t *testing.T) {
 	nameHL := callback.NameHandler{Name: "Bob"}
 
 	tests := []struct {
-		name     string
-		handlers []callback.Handler
-		pop      bool
+		name      string
+		handlers  []callback.Handler
+		pop       bool
+		unhandled int
 	}{
 		{name: "Name/Auth/Reg", handlers: []callback.Handler{nameHL, authHL, regHL}, pop: true},
-		{name: "Name/Auth", handlers: []callback.Handler{nameHL, authHL}, pop: true},
-		{name: "Name/Reg", handlers: []callback.Handler{nameHL, regHL}, pop: true},
-		{name: "Auth/Reg", handlers: []callback.Handler{authHL, regHL}, pop: true},
-		{name: "Name", handlers: []callback.Handler{nameHL}, pop: false},
-		{name: "Auth", handlers: []callback.Handler{authHL}, pop: true},
-		{name: "Reg", handlers: []callback.Handler{regHL}, pop: true},
+		{name: "Name/Auth", handlers: []callback.Handler{nameHL, authHL}, pop: true, unhandled: 1},
+		{name: "Name/Reg", handlers: []callback.Handler{nameHL, regHL}, pop: true, unhandled: 1},
+		{name: "Auth/Reg", handlers: []callback.Handler{authHL, regHL}, pop: true, unhandled: 1},
+		{name: "Name", handlers: []callback.Handler{nameHL}, pop: false, unhandled: 2},
+		{name: "Auth", handlers: []callback.Handler{authHL}, pop: true, unhandled: 2},
+		{name: "Reg", handlers: []callback.Handler{regHL}, pop: true, unhandled: 2},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			signer, err := processCallbacks(test.handlers, callbacks)
+			signer, unhandled, err := processCallbacks(test.handlers, callbacks)
 			if err != nil {
 				t.Errorf("processCallbacks() - unexpected error: %s", err)
 			}
 			if test.pop && signer == nil {
 				t.Errorf("processCallbacks() should have returned a signing key")
 			}
+			if len(unhandled) != test.unhandled {
+				t.Errorf("processCallbacks() - expected %d unhandled callbacks, got %v", test.unhandled, unhandled)
+			}
 		})
 	}
 }
+
+// loopingAM returns a connection that never completes the journey and counts the authenticate requests
+func loopingAM(rounds *int) *mocks.MockClient {
+	return &mocks.MockClient{
+		AuthenticateFunc: func(client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+			*rounds++
+			reply.AuthId = "auth-id"
+			reply.Callbacks = []callback.Callback{{
+				Type:   callback.TypeHiddenValueCallback,
+				Output: []callback.Entry{{Name: "id", Value: "unknown-node"}, {Name: "value", Value: "challenge"}},
+				Input:  []callback.Entry{{Name: "IDToken1", Value: ""}},
+			}}
+			return reply, nil
+		}}
+}
+
+func TestBuilder_Create_MaxRounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		builder  func(b *Builder) session.Builder
+		expected int
+	}{
+		{name: "three", builder: func(b *Builder) session.Builder { return b.WithMaxRounds(3) }, expected: 3},
+		{name: "thirty", builder: func(b *Builder) session.Builder { return b.WithMaxRounds(30) }, expected: 30},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rounds := 0
+			builder := &Builder{connection: loopingAM(&rounds)}
+			_, err := test.builder(builder).Create()
+			if !errors.Is(err, session.ErrTooManyRounds) {
+				t.Fatalf("expected %v, got %v", session.ErrTooManyRounds, err)
+			}
+			var unhandled *session.UnhandledCallbacksError
+			if !errors.As(err, &unhandled) || len(unhandled.Callbacks) != 1 {
+				t.Errorf("expected the unhandled callback, got %v", err)
+			}
+			if !strings.Contains(err.Error(), "id=unknown-node") {
+				t.Errorf("expected the callback ID in the error, got %v", err)
+			}
+			if rounds != test.expected {
+				t.Errorf("expected %d rounds, got %d", test.expected, rounds)
+			}
+		})
+	}
+}
+
+// check that a journey that polls for longer than any fixed number of rounds is not limited by default
+func TestBuilder_Create_NoRoundLimit(t *testing.T) {
+	rounds := 0
+	connection := loopingAM(&rounds)
+	authenticate := connection.AuthenticateFunc
+	connection.AuthenticateFunc = func(payload client.AuthenticatePayload) (client.AuthenticatePayload, error) {
+		if rounds == 100 {
+			var reply client.AuthenticatePayload
+			reply.TokenID = "token"
+			return reply, nil
+		}
+		return authenticate(payload)
+	}
+	s, err := (&Builder{connection: connection}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Token() != "token" {
+		t.Errorf("unexpected session token %s", s.Token())
+	}
+}
+
+func TestBuilder_Create_JourneyTimeout(t *testing.T) {
+	now := time.Now()
+	clock.Clock = func() time.Time {
+		return now
+	}
+	t.Cleanup(func() {
+		clock.Clock = clock.DefaultClock()
+	})
+	rounds := 0
+	connection := loopingAM(&rounds)
+	authenticate := connection.AuthenticateFunc
+	connection.AuthenticateFunc = func(payload client.AuthenticatePayload) (client.AuthenticatePayload, error) {
+		now = now.Add(time.Second)
+		return authenticate(payload)
+	}
+	_, err := (&Builder{connection: connection}).
+		WithMaxRounds(0).
+		TimeoutJourneyAfter(5 * time.Second).
+		Create()
+	if !errors.Is(err, session.ErrJourneyTimeout) {
+		t.Fatalf("expected %v, got %v", session.ErrJourneyTimeout, err)
+	}
+	if rounds != 5 {
+		t.Errorf("expected 5 rounds, got %d", rounds)
+	}
+}
+
+func TestBuilder_Create_FailOnUnhandledCallbacks(t *testing.T) {
+	rounds := 0
+	_, err := (&Builder{connection: loopingAM(&rounds)}).
+		AuthenticateWith(callback.NameHandler{Name: "Bob"}).
+		FailOnUnhandledCallbacks().
+		Create()
+	var unhandled *session.UnhandledCallbacksError
+	if !errors.As(err, &unhandled) {
+		t.Fatalf("expected an unhandled callbacks error, got %v", err)
+	}
+	if unhandled.Callbacks[0].ID() != "unknown-node" {
+		t.Errorf("unexpected callbacks %v", unhandled.Callbacks)
+	}
+	if rounds != 1 {
+		t.Errorf("expected the journey to stop after the first round, got %d rounds", rounds)
+	}
+}
+
+// passwordAM returns a connection to a tree that authenticates with a username and password
+func passwordAM() *mocks.MockClient {
+	return &mocks.MockClient{
+		AuthenticateFunc: func(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+			if len(payload.Callbacks) == 0 {
+				reply.AuthId = "secret-auth-id"
+				reply.Callbacks = []callback.Callback{
+					{
+						Type:   callback.TypeNameCallback,
+						Output: []callback.Entry{{Name: "prompt", Value: "User Name"}},
+						Input:  []callback.Entry{{Name: "IDToken1", Value: ""}},
+					},
+					{
+						Type:   callback.TypePasswordCallback,
+						Output: []callback.Entry{{Name: "prompt", Value: "Password"}},
+						Input:  []callback.Entry{{Name: "IDToken2", Value: ""}},
+					},
+				}
+				return reply, nil
+			}
+			if payload.Callbacks[1].Input[0].Value != "secret-password" {
+				return reply, client.ResponseError{ResponseCode: client.CodeUnauthorized}
+			}
+			reply.TokenID = "secret-token"
+			return reply, nil
+		},
+	}
+}
+
+func TestBuilder_RecordJourneyTo(t *testing.T) {
+	var recording strings.Builder
+	handlers := []callback.Handler{
+		callback.NameHandler{Name: "thing-1"},
+		callback.PasswordHandler{Password: "secret-password"},
+	}
+	_, err := (&Builder{connection: passwordAM()}).
+		AuthenticateWith(handlers...).
+		RecordJourneyTo(&recording).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(recording.String(), "\n"); lines != 2 {
+		t.Errorf("expected 2 rounds, got %d", lines)
+	}
+	for _, secret := range []string{"thing-1", "secret-password", "secret-auth-id", "secret-token"} {
+		if strings.Contains(recording.String(), secret) {
+			t.Errorf("expected %s to be redacted from the recording\n%s", secret, recording.String())
+		}
+	}
+
+	// the handlers pass against the recording
+	replayed, err := (&Builder{}).
+		AuthenticateWith(handlers...).
+		ReplayJourneyFrom(strings.NewReader(recording.String())).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.Token() == "" {
+		t.Error("expected a session token")
+	}
+	// a missing handler fails
+	_, err = (&Builder{}).
+		AuthenticateWith(callback.NameHandler{Name: "thing-1"}).
+		ReplayJourneyFrom(strings.NewReader(recording.String())).
+		Create()
+	if err == nil || !strings.Contains(err.Error(), "input IDToken2 was not set") {
+		t.Errorf("expected an unset input error, got %v", err)
+	}
+}
+
+func TestBuilder_ReplayJourneyFrom_Error(t *testing.T) {
+	var recording strings.Builder
+	handlers := []callback.Handler{
+		callback.NameHandler{Name: "thing-1"},
+		callback.PasswordHandler{Password: "wrong-password"},
+	}
+	_, err := (&Builder{connection: passwordAM()}).
+		AuthenticateWith(handlers...).
+		RecordJourneyTo(&recording).
+		Create()
+	if !client.CodeUnauthorized.IsWrappedIn(err) {
+		t.Fatalf("expected an unauthorized error, got %v", err)
+	}
+	_, err = (&Builder{}).
+		AuthenticateWith(handlers...).
+		ReplayJourneyFrom(strings.NewReader(recording.String())).
+		Create()
+	if !client.CodeUnauthorized.IsWrappedIn(err) {
+		t.Errorf("expected the recorded unauthorized error, got %v", err)
+	}
+	if _, err = (&Builder{}).ReplayJourneyFrom(strings.NewReader("")).Create(); err == nil {
+		t.Error("expected an error for an empty recording")
+	}
+}
+
+func TestBuilder_StepUp(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	connection := passwordAM()
+	var tokenID, tree string
+	var forceAuth bool
+	connection.AuthenticateStepUpFunc = func(token, stepUpTree string, force bool,
+		payload client.AuthenticatePayload) (client.AuthenticatePayload, error) {
+		tokenID, tree, forceAuth = token, stepUpTree, force
+		reply, err := connection.Authenticate(payload)
+		if reply.TokenID != "" && force {
+			reply.TokenID = "reauthenticated-token"
+		} else if reply.TokenID != "" {
+			reply.TokenID = token
+		}
+		return reply, err
+	}
+	existing := &PoPSession{
+		DefaultSession: DefaultSession{connection: connection, token: "existing-token"},
+		nonce:          3,
+		key:            key,
+	}
+	handlers := []callback.Handler{
+		callback.NameHandler{Name: "thing-1"},
+		callback.PasswordHandler{Password: "secret-password"},
+	}
+
+	// the connection of the existing session is used
+	upgraded, err := (&Builder{}).
+		WithTree("step-up-tree").
+		AuthenticateWith(handlers...).
+		StepUp(existing).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenID != "existing-token" || tree != "step-up-tree" || forceAuth {
+		t.Errorf("unexpected step-up request %s, %s, %v", tokenID, tree, forceAuth)
+	}
+	popSession, ok := upgraded.(*PoPSession)
+	if !ok {
+		t.Fatalf("expected the upgraded session to keep the proof of possession key, got %T", upgraded)
+	}
+	if popSession.Token() != "existing-token" || popSession.key != key || popSession.nonce != 3 {
+		t.Errorf("unexpected upgraded session %+v", popSession)
+	}
+
+	// a new session token starts a new nonce sequence
+	reauthenticated, err := (&Builder{}).
+		WithTree("step-up-tree").
+		AuthenticateWith(handlers...).
+		StepUp(existing).
+		ForceAuth().
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !forceAuth {
+		t.Error("expected ForceAuth")
+	}
+	if popSession = reauthenticated.(*PoPSession); popSession.Token() != "reauthenticated-token" || popSession.nonce != 0 {
+		t.Errorf("unexpected re-authenticated session %+v", popSession)
+	}
+}
+
+func TestBuilder_StepUp_Error(t *testing.T) {
+	existing := &DefaultSession{connection: passwordAM(), token: "existing-token"}
+	if _, err := (&Builder{}).StepUp(existing).Create(); err == nil {
+		t.Error("expected an error without a tree")
+	}
+	// connections to the IoT Gateway do not support step-up
+	gateway := struct{ client.Connection }{passwordAM()}
+	_, err := (&Builder{connection: gateway}).WithTree("step-up-tree").StepUp(existing).Create()
+	if !errors.Is(err, session.ErrStepUpNotSupported) {
+		t.Errorf("expected %v, got %v", session.ErrStepUpNotSupported, err)
+	}
+}
+
+const sessionInfoJSON = `{
+	"username": "thing-1",
+	"universalId": "id=thing-1,ou=user,o=things,ou=services,ou=am-config",
+	"realm": "/things",
+	"latestAccessTime": "2023-06-01T10:00:00Z",
+	"maxIdleExpirationTime": "2023-06-01T10:30:00Z",
+	"maxSessionExpirationTime": "2023-06-01T12:00:00Z",
+	"properties": {"Service": "reg-tree", "AMCtxId": "ctx"}
+}`
+
+func TestDefaultSession_Info(t *testing.T) {
+	var requestedToken string
+	s := &DefaultSession{
+		connection: &mocks.MockClient{
+			SessionInfoFunc: func(tokenID string, _ string) ([]byte, error) {
+				requestedToken = tokenID
+				return []byte(sessionInfoJSON), nil
+			},
+		},
+		token: "token",
+	}
+	info, err := s.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requestedToken != "token" {
+		t.Errorf("unexpected token %s", requestedToken)
+	}
+	if info.UniversalID != "id=thing-1,ou=user,o=things,ou=services,ou=am-config" || info.Realm != "/things" {
+		t.Errorf("unexpected info %+v", info)
+	}
+	idle := time.Date(2023, 6, 1, 10, 30, 0, 0, time.UTC)
+	if !info.MaxIdleExpiry.Equal(idle) || !info.MaxExpiry.Equal(idle.Add(90*time.Minute)) {
+		t.Errorf("unexpected expiry times %v, %v", info.MaxIdleExpiry, info.MaxExpiry)
+	}
+	if !info.Expiry().Equal(idle) {
+		t.Errorf("expected the idle expiry, got %v", info.Expiry())
+	}
+	if info.Tree() != "reg-tree" {
+		t.Errorf("unexpected tree %s", info.Tree())
+	}
+}
+
+func TestPoPSession_Info(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	connection := &mocks.MockClient{
+		AMInfoSet: client.AMInfoResponse{
+			SessionsVersion: "resource=4.0",
+			SessionInfoURL:  "https://am.example.com/json/sessions?_action=getSessionInfo",
+		},
+	}
+	var header jws.Header
+	connection.SessionInfoFunc = func(_ string, payload string) (reply []byte, err error) {
+		if header, err = jws.Verify(payload, key.Public()); err != nil {
+			return nil, err
+		}
+		return []byte(sessionInfoJSON), nil
+	}
+	s := &PoPSession{
+		DefaultSession: DefaultSession{connection: connection, token: "token"},
+		key:            key,
+	}
+	info, err := s.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Audience != connection.AMInfoSet.SessionInfoURL || header.API != "resource=4.0" {
+		t.Errorf("unexpected header %+v", header)
+	}
+	if info.Username != "thing-1" {
+		t.Errorf("unexpected info %+v", info)
+	}
+}
+
+// memoryStore is a session store that counts the saves
+type memoryStore struct {
+	stored  *session.Stored
+	saves   int
+	saveErr error
+}
+
+func (s *memoryStore) Load() (*session.Stored, error) {
+	return s.stored, nil
+}
+
+func (s *memoryStore) Save(stored session.Stored) error {
+	if s.saveErr != nil {
+		return s.saveErr
+	}
+	s.saves++
+	s.stored = &stored
+	return nil
+}
+
+func (s *memoryStore) Delete() error {
+	s.stored = nil
+	return nil
+}
+
+func TestBuilder_WithStore_Resume(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	thumbprint, _ := keyThumbprint(key)
+	store := &memoryStore{stored: &session.Stored{Token: "stored-token", Key: thumbprint, Nonce: 250}}
+	var nonce int64
+	connection := &mocks.MockClient{
+		AuthenticateFunc: func(client.AuthenticatePayload) (client.AuthenticatePayload, error) {
+			t.Fatal("expected the stored session to be resumed")
+			return client.AuthenticatePayload{}, nil
+		},
+		ValidateSessionFunc: func(token string, payload string) (bool, error) {
+			header, err := jws.Verify(payload, key.Public())
+			if err != nil {
+				return false, err
+			}
+			nonce = *header.Nonce
+			return token == "stored-token", nil
+		},
+	}
+	resumed, err := (&Builder{connection: connection}).
+		AuthenticateWith(callback.AuthenticateHandler{Key: key, KeyID: "kid"}).
+		WithStore(store).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	popSession, ok := resumed.(*PoPSession)
+	if !ok {
+		t.Fatalf("expected a proof of possession session, got %T", resumed)
+	}
+	// the nonces used before the restart may not have been saved so the session continues after the reserved nonces
+	if nonce != 250 || store.saves != 1 || store.stored.Nonce != 250+session.NonceWindow {
+		t.Errorf("unexpected nonce %d, saves %d and stored session %+v", nonce, store.saves, store.stored)
+	}
+	for i := 1; i < session.NonceWindow; i++ {
+		if _, err = popSession.SignRequestBody("aud", "1", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.saves != 1 {
+		t.Errorf("expected the nonces to be reserved, got %d saves", store.saves)
+	}
+	if _, err = popSession.SignRequestBody("aud", "1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 2 || store.stored.Nonce != 250+2*session.NonceWindow {
+		t.Errorf("expected the next window to be reserved, got %d saves and %+v", store.saves, store.stored)
+	}
+	// a nonce is not used unless it can be reserved
+	store.saveErr = errors.New("disk full")
+	popSession.nonce = popSession.nonceLimit
+	if _, err = popSession.SignRequestBody("aud", "1", nil); !errors.Is(err, store.saveErr) {
+		t.Errorf("expected %v, got %v", store.saveErr, err)
+	}
+
+	// logging out deletes the stored session
+	store.saveErr = nil
+	if err = popSession.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	if store.stored != nil {
+		t.Errorf("expected the stored session to be deleted, got %+v", store.stored)
+	}
+}
+
+func TestBuilder_WithStore_Authenticate(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherThumbprint, _ := keyThumbprint(otherKey)
+	tests := []struct {
+		name   string
+		stored *session.Stored
+		valid  bool
+	}{
+		{name: "nothing-stored"},
+		{name: "invalid", stored: &session.Stored{Token: "stored-token"}},
+		{name: "other-key", stored: &session.Stored{Token: "stored-token", Key: otherThumbprint}, valid: true},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			store := &memoryStore{stored: subtest.stored}
+			connection := &mocks.MockClient{
+				AuthenticateFunc: func(client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+					reply.TokenID = "new-token"
+					return reply, nil
+				},
+				ValidateSessionFunc: func(string, string) (bool, error) {
+					return subtest.valid, nil
+				},
+			}
+			created, err := (&Builder{connection: connection}).
+				AuthenticateWith(callback.AuthenticateHandler{Key: key, KeyID: "kid"}).
+				WithStore(store).
+				Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created.Token() != "new-token" || store.stored == nil || store.stored.Token != "new-token" {
+				t.Errorf("expected the new session to be stored, got %+v", store.stored)
+			}
+		})
+	}
+}
+
+func TestDefaultSession_Logout_Store(t *testing.T) {
+	// a session does not delete the session that replaced it in the store
+	store := &memoryStore{stored: &session.Stored{Token: "replacement-token"}}
+	s := &DefaultSession{connection: &mocks.MockClient{}, token: "token", store: store}
+	if err := s.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	if store.stored == nil {
+		t.Error("expected the replacement session to remain stored")
+	}
+}
@@ -1,5 +1,5 @@
 /*
- * Copyright 2020-2022 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -22,16 +22,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/ForgeRock/iot-edge/v7/internal/client"
 	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
 	isession "github.com/ForgeRock/iot-edge/v7/internal/session"
 	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
 	"github.com/ForgeRock/iot-edge/v7/pkg/session"
 	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
+	"github.com/dchest/uniuri"
 )
 
 const (
@@ -42,9 +45,26 @@ const (
 )
 
 type DefaultThing struct {
+	thingID    string
 	connection client.Connection
 	handlers   []callback.Handler
+	limits     isession.JourneyLimits
 	session    session.Session
+	// creates a connection for the key rotation tree, the thing's connection is used if nil
+	rotationConnection func() (client.Connection, error)
+	// the handlers for the trees advised by AM, the session is only stepped up on advice if not nil
+	stepUpHandlers []callback.Handler
+	// persists the thing's session if not nil
+	store session.Store
+}
+
+// logger returns a logger that annotates records with the thing ID and a new request ID
+func (t *DefaultThing) logger() *slog.Logger {
+	logger := debug.Log.With(debug.RequestID(uniuri.NewLen(8)))
+	if t.thingID != "" {
+		logger = logger.With(debug.ThingID(t.thingID))
+	}
+	return logger
 }
 
 func (t *DefaultThing) Logout() error {
@@ -53,26 +73,71 @@ func (t *DefaultThing) Logout() error {
 
 // makeAuthorisedRequest makes a request that requires a session token
 // if the session has expired, the session is renewed and the request is repeated
+// if AM advises a step-up and the thing steps up on advice, the session is stepped up and the request is repeated
 func (t *DefaultThing) makeAuthorisedRequest(f func(session session.Session) error) (err error) {
-	for i := 0; i < 2; i++ {
+	renewed, steppedUp := false, false
+	for {
 		err = f(t.session)
-		if err == nil || !client.CodeUnauthorized.IsWrappedIn(err) {
+		if err == nil {
+			return nil
+		}
+		if tree, ok := client.AdvisedTree(err); ok && t.stepUpHandlers != nil && !steppedUp {
+			steppedUp = true
+			if stepUpErr := t.StepUp(tree, t.stepUpHandlers...); stepUpErr != nil {
+				t.logger().Warn("failed to step up the session", "tree", tree, "error", stepUpErr)
+				return err
+			}
+			continue
+		}
+		if renewed || !client.CodeUnauthorized.IsWrappedIn(err) {
 			return err
 		}
 		valid, validateErr := t.session.Valid()
 		if validateErr != nil || valid {
 			return err
 		}
-		builder := &isession.Builder{}
-		t.session, err = builder.
-			WithConnection(t.connection).
+		t.session, err = t.sessionBuilder().
 			AuthenticateWith(t.handlers...).
 			Create()
 		if err != nil {
 			return err
 		}
+		renewed = true
 	}
-	return err
+}
+
+// RequestWithSession makes a request with the token of the thing's session. If the session has expired, the session
+// is renewed and the request is repeated.
+func (t *DefaultThing) RequestWithSession(f func(tokenID string) error) error {
+	return t.makeAuthorisedRequest(func(session session.Session) error {
+		return f(session.Token())
+	})
+}
+
+// sessionBuilder returns a builder for the thing's sessions
+func (t *DefaultThing) sessionBuilder() session.Builder {
+	builder := (&isession.Builder{}).WithLimits(t.limits).WithConnection(t.connection)
+	if t.store != nil {
+		builder = builder.WithStore(t.store)
+	}
+	return builder
+}
+
+func (t *DefaultThing) StepUp(tree string, handlers ...callback.Handler) error {
+	if tree == "" {
+		return errors.New("step-up requires a tree")
+	}
+	upgraded, err := t.sessionBuilder().
+		WithTree(tree).
+		StepUp(t.session).
+		AuthenticateWith(append(append([]callback.Handler{}, t.handlers...), handlers...)...).
+		Create()
+	if err != nil {
+		return err
+	}
+	t.logger().Info("session stepped up", "tree", tree)
+	t.session = upgraded
+	return nil
 }
 
 func (t *DefaultThing) RequestAccessToken(scopes ...string) (response thing.AccessTokenResponse, err error) {
@@ -89,6 +154,7 @@ func (t *DefaultThing) RefreshAccessToken(refreshToken string, scopes ...string)
 func (t *DefaultThing) accessToken(payload client.GetAccessTokenPayload) (response thing.AccessTokenResponse, err error) {
 	var requestBody string
 	var content client.ContentType
+	logger := t.logger()
 
 	err = t.makeAuthorisedRequest(func(session session.Session) error {
 		if popSession, ok := session.(*isession.PoPSession); ok {
@@ -111,7 +177,7 @@ func (t *DefaultThing) accessToken(payload client.GetAccessTokenPayload) (respon
 		}
 		reply, err := t.connection.AccessToken(session.Token(), content, requestBody)
 		if reply != nil {
-			debug.Logger.Println("RequestAccessToken response: ", string(reply))
+			logger.Debug("RequestAccessToken response", "response", debug.Redact(string(reply)))
 		}
 		if err != nil {
 			return err
@@ -125,6 +191,7 @@ func (t *DefaultThing) IntrospectAccessToken(token string) (introspection thing.
 	var requestBody string
 	var content client.ContentType
 	payload := client.IntrospectPayload{Token: token}
+	logger := t.logger()
 
 	err = t.makeAuthorisedRequest(func(session session.Session) error {
 		if popSession, ok := session.(*isession.PoPSession); ok {
@@ -147,7 +214,7 @@ func (t *DefaultThing) IntrospectAccessToken(token string) (introspection thing.
 		}
 		reply, err := t.connection.IntrospectAccessToken(session.Token(), content, requestBody)
 		if reply != nil {
-			debug.Logger.Println("IntrospectAccessToken response: ", string(reply))
+			logger.Debug("IntrospectAccessToken response", "response", debug.Redact(string(reply)))
 		}
 		if err != nil {
 			return err
@@ -158,6 +225,7 @@ func (t *DefaultThing) IntrospectAccessToken(token string) (introspection thing.
 }
 
 func (t *DefaultThing) RequestAttributes(names ...string) (response thing.AttributesResponse, err error) {
+	logger := t.logger()
 	err = t.makeAuthorisedRequest(func(session session.Session) error {
 		var requestBody string
 		var content client.ContentType
@@ -191,7 +259,7 @@ func (t *DefaultThing) RequestAttributes(names ...string) (response thing.Attrib
 		}
 		reply, err := t.connection.Attributes(session.Token(), content, requestBody, names)
 		if reply != nil {
-			debug.Logger.Println("RequestAttributes response: ", string(reply))
+			logger.Debug("RequestAttributes response", "response", debug.Redact(string(reply)))
 		}
 		if err != nil {
 			return err
@@ -201,12 +269,128 @@ func (t *DefaultThing) RequestAttributes(names ...string) (response thing.Attrib
 	return response, err
 }
 
+func (t *DefaultThing) RequestCertificateChain(attribute string) (thing.CertificateChain, error) {
+	if attribute == "" {
+		attribute = thing.CertificateAttribute
+	}
+	response, err := t.RequestAttributes(attribute)
+	if err != nil {
+		return nil, err
+	}
+	return response.CertificateChain(attribute)
+}
+
+func (t *DefaultThing) RotateKey(newKey crypto.Signer, newKeyID string) error {
+	if newKey == nil {
+		return jws.ErrMissingSigner
+	}
+	if newKeyID == "" {
+		return errors.New("key rotation requires a key ID")
+	}
+	auth, ok := authenticateHandler(t.handlers)
+	if !ok {
+		return errors.New("key rotation requires AuthenticateThing")
+	}
+	if auth.KeyID == newKeyID {
+		return nil
+	}
+	logger := t.logger()
+	connection := t.connection
+	if t.rotationConnection != nil {
+		var err error
+		if connection, err = t.rotationConnection(); err != nil {
+			return err
+		}
+	}
+	// prove possession of the current key with the thing's handlers and of the new key with the rotation handler
+	rotation := callback.KeyRotationHandler{
+		Audience:      auth.Audience,
+		ThingID:       auth.ThingID,
+		KeyID:         newKeyID,
+		Key:           newKey,
+		PreviousKeyID: auth.KeyID,
+	}
+	rotated := false
+	rotationSession, err := (&isession.Builder{}).WithLimits(t.limits).
+		WithConnection(connection).
+		AuthenticateWith(append(append([]callback.Handler{}, t.handlers...),
+			callback.HandlerFunc(func(cb callback.Callback) (bool, error) {
+				handled, err := rotation.Handle(cb)
+				rotated = rotated || (handled && err == nil)
+				return handled, err
+			}))...).
+		Create()
+	if err != nil {
+		return err
+	}
+	if err = rotationSession.Logout(); err != nil {
+		logger.Debug("failed to log out of the key rotation session", "error", err)
+	}
+	// the journey may complete without the key rotation callback, for example if the tree is not a key rotation tree
+	if !rotated {
+		return errors.New("key rotation tree did not request proof of possession of the new key")
+	}
+	logger.Info("key rotated", "keyID", newKeyID, "previousKeyID", auth.KeyID)
+
+	// AM only accepts the new key from now on so the handlers keep it even if the new session can not be created, the
+	// next request then renews the session with the new key
+	previous := t.session
+	t.handlers = withKey(t.handlers, newKey, newKeyID)
+	t.session, err = t.sessionBuilder().
+		AuthenticateWith(t.handlers...).
+		Create()
+	if err != nil {
+		t.session = previous
+		return err
+	}
+	if err = previous.Logout(); err != nil {
+		logger.Debug("failed to log out of the session bound to the previous key", "error", err)
+	}
+	return nil
+}
+
+// authenticateHandler returns the handler that authenticates the thing with its key
+func authenticateHandler(handlers []callback.Handler) (callback.AuthenticateHandler, bool) {
+	for _, h := range handlers {
+		switch h := h.(type) {
+		case callback.AuthenticateHandler:
+			return h, true
+		case callback.JWTPoPHandler:
+			return h.AuthenticateHandler, true
+		}
+	}
+	return callback.AuthenticateHandler{}, false
+}
+
+// withKey returns a copy of the handlers where the handlers that sign with the thing's key use the given key instead
+func withKey(handlers []callback.Handler, key crypto.Signer, keyID string) []callback.Handler {
+	updated := make([]callback.Handler, len(handlers))
+	for i, h := range handlers {
+		switch h := h.(type) {
+		case callback.AuthenticateHandler:
+			h.Key, h.KeyID = key, keyID
+			updated[i] = h
+		case callback.RegisterHandler:
+			h.Key, h.KeyID = key, keyID
+			updated[i] = h
+		case callback.JWTPoPHandler:
+			h.AuthenticateHandler.Key, h.AuthenticateHandler.KeyID = key, keyID
+			h.RegisterHandler.Key, h.RegisterHandler.KeyID = key, keyID
+			updated[i] = h
+		default:
+			updated[i] = h
+		}
+	}
+	return updated
+}
+
 func (t *DefaultThing) RequestUserCode(scopes ...string) (response thing.DeviceAuthorizationResponse, err error) {
 	payload := struct {
 		Scope []string `json:"scope,omitempty"`
 	}{Scope: scopes}
 	var requestBody string
 	var content client.ContentType
+	logger := t.logger()
 
 	err = t.makeAuthorisedRequest(func(session session.Session) error {
 		if popSession, ok := session.(*isession.PoPSession); ok {
@@ -229,7 +413,7 @@ func (t *DefaultThing) RequestUserCode(scopes ...string) (response thing.DeviceA
 		}
 		reply, err := t.connection.UserCode(session.Token(), content, requestBody)
 		if reply != nil {
-			debug.Logger.Println("RequestUserCode response: ", string(reply))
+			logger.Debug("RequestUserCode response", "response", debug.Redact(string(reply)))
 		}
 		if err != nil {
 			return err
@@ -252,6 +436,7 @@ func (t *DefaultThing) RequestUserToken(authorizationResponse thing.DeviceAuthor
 		interval = time.Second * time.Duration(authorizationResponse.Interval)
 	}
 	var responseBytes []byte
+	logger := t.logger()
 	authorisedRequest := func(session session.Session) error {
 		var content client.ContentType
 		var requestBody string
@@ -275,7 +460,7 @@ func (t *DefaultThing) RequestUserToken(authorizationResponse thing.DeviceAuthor
 		}
 		responseBytes, err = t.connection.UserToken(session.Token(), content, requestBody)
 		if responseBytes != nil {
-			debug.Logger.Println("RequestUserToken response: ", string(responseBytes))
+			logger.Debug("RequestUserToken response", "response", debug.Redact(string(responseBytes)))
 		}
 		return err
 	}
@@ -298,7 +483,7 @@ func (t *DefaultThing) RequestUserToken(authorizationResponse thing.DeviceAuthor
 		}
 		err = json.Unmarshal(responseBytes, &errorResponse)
 		if err != nil {
-			debug.Logger.Println("Unrecognized error response: ", string(responseBytes))
+			logger.Warn("unrecognized error response", "response", debug.Redact(string(responseBytes)))
 			return
 		}
 		switch errorResponse.Detail.Error {
@@ -308,7 +493,7 @@ func (t *DefaultThing) RequestUserToken(authorizationResponse thing.DeviceAuthor
 			// Increase poling time by 5 seconds, see https://tools.ietf.org/html/rfc8628#section-3.5
 			interval += intervalDefault
 		default:
-			debug.Logger.Println("Error response: ", string(responseBytes))
+			logger.Debug("error response", "response", debug.Redact(string(responseBytes)))
 			return tokenResponse, errors.New(errorResponse.Detail.Error)
 		}
 		time.Sleep(interval)
@@ -328,6 +513,11 @@ type regHandlerBuilder struct {
 	claims       func() interface{}
 }
 
+type keyBuilder struct {
+	keyID string
+	key   crypto.Signer
+}
+
 type BaseBuilder struct {
 	u           *url.URL
 	realm       string
@@ -338,6 +528,15 @@ type BaseBuilder struct {
 	authHandler *authHandlerBuilder
 	regHandler  *regHandlerBuilder
 	connection  client.Connection
+	limits      isession.JourneyLimits
+	// the tree used to rotate the thing's key
+	rotationTree string
+	// the new key of an interrupted key rotation
+	pendingKey *keyBuilder
+	// the handlers for the trees advised by AM, the thing only steps up on advice if not nil
+	stepUpHandlers []callback.Handler
+	// persists the thing's session if not nil
+	store session.Store
 }
 
 func (b *BaseBuilder) AsService() thing.Builder {
@@ -384,6 +583,29 @@ func (b *BaseBuilder) WithTree(tree string) thing.Builder {
 	return b
 }
 
+func (b *BaseBuilder) WithKeyRotationTree(tree string) thing.Builder {
+	b.rotationTree = tree
+	return b
+}
+
+func (b *BaseBuilder) ResumeKeyRotation(newKeyID string, newKey crypto.Signer) thing.Builder {
+	b.pendingKey = &keyBuilder{
+		keyID: newKeyID,
+		key:   newKey,
+	}
+	return b
+}
+
+func (b *BaseBuilder) StepUpOnAdvice(handlers ...callback.Handler) thing.Builder {
+	b.stepUpHandlers = append([]callback.Handler{}, handlers...)
+	return b
+}
+
+func (b *BaseBuilder) WithSessionStore(store session.Store) thing.Builder {
+	b.store = store
+	return b
+}
+
 func (b *BaseBuilder) TimeoutRequestAfter(d time.Duration) thing.Builder {
 	b.timeout = d
 	return b
@@ -394,7 +616,26 @@ func (b *BaseBuilder) WithConnection(connection client.Connection) thing.Builder
 	return b
 }
 
+func (b *BaseBuilder) WithMaxRounds(n int) thing.Builder {
+	if n < 1 {
+		n = -1
+	}
+	b.limits.MaxRounds = n
+	return b
+}
+
+func (b *BaseBuilder) TimeoutJourneyAfter(d time.Duration) thing.Builder {
+	b.limits.Timeout = d
+	return b
+}
+
+func (b *BaseBuilder) FailOnUnhandledCallbacks() thing.Builder {
+	b.limits.Strict = true
+	return b
+}
+
 func (b *BaseBuilder) Create() (thing.Thing, error) {
+	var rotationConnection func() (client.Connection, error)
 	if b.connection == nil {
 		if b.u == nil {
 			return nil, errors.New("URL must be provided via ConnectTo")
@@ -409,6 +650,7 @@ func (b *BaseBuilder) Create() (thing.Thing, error) {
 		if err != nil {
 			return nil, err
 		}
+		rotationConnection = b.rotationConnection()
 	}
 	if b.authHandler != nil {
 		// check we have a signer and key ID
@@ -440,17 +682,78 @@ func (b *BaseBuilder) Create() (thing.Thing, error) {
 			})
 		}
 	}
-	builder := &isession.Builder{}
-	thingSession, err := builder.
-		WithConnection(b.connection).
-		AuthenticateWith(b.handlers...).
-		Create()
+	if b.pendingKey != nil {
+		if b.authHandler == nil {
+			return nil, fmt.Errorf("resume key rotation requires AuthenticateThing")
+		}
+		if b.pendingKey.key == nil || b.pendingKey.keyID == "" {
+			return nil, fmt.Errorf("resume key rotation requires Key and Key ID")
+		}
+	}
+	thingSession, err := b.authenticate()
 	if err != nil {
 		return nil, err
 	}
+	thingID := ""
+	if b.authHandler != nil {
+		thingID = b.authHandler.thingID
+	}
 	return &DefaultThing{
-		connection: b.connection,
-		handlers:   b.handlers,
-		session:    thingSession,
+		thingID:            thingID,
+		connection:         b.connection,
+		handlers:           b.handlers,
+		limits:             b.limits,
+		session:            thingSession,
+		rotationConnection: rotationConnection,
+		stepUpHandlers:     b.stepUpHandlers,
+		store:              b.store,
 	}, nil
 }
+
+// authenticate creates the thing's session. If a key rotation is being resumed, the new key is tried first and the
+// current key is only used if AM rejects the new key.
+func (b *BaseBuilder) authenticate() (session.Session, error) {
+	create := func(handlers []callback.Handler) (session.Session, error) {
+		builder := (&isession.Builder{}).WithLimits(b.limits).WithConnection(b.connection)
+		if b.store != nil {
+			builder = builder.WithStore(b.store)
+		}
+		return builder.AuthenticateWith(handlers...).Create()
+	}
+	if b.pendingKey == nil {
+		return create(b.handlers)
+	}
+	handlers := withKey(b.handlers, b.pendingKey.key, b.pendingKey.keyID)
+	thingSession, err := create(handlers)
+	if err == nil {
+		debug.Log.Info("authenticated with the new key of the key rotation", "keyID", b.pendingKey.keyID)
+		b.handlers = handlers
+		return thingSession, nil
+	}
+	if !client.CodeUnauthorized.IsWrappedIn(err) {
+		return nil, err
+	}
+	debug.Log.Info("new key of the key rotation was rejected, authenticating with the current key",
+		"keyID", b.authHandler.keyID)
+	return create(b.handlers)
+}
+
+// rotationConnection returns the function that creates a connection to AM for the key rotation tree. The thing's
+// connection is used instead if the thing connects to the IoT Gateway.
+func (b *BaseBuilder) rotationConnection() func() (client.Connection, error) {
+	if b.u.Scheme != "http" && b.u.Scheme != "https" {
+		return nil
+	}
+	u, realm, tree, timeout := b.u, b.realm, b.rotationTree, b.timeout
+	return func() (client.Connection, error) {
+		if tree == "" {
+			return nil, errors.New("key rotation requires a tree, see WithKeyRotationTree")
+		}
+		return client.NewConnection().
+			ConnectTo(u).
+			InRealm(realm).
+			WithTree(tree).
+			TimeoutRequestAfter(timeout).
+			Create()
+	}
+}
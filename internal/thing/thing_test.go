@@ -1,5 +1,5 @@
 /*
- * Copyright 2020 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -17,10 +17,24 @@
 package thing
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	frcrypto "github.com/ForgeRock/iot-edge/v7/internal/crypto"
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
 	"github.com/ForgeRock/iot-edge/v7/internal/mocks"
+	isession "github.com/ForgeRock/iot-edge/v7/internal/session"
+	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+	"github.com/ForgeRock/iot-edge/v7/pkg/session"
 	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
 )
 
@@ -63,3 +77,362 @@ func TestDefaultThing_RequestUserToken(t *testing.T) {
 		})
 	}
 }
+
+func TestDefaultThing_RequestCertificateChain(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert, _ := frcrypto.PublicKeyCertificate(key)
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}))
+	var requested []string
+	dt := DefaultThing{
+		connection: &mocks.MockClient{
+			AttributesFunc: func(_ string, _ string, names []string) ([]byte, error) {
+				requested = names
+				return json.Marshal(map[string]interface{}{
+					"_id":                      "thing-1",
+					thing.CertificateAttribute: []string{certPEM},
+				})
+			},
+		},
+		session: &mocks.MockSession{},
+	}
+	chain, err := dt.RequestCertificateChain("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(requested, []string{thing.CertificateAttribute}) {
+		t.Errorf("unexpected attributes requested %v", requested)
+	}
+	if len(chain) != 1 || !chain.Expiry().Equal(chain.Leaf().NotAfter) {
+		t.Errorf("unexpected chain %v", chain)
+	}
+}
+
+// keyAM mocks an AM tree that authenticates a thing with its registered key and, if rotate is true, replaces the
+// registered key with the key that the thing proves possession of
+func keyAM(registered *string, rotate bool) *mocks.MockClient {
+	challenge := func(id string) callback.Callback {
+		return callback.Callback{
+			Type:   callback.TypeHiddenValueCallback,
+			Output: []callback.Entry{{Name: "value", Value: "challenge"}, {Name: "id", Value: id}},
+			Input:  []callback.Entry{{Name: "IDToken1", Value: ""}},
+		}
+	}
+	return &mocks.MockClient{
+		AuthenticateFunc: func(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+			if len(payload.Callbacks) == 0 {
+				reply.Callbacks = []callback.Callback{challenge("jwt-pop-authentication")}
+				if rotate {
+					reply.Callbacks = append(reply.Callbacks, challenge(callback.KeyRotationCallbackID))
+				}
+				return reply, nil
+			}
+			newKeyID := ""
+			for _, cb := range payload.Callbacks {
+				var claims struct {
+					CNF struct {
+						KID string `json:"kid"`
+					} `json:"cnf"`
+				}
+				if err = jws.ExtractClaims(cb.Input[0].Value.(string), &claims); err != nil {
+					return reply, err
+				}
+				if cb.ID() == callback.KeyRotationCallbackID {
+					newKeyID = claims.CNF.KID
+				} else if claims.CNF.KID != *registered {
+					return reply, client.ResponseError{ResponseCode: client.CodeUnauthorized}
+				}
+			}
+			if newKeyID != "" {
+				*registered = newKeyID
+			}
+			reply.TokenID = "token-" + *registered
+			return reply, nil
+		},
+	}
+}
+
+func TestDefaultThing_RotateKey(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	registered := "old"
+	connection := keyAM(&registered, false)
+	loggedOut := 0
+	connection.LogoutSessionFunc = func(string, string) error {
+		loggedOut++
+		return nil
+	}
+	device, err := (&BaseBuilder{}).WithConnection(connection).
+		AuthenticateThing("thing-1", "/", "old", oldKey, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt := device.(*DefaultThing)
+	rotation := keyAM(&registered, true)
+	rotation.LogoutSessionFunc = connection.LogoutSessionFunc
+	dt.rotationConnection = func() (client.Connection, error) {
+		return rotation, nil
+	}
+
+	if err = dt.RotateKey(newKey, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if registered != "new" {
+		t.Errorf("expected the new key to be registered, got %s", registered)
+	}
+	if auth, _ := authenticateHandler(dt.handlers); auth.KeyID != "new" || auth.Key != newKey {
+		t.Errorf("expected the handlers to use the new key, got %s", auth.KeyID)
+	}
+	// the rotation session and the session bound to the old key
+	if loggedOut != 2 {
+		t.Errorf("expected 2 sessions to be logged out, got %d", loggedOut)
+	}
+	popSession, ok := dt.session.(*isession.PoPSession)
+	if !ok || popSession.Token() != "token-new" {
+		t.Fatalf("unexpected session %v", dt.session)
+	}
+	signed, err := popSession.SignRequestBody("/things", "1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = jws.Verify(signed, newKey.Public()); err != nil {
+		t.Errorf("expected the session to be signed with the new key, %v", err)
+	}
+
+	// rotating to the same key again does nothing
+	dt.rotationConnection = func() (client.Connection, error) {
+		return nil, errors.New("unexpected rotation")
+	}
+	if err = dt.RotateKey(newKey, "new"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDefaultThing_RotateKey_Rejected(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	registered := "old"
+	device, err := (&BaseBuilder{}).WithConnection(keyAM(&registered, false)).
+		AuthenticateThing("thing-1", "/", "old", oldKey, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt := device.(*DefaultThing)
+	// the key is rotated by another process
+	registered = "other"
+	if err = dt.RotateKey(newKey, "new"); !client.CodeUnauthorized.IsWrappedIn(err) {
+		t.Fatalf("expected an unauthorized error, got %v", err)
+	}
+	if auth, _ := authenticateHandler(dt.handlers); auth.KeyID != "old" {
+		t.Errorf("expected the handlers to keep the old key, got %s", auth.KeyID)
+	}
+}
+
+func TestDefaultThing_RotateKey_NotRotated(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	registered := "old"
+	device, err := (&BaseBuilder{}).WithConnection(keyAM(&registered, false)).
+		AuthenticateThing("thing-1", "/", "old", oldKey, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt := device.(*DefaultThing)
+
+	// the journey completes without the key rotation callback, for example over the IoT Gateway
+	dt.rotationConnection = nil
+	if err = dt.RotateKey(newKey, "new"); err == nil {
+		t.Fatal("expected an error when the tree does not rotate the key")
+	}
+	if auth, _ := authenticateHandler(dt.handlers); auth.KeyID != "old" {
+		t.Errorf("expected the handlers to keep the old key, got %s", auth.KeyID)
+	}
+}
+
+func TestDefaultThing_RotateKey_SessionFailed(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	registered := "old"
+	connection := keyAM(&registered, false)
+	device, err := (&BaseBuilder{}).WithConnection(connection).
+		AuthenticateThing("thing-1", "/", "old", oldKey, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt := device.(*DefaultThing)
+	rotation := keyAM(&registered, true)
+	dt.rotationConnection = func() (client.Connection, error) {
+		return rotation, nil
+	}
+
+	// AM accepts the new key but the session bound to it can not be created
+	authenticate := connection.AuthenticateFunc
+	connection.AuthenticateFunc = func(client.AuthenticatePayload) (client.AuthenticatePayload, error) {
+		return client.AuthenticatePayload{}, errors.New("connection reset")
+	}
+	if err = dt.RotateKey(newKey, "new"); err == nil {
+		t.Fatal("expected an error when the new session can not be created")
+	}
+	if auth, _ := authenticateHandler(dt.handlers); auth.KeyID != "new" {
+		t.Errorf("expected the handlers to keep the new key, got %s", auth.KeyID)
+	}
+	if dt.session.Token() != "token-old" {
+		t.Errorf("expected the previous session to be kept, got %s", dt.session.Token())
+	}
+
+	// the next request renews the session with the new key
+	connection.AuthenticateFunc = authenticate
+	connection.AccessTokenFunc = func(tokenID, _ string) ([]byte, error) {
+		if tokenID != "token-new" {
+			return nil, client.ResponseError{ResponseCode: client.CodeUnauthorized}
+		}
+		return []byte(`{"access_token":"token"}`), nil
+	}
+	connection.ValidateSessionFunc = func(tokenID, _ string) (bool, error) {
+		return tokenID == "token-new", nil
+	}
+	if _, err = dt.RequestAccessToken("publish"); err != nil {
+		t.Fatal(err)
+	}
+	if dt.session.Token() != "token-new" {
+		t.Errorf("expected the session to be renewed with the new key, got %s", dt.session.Token())
+	}
+}
+
+func TestBaseBuilder_ResumeKeyRotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	for _, registered := range []string{"old", "new"} {
+		t.Run(registered, func(t *testing.T) {
+			device, err := (&BaseBuilder{}).WithConnection(keyAM(&registered, false)).
+				AuthenticateThing("thing-1", "/", "old", oldKey, nil).
+				ResumeKeyRotation("new", newKey).
+				Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dt := device.(*DefaultThing)
+			if auth, _ := authenticateHandler(dt.handlers); auth.KeyID != registered {
+				t.Errorf("expected the handlers to use the %s key, got %s", registered, auth.KeyID)
+			}
+			if dt.session.Token() != "token-"+registered {
+				t.Errorf("unexpected session token %s", dt.session.Token())
+			}
+		})
+	}
+	_, err := (&BaseBuilder{}).WithConnection(&mocks.MockClient{}).
+		ResumeKeyRotation("new", newKey).
+		Create()
+	if err == nil {
+		t.Error("expected an error without AuthenticateThing")
+	}
+}
+
+// adviceAM mocks AM refusing attribute requests with an advice until the session has been stepped up
+func adviceAM(steppedUpTree *string) *mocks.MockClient {
+	return &mocks.MockClient{
+		AuthenticateStepUpFunc: func(_ string, tree string, _ bool, payload client.AuthenticatePayload) (
+			reply client.AuthenticatePayload, err error) {
+			if len(payload.Callbacks) == 0 {
+				reply.Callbacks = []callback.Callback{{
+					Type:  callback.TypeNameCallback,
+					Input: []callback.Entry{{Name: "IDToken1", Value: ""}},
+				}}
+				return reply, nil
+			}
+			if payload.Callbacks[0].Input[0].Value != "attested" {
+				return reply, client.ResponseError{ResponseCode: client.CodeUnauthorized}
+			}
+			*steppedUpTree = tree
+			reply.TokenID = "stepped-up-token"
+			return reply, nil
+		},
+		AttributesFunc: func(token string, _ string, _ []string) ([]byte, error) {
+			if token != "stepped-up-token" {
+				return nil, client.ResponseError{
+					ResponseCode: client.CodeForbidden,
+					Message:      `{"code":403,"detail":{"advices":{"AuthenticateToTreeConditionAdvice":["attest-tree"]}}}`,
+				}
+			}
+			return []byte(`{"_id":"thing-1"}`), nil
+		},
+	}
+}
+
+func TestDefaultThing_StepUpOnAdvice(t *testing.T) {
+	var tree string
+	device, err := (&BaseBuilder{}).WithConnection(adviceAM(&tree)).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = device.RequestAttributes(); !client.CodeForbidden.IsWrappedIn(err) {
+		t.Fatalf("expected a forbidden error without step-up on advice, got %v", err)
+	}
+
+	device, err = (&BaseBuilder{}).WithConnection(adviceAM(&tree)).
+		StepUpOnAdvice(callback.NameHandler{Name: "attested"}).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := device.RequestAttributes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree != "attest-tree" || response.Content["_id"] != "thing-1" {
+		t.Errorf("unexpected step-up tree %s and response %v", tree, response.Content)
+	}
+
+	// the request fails with the original error if the step-up fails
+	device, err = (&BaseBuilder{}).WithConnection(adviceAM(&tree)).
+		StepUpOnAdvice(callback.NameHandler{Name: "not-attested"}).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = device.RequestAttributes(); !client.CodeForbidden.IsWrappedIn(err) {
+		t.Errorf("expected a forbidden error when the step-up fails, got %v", err)
+	}
+}
+
+func TestBaseBuilder_WithSessionStore(t *testing.T) {
+	store := session.FileStore{Path: filepath.Join(t.TempDir(), "session"), Key: make([]byte, 32)}
+	authentications := 0
+	connection := &mocks.MockClient{
+		AuthenticateFunc: func(client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+			authentications++
+			reply.TokenID = fmt.Sprintf("token-%d", authentications)
+			return reply, nil
+		},
+	}
+	device, err := (&BaseBuilder{}).WithConnection(connection).WithSessionStore(store).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the session is resumed after a restart
+	_, err = (&BaseBuilder{}).WithConnection(connection).WithSessionStore(store).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authentications != 1 {
+		t.Errorf("expected the stored session to be resumed, got %d authentications", authentications)
+	}
+
+	// the session is not resumed once the thing has logged out
+	if err = device.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&BaseBuilder{}).WithConnection(connection).WithSessionStore(store).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authentications != 2 {
+		t.Errorf("expected the thing to authenticate after logging out, got %d authentications", authentications)
+	}
+	if stored, _ := store.Load(); stored == nil || stored.Token != "token-2" {
+		t.Errorf("expected the new session to be stored, got %+v", stored)
+	}
+}
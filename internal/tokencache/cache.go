@@ -1,5 +1,5 @@
 /*
- * Copyright 2020 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -17,20 +17,41 @@
 package tokencache
 
 import (
+	"errors"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
 
-// Cache for signed JSON Web Tokens
+// ErrFull is returned when a token can not be added because the cache holds the maximum number of entries
+var ErrFull = errors.New("token cache is full")
+
+// Store holds the tokens issued during authentication journeys, keyed by a value that can be shared with the thing.
+// Implementations that keep the tokens in shared storage allow a journey to continue on any gateway that uses the same
+// storage.
+type Store interface {
+	// Add the token to the store with the given key
+	Add(key, token string) error
+	// Get a token from the store
+	Get(key string) (token string, ok bool)
+}
+
+// Cache for signed JSON Web Tokens held in process memory
 type Cache struct {
-	store *cache.Cache
+	store      *cache.Cache
+	maxEntries int
 }
 
 // New creates a new token cache
 func New(defaultExpiration, cleanupInterval time.Duration) *Cache {
-	return &Cache{store: cache.New(defaultExpiration, cleanupInterval)}
+	return NewWithLimit(defaultExpiration, cleanupInterval, 0)
+}
+
+// NewWithLimit creates a new token cache that holds at most maxEntries tokens. A limit of zero or less means that the
+// number of entries is unlimited.
+func NewWithLimit(defaultExpiration, cleanupInterval time.Duration, maxEntries int) *Cache {
+	return &Cache{store: cache.New(defaultExpiration, cleanupInterval), maxEntries: maxEntries}
 }
 
 // unsafeClaimsOfAuthId deserialises the claims of the token without verifying them with the signature
@@ -46,8 +67,24 @@ func unsafeClaimsOfAuthId(rawToken string) (claims jwt.Claims, ok bool) {
 	return claims, true
 }
 
+// Expiry returns the expiry time in the token if it can be parsed
+func Expiry(token string) (expiry time.Time, ok bool) {
+	claims, ok := unsafeClaimsOfAuthId(token)
+	if !ok || claims.Expiry == nil {
+		return expiry, false
+	}
+	return claims.Expiry.Time(), true
+}
+
 // Add the token with the cache with the given key
-func (c *Cache) Add(key, token string) {
+func (c *Cache) Add(key, token string) error {
+	if c.maxEntries > 0 && c.store.ItemCount() >= c.maxEntries {
+		// expired items are only removed periodically so remove them now before checking again
+		c.store.DeleteExpired()
+		if c.store.ItemCount() >= c.maxEntries {
+			return ErrFull
+		}
+	}
 	// use expiry time in header if we are able to parse it, otherwise use default expiry time.
 	claims, ok := unsafeClaimsOfAuthId(token)
 	if ok && !claims.Expiry.Time().IsZero() {
@@ -55,6 +92,7 @@ func (c *Cache) Add(key, token string) {
 	} else {
 		c.store.SetDefault(key, token)
 	}
+	return nil
 }
 
 // Get a token from the cache
@@ -54,3 +54,19 @@ func TestTokenCache_Add_Expiry(t *testing.T) {
 	}
 
 }
+
+// check that tokens are not added once the cache is full
+func TestTokenCache_Add_Full(t *testing.T) {
+	cache := NewWithLimit(5*time.Minute, 10*time.Minute, 2)
+	for _, key := range []string{"1", "2"} {
+		if err := cache.Add(key, "token"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cache.Add("3", "token"); err != ErrFull {
+		t.Errorf("expected ErrFull, got %v", err)
+	}
+	if _, ok := cache.Get("3"); ok {
+		t.Error("token added to a full cache")
+	}
+}
@@ -1,5 +1,5 @@
 /*
- * Copyright 2020-2022 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -40,6 +40,14 @@ const (
 	TypePasswordCallback    = "PasswordCallback"
 	TypeTextInputCallback   = "TextInputCallback"
 	TypeHiddenValueCallback = "HiddenValueCallback"
+	// Callback names of the standard AM nodes
+	TypeChoiceCallback              = "ChoiceCallback"
+	TypeConfirmationCallback        = "ConfirmationCallback"
+	TypeTextOutputCallback          = "TextOutputCallback"
+	TypePollingWaitCallback         = "PollingWaitCallback"
+	TypeMetadataCallback            = "MetadataCallback"
+	TypeSuspendedTextOutputCallback = "SuspendedTextOutputCallback"
+	TypeDeviceProfileCallback       = "DeviceProfileCallback"
 	// Entry keys
 	keyHiddenID = "id"
 	keyValue    = "value"
@@ -82,7 +90,7 @@ func (c Callback) ID() string {
 		if e.Name == keyHiddenID {
 			id, ok := e.Value.(string)
 			if !ok {
-				debug.Logger.Printf("Expected 'string' id %v", e)
+				debug.Log.Debug("expected 'string' id", "entry", e)
 			}
 			return id
 		}
@@ -213,7 +221,7 @@ func (h AuthenticateHandler) Handle(cb Callback) (bool, error) {
 	if err != nil {
 		return true, err
 	}
-	debug.Logger.Println("handling request for " + cb.ID() + " callback with: " + response)
+	debug.Log.Debug("handling callback", "id", cb.ID(), "response", debug.Redact(response), debug.ThingID(h.ThingID))
 	cb.Input[0].Value = response
 	return true, nil
 }
@@ -240,7 +248,7 @@ func (h RegisterHandler) Handle(cb Callback) (bool, error) {
 		return true, errNoInput
 	}
 	if softwareStatement {
-		debug.Logger.Println("handling request for software_statement callback with: " + h.SoftwareStatement)
+		debug.Log.Debug("handling callback", "id", cb.ID(), "response", debug.Redact(h.SoftwareStatement))
 		cb.Input[0].Value = h.SoftwareStatement
 		return true, nil
 	}
@@ -284,7 +292,7 @@ func (h RegisterHandler) Handle(cb Callback) (bool, error) {
 	if err != nil {
 		return true, err
 	}
-	debug.Logger.Println("handling request for jwt-pop-registration callback with: " + response)
+	debug.Log.Debug("handling callback", "id", cb.ID(), "response", debug.Redact(response), debug.ThingID(h.ThingID))
 	cb.Input[0].Value = response
 	return true, nil
 }
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
+)
+
+// CSRCallbackID is the ID of the hidden value callback that certificate enrolment tree nodes use to request a
+// certificate signing request from the thing.
+const CSRCallbackID = "csr"
+
+// CSRHandler handles the callback of a certificate enrolment tree node by sending a PEM encoded PKCS #10 certificate
+// signing request for the thing's key. The issued certificate chain is stored as an attribute of the thing, see
+// thing.Thing.RequestCertificateChain.
+type CSRHandler struct {
+	// the ID of the callback, CSRCallbackID if empty
+	ID string
+	// the key of the thing, an ECDSA, RSA or Ed25519 key
+	Key     crypto.Signer
+	Subject pkix.Name
+	// the subject alternative names
+	DNSNames       []string
+	IPAddresses    []net.IP
+	EmailAddresses []string
+	URIs           []*url.URL
+}
+
+// CertificateRequest returns the PEM encoded certificate signing request.
+func (h CSRHandler) CertificateRequest() (string, error) {
+	if h.Key == nil {
+		return "", jws.ErrMissingSigner
+	}
+	switch h.Key.Public().(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+	default:
+		return "", fmt.Errorf("unsupported key type %T", h.Key.Public())
+	}
+	template := &x509.CertificateRequest{
+		Subject:        h.Subject,
+		DNSNames:       h.DNSNames,
+		IPAddresses:    h.IPAddresses,
+		EmailAddresses: h.EmailAddresses,
+		URIs:           h.URIs,
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, h.Key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+func (h CSRHandler) Handle(cb Callback) (bool, error) {
+	id := h.ID
+	if id == "" {
+		id = CSRCallbackID
+	}
+	return HiddenValueHandler{
+		ID: id,
+		Respond: func(HiddenValueOutput) (string, error) {
+			return h.CertificateRequest()
+		},
+	}.Handle(cb)
+}
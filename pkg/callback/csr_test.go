@@ -0,0 +1,87 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
+)
+
+func TestCSRHandler_Handle(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	for _, key := range []crypto.Signer{testKey, ecKey, rsaKey, edKey} {
+		handler := CSRHandler{
+			Key:         key,
+			Subject:     pkix.Name{CommonName: "thing-1", Organization: []string{"ForgeRock"}},
+			DNSNames:    []string{"thing-1.example.com"},
+			IPAddresses: []net.IP{net.ParseIP("192.168.1.10")},
+		}
+		cb := hiddenCB(CSRCallbackID, "")
+		if handled, err := handler.Handle(cb); !handled || err != nil {
+			t.Fatalf("%T: unexpected result %v, %v", key, handled, err)
+		}
+		block, _ := pem.Decode([]byte(cb.Input[0].Value.(string)))
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			t.Fatalf("%T: expected a PEM encoded CSR, got %v", key, cb.Input[0].Value)
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = csr.CheckSignature(); err != nil {
+			t.Errorf("%T: %v", key, err)
+		}
+		if csr.Subject.CommonName != "thing-1" || !reflect.DeepEqual(csr.DNSNames, handler.DNSNames) ||
+			!csr.IPAddresses[0].Equal(handler.IPAddresses[0]) {
+			t.Errorf("%T: unexpected CSR %+v", key, csr)
+		}
+		if !reflect.DeepEqual(csr.PublicKey, key.Public()) {
+			t.Errorf("%T: expected the CSR for the key", key)
+		}
+	}
+}
+
+func TestCSRHandler_Handle_ID(t *testing.T) {
+	handler := CSRHandler{ID: "enrol", Key: testKey}
+	if handled, _ := handler.Handle(hiddenCB(CSRCallbackID, "")); handled {
+		t.Error("expected the default callback ID not to be handled")
+	}
+	if handled, err := handler.Handle(hiddenCB("enrol", "")); !handled || err != nil {
+		t.Errorf("unexpected result %v, %v", handled, err)
+	}
+}
+
+func TestCSRHandler_CertificateRequest_NoKey(t *testing.T) {
+	if _, err := (CSRHandler{}).CertificateRequest(); !errors.Is(err, jws.ErrMissingSigner) {
+		t.Errorf("expected %v, got %v", jws.ErrMissingSigner, err)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+)
+
+// HiddenValueOutput is the output of a hidden value callback.
+type HiddenValueOutput struct {
+	// the ID that the tree node gave the callback
+	ID string
+	// the value that the tree node sent to the thing, for example a challenge
+	Value string
+}
+
+// HiddenValueOutput returns the output of a hidden value callback.
+func (c Callback) HiddenValueOutput() (out HiddenValueOutput, err error) {
+	if c.Type != TypeHiddenValueCallback {
+		return out, fmt.Errorf("expected %s, got %s", TypeHiddenValueCallback, c.Type)
+	}
+	if out.ID, err = c.outputString(keyHiddenID); err != nil {
+		return out, err
+	}
+	// the value is optional since a node may only collect data from the thing
+	if _, ok := c.output(keyValue); ok {
+		if out.Value, err = c.outputString(keyValue); err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// HiddenValueHandler handles the hidden value callbacks with the given ID, which custom tree nodes use to exchange
+// data with things. For example, to send a certificate signing request to a node that gives its callback the ID csr:
+//
+//	callback.HiddenValueHandler{
+//	    ID: "csr",
+//	    Respond: func(out callback.HiddenValueOutput) (string, error) {
+//	        return certificateSigningRequest()
+//	    },
+//	}
+type HiddenValueHandler struct {
+	// the ID of the callbacks to handle
+	ID string
+	// returns the value that the thing sends to the tree node, an error ends the authentication journey
+	Respond func(out HiddenValueOutput) (string, error)
+}
+
+func (h HiddenValueHandler) Handle(cb Callback) (bool, error) {
+	if cb.Type != TypeHiddenValueCallback {
+		return false, nil
+	}
+	if h.ID == "" {
+		return false, errors.New("hidden value handler requires an ID")
+	}
+	if cb.ID() != h.ID {
+		return false, nil
+	}
+	if h.Respond == nil {
+		return true, fmt.Errorf("hidden value handler %s requires a Respond function", h.ID)
+	}
+	if len(cb.Input) != 1 {
+		return true, fmt.Errorf("hidden value callback %s: expected one input, got %d", h.ID, len(cb.Input))
+	}
+	out, err := cb.HiddenValueOutput()
+	if err != nil {
+		return true, fmt.Errorf("hidden value callback %s: %w", h.ID, err)
+	}
+	value, err := h.Respond(out)
+	if err != nil {
+		return true, fmt.Errorf("hidden value callback %s: %w", h.ID, err)
+	}
+	debug.Log.Debug("handling callback", "id", h.ID, "response", debug.Redact(value))
+	cb.Input[0].Value = value
+	return true, nil
+}
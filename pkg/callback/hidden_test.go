@@ -0,0 +1,101 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func hiddenCB(id string, value interface{}) Callback {
+	return Callback{
+		Type:   TypeHiddenValueCallback,
+		Output: []Entry{{Name: "value", Value: value}, {Name: "id", Value: id}},
+		Input:  []Entry{{Name: "IDToken1", Value: ""}},
+	}
+}
+
+func TestHiddenValueHandler_Handle(t *testing.T) {
+	handler := HiddenValueHandler{
+		ID: "firmware",
+		Respond: func(out HiddenValueOutput) (string, error) {
+			return "version=" + out.Value, nil
+		},
+	}
+	cb := hiddenCB("firmware", "2.1")
+	if handled, err := handler.Handle(cb); !handled || err != nil {
+		t.Fatalf("unexpected result %v, %v", handled, err)
+	}
+	if cb.Input[0].Value != "version=2.1" {
+		t.Errorf("unexpected input %v", cb.Input[0].Value)
+	}
+
+	for _, other := range []Callback{hiddenCB("csr", ""), dummyCB(TypeNameCallback)} {
+		if handled, err := handler.Handle(other); handled || err != nil {
+			t.Errorf("expected %v not to be handled, got %v, %v", other, handled, err)
+		}
+	}
+}
+
+func TestHiddenValueHandler_Handle_Invalid(t *testing.T) {
+	respond := func(HiddenValueOutput) (string, error) {
+		return "ok", nil
+	}
+	failed := errors.New("no firmware")
+	fail := func(HiddenValueOutput) (string, error) {
+		return "", failed
+	}
+	noInput := hiddenCB("firmware", "2.1")
+	noInput.Input = nil
+
+	tests := []struct {
+		name    string
+		handler HiddenValueHandler
+		cb      Callback
+		err     string
+	}{
+		{name: "no-id", handler: HiddenValueHandler{Respond: respond}, cb: hiddenCB("firmware", "2.1"),
+			err: "requires an ID"},
+		{name: "no-respond", handler: HiddenValueHandler{ID: "firmware"}, cb: hiddenCB("firmware", "2.1"),
+			err: "requires a Respond function"},
+		{name: "no-input", handler: HiddenValueHandler{ID: "firmware", Respond: respond}, cb: noInput,
+			err: "expected one input, got 0"},
+		{name: "value-type", handler: HiddenValueHandler{ID: "firmware", Respond: respond},
+			cb: hiddenCB("firmware", 2.1), err: "expected `string` value"},
+		{name: "respond-error", handler: HiddenValueHandler{ID: "firmware", Respond: fail},
+			cb: hiddenCB("firmware", "2.1"), err: "hidden value callback firmware: no firmware"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			_, err := subtest.handler.Handle(subtest.cb)
+			if err == nil || !strings.Contains(err.Error(), subtest.err) {
+				t.Errorf("expected an error containing %q, got %v", subtest.err, err)
+			}
+		})
+	}
+}
+
+func TestCallback_HiddenValueOutput(t *testing.T) {
+	out, err := hiddenCB("firmware", "2.1").HiddenValueOutput()
+	if err != nil || out != (HiddenValueOutput{ID: "firmware", Value: "2.1"}) {
+		t.Errorf("unexpected output %+v, %v", out, err)
+	}
+	if _, err = dummyCB(TypeNameCallback).HiddenValueOutput(); err == nil {
+		t.Error("expected an error for a name callback")
+	}
+}
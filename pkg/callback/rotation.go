@@ -0,0 +1,86 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"crypto"
+	"errors"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// KeyRotationCallbackID is the ID of the callback that key rotation tree nodes use to request proof of possession of
+// the thing's new key.
+const KeyRotationCallbackID = "jwt-pop-key-rotation"
+
+// KeyRotationHandler handles the callback of a key rotation tree node. The response is a JWT that contains the new
+// public key and the challenge, signed with the new key. The tree should also contain an Authenticate Thing node so
+// that the thing proves possession of its current key, see AuthenticateHandler.
+type KeyRotationHandler struct {
+	Audience string
+	ThingID  string
+	// the ID and key that will replace the thing's current key
+	KeyID string
+	Key   crypto.Signer
+	// the ID of the thing's current key
+	PreviousKeyID string
+}
+
+func (h KeyRotationHandler) Handle(cb Callback) (bool, error) {
+	return HiddenValueHandler{
+		ID: KeyRotationCallbackID,
+		Respond: func(out HiddenValueOutput) (string, error) {
+			if out.Value == "" {
+				return "", errNoOutput
+			}
+			if h.Key == nil {
+				return "", jws.ErrMissingSigner
+			}
+			if h.KeyID == "" {
+				return "", errors.New("requires a key ID")
+			}
+			opts := &jose.SignerOptions{}
+			opts.WithHeader(jose.HeaderType, "JWT")
+			sig, err := jws.NewSigner(h.Key, opts)
+			if err != nil {
+				return "", err
+			}
+			claims := baseJWTClaims(h.ThingID, h.Audience)
+			claims.Nonce = out.Value
+			claims.CNF.KID = h.KeyID
+			claims.CNF.JWK = &jose.JSONWebKey{
+				Key:   h.Key.Public(),
+				KeyID: h.KeyID,
+				Use:   "sig",
+			}
+			response, err := jwt.Signed(sig).Claims(claims).Claims(struct {
+				PreviousKID string `json:"previous_kid,omitempty"`
+			}{
+				PreviousKID: h.PreviousKeyID,
+			}).CompactSerialize()
+			if err != nil {
+				return "", err
+			}
+			debug.Log.Debug("handling callback", "id", KeyRotationCallbackID, "response", debug.Redact(response),
+				debug.ThingID(h.ThingID))
+			return response, nil
+		},
+	}.Handle(cb)
+}
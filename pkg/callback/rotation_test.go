@@ -0,0 +1,81 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestKeyRotationHandler_Handle(t *testing.T) {
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	h := KeyRotationHandler{
+		Audience:      testRealm,
+		ThingID:       "thingOne",
+		KeyID:         "newKID",
+		Key:           newKey,
+		PreviousKeyID: testKID,
+	}
+	if handled, err := h.Handle(jwtCB("jwt-pop-authentication")); handled || err != nil {
+		t.Fatalf("unexpected result %v, %v", handled, err)
+	}
+	cb := jwtCB(KeyRotationCallbackID)
+	if handled, err := h.Handle(cb); !handled || err != nil {
+		t.Fatalf("unexpected result %v, %v", handled, err)
+	}
+	token, err := jwt.ParseSigned(cb.Input[0].Value.(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := struct {
+		Sub   string `json:"sub"`
+		Aud   string `json:"aud"`
+		Nonce string `json:"nonce"`
+		CNF   struct {
+			JWK *jose.JSONWebKey `json:"jwk"`
+			KID string           `json:"kid"`
+		} `json:"cnf"`
+		PreviousKID string `json:"previous_kid"`
+	}{}
+	// the JWT must be signed with the new key
+	if err = token.Claims(newKey.Public(), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Sub != "thingOne" || claims.Aud != testRealm || claims.Nonce != "12345" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if claims.CNF.KID != "newKID" || claims.CNF.JWK == nil || !newKey.PublicKey.Equal(claims.CNF.JWK.Key) {
+		t.Errorf("expected the new key in the confirmation claim, got %+v", claims.CNF)
+	}
+	if claims.PreviousKID != testKID {
+		t.Errorf("expected the previous key ID %s, got %s", testKID, claims.PreviousKID)
+	}
+}
+
+func TestKeyRotationHandler_Handle_NoKey(t *testing.T) {
+	_, err := KeyRotationHandler{KeyID: "newKID"}.Handle(jwtCB(KeyRotationCallbackID))
+	if !errors.Is(err, jws.ErrMissingSigner) {
+		t.Errorf("expected %v, got %v", jws.ErrMissingSigner, err)
+	}
+}
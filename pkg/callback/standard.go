@@ -0,0 +1,461 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+)
+
+// sleep waits for the polling wait time, replaced in tests
+var sleep = time.Sleep
+
+// output returns the value of the output entry with the given name
+func (c Callback) output(name string) (interface{}, bool) {
+	for _, e := range c.Output {
+		if e.Name == name {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// outputString returns the value of the string output entry with the given name
+func (c Callback) outputString(name string) (string, error) {
+	v, ok := c.output(name)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", errNoOutput, name)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("expected `string` %s %v", name, v)
+	}
+	return s, nil
+}
+
+// outputInt returns the value of the number output entry with the given name. AM sends some numbers as strings.
+func (c Callback) outputInt(name string) (int, error) {
+	v, ok := c.output(name)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", errNoOutput, name)
+	}
+	switch n := v.(type) {
+	case float64:
+		return int(n), nil
+	case int:
+		return n, nil
+	case string:
+		return strconv.Atoi(n)
+	default:
+		return 0, fmt.Errorf("expected number %s %v", name, v)
+	}
+}
+
+// outputStrings returns the value of the string array output entry with the given name
+func (c Callback) outputStrings(name string) ([]string, error) {
+	v, ok := c.output(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errNoOutput, name)
+	}
+	switch values := v.(type) {
+	case []string:
+		return values, nil
+	case []interface{}:
+		result := make([]string, len(values))
+		for i, value := range values {
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected `string` %s %v", name, value)
+			}
+			result[i] = s
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("expected array %s %v", name, v)
+	}
+}
+
+// outputBool returns the value of the boolean output entry with the given name, false if there is no such entry
+func (c Callback) outputBool(name string) bool {
+	v, _ := c.output(name)
+	b, _ := v.(bool)
+	return b
+}
+
+// indexOf returns the index of the value, the default index if the value is empty
+func indexOf(values []string, value string, defaultIndex int) (int, error) {
+	if value == "" {
+		return defaultIndex, nil
+	}
+	for i, v := range values {
+		if v == value {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%s is not one of %v", value, values)
+}
+
+// ChoiceOutput is the output of a choice callback.
+type ChoiceOutput struct {
+	Prompt        string
+	Choices       []string
+	DefaultChoice int
+}
+
+// ChoiceOutput returns the output of a choice callback.
+func (c Callback) ChoiceOutput() (out ChoiceOutput, err error) {
+	if out.Prompt, err = c.outputString("prompt"); err != nil {
+		return out, err
+	}
+	if out.Choices, err = c.outputStrings("choices"); err != nil {
+		return out, err
+	}
+	out.DefaultChoice, err = c.outputInt("defaultChoice")
+	return out, err
+}
+
+// ChoiceHandler handles an AM Choice Collector callback.
+type ChoiceHandler struct {
+	// the prompt of the callbacks to handle, callbacks with any prompt are handled if empty
+	Prompt string
+	// the choice to make, the default choice is made if empty
+	Choice string
+}
+
+func (h ChoiceHandler) Handle(cb Callback) (bool, error) {
+	if cb.Type != TypeChoiceCallback {
+		return false, nil
+	}
+	out, err := cb.ChoiceOutput()
+	if err != nil {
+		return true, err
+	}
+	if h.Prompt != "" && h.Prompt != out.Prompt {
+		return false, nil
+	}
+	if len(cb.Input) == 0 {
+		return true, errNoInput
+	}
+	index, err := indexOf(out.Choices, h.Choice, out.DefaultChoice)
+	if err != nil {
+		return true, err
+	}
+	cb.Input[0].Value = index
+	return true, nil
+}
+
+// ConfirmationOutput is the output of a confirmation callback.
+type ConfirmationOutput struct {
+	Prompt        string
+	MessageType   int
+	Options       []string
+	OptionType    int
+	DefaultOption int
+}
+
+// ConfirmationOutput returns the output of a confirmation callback.
+func (c Callback) ConfirmationOutput() (out ConfirmationOutput, err error) {
+	if out.Prompt, err = c.outputString("prompt"); err != nil {
+		return out, err
+	}
+	if out.MessageType, err = c.outputInt("messageType"); err != nil {
+		return out, err
+	}
+	if out.Options, err = c.outputStrings("options"); err != nil {
+		return out, err
+	}
+	if out.OptionType, err = c.outputInt("optionType"); err != nil {
+		return out, err
+	}
+	out.DefaultOption, err = c.outputInt("defaultOption")
+	return out, err
+}
+
+// ConfirmationHandler handles an AM confirmation callback, such as the one sent by the Message node.
+type ConfirmationHandler struct {
+	// the prompt of the callbacks to handle, callbacks with any prompt are handled if empty
+	Prompt string
+	// the option to select, the default option is selected if empty
+	Option string
+}
+
+func (h ConfirmationHandler) Handle(cb Callback) (bool, error) {
+	if cb.Type != TypeConfirmationCallback {
+		return false, nil
+	}
+	out, err := cb.ConfirmationOutput()
+	if err != nil {
+		return true, err
+	}
+	if h.Prompt != "" && h.Prompt != out.Prompt {
+		return false, nil
+	}
+	if len(cb.Input) == 0 {
+		return true, errNoInput
+	}
+	index, err := indexOf(out.Options, h.Option, out.DefaultOption)
+	if err != nil {
+		return true, err
+	}
+	cb.Input[0].Value = index
+	return true, nil
+}
+
+// Message types of text output callbacks
+const (
+	MessageInformation = "0"
+	MessageWarning     = "1"
+	MessageError       = "2"
+	MessageScript      = "4"
+)
+
+// TextOutput is the output of a text output or suspended text output callback.
+type TextOutput struct {
+	Message string
+	// one of MessageInformation, MessageWarning, MessageError or MessageScript
+	MessageType string
+}
+
+// TextOutput returns the output of a text output or suspended text output callback.
+func (c Callback) TextOutput() (out TextOutput, err error) {
+	if out.Message, err = c.outputString("message"); err != nil {
+		return out, err
+	}
+	v, _ := c.output("messageType")
+	switch t := v.(type) {
+	case string:
+		out.MessageType = t
+	case float64:
+		out.MessageType = strconv.Itoa(int(t))
+	}
+	return out, nil
+}
+
+// TextOutputHandler handles an AM text output callback. The callback has no input so the handler only passes the
+// message on to the Receive function.
+type TextOutputHandler struct {
+	// receives the message, an error ends the authentication journey. The message is logged if not set.
+	Receive func(TextOutput) error
+}
+
+func (h TextOutputHandler) Handle(cb Callback) (bool, error) {
+	if cb.Type != TypeTextOutputCallback {
+		return false, nil
+	}
+	return true, receiveTextOutput(cb, h.Receive)
+}
+
+// SuspendedTextOutputHandler handles the AM suspended text output callback, sent when a node such as Email Suspend
+// suspends the journey until the user follows a link sent to them. The callback has no input so the handler only
+// passes the message on to the Receive function.
+type SuspendedTextOutputHandler struct {
+	// receives the message, an error ends the authentication journey. The message is logged if not set.
+	Receive func(TextOutput) error
+}
+
+func (h SuspendedTextOutputHandler) Handle(cb Callback) (bool, error) {
+	if cb.Type != TypeSuspendedTextOutputCallback {
+		return false, nil
+	}
+	return true, receiveTextOutput(cb, h.Receive)
+}
+
+func receiveTextOutput(cb Callback, receive func(TextOutput) error) error {
+	out, err := cb.TextOutput()
+	if err != nil {
+		return err
+	}
+	if receive == nil {
+		debug.Log.Info("authentication journey message", "type", cb.Type, "message", out.Message)
+		return nil
+	}
+	return receive(out)
+}
+
+// PollingWaitOutput is the output of a polling wait callback.
+type PollingWaitOutput struct {
+	WaitTime time.Duration
+	Message  string
+}
+
+// PollingWaitOutput returns the output of a polling wait callback.
+func (c Callback) PollingWaitOutput() (out PollingWaitOutput, err error) {
+	ms, err := c.outputInt("waitTime")
+	if err != nil {
+		return out, err
+	}
+	out.WaitTime = time.Duration(ms) * time.Millisecond
+	out.Message, _ = c.outputString("message")
+	return out, nil
+}
+
+// PollingWaitHandler handles an AM polling wait callback by waiting for the wait time that AM asks for before the
+// journey continues. Each wait adds a request to the journey, so a journey that polls for a long time must not be
+// limited with WithMaxRounds. Bound it with TimeoutJourneyAfter instead, which is checked after each wait.
+type PollingWaitHandler struct {
+	// the longest time to wait, the wait time set by AM is used if zero
+	MaxWait time.Duration
+}
+
+func (h PollingWaitHandler) Handle(cb Callback) (bool, error) {
+	if cb.Type != TypePollingWaitCallback {
+		return false, nil
+	}
+	out, err := cb.PollingWaitOutput()
+	if err != nil {
+		return true, err
+	}
+	wait := out.WaitTime
+	if h.MaxWait > 0 && wait > h.MaxWait {
+		wait = h.MaxWait
+	}
+	debug.Log.Debug("polling wait", "wait", wait, "message", out.Message)
+	sleep(wait)
+	return true, nil
+}
+
+// MetadataOutput returns the data of a metadata callback.
+func (c Callback) MetadataOutput() (map[string]interface{}, error) {
+	v, ok := c.output("data")
+	if !ok {
+		return nil, fmt.Errorf("%w: data", errNoOutput)
+	}
+	data, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected object data %v", v)
+	}
+	return data, nil
+}
+
+// MetadataHandler handles AM metadata callbacks, which have no input, by collecting their data. Callbacks are handled
+// in the order that AM sends them so later handlers can use the data collected by the handler, for example:
+//
+//	metadata := &callback.MetadataHandler{}
+//	handlers := []callback.Handler{metadata, callback.HandlerFunc(func(cb callback.Callback) (bool, error) {
+//	    ... metadata.Data() ...
+//	})}
+//
+// Use a new handler for each authentication journey.
+type MetadataHandler struct {
+	mu   sync.Mutex
+	data []map[string]interface{}
+}
+
+func (h *MetadataHandler) Handle(cb Callback) (bool, error) {
+	if cb.Type != TypeMetadataCallback {
+		return false, nil
+	}
+	data, err := cb.MetadataOutput()
+	if err != nil {
+		return true, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.data = append(h.data, data)
+	return true, nil
+}
+
+// Data returns the data of the metadata callbacks that have been handled, in the order that they were received.
+func (h *MetadataHandler) Data() []map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]map[string]interface{}(nil), h.data...)
+}
+
+// Latest returns the data of the last metadata callback that was handled, nil if none has been handled.
+func (h *MetadataHandler) Latest() map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.data) == 0 {
+		return nil
+	}
+	return h.data[len(h.data)-1]
+}
+
+// HandlerFunc is an adapter that allows the use of an ordinary function as a callback handler.
+type HandlerFunc func(cb Callback) (bool, error)
+
+func (f HandlerFunc) Handle(cb Callback) (bool, error) {
+	return f(cb)
+}
+
+// DeviceProfileOutput is the output of a device profile callback.
+type DeviceProfileOutput struct {
+	// true if the device metadata is requested
+	Metadata bool
+	// true if the device location is requested
+	Location bool
+	Message  string
+}
+
+// DeviceProfileOutput returns the output of a device profile callback.
+func (c Callback) DeviceProfileOutput() (out DeviceProfileOutput) {
+	out.Metadata = c.outputBool("metadata")
+	out.Location = c.outputBool("location")
+	out.Message, _ = c.outputString("message")
+	return out
+}
+
+// DeviceLocation is the location of a device.
+type DeviceLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// DeviceProfileHandler handles the AM device profile callback sent by the Device Profile Collector node.
+type DeviceProfileHandler struct {
+	// the unique identifier of the device
+	Identifier string
+	// returns the device metadata, called if AM requests metadata
+	Metadata func() interface{}
+	// returns the device location, called if AM requests the location. A nil location is not sent.
+	Location func() *DeviceLocation
+}
+
+func (h DeviceProfileHandler) Handle(cb Callback) (bool, error) {
+	if cb.Type != TypeDeviceProfileCallback {
+		return false, nil
+	}
+	if len(cb.Input) == 0 {
+		return true, errNoInput
+	}
+	out := cb.DeviceProfileOutput()
+	profile := struct {
+		Identifier string          `json:"identifier"`
+		Metadata   interface{}     `json:"metadata,omitempty"`
+		Location   *DeviceLocation `json:"location,omitempty"`
+	}{
+		Identifier: h.Identifier,
+	}
+	if out.Metadata && h.Metadata != nil {
+		profile.Metadata = h.Metadata()
+	}
+	if out.Location && h.Location != nil {
+		profile.Location = h.Location()
+	}
+	b, err := json.Marshal(profile)
+	if err != nil {
+		return true, err
+	}
+	cb.Input[0].Value = string(b)
+	return true, nil
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// amCallback decodes a callback as it is sent by AM
+func amCallback(t *testing.T, payload string) Callback {
+	t.Helper()
+	var cb Callback
+	if err := json.Unmarshal([]byte(payload), &cb); err != nil {
+		t.Fatal(err)
+	}
+	return cb
+}
+
+const (
+	choiceJSON = `{"type":"ChoiceCallback","output":[{"name":"prompt","value":"Zone"},
+		{"name":"choices","value":["north","south"]},{"name":"defaultChoice","value":1}],
+		"input":[{"name":"IDToken1","value":0}]}`
+	confirmationJSON = `{"type":"ConfirmationCallback","output":[{"name":"prompt","value":"Accept terms?"},
+		{"name":"messageType","value":0},{"name":"options","value":["Yes","No"]},{"name":"optionType","value":-1},
+		{"name":"defaultOption","value":1}],"input":[{"name":"IDToken1","value":0}]}`
+	textOutputJSON = `{"type":"TextOutputCallback","output":[{"name":"message","value":"Welcome"},
+		{"name":"messageType","value":"1"}]}`
+	suspendedJSON = `{"type":"SuspendedTextOutputCallback","output":[{"name":"message","value":"Check your email"},
+		{"name":"messageType","value":"0"}]}`
+	pollingWaitJSON = `{"type":"PollingWaitCallback","output":[{"name":"waitTime","value":"8000"},
+		{"name":"message","value":"Waiting for approval"}]}`
+	metadataJSON = `{"type":"MetadataCallback","output":[{"name":"data","value":{"zone":"south","interval":30}}]}`
+	deviceJSON   = `{"type":"DeviceProfileCallback","output":[{"name":"metadata","value":true},
+		{"name":"location","value":false},{"name":"message","value":""}],"input":[{"name":"IDToken1","value":""}]}`
+)
+
+func TestChoiceHandler_Handle(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  ChoiceHandler
+		handled  bool
+		expected interface{}
+		err      bool
+	}{
+		{name: "choice", handler: ChoiceHandler{Choice: "north"}, handled: true, expected: 0},
+		{name: "default", handler: ChoiceHandler{}, handled: true, expected: 1},
+		{name: "prompt", handler: ChoiceHandler{Prompt: "Zone", Choice: "south"}, handled: true, expected: 1},
+		{name: "other-prompt", handler: ChoiceHandler{Prompt: "Colour"}, handled: false, expected: float64(0)},
+		{name: "unknown-choice", handler: ChoiceHandler{Choice: "east"}, handled: true, err: true,
+			expected: float64(0)},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			cb := amCallback(t, choiceJSON)
+			handled, err := subtest.handler.Handle(cb)
+			if handled != subtest.handled || (err != nil) != subtest.err {
+				t.Fatalf("unexpected result %v, %v", handled, err)
+			}
+			if cb.Input[0].Value != subtest.expected {
+				t.Errorf("expected %v, got %v", subtest.expected, cb.Input[0].Value)
+			}
+		})
+	}
+}
+
+func TestConfirmationHandler_Handle(t *testing.T) {
+	cb := amCallback(t, confirmationJSON)
+	out, err := cb.ConfirmationOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ConfirmationOutput{Prompt: "Accept terms?", Options: []string{"Yes", "No"}, OptionType: -1,
+		DefaultOption: 1}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected %+v, got %+v", expected, out)
+	}
+	if handled, err := (ConfirmationHandler{Option: "Yes"}).Handle(cb); !handled || err != nil {
+		t.Fatalf("unexpected result %v, %v", handled, err)
+	}
+	if cb.Input[0].Value != 0 {
+		t.Errorf("expected the first option, got %v", cb.Input[0].Value)
+	}
+	if handled, _ := (ConfirmationHandler{}).Handle(amCallback(t, choiceJSON)); handled {
+		t.Error("expected a choice callback not to be handled")
+	}
+}
+
+func TestTextOutputHandlers_Handle(t *testing.T) {
+	var received []TextOutput
+	receive := func(out TextOutput) error {
+		received = append(received, out)
+		return nil
+	}
+	handlers := []Handler{TextOutputHandler{Receive: receive}, SuspendedTextOutputHandler{Receive: receive}}
+	for _, payload := range []string{textOutputJSON, suspendedJSON} {
+		handled := 0
+		for _, h := range handlers {
+			ok, err := h.Handle(amCallback(t, payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok {
+				handled++
+			}
+		}
+		if handled != 1 {
+			t.Errorf("expected one handler to handle %s, got %d", payload, handled)
+		}
+	}
+	expected := []TextOutput{
+		{Message: "Welcome", MessageType: MessageWarning},
+		{Message: "Check your email", MessageType: MessageInformation},
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected %v, got %v", expected, received)
+	}
+
+	stop := errors.New("stop")
+	_, err := TextOutputHandler{Receive: func(TextOutput) error { return stop }}.Handle(amCallback(t, textOutputJSON))
+	if !errors.Is(err, stop) {
+		t.Errorf("expected %v, got %v", stop, err)
+	}
+	if handled, err := (TextOutputHandler{}).Handle(amCallback(t, textOutputJSON)); !handled || err != nil {
+		t.Errorf("unexpected result %v, %v", handled, err)
+	}
+}
+
+func TestPollingWaitHandler_Handle(t *testing.T) {
+	var waited []time.Duration
+	sleep = func(d time.Duration) {
+		waited = append(waited, d)
+	}
+	t.Cleanup(func() {
+		sleep = time.Sleep
+	})
+	cb := amCallback(t, pollingWaitJSON)
+	out, err := cb.PollingWaitOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.WaitTime != 8*time.Second || out.Message != "Waiting for approval" {
+		t.Errorf("unexpected output %+v", out)
+	}
+	for _, h := range []PollingWaitHandler{{}, {MaxWait: time.Second}} {
+		if handled, err := h.Handle(cb); !handled || err != nil {
+			t.Fatalf("unexpected result %v, %v", handled, err)
+		}
+	}
+	if !reflect.DeepEqual(waited, []time.Duration{8 * time.Second, time.Second}) {
+		t.Errorf("unexpected waits %v", waited)
+	}
+}
+
+func TestMetadataHandler_Handle(t *testing.T) {
+	metadata := &MetadataHandler{}
+	if metadata.Latest() != nil {
+		t.Error("expected no data before a callback is handled")
+	}
+	var zone string
+	handlers := []Handler{metadata, HandlerFunc(func(cb Callback) (bool, error) {
+		if cb.Type != TypeChoiceCallback {
+			return false, nil
+		}
+		zone, _ = metadata.Latest()["zone"].(string)
+		return ChoiceHandler{Choice: zone}.Handle(cb)
+	})}
+	callbacks := []Callback{amCallback(t, metadataJSON), amCallback(t, choiceJSON)}
+	for _, cb := range callbacks {
+		for _, h := range handlers {
+			if handled, err := h.Handle(cb); err != nil {
+				t.Fatal(err)
+			} else if handled {
+				break
+			}
+		}
+	}
+	if zone != "south" || callbacks[1].Input[0].Value != 1 {
+		t.Errorf("expected the metadata to select the choice, got %s, %v", zone, callbacks[1].Input[0].Value)
+	}
+	if data := metadata.Data(); len(data) != 1 || data[0]["interval"] != float64(30) {
+		t.Errorf("unexpected data %v", data)
+	}
+}
+
+func TestDeviceProfileHandler_Handle(t *testing.T) {
+	cb := amCallback(t, deviceJSON)
+	handler := DeviceProfileHandler{
+		Identifier: "thing-1",
+		Metadata: func() interface{} {
+			return map[string]string{"model": "ble-thermometer"}
+		},
+		Location: func() *DeviceLocation {
+			return &DeviceLocation{Latitude: 51.5, Longitude: -0.1}
+		},
+	}
+	if handled, err := handler.Handle(cb); !handled || err != nil {
+		t.Fatalf("unexpected result %v, %v", handled, err)
+	}
+	// the location is not sent since AM did not request it
+	expected := `{"identifier":"thing-1","metadata":{"model":"ble-thermometer"}}`
+	if cb.Input[0].Value != expected {
+		t.Errorf("expected %s, got %v", expected, cb.Input[0].Value)
+	}
+}
+
+func TestStandardCallbacks_MissingOutput(t *testing.T) {
+	handlers := []Handler{ChoiceHandler{}, ConfirmationHandler{}, TextOutputHandler{}, SuspendedTextOutputHandler{},
+		PollingWaitHandler{}, &MetadataHandler{}}
+	types := []string{TypeChoiceCallback, TypeConfirmationCallback, TypeTextOutputCallback,
+		TypeSuspendedTextOutputCallback, TypePollingWaitCallback, TypeMetadataCallback}
+	for i, h := range handlers {
+		cb := Callback{Type: types[i], Input: make([]Entry, 1)}
+		if handled, err := h.Handle(cb); !handled || !errors.Is(err, errNoOutput) {
+			t.Errorf("%s: expected %v, got %v, %v", types[i], errNoOutput, handled, err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package gateway allows applications to embed the IoT Gateway and add middleware to the requests that it serves.
+//
+// Middleware wraps the handlers of the CoAP endpoints. Each request is described by an Exchange that carries the
+// endpoint, the DTLS peer and the identity of the thing that made the request, as far as the gateway knows it.
+// Middleware can inspect the exchange, reject the request without calling the next handler or inspect the response
+// code once the next handler has returned. The gateway rejects requests that fail the proof of possession check before
+// the middleware is called, so the identity of a thing with a proof of possession session has been verified by then.
+//
+// This example blocks devices from requesting user codes:
+//
+//    gw := gateway.New("https://am.example.com:8443/am", "/all-the-things", "auth-tree", 5*time.Second, nil)
+//    gw.Use(func(next gateway.ExchangeHandler) gateway.ExchangeHandler {
+//        return func(e *gateway.Exchange) {
+//            if e.Endpoint == "usercode" && e.Thing.Type == callback.TypeDevice {
+//                e.Respond(codes.Forbidden, []byte("devices can not request user codes"))
+//                return
+//            }
+//            next(e)
+//        }
+//    })
+//    _ = gw.Initialise()
+//    _ = gw.StartCOAPServer(":5688", key)
+//
+package gateway
@@ -0,0 +1,44 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"time"
+
+	igateway "github.com/ForgeRock/iot-edge/v7/internal/gateway"
+	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+)
+
+// Gateway represents the IoT Gateway
+type Gateway = igateway.Gateway
+
+// Exchange describes a request received by the CoAP server and its outcome
+type Exchange = igateway.Exchange
+
+// ExchangeHandler handles an exchange
+type ExchangeHandler = igateway.ExchangeHandler
+
+// Middleware wraps the handler of an exchange, see Gateway.Use
+type Middleware = igateway.Middleware
+
+// ThingIdentity is the identity of the thing that made a request, as far as the gateway knows it
+type ThingIdentity = igateway.ThingIdentity
+
+// New creates a new IoT Gateway that authenticates things with the tree in the realm of the AM at the base URL
+func New(baseURL string, realm string, authTree string, timeout time.Duration, handlers []callback.Handler) *Gateway {
+	return igateway.New(baseURL, realm, authTree, timeout, handlers)
+}
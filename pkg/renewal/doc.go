@@ -0,0 +1,48 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package renewal keeps the X.509 certificate of a thing valid by renewing it before it expires.
+//
+// The renewal manager monitors the expiry of the thing's certificate chain. Once a configurable fraction of the
+// certificate's lifetime has passed, the manager authenticates the thing with a renewal tree that contains a
+// certificate enrolment node, sends a certificate signing request for a new (or the existing) key and stores the
+// issued certificate chain.
+//
+//    // Load the current certificate chain and key
+//    store := renewal.FileStore{Path: "/var/lib/my-device/certificate.pem"}
+//    chain, key, _ := store.Load()
+//
+//    manager := renewal.New(chain, key)
+//    manager.Tree = "renewal-tree"
+//    manager.Store = store
+//    manager.NewBuilder = func(key crypto.Signer) thing.Builder {
+//        keyID, _ := thing.JWKThumbprint(key)
+//        return builder.Thing().
+//            ConnectTo(amURL).
+//            InRealm("/all-the-things").
+//            AuthenticateThing("my-device", "/all-the-things", keyID, key, nil)
+//    }
+//    manager.NewKey = func() (crypto.Signer, error) {
+//        return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+//    }
+//    manager.Notify = func(event renewal.Event) {
+//        log.Println(event)
+//    }
+//
+//    // Renew the certificate until the context is cancelled
+//    go manager.Run(ctx)
+//
+package renewal
@@ -0,0 +1,319 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package renewal
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+	"github.com/ForgeRock/iot-edge/v7/internal/debug"
+	"github.com/ForgeRock/iot-edge/v7/internal/jws"
+	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
+)
+
+const (
+	// DefaultFraction is the fraction of the certificate's lifetime after which the certificate is renewed if no
+	// other fraction is set.
+	DefaultFraction = 0.8
+	// DefaultRetryAfter is the time to wait before retrying a failed renewal if no other time is set.
+	DefaultRetryAfter = time.Hour
+)
+
+// maxWait is the longest time that Run waits before checking the clock again, so that a renewal is not delayed for
+// long if the system clock jumps or the system is suspended
+var maxWait = time.Minute
+
+// EventType is the type of renewal event.
+type EventType int
+
+const (
+	// EventScheduled is emitted when the time of the next renewal is set.
+	EventScheduled EventType = iota
+	// EventRenewed is emitted once a renewed certificate chain has been stored.
+	EventRenewed
+	// EventFailed is emitted when a renewal fails. The renewal is retried at the scheduled time.
+	EventFailed
+	// EventNotStored is emitted when a renewed certificate chain is in use but could not be stored. Storing the chain
+	// is retried at the scheduled time and EventRenewed is emitted once it has been stored.
+	EventNotStored
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventScheduled:
+		return "scheduled"
+	case EventRenewed:
+		return "renewed"
+	case EventFailed:
+		return "failed"
+	case EventNotStored:
+		return "not stored"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event describes a change in the renewal state of the thing's certificate.
+type Event struct {
+	Type EventType
+	// the current certificate chain, the renewed chain for EventRenewed and EventNotStored
+	Chain thing.CertificateChain
+	// the key of the current certificate chain
+	Key crypto.Signer
+	// the time of the next renewal
+	RenewAt time.Time
+	// the reason that the renewal failed or that the renewed chain could not be stored
+	Err error
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("certificate renewal %s", e.Type)
+	if len(e.Chain) > 0 {
+		s += fmt.Sprintf(", expires %s", e.Chain.Expiry().Format(time.RFC3339))
+	}
+	if !e.RenewAt.IsZero() {
+		s += fmt.Sprintf(", renew at %s", e.RenewAt.Format(time.RFC3339))
+	}
+	if e.Err != nil {
+		s += fmt.Sprintf(": %v", e.Err)
+	}
+	return s
+}
+
+// Manager renews the certificate chain of a thing before it expires.
+// Set the configuration fields before calling Run or Renew and do not change them afterwards.
+type Manager struct {
+	// NewBuilder returns a builder for the thing that authenticates with the key of the current certificate, for
+	// example with AuthenticateThing. The manager sets the tree and the callback handlers of the builder.
+	NewBuilder func(key crypto.Signer) thing.Builder
+	// Tree is the name of the AM authentication tree that renews the certificate. The tree is ignored when
+	// connecting to the IoT Gateway.
+	Tree string
+	// Handlers are the callback handlers required by the renewal tree in addition to the CSR handler.
+	Handlers []callback.Handler
+	// CSR is the template of the certificate signing request. The key is set by the manager. The subject and
+	// subject alternative names of the current certificate are used if no subject is set.
+	CSR callback.CSRHandler
+	// Attribute is the thing attribute that the renewal tree stores the certificate chain in,
+	// thing.CertificateAttribute if empty.
+	Attribute string
+	// Fraction of the certificate's lifetime after which the certificate is renewed, DefaultFraction if zero.
+	Fraction float64
+	// RetryAfter is the time to wait before retrying a failed renewal, DefaultRetryAfter if zero.
+	RetryAfter time.Duration
+	// NewKey returns the key for the renewed certificate. The current key is reused if NewKey is nil. If a new key
+	// is used then the renewal tree must also update the key registered for the thing.
+	NewKey func() (crypto.Signer, error)
+	// Store persists the renewed certificate chain and key. The renewed chain is not persisted if Store is nil.
+	Store Store
+	// Notify is called with each renewal event and should not block.
+	Notify func(Event)
+
+	// serialises renewals
+	renewing sync.Mutex
+	mu       sync.Mutex
+	chain    thing.CertificateChain
+	key      crypto.Signer
+	retryAt  time.Time
+	// the current chain and key have been renewed but not stored yet
+	unstored bool
+}
+
+// New returns a renewal manager for the given certificate chain and the key of the thing's certificate.
+func New(chain thing.CertificateChain, key crypto.Signer) *Manager {
+	return &Manager{
+		chain: chain,
+		key:   key,
+	}
+}
+
+// Current returns the current certificate chain and key.
+func (m *Manager) Current() (thing.CertificateChain, crypto.Signer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.chain, m.key
+}
+
+// RenewAt returns the time of the next renewal.
+func (m *Manager) RenewAt() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.retryAt.IsZero() {
+		return m.retryAt
+	}
+	fraction := m.Fraction
+	if fraction <= 0 {
+		fraction = DefaultFraction
+	}
+	return m.chain.RenewAt(fraction)
+}
+
+// Run renews the certificate each time it is due until the context is cancelled. Failed renewals are retried after
+// the RetryAfter time. Run always returns a non-nil error.
+func (m *Manager) Run(ctx context.Context) error {
+	if chain, _ := m.Current(); len(chain) == 0 {
+		return errors.New("renewal manager requires a certificate chain")
+	}
+	var scheduled time.Time
+	for {
+		renewAt := m.RenewAt()
+		if !renewAt.Equal(scheduled) {
+			scheduled = renewAt
+			chain, key := m.Current()
+			m.notify(Event{Type: EventScheduled, Chain: chain, Key: key, RenewAt: renewAt})
+		}
+		wait := renewAt.Sub(clock.Clock())
+		if wait <= 0 {
+			// the failure has been reported to Notify and the renewal has been rescheduled
+			_ = m.Renew()
+			continue
+		}
+		if wait > maxWait {
+			wait = maxWait
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Renew the certificate now. On failure, the renewal is rescheduled and the current chain and key are kept. If the
+// renewed chain can not be stored, it replaces the current chain and key anyway since AM may no longer accept the
+// current key, and storing it is retried instead of the next renewal.
+func (m *Manager) Renew() error {
+	m.renewing.Lock()
+	defer m.renewing.Unlock()
+
+	m.mu.Lock()
+	chain, key, unstored := m.chain, m.key, m.unstored
+	m.mu.Unlock()
+	if unstored {
+		return m.store(chain, key)
+	}
+	renewed, renewedKey, err := m.renew(chain, key)
+	if err != nil {
+		retryAt := m.retry(false)
+		debug.Log.Warn("certificate renewal failed", "retryAt", retryAt, "error", err)
+		m.notify(Event{Type: EventFailed, Chain: chain, Key: key, RenewAt: retryAt, Err: err})
+		return err
+	}
+	m.mu.Lock()
+	m.chain, m.key = renewed, renewedKey
+	m.mu.Unlock()
+	return m.store(renewed, renewedKey)
+}
+
+// retry schedules the next attempt after the RetryAfter time and returns its time
+func (m *Manager) retry(unstored bool) time.Time {
+	retryAfter := m.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = DefaultRetryAfter
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retryAt = clock.Clock().Add(retryAfter)
+	m.unstored = unstored
+	return m.retryAt
+}
+
+// store persists the renewed certificate chain and key, rescheduling the attempt if the store fails
+func (m *Manager) store(renewed thing.CertificateChain, renewedKey crypto.Signer) error {
+	if m.Store != nil {
+		if err := m.Store.Save(renewed, renewedKey); err != nil {
+			err = fmt.Errorf("store renewed certificate: %w", err)
+			retryAt := m.retry(true)
+			debug.Log.Warn("renewed certificate could not be stored", "retryAt", retryAt, "error", err)
+			m.notify(Event{Type: EventNotStored, Chain: renewed, Key: renewedKey, RenewAt: retryAt, Err: err})
+			return err
+		}
+	}
+	m.mu.Lock()
+	m.retryAt, m.unstored = time.Time{}, false
+	m.mu.Unlock()
+	renewAt := m.RenewAt()
+	debug.Log.Info("certificate renewed", "expiry", renewed.Expiry(), "renewAt", renewAt)
+	m.notify(Event{Type: EventRenewed, Chain: renewed, Key: renewedKey, RenewAt: renewAt})
+	return nil
+}
+
+// renew runs the renewal tree and returns the renewed certificate chain and its key
+func (m *Manager) renew(chain thing.CertificateChain, key crypto.Signer) (thing.CertificateChain, crypto.Signer,
+	error) {
+	if m.NewBuilder == nil {
+		return nil, nil, errors.New("renewal manager requires NewBuilder")
+	}
+	if key == nil {
+		return nil, nil, jws.ErrMissingSigner
+	}
+	renewedKey := key
+	if m.NewKey != nil {
+		var err error
+		if renewedKey, err = m.NewKey(); err != nil {
+			return nil, nil, fmt.Errorf("generate key: %w", err)
+		}
+	}
+	csr := m.CSR
+	csr.Key = renewedKey
+	if leaf := chain.Leaf(); leaf != nil && csr.Subject.String() == "" {
+		csr.Subject = leaf.Subject
+		csr.DNSNames = leaf.DNSNames
+		csr.IPAddresses = leaf.IPAddresses
+		csr.EmailAddresses = leaf.EmailAddresses
+		csr.URIs = leaf.URIs
+	}
+	handlers := append(append([]callback.Handler{}, m.Handlers...), csr)
+	device, err := m.NewBuilder(key).
+		WithTree(m.Tree).
+		HandleCallbacksWith(handlers...).
+		Create()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err := device.Logout(); err != nil {
+			debug.Log.Debug("failed to log out after certificate renewal", "error", err)
+		}
+	}()
+	renewed, err := device.RequestCertificateChain(m.Attribute)
+	if err != nil {
+		return nil, nil, err
+	}
+	if leaf := chain.Leaf(); leaf != nil && renewed.Leaf().Equal(leaf) {
+		return nil, nil, errors.New("the renewal tree did not issue a new certificate")
+	}
+	publicKey, ok := renewed.Leaf().PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(renewedKey.Public()) {
+		return nil, nil, errors.New("the renewed certificate is not for the requested key")
+	}
+	return renewed, renewedKey, nil
+}
+
+func (m *Manager) notify(event Event) {
+	if m.Notify != nil {
+		m.Notify(event)
+	}
+}
@@ -0,0 +1,408 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package renewal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ForgeRock/iot-edge/v7/internal/client"
+	"github.com/ForgeRock/iot-edge/v7/internal/clock"
+	"github.com/ForgeRock/iot-edge/v7/internal/mocks"
+	ithing "github.com/ForgeRock/iot-edge/v7/internal/thing"
+	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
+)
+
+const lifetime = 10 * 24 * time.Hour
+
+// testCA is a local certificate authority that issues certificates valid for the lifetime from the current time
+type testCA struct {
+	t      *testing.T
+	key    crypto.Signer
+	cert   *x509.Certificate
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             clock.Clock().Add(-time.Hour),
+		NotAfter:              clock.Clock().Add(100 * lifetime),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{t: t, key: key, cert: cert, serial: 1}
+}
+
+func (ca *testCA) issue(subject pkix.Name, key crypto.PublicKey) thing.CertificateChain {
+	ca.serial++
+	notBefore := clock.Clock().Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      subject,
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(lifetime),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return thing.CertificateChain{cert, ca.cert}
+}
+
+// renewalAM returns a connection to a renewal tree that requests a CSR and issues a certificate with the local CA
+func renewalAM(t *testing.T, ca *testCA) *mocks.MockClient {
+	var mu sync.Mutex
+	var issued thing.CertificateChain
+	return &mocks.MockClient{
+		AuthenticateFunc: func(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+			if len(payload.Callbacks) == 0 {
+				reply.AuthId = "auth-id"
+				reply.Callbacks = []callback.Callback{{
+					Type:   callback.TypeHiddenValueCallback,
+					Output: []callback.Entry{{Name: "id", Value: callback.CSRCallbackID}, {Name: "value", Value: ""}},
+					Input:  []callback.Entry{{Name: "IDToken1", Value: ""}},
+				}}
+				return reply, nil
+			}
+			block, _ := pem.Decode([]byte(payload.Callbacks[0].Input[0].Value.(string)))
+			if block == nil {
+				return reply, errors.New("no CSR")
+			}
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			if err != nil {
+				return reply, err
+			}
+			mu.Lock()
+			issued = ca.issue(csr.Subject, csr.PublicKey)
+			mu.Unlock()
+			reply.TokenID = "token"
+			return reply, nil
+		},
+		AttributesFunc: func(string, string, []string) ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			var values []string
+			for _, cert := range issued {
+				values = append(values, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+			}
+			return json.Marshal(map[string]interface{}{thing.CertificateAttribute: values})
+		},
+	}
+}
+
+// fakeClock sets the SDK clock to the returned function's time
+func fakeClock(t *testing.T, now time.Time) (set func(time.Time)) {
+	var mu sync.Mutex
+	clock.Clock = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	t.Cleanup(func() {
+		clock.Clock = clock.DefaultClock()
+	})
+	return func(t time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = t
+	}
+}
+
+func testManager(t *testing.T, connection client.Connection) (*Manager, *[]Event) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	chain := newTestCA(t).issue(pkix.Name{CommonName: "thing-1"}, key.Public())
+	var mu sync.Mutex
+	var events []Event
+	m := New(chain, key)
+	m.Tree = "renewal-tree"
+	m.NewBuilder = func(key crypto.Signer) thing.Builder {
+		return (&ithing.BaseBuilder{}).WithConnection(connection)
+	}
+	m.Notify = func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	return m, &events
+}
+
+func TestManager_RenewAt(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	fakeClock(t, start)
+	m, _ := testManager(t, nil)
+	if !m.RenewAt().Equal(start.Add(8 * 24 * time.Hour)) {
+		t.Errorf("unexpected default renewal time %v", m.RenewAt())
+	}
+	m.Fraction = 0.5
+	if !m.RenewAt().Equal(start.Add(5 * 24 * time.Hour)) {
+		t.Errorf("unexpected renewal time %v", m.RenewAt())
+	}
+}
+
+func TestManager_Renew(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	for _, newKey := range []bool{false, true} {
+		setClock := fakeClock(t, start)
+		ca := newTestCA(t)
+		m, events := testManager(t, renewalAM(t, ca))
+		oldChain, oldKey := m.Current()
+		if newKey {
+			m.NewKey = func() (crypto.Signer, error) {
+				return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			}
+		}
+		store := FileStore{Path: filepath.Join(t.TempDir(), "certificate.pem")}
+		m.Store = store
+
+		renewed := start.Add(8 * 24 * time.Hour)
+		setClock(renewed)
+		if err := m.Renew(); err != nil {
+			t.Fatal(err)
+		}
+		chain, key := m.Current()
+		if chain.Leaf().Equal(oldChain.Leaf()) || chain.Leaf().Subject.CommonName != "thing-1" {
+			t.Errorf("expected a renewed certificate for thing-1, got %v", chain.Leaf().Subject)
+		}
+		if reused := key == oldKey; reused == newKey {
+			t.Errorf("new key %v: expected the key to be reused %v", newKey, !newKey)
+		}
+		if !m.RenewAt().Equal(renewed.Add(8 * 24 * time.Hour)) {
+			t.Errorf("unexpected renewal time %v", m.RenewAt())
+		}
+		if len(*events) != 1 || (*events)[0].Type != EventRenewed || (*events)[0].Key != key {
+			t.Errorf("unexpected events %v", *events)
+		}
+		storedChain, storedKey, err := store.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !storedChain.Leaf().Equal(chain.Leaf()) || !key.Public().(*ecdsa.PublicKey).Equal(storedKey.Public()) {
+			t.Error("expected the renewed chain and key to be stored")
+		}
+	}
+}
+
+func TestManager_Renew_Failure(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	fakeClock(t, start)
+	failed := errors.New("tree not found")
+	m, events := testManager(t, &mocks.MockClient{
+		AuthenticateFunc: func(client.AuthenticatePayload) (client.AuthenticatePayload, error) {
+			return client.AuthenticatePayload{}, failed
+		},
+	})
+	chain, key := m.Current()
+	store := FileStore{Path: filepath.Join(t.TempDir(), "certificate.pem")}
+	if err := store.Save(chain, key); err != nil {
+		t.Fatal(err)
+	}
+	m.Store = store
+	m.RetryAfter = 10 * time.Minute
+
+	if err := m.Renew(); !errors.Is(err, failed) {
+		t.Fatalf("expected %v, got %v", failed, err)
+	}
+	if current, _ := m.Current(); !current.Leaf().Equal(chain.Leaf()) {
+		t.Error("expected the current chain to be kept")
+	}
+	if !m.RenewAt().Equal(start.Add(10 * time.Minute)) {
+		t.Errorf("expected a retry after 10 minutes, got %v", m.RenewAt())
+	}
+	if len(*events) != 1 || (*events)[0].Type != EventFailed || !errors.Is((*events)[0].Err, failed) {
+		t.Errorf("unexpected events %v", *events)
+	}
+	if stored, _, err := store.Load(); err != nil || !stored.Leaf().Equal(chain.Leaf()) {
+		t.Errorf("expected the stored chain to be unchanged, %v", err)
+	}
+}
+
+// failingStore is a store that fails until it is fixed
+type failingStore struct {
+	FileStore
+	failed *bool
+}
+
+func (s failingStore) Save(chain thing.CertificateChain, key crypto.Signer) error {
+	if *s.failed {
+		return errors.New("disk full")
+	}
+	return s.FileStore.Save(chain, key)
+}
+
+func TestManager_Renew_NotStored(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	setClock := fakeClock(t, start)
+	m, events := testManager(t, renewalAM(t, newTestCA(t)))
+	oldChain, _ := m.Current()
+	m.NewKey = func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	failed := true
+	store := failingStore{FileStore: FileStore{Path: filepath.Join(t.TempDir(), "certificate.pem")}, failed: &failed}
+	m.Store = store
+	m.RetryAfter = 10 * time.Minute
+
+	// the renewed chain and key are used even though they can not be stored since AM has registered the new key
+	if err := m.Renew(); err == nil {
+		t.Fatal("expected an error")
+	}
+	chain, key := m.Current()
+	if chain.Leaf().Equal(oldChain.Leaf()) {
+		t.Error("expected the renewed chain to be used")
+	}
+	if !m.RenewAt().Equal(start.Add(10 * time.Minute)) {
+		t.Errorf("expected a retry after 10 minutes, got %v", m.RenewAt())
+	}
+	if len(*events) != 1 || (*events)[0].Type != EventNotStored || (*events)[0].Key != key {
+		t.Errorf("unexpected events %v", *events)
+	}
+
+	// the retry stores the renewed chain instead of renewing it again
+	failed = false
+	setClock(start.Add(10 * time.Minute))
+	if err := m.Renew(); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := m.Current(); !current.Leaf().Equal(chain.Leaf()) {
+		t.Error("expected the renewed chain to be kept")
+	}
+	if len(*events) != 2 || (*events)[1].Type != EventRenewed {
+		t.Errorf("unexpected events %v", *events)
+	}
+	if stored, _, err := store.Load(); err != nil || !stored.Leaf().Equal(chain.Leaf()) {
+		t.Errorf("expected the renewed chain to be stored, %v", err)
+	}
+	if !m.RenewAt().Equal(chain.RenewAt(DefaultFraction)) {
+		t.Errorf("unexpected renewal time %v", m.RenewAt())
+	}
+}
+
+func TestManager_Renew_WrongKey(t *testing.T) {
+	fakeClock(t, time.Now())
+	ca := newTestCA(t)
+	connection := renewalAM(t, ca)
+	connection.AttributesFunc = func(string, string, []string) ([]byte, error) {
+		// return a certificate for another key
+		other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		leaf := ca.issue(pkix.Name{CommonName: "thing-1"}, other.Public()).Leaf()
+		certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}))
+		return json.Marshal(map[string]interface{}{thing.CertificateAttribute: certPEM})
+	}
+	m, _ := testManager(t, connection)
+	if err := m.Renew(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestManager_Run(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	setClock := fakeClock(t, start)
+	maxWait = 10 * time.Millisecond
+	defer func() {
+		maxWait = time.Minute
+	}()
+	m, _ := testManager(t, renewalAM(t, newTestCA(t)))
+	renewed := make(chan Event, 1)
+	scheduled := make(chan Event, 3)
+	m.Notify = func(event Event) {
+		switch event.Type {
+		case EventRenewed:
+			renewed <- event
+		case EventScheduled:
+			scheduled <- event
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- m.Run(ctx)
+	}()
+
+	if event := <-scheduled; !event.RenewAt.Equal(start.Add(8 * 24 * time.Hour)) {
+		t.Errorf("unexpected renewal time %v", event.RenewAt)
+	}
+	select {
+	case event := <-renewed:
+		t.Fatalf("unexpected renewal %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	now := start.Add(9 * 24 * time.Hour)
+	setClock(now)
+	select {
+	case <-renewed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the certificate to be renewed")
+	}
+	if event := <-scheduled; !event.RenewAt.Equal(now.Add(8 * 24 * time.Hour)) {
+		t.Errorf("unexpected renewal time %v", event.RenewAt)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	chain := newTestCA(t).issue(pkix.Name{CommonName: "thing-1"}, key.Public())
+	store := FileStore{Path: filepath.Join(t.TempDir(), "certificate.pem")}
+	if _, _, err := store.Load(); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	if err := store.Save(chain, key); err != nil {
+		t.Fatal(err)
+	}
+	loadedChain, loadedKey, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loadedChain) != 2 || !loadedChain.Leaf().Equal(chain.Leaf()) || !key.Equal(loadedKey) {
+		t.Errorf("unexpected chain %v or key", loadedChain)
+	}
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(store.Path), "*.tmp"))
+	if len(matches) != 0 {
+		t.Errorf("unexpected temporary files %v", matches)
+	}
+	if err = (FileStore{Path: filepath.Join(t.TempDir(), "missing", "certificate.pem")}).Save(chain, key); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
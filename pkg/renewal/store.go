@@ -0,0 +1,123 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package renewal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	frcrypto "github.com/ForgeRock/iot-edge/v7/internal/crypto"
+	"github.com/ForgeRock/iot-edge/v7/pkg/thing"
+)
+
+// Store persists the certificate chain and key of a thing.
+type Store interface {
+	// Save the certificate chain and key. The save must be atomic, either both the chain and key are replaced or
+	// neither are.
+	Save(chain thing.CertificateChain, key crypto.Signer) error
+}
+
+// FileStore stores the certificate chain and key as PEM blocks in a single file that is only readable by its owner.
+// The file is replaced atomically by writing a temporary file in the same directory and renaming it.
+type FileStore struct {
+	Path string
+}
+
+// Save the certificate chain and the PKCS #8 encoded key.
+func (s FileStore) Save(chain thing.CertificateChain, key crypto.Signer) (err error) {
+	if s.Path == "" {
+		return errors.New("file store requires a path")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		return err
+	}
+	for _, cert := range chain {
+		if err = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+	if err = file.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err = file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(file.Name(), s.Path); err != nil {
+		return err
+	}
+	// the rename is only durable once the directory entry has been written
+	dir, err := os.Open(filepath.Dir(s.Path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Load the certificate chain and key.
+func (s FileStore) Load() (thing.CertificateChain, crypto.Signer, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, err := thing.ParseCertificateChain(string(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, nil, errors.New("no private key found")
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			key, err := frcrypto.ParsePEM(block)
+			if err != nil {
+				return nil, nil, err
+			}
+			return chain, key, nil
+		}
+	}
+}
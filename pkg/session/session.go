@@ -1,5 +1,5 @@
 /*
- * Copyright 2020 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -17,12 +17,77 @@
 package session
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
 )
 
+var (
+	// ErrTooManyRounds is returned when an authentication journey does not complete within the maximum number of
+	// rounds. It is joined with an UnhandledCallbacksError if the last round had callbacks that were not handled.
+	ErrTooManyRounds = errors.New("authentication journey did not complete within the maximum number of rounds")
+	// ErrJourneyTimeout is returned when an authentication journey does not complete before its deadline. It is
+	// joined with an UnhandledCallbacksError if the last round had callbacks that were not handled.
+	ErrJourneyTimeout = errors.New("authentication journey did not complete before the deadline")
+	// ErrStepUpNotSupported is returned when a session is stepped up with a connection that does not support it.
+	// Sessions can only be stepped up when connecting directly to AM.
+	ErrStepUpNotSupported = errors.New("session step-up is only supported when connecting to AM")
+)
+
+// UnhandledCallbacksError is returned when none of the callback handlers handled some of the callbacks received from
+// AM. This usually means that the handlers do not match the nodes of the authentication tree.
+type UnhandledCallbacksError struct {
+	Callbacks []callback.Callback
+}
+
+func (e *UnhandledCallbacksError) Error() string {
+	descriptions := make([]string, len(e.Callbacks))
+	for i, cb := range e.Callbacks {
+		descriptions[i] = cb.Type
+		if id := cb.ID(); id != "" {
+			descriptions[i] += " id=" + id
+		}
+		if len(cb.Output) > 0 {
+			descriptions[i] += fmt.Sprintf(" output=%v", cb.Output)
+		}
+	}
+	return "unhandled callbacks: " + strings.Join(descriptions, ", ")
+}
+
+// Info is the information held by AM about a session.
+type Info struct {
+	Username    string `json:"username"`
+	UniversalID string `json:"universalId"`
+	Realm       string `json:"realm"`
+	// the last time that the session was used
+	LatestAccess time.Time `json:"latestAccessTime"`
+	// the time that the session expires if it is not used
+	MaxIdleExpiry time.Time `json:"maxIdleExpirationTime"`
+	// the time that the session expires even if it is used
+	MaxExpiry time.Time `json:"maxSessionExpirationTime"`
+	// the session properties that AM is configured to return, see the Session Property Whitelist Service in AM
+	Properties map[string]string `json:"properties"`
+}
+
+// Expiry returns the time that the session expires unless it is used, the earlier of the idle and maximum expiry.
+func (i Info) Expiry() time.Time {
+	if i.MaxIdleExpiry.IsZero() || (!i.MaxExpiry.IsZero() && i.MaxExpiry.Before(i.MaxIdleExpiry)) {
+		return i.MaxExpiry
+	}
+	return i.MaxIdleExpiry
+}
+
+// Tree returns the name of the authentication tree that created the session. AM only returns the name if the
+// "Service" session property is allowed by the Session Property Whitelist Service.
+func (i Info) Tree() string {
+	return i.Properties["Service"]
+}
+
 // Session represents an authenticated session with AM.
 type Session interface {
 
@@ -32,6 +97,9 @@ type Session interface {
 	// Valid returns true if the session is valid.
 	Valid() (bool, error)
 
+	// Info requests the information held by AM about the session, such as its expiry times and realm.
+	Info() (Info, error)
+
 	// Logout the session.
 	Logout() error
 }
@@ -57,6 +125,50 @@ type Builder interface {
 	// TimeoutRequestAfter sets the timeout on the communications between the Thing and AM or the IoT Gateway.
 	TimeoutRequestAfter(d time.Duration) Builder
 
+	// WithMaxRounds sets the maximum number of requests made to AM during the authentication journey. By default, and
+	// for a value less than one, the number of requests is not limited since journeys that poll, for example with a
+	// polling wait callback, make a request each time they poll.
+	WithMaxRounds(n int) Builder
+
+	// TimeoutJourneyAfter sets the time that the whole authentication journey must complete in. The deadline is
+	// checked between rounds so a request in progress is only bounded by the request timeout. By default, the journey
+	// has no deadline.
+	TimeoutJourneyAfter(d time.Duration) Builder
+
+	// FailOnUnhandledCallbacks makes Create return an UnhandledCallbacksError as soon as a callback is not handled by
+	// any of the callback handlers, instead of submitting the callback to AM with an empty input.
+	FailOnUnhandledCallbacks() Builder
+
+	// RecordJourneyTo writes every authenticate request and response of the authentication journey to the writer, for
+	// example a file, as a line of JSON. The values of callback inputs are redacted, along with the session and
+	// authentication IDs and the other sensitive values that are redacted from the debug output. The recording can be
+	// played back with ReplayJourneyFrom.
+	RecordJourneyTo(w io.Writer) Builder
+
+	// ReplayJourneyFrom plays back a recording made with RecordJourneyTo instead of connecting to AM or the IoT Gateway.
+	// Each request must match the recorded request: the callbacks must have the same types and IDs and every input that
+	// was set in the recording must be set by the callback handlers. Use it to test callback handlers against the
+	// callbacks of a real authentication tree. The created session can not be validated or logged out.
+	ReplayJourneyFrom(r io.Reader) Builder
+
+	// StepUp runs the authentication tree set by WithTree against the existing session instead of creating a new
+	// session, for example to satisfy a policy that requires a stronger authentication journey. AM upgrades the
+	// existing session when the journey completes and Create returns the upgraded session, which replaces the existing
+	// session. The connection of the existing session is used unless another connection is provided. Create returns
+	// ErrStepUpNotSupported if the connection is to the IoT Gateway.
+	StepUp(existing Session) Builder
+
+	// ForceAuth makes AM run the authentication tree of a step-up even if the existing session already satisfies it,
+	// in order to re-authenticate the session.
+	ForceAuth() Builder
+
+	// WithStore persists the session in the store. Create resumes the stored session if it is still valid instead of
+	// authenticating, and saves the session that it creates otherwise. A session that is bound to a proof of
+	// possession key is only resumed if one of the callback handlers signs with the same key. The nonces of a proof of
+	// possession session are reserved in the store before they are used, see NonceWindow. Logout deletes the stored
+	// session.
+	WithStore(store Store) Builder
+
 	// Create a Session instance and make an authentication request to AM. The callback handlers provided
 	// will be used to satisfy the callbacks received from the AM authentication process.
 	Create() (Session, error)
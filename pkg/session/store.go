@@ -0,0 +1,163 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// NonceWindow is the number of proof of possession nonces that a session reserves in its store at a time. A session
+// only signs a request with a nonce once the nonce has been reserved, so a session resumed after a crash continues
+// after the last reserved nonce and never reuses a nonce. At most NonceWindow nonces are skipped by a restart.
+const NonceWindow = 100
+
+// Stored is the state of a session that is persisted so that the session can be resumed after a restart.
+type Stored struct {
+	Token string `json:"token"`
+	// the JWK thumbprint of the proof of possession key, empty if the session is not bound to a key
+	Key string `json:"key,omitempty"`
+	// the first proof of possession nonce that has not been reserved
+	Nonce int `json:"nonce,omitempty"`
+}
+
+// Store persists the state of a session, see Builder.WithStore.
+type Store interface {
+	// Load the stored session. Returns nil if no session is stored.
+	Load() (*Stored, error)
+
+	// Save the session, replacing any stored session. The session must be persisted when Save returns since the
+	// session signs requests with the reserved nonces straight after.
+	Save(stored Stored) error
+
+	// Delete the stored session.
+	Delete() error
+}
+
+// FileStore stores a session in a file that is encrypted with AES-GCM and only readable by its owner. The file is
+// replaced atomically by writing a temporary file in the same directory and renaming it.
+type FileStore struct {
+	Path string
+	// the AES key, which must be 16, 24 or 32 bytes long
+	Key []byte
+}
+
+func (s FileStore) aead() (cipher.AEAD, error) {
+	if s.Path == "" {
+		return nil, errors.New("file store requires a path")
+	}
+	block, err := aes.NewCipher(s.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Load the stored session. Returns nil if the file does not exist.
+func (s FileStore) Load() (*Stored, error) {
+	aead, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("stored session is too short")
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	var stored Stored
+	if err = json.Unmarshal(plaintext, &stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// Save the session.
+func (s FileStore) Save(stored Stored) (err error) {
+	aead, err := s.aead()
+	if err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	data := aead.Seal(nonce, nonce, plaintext, nil)
+
+	file, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+	if err = file.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(file.Name(), s.Path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(s.Path))
+}
+
+// syncDir flushes the directory so that a file renamed into it is not lost if the host fails
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Delete the file. It is not an error if the file does not exist.
+func (s FileStore) Delete() error {
+	err := os.Remove(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package session
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	store := FileStore{Path: filepath.Join(t.TempDir(), "session"), Key: key}
+	stored, err := store.Load()
+	if stored != nil || err != nil {
+		t.Fatalf("expected no stored session, got %v, %v", stored, err)
+	}
+
+	expected := Stored{Token: "secret-token", Key: "thumbprint", Nonce: 200}
+	if err = store.Save(expected); err != nil {
+		t.Fatal(err)
+	}
+	stored, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == nil || *stored != expected {
+		t.Errorf("expected %v, got %v", expected, stored)
+	}
+	info, err := os.Stat(store.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the file to be only readable by its owner, got %v", info.Mode())
+	}
+	data, _ := os.ReadFile(store.Path)
+	if bytes.Contains(data, []byte("secret-token")) {
+		t.Error("expected the session to be encrypted")
+	}
+	if _, err = (FileStore{Path: store.Path, Key: bytes.Repeat([]byte{8}, 32)}).Load(); err == nil {
+		t.Error("expected an error when loading with the wrong key")
+	}
+
+	if err = store.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err = store.Load(); stored != nil || err != nil {
+		t.Errorf("expected no stored session after delete, got %v, %v", stored, err)
+	}
+	if err = store.Delete(); err != nil {
+		t.Errorf("expected no error when deleting a missing file, got %v", err)
+	}
+	if err = (FileStore{Path: store.Path, Key: []byte("short")}).Save(expected); err == nil {
+		t.Error("expected an error for an invalid key")
+	}
+}
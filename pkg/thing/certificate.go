@@ -0,0 +1,110 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CertificateAttribute is the thing attribute that certificate enrolment tree nodes store the issued certificate
+// chain in.
+const CertificateAttribute = "thingCertificatePem"
+
+// CertificateChain is a certificate chain issued to a thing, starting with the thing's certificate.
+type CertificateChain []*x509.Certificate
+
+// ParseCertificateChain parses the PEM encoded certificates. Each value may hold one or more certificates.
+func ParseCertificateChain(values ...string) (CertificateChain, error) {
+	var chain CertificateChain
+	for _, value := range values {
+		rest := []byte(value)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, cert)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return chain, nil
+}
+
+// Leaf returns the thing's certificate, nil if the chain is empty.
+func (c CertificateChain) Leaf() *x509.Certificate {
+	if len(c) == 0 {
+		return nil
+	}
+	return c[0]
+}
+
+// Expiry returns the time that the first certificate in the chain expires.
+func (c CertificateChain) Expiry() time.Time {
+	var expiry time.Time
+	for _, cert := range c {
+		if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+	return expiry
+}
+
+// RenewAt returns the time that the given fraction of the thing certificate's lifetime, up to the expiry of the
+// chain, has passed. For example, RenewAt(0.8) returns the time to renew a certificate at 80% of its lifetime.
+func (c CertificateChain) RenewAt(fraction float64) time.Time {
+	leaf := c.Leaf()
+	if leaf == nil {
+		return time.Time{}
+	}
+	lifetime := c.Expiry().Sub(leaf.NotBefore)
+	return leaf.NotBefore.Add(time.Duration(float64(lifetime) * fraction))
+}
+
+// CertificateChain reads and parses the certificate chain held in the specified attribute.
+func (a AttributesResponse) CertificateChain(key string) (CertificateChain, error) {
+	var values []string
+	switch value := a.Content[key].(type) {
+	case string:
+		values = []string{value}
+	case []interface{}:
+		var err error
+		if values, err = a.Content.GetStringArray(key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, readError{key: key}
+	}
+	chain, err := ParseCertificateChain(values...)
+	if err != nil {
+		return nil, fmt.Errorf("attribute %s: %w", key, err)
+	}
+	return chain, nil
+}
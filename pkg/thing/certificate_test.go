@@ -0,0 +1,117 @@
+/*
+ * Copyright 2023 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testChain returns a PEM encoded thing certificate and the CA certificate that issued it
+func testChain(t *testing.T, notBefore time.Time) (thingPEM, caPEM string) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "thing-1"},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(10 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(der []byte) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+	return encode(der), encode(caDER)
+}
+
+func TestParseCertificateChain(t *testing.T) {
+	notBefore := time.Now().Truncate(time.Second).UTC()
+	thingPEM, caPEM := testChain(t, notBefore)
+	for name, values := range map[string][]string{
+		"one-value":    {thingPEM + caPEM},
+		"two-values":   {thingPEM, caPEM},
+		"with-comment": {"issued by test-ca\n" + thingPEM + caPEM},
+	} {
+		t.Run(name, func(t *testing.T) {
+			chain, err := ParseCertificateChain(values...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chain) != 2 || chain.Leaf().Subject.CommonName != "thing-1" {
+				t.Fatalf("unexpected chain %v", chain)
+			}
+			expiry := notBefore.Add(10 * 24 * time.Hour)
+			if !chain.Expiry().Equal(expiry) {
+				t.Errorf("expected expiry %v, got %v", expiry, chain.Expiry())
+			}
+			if renewAt := chain.RenewAt(0.8); !renewAt.Equal(notBefore.Add(8 * 24 * time.Hour)) {
+				t.Errorf("unexpected renewal time %v", renewAt)
+			}
+		})
+	}
+	if _, err := ParseCertificateChain("not a certificate"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestAttributesResponse_CertificateChain(t *testing.T) {
+	thingPEM, caPEM := testChain(t, time.Now())
+	response := AttributesResponse{Content: JSONContent{
+		"_id":                "thing-1",
+		CertificateAttribute: []interface{}{thingPEM, caPEM},
+		"single":             thingPEM,
+		"empty":              []interface{}{},
+	}}
+	for key, length := range map[string]int{CertificateAttribute: 2, "single": 1} {
+		chain, err := response.CertificateChain(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chain) != length {
+			t.Errorf("%s: expected %d certificates, got %d", key, length, len(chain))
+		}
+	}
+	for _, key := range []string{"empty", "missing", "_id"} {
+		if _, err := response.CertificateChain(key); err == nil {
+			t.Errorf("%s: expected an error", key)
+		}
+	}
+}
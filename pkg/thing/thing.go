@@ -1,5 +1,5 @@
 /*
- * Copyright 2020-2022 ForgeRock AS
+ * Copyright 2020-2023 ForgeRock AS
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -21,30 +21,52 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"log"
+	"log/slog"
 	"net/url"
 	"time"
 
 	"github.com/ForgeRock/iot-edge/v7/internal/debug"
 	"github.com/ForgeRock/iot-edge/v7/internal/jws"
 	"github.com/ForgeRock/iot-edge/v7/pkg/callback"
+	"github.com/ForgeRock/iot-edge/v7/pkg/session"
 	"gopkg.in/square/go-jose.v2"
 )
 
-// DebugLogger is the destination of all SDK debug information. The logger is muted by default. Redirect the debug
-// output by assigning your own logger to this variable or setting the output writer, for example:
+// DebugLogger is the destination of the default SDK log handler, which writes log records as text. The logger is
+// muted by default. Redirect the debug output by setting the output writer, for example:
 //
-//    thing.DebugLogger().SetOutput(os.Stdout)
+//	thing.DebugLogger().SetOutput(os.Stdout)
 func DebugLogger() *log.Logger {
 	return debug.Logger
 }
 
-// SetDebugLogger will replace the default debug logger.
+// SetDebugLogger will replace the default debug logger and direct all SDK log records to it as text. It replaces any
+// handler set with SetLogHandler.
 func SetDebugLogger(logger *log.Logger) {
 	if logger != nil {
 		debug.Logger = logger
+		debug.SetHandler(nil)
 	}
 }
 
+// SetLogHandler directs all SDK log records to the given handler. Records are annotated, where known, with the thing
+// ID, endpoint, CoAP message ID and request ID. For example, to write JSON records that include debug information:
+//
+//	thing.SetLogHandler(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+//
+// A nil handler restores the default handler that writes to the DebugLogger.
+func SetLogHandler(handler slog.Handler) {
+	debug.SetHandler(handler)
+}
+
+// SetRedactionAllowlist sets the names of HTTP headers, cookies and JSON fields that will not be redacted from the SDK
+// debug output. By default, credentials such as session cookies, access and refresh tokens, authentication IDs and
+// JWT signatures are redacted. Include "jwt_signature" to keep the signatures of JWTs.
+// This should only be used for troubleshooting since the unredacted values can be used to impersonate a thing.
+func SetRedactionAllowlist(names ...string) {
+	debug.SetRedactionAllowlist(names...)
+}
+
 // Thing represents a device or a service with a digital identity in the ForgeRock Identity Platform.
 type Thing interface {
 
@@ -67,6 +89,11 @@ type Thing interface {
 	// If no names are specified then all the allowed attributes will be returned.
 	RequestAttributes(names ...string) (response AttributesResponse, err error)
 
+	// RequestCertificateChain requests the certificate chain that was issued to the thing, for example in response to
+	// the certificate signing request sent by callback.CSRHandler, and stored in the specified attribute. The
+	// CertificateAttribute is used if no attribute is specified.
+	RequestCertificateChain(attribute string) (chain CertificateChain, err error)
+
 	// RequestUserCode makes the device authorization request as defined by the OAuth 2.0 Device Authorization Grant
 	// specification (rfc8628). The device authorization response can be used to request a user access token with the
 	// RequestUserToken method. The provided scopes will be included in the token if they are configured in the thing's
@@ -79,6 +106,22 @@ type Thing interface {
 	// block until the user authorizes the request or the device code expires.
 	RequestUserToken(authorizationResponse DeviceAuthorizationResponse) (response AccessTokenResponse, err error)
 
+	// RotateKey replaces the thing's key with the new key. The thing authenticates with the key rotation tree, see
+	// Builder.WithKeyRotationTree, proving possession of both its current and new key. Once AM has accepted the new
+	// key, the thing's callback handlers are updated and a new session that is bound to the new key is created.
+	// RotateKey returns immediately if the thing already uses a key with the new key ID.
+	//
+	// A thing that restarts before RotateKey returns does not know which of its keys AM accepts. Persist the new key
+	// before calling RotateKey and recreate the thing with Builder.ResumeKeyRotation until RotateKey has succeeded.
+	RotateKey(newKey crypto.Signer, newKeyID string) error
+
+	// StepUp runs the given authentication tree against the thing's session, for example to satisfy a policy that
+	// requires a stronger authentication journey. The thing responds to the callbacks with its own callback handlers
+	// and the given handlers. AM upgrades the session when the journey completes and the thing uses the upgraded
+	// session from then on. A session that is created after the upgraded session expires is not stepped up.
+	// StepUp returns session.ErrStepUpNotSupported if the thing connects to the IoT Gateway.
+	StepUp(tree string, handlers ...callback.Handler) error
+
 	// Logout will invalidate the thing's session with AM. It is good practice logging out if the thing will not make
 	// new requests for a prolonged period. Once logged out the thing will automatically create a new session when a
 	// new request is made.
@@ -123,6 +166,26 @@ type Builder interface {
 	// be added to the thing's identity on successful registration.
 	RegisterThing(certificates []*x509.Certificate, claims func() interface{}) Builder
 
+	// WithKeyRotationTree sets the name of the AM authentication tree that is used to rotate the thing's key, see
+	// Thing.RotateKey. The tree is not required if the thing is connecting to the IoT Gateway, in which case the tree of
+	// the gateway must contain the key rotation node.
+	WithKeyRotationTree(tree string) Builder
+
+	// ResumeKeyRotation resumes a key rotation that was interrupted, for example by a restart. Create authenticates
+	// the thing with the new key and, if AM rejects it, with the key provided in the AuthenticateThing method. Call
+	// Thing.RotateKey with the new key afterwards to complete the rotation.
+	ResumeKeyRotation(newKeyID string, newKey crypto.Signer) Builder
+
+	// StepUpOnAdvice makes the thing step up its session when AM refuses a request with an advice to authenticate with
+	// another tree, see Thing.StepUp, and repeat the request once. The thing responds to the callbacks of the advised
+	// tree with its own callback handlers and the given handlers. By default, the refused request returns an error.
+	StepUpOnAdvice(handlers ...callback.Handler) Builder
+
+	// WithSessionStore persists the thing's session in the store, for example a session.FileStore, so that the session
+	// survives a restart. Create resumes the stored session if it is still valid instead of authenticating the thing,
+	// and every session that the thing creates afterwards replaces the stored session. See session.Builder.WithStore.
+	WithSessionStore(store session.Store) Builder
+
 	// HandleCallbacksWith the supplied callback handlers when the thing is authenticated. The provided handlers must
 	// match those configured in the AM authentication tree.
 	HandleCallbacksWith(handlers ...callback.Handler) Builder
@@ -130,6 +193,20 @@ type Builder interface {
 	// TimeoutRequestAfter sets the timeout on the communications between the Thing and AM or the IoT Gateway.
 	TimeoutRequestAfter(time.Duration) Builder
 
+	// WithMaxRounds sets the maximum number of requests made to AM during the authentication journey. By default, and
+	// for a value less than one, the number of requests is not limited since journeys that poll, for example with a
+	// polling wait callback, make a request each time they poll.
+	WithMaxRounds(n int) Builder
+
+	// TimeoutJourneyAfter sets the time that the whole authentication journey must complete in. The deadline is
+	// checked between rounds so a request in progress is only bounded by the request timeout. By default, the journey
+	// has no deadline.
+	TimeoutJourneyAfter(time.Duration) Builder
+
+	// FailOnUnhandledCallbacks makes Create return a session.UnhandledCallbacksError as soon as a callback is not
+	// handled by any of the callback handlers, instead of submitting the callback to AM with an empty input.
+	FailOnUnhandledCallbacks() Builder
+
 	// Create a Thing instance and make an authentication request to AM. The callback handlers and information provided
 	// in the AuthenticateThing and RegisterThing methods will be used to satisfy the callbacks received from the AM
 	// authentication process.